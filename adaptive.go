@@ -0,0 +1,191 @@
+package rdns
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// Adaptive is a resolver group that measures the response time and error rate
+// of its resolvers from live traffic and sends queries to the one that
+// performs best. A small fraction of queries is sent to the other resolvers
+// to keep their measurements current. To avoid switching back and forth
+// between resolvers with similar performance, a different resolver only
+// becomes active once it is better than the current one by a margin.
+type Adaptive struct {
+	id        string
+	resolvers []Resolver
+	opt       AdaptiveOptions
+	mu        sync.Mutex
+	stats     []adaptiveStats
+	active    int
+	metrics   *FailRouterMetrics
+
+	probeRate  float64
+	hysteresis float64
+}
+
+var _ Resolver = &Adaptive{}
+
+// AdaptiveOptions contain settings for the adaptive resolver group.
+type AdaptiveOptions struct {
+	// Fraction of queries, between 0 and 1, sent to resolvers other than
+	// the active one to measure their performance. Default 0.05 if nil.
+	ProbeRate *float64
+
+	// Fraction by which the score of a resolver has to be better than that of
+	// the active resolver before switching to it. Default 0.2 if nil.
+	Hysteresis *float64
+
+	// Determines if a SERVFAIL returned by a resolver should be considered an
+	// error.
+	ServfailError bool
+}
+
+// Performance measurements of a resolver, as moving averages.
+type adaptiveStats struct {
+	latency   time.Duration
+	errorRate float64
+	samples   int
+}
+
+// Weight of a new measurement in the moving averages.
+const adaptiveSmoothing = 0.1
+
+// Time added to the score of a resolver for an error rate of 1. A resolver
+// failing 10% of queries is considered as slow as one that takes 500ms longer
+// to respond.
+const adaptiveErrorPenalty = 5 * time.Second
+
+// Returns the score of a resolver, lower is better.
+func (s adaptiveStats) score() time.Duration {
+	return s.latency + time.Duration(s.errorRate*float64(adaptiveErrorPenalty))
+}
+
+// NewAdaptive returns a new instance of an adaptive resolver group.
+func NewAdaptive(id string, opt AdaptiveOptions, resolvers ...Resolver) *Adaptive {
+	r := &Adaptive{
+		id:         id,
+		resolvers:  resolvers,
+		opt:        opt,
+		stats:      make([]adaptiveStats, len(resolvers)),
+		metrics:    NewFailRouterMetrics(id, len(resolvers)),
+		probeRate:  0.05,
+		hysteresis: 0.2,
+	}
+	if opt.ProbeRate != nil {
+		r.probeRate = *opt.ProbeRate
+	}
+	if opt.Hysteresis != nil {
+		r.hysteresis = *opt.Hysteresis
+	}
+	return r
+}
+
+// Resolve a DNS query using the best performing resolver. If it fails, the
+// query is retried on the others in order of their score.
+func (r *Adaptive) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	log := logger(r.id, q, ci)
+	var (
+		err error
+		a   *dns.Msg
+	)
+	for _, i := range r.order() {
+		resolver := r.resolvers[i]
+		log.WithField("resolver", resolver.String()).Debug("forwarding query to resolver")
+		r.metrics.route.Add(resolver.String(), 1)
+		start := time.Now()
+		a, err = resolver.Resolve(q, ci)
+		failed := err != nil || (r.opt.ServfailError && a != nil && a.Rcode == dns.RcodeServerFailure)
+		r.record(i, time.Since(start), failed)
+		if !failed {
+			return a, err
+		}
+		log.WithField("resolver", resolver.String()).WithError(err).Debug("resolver returned failure")
+		r.metrics.failure.Add(resolver.String(), 1)
+	}
+	return a, err
+}
+
+func (r *Adaptive) String() string {
+	return r.id
+}
+
+// Returns the order in which resolvers should be tried for a query. This is
+// usually the active resolver first, or another one for probe queries,
+// followed by the rest in order of their score.
+func (r *Adaptive) order() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	order := make([]int, len(r.resolvers))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return r.stats[order[i]].score() < r.stats[order[j]].score()
+	})
+
+	first := r.active
+	if len(r.resolvers) > 1 && randFloat64() < r.probeRate {
+		first = randIntn(len(r.resolvers) - 1)
+		if first >= r.active {
+			first++
+		}
+	}
+	for i, idx := range order {
+		if idx == first {
+			copy(order[1:i+1], order[:i])
+			order[0] = first
+			break
+		}
+	}
+	return order
+}
+
+// Records the result of a query and switches to a different resolver if it
+// is better than the active one by the configured margin.
+func (r *Adaptive) record(i int, d time.Duration, failed bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := &r.stats[i]
+	var errorValue float64
+	if failed {
+		errorValue = 1
+	}
+	if s.samples == 0 {
+		s.latency = d
+		s.errorRate = errorValue
+	} else {
+		s.latency += time.Duration(adaptiveSmoothing * float64(d-s.latency))
+		s.errorRate += adaptiveSmoothing * (errorValue - s.errorRate)
+	}
+	s.samples++
+
+	// Find the best resolver that has been measured. Stay on the active one
+	// until there is something to compare it to.
+	if r.stats[r.active].samples == 0 {
+		return
+	}
+	best := r.active
+	for j, st := range r.stats {
+		if st.samples > 0 && st.score() < r.stats[best].score() {
+			best = j
+		}
+	}
+	if best == r.active {
+		return
+	}
+	if float64(r.stats[best].score()) > float64(r.stats[r.active].score())*(1-r.hysteresis) {
+		return
+	}
+	Log.WithFields(logrus.Fields{
+		"id":       r.id,
+		"resolver": r.resolvers[best].String(),
+		"score":    r.stats[best].score(),
+	}).Debug("switching to resolver")
+	r.active = best
+	r.metrics.failover.Add(1)
+}
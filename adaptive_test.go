@@ -0,0 +1,63 @@
+package rdns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdaptive(t *testing.T) {
+	var ci ClientInfo
+
+	// Slow resolver
+	r1 := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			time.Sleep(20 * time.Millisecond)
+			return q, nil
+		},
+	}
+	r2 := new(TestResolver) // fast resolver
+
+	g := NewAdaptive("adaptive", AdaptiveOptions{}, r1, r2)
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+
+	// The first query goes to the active (slow) resolver. Disable probes
+	// to make the test deterministic.
+	g.probeRate = 0
+	_, err := g.Resolve(q, ci)
+	require.NoError(t, err)
+
+	// A probe query then measures the fast one and switches to it
+	g.probeRate = 1
+	_, err = g.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r1.HitCount())
+	require.Equal(t, 1, r2.HitCount())
+	require.Equal(t, 1, g.active)
+
+	// Failures are retried on the other resolver. The probe goes to the
+	// failing one first.
+	r2.SetFail(true)
+	probeRate := 1.0
+	g = NewAdaptive("adaptive", AdaptiveOptions{ProbeRate: &probeRate}, r1, r2)
+	_, err = g.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 2, r1.HitCount())
+	require.Equal(t, 2, r2.HitCount())
+}
+
+func TestAdaptiveOptions(t *testing.T) {
+	// Defaults apply when the options aren't set
+	g := NewAdaptive("adaptive-options", AdaptiveOptions{})
+	require.Equal(t, 0.05, g.probeRate)
+	require.Equal(t, 0.2, g.hysteresis)
+
+	// A value of 0 disables probes or hysteresis
+	var zero float64
+	g = NewAdaptive("adaptive-options", AdaptiveOptions{ProbeRate: &zero, Hysteresis: &zero})
+	require.Equal(t, 0.0, g.probeRate)
+	require.Equal(t, 0.0, g.hysteresis)
+}
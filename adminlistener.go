@@ -2,15 +2,23 @@ package rdns
 
 import (
 	"context"
+	"crypto/subtle"
 	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"expvar"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/lucas-clemente/quic-go"
 	"github.com/lucas-clemente/quic-go/http3"
+	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
 )
 
@@ -21,6 +29,7 @@ const adminServerTimeout = 10 * time.Second
 type AdminListener struct {
 	httpServer *http.Server
 	quicServer *http3.Server
+	quicConn   net.PacketConn
 
 	id   string
 	addr string
@@ -38,9 +47,41 @@ type AdminListenerOptions struct {
 	// Transport protocol to run HTTPS over. "quic" or "tcp", defaults to "tcp".
 	Transport string
 
+	// Caches, by ID, that can be invalidated with requests to the admin service.
+	Caches map[string]*Cache
+
+	// Blocklists, by ID, that can be managed with requests to the admin service.
+	Blocklists map[string]*Blocklist
+
+	// Blocklists matching IPs, by ID, that can be tested with requests to the
+	// admin service.
+	IPBlocklists map[string]IPBlocklistTester
+
+	// Statistics elements, by ID, that can be queried through the admin service.
+	Stats map[string]*ClientStats
+
+	// Token that needs to be sent as "Authorization: Bearer <token>" header in
+	// requests that modify the configuration, like cache invalidation, or
+	// return statistics. Such requests are rejected unless a token is set or
+	// clients authenticate with a certificate.
+	AuthToken string
+
+	// Running listeners that can be listed, added and removed through the
+	// admin service.
+	Listeners *ListenerSet
+
+	// Elements, by ID, that names can be resolved through for debugging.
+	Resolvers map[string]Resolver
+
 	TLSConfig *tls.Config
 }
 
+// IPBlocklistTester is implemented by blocklists that match IPs, like response
+// IP and client blocklists, to show which rule matches an IP.
+type IPBlocklistTester interface {
+	TestIP(ip net.IP) BlocklistTestResult
+}
+
 // NewAdminListener returns an instance of an admin service listener.
 func NewAdminListener(id, addr string, opt AdminListenerOptions) (*AdminListener, error) {
 	switch opt.Transport {
@@ -58,8 +99,23 @@ func NewAdminListener(id, addr string, opt AdminListenerOptions) (*AdminListener
 		opt:  opt,
 		mux:  http.NewServeMux(),
 	}
+	if !l.authConfigured() {
+		Log.WithField("id", id).Warn("no admin token or client certificate authentication configured, management requests are rejected")
+	}
 	// Serve metrics.
 	l.mux.Handle("/routedns/vars", expvar.Handler())
+	// Evict names from caches.
+	l.mux.HandleFunc("/routedns/cache/invalidate", l.authorize(l.invalidateCache))
+	// Manage blocklists, "/routedns/blocklist/<id>/<action>".
+	l.mux.HandleFunc("/routedns/blocklist/", l.authorize(l.blocklistHandler))
+	// Query statistics, "/routedns/stats/<id>".
+	l.mux.HandleFunc("/routedns/stats/", l.authorize(l.statsHandler))
+	// Manage listeners, "/routedns/listener/<id>".
+	l.mux.HandleFunc("/routedns/listener/", l.authorize(l.listenerHandler))
+	// Resolve a name starting at any element, "/routedns/resolve/<id>".
+	l.mux.HandleFunc("/routedns/resolve/", l.authorize(l.resolveHandler))
+	// Export and import changes made at runtime.
+	l.mux.HandleFunc("/routedns/overrides", l.authorize(l.overridesHandler))
 	return l, nil
 }
 
@@ -82,7 +138,7 @@ func (s *AdminListener) startTCP() error {
 		WriteTimeout: adminServerTimeout,
 	}
 
-	ln, err := net.Listen("tcp", s.addr)
+	ln, err := listenTCP(s.addr, s.opt.ListenOptions)
 	if err != nil {
 		return err
 	}
@@ -102,18 +158,571 @@ func (s *AdminListener) startQUIC() error {
 		},
 		QuicConfig: &quic.Config{},
 	}
-	return s.quicServer.ListenAndServe()
+	// Open the socket here so it can be handed over to a new instance
+	pc, err := listenUDP(s.addr, s.opt.ListenOptions, false)
+	if err != nil {
+		return err
+	}
+	s.quicConn = pc
+	return s.quicServer.Serve(pc)
 }
 
 // Stop the server.
 func (s *AdminListener) Stop() error {
 	Log.WithFields(logrus.Fields{"id": s.id, "protocol": s.opt.Transport, "addr": s.addr}).Info("stopping listener")
 	if s.opt.Transport == "quic" {
-		return s.quicServer.Close()
+		err := s.quicServer.Close()
+		// The server doesn't close sockets it didn't open
+		if s.quicConn != nil {
+			if cerr := s.quicConn.Close(); err == nil {
+				err = cerr
+			}
+		}
+		return err
 	}
 	return s.httpServer.Shutdown(context.Background())
 }
 
+// Returns true if clients have to authenticate, either with a token or with a
+// client certificate.
+func (s *AdminListener) authConfigured() bool {
+	return s.opt.AuthToken != "" || s.mutualTLS()
+}
+
+func (s *AdminListener) mutualTLS() bool {
+	return s.opt.TLSConfig != nil && s.opt.TLSConfig.ClientAuth == tls.RequireAndVerifyClientCert
+}
+
+// Wraps handlers for requests that can modify the configuration or return data
+// about clients. Clients need to be in the allowed networks and authenticate
+// with the token or a client certificate. Requests are rejected if neither is
+// configured.
+func (s *AdminListener) authorize(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		if !isAllowed(s.opt.AllowedNet, net.ParseIP(host)) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		if !s.authConfigured() {
+			http.Error(w, "no admin-token or mutual-tls configured", http.StatusForbidden)
+			return
+		}
+		if s.mutualTLS() && (r.TLS == nil || len(r.TLS.PeerCertificates) == 0) {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		if s.opt.AuthToken != "" {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(s.opt.AuthToken)) != 1 {
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+		}
+		h(w, r)
+	}
+}
+
+// Request to remove names from caches. All caches are used if none are listed.
+type cacheInvalidateRequest struct {
+	Caches     []string `json:"caches"`
+	Names      []string `json:"names"`
+	Subdomains bool     `json:"subdomains"`
+}
+
+type cacheInvalidateResponse struct {
+	Evicted int `json:"evicted"`
+}
+
+// Handles notifications about changed names, like from a CI pipeline, and removes
+// the names from caches so changes are picked up without waiting for TTLs to expire.
+func (s *AdminListener) invalidateCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var req cacheInvalidateRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	caches := req.Caches
+	if len(caches) == 0 {
+		for id := range s.opt.Caches {
+			caches = append(caches, id)
+		}
+	}
+	for _, id := range caches {
+		if _, ok := s.opt.Caches[id]; !ok {
+			http.Error(w, fmt.Sprintf("unknown cache '%s'", id), http.StatusNotFound)
+			return
+		}
+	}
+	var resp cacheInvalidateResponse
+	for _, id := range caches {
+		resp.Evicted += s.opt.Caches[id].Evict(req.Names, req.Subdomains)
+	}
+	Log.WithFields(logrus.Fields{
+		"id":      s.id,
+		"client":  r.RemoteAddr,
+		"names":   req.Names,
+		"evicted": resp.Evicted,
+	}).Info("invalidating cache")
+	writeJSON(w, resp)
+}
+
+// Request to add or remove a blocklist rule.
+type blocklistRuleRequest struct {
+	Rule      string `json:"rule"`
+	Allowlist bool   `json:"allowlist"` // Change the allowlist instead of the blocklist
+}
+
+// Request to allow a name temporarily.
+type blocklistAllowRequest struct {
+	Rule     string `json:"rule"`
+	Duration int    `json:"duration"` // Seconds, default 300
+}
+
+type blocklistRulesResponse struct {
+	Blocklist []string `json:"blocklist"`
+	Allowlist []string `json:"allowlist"`
+}
+
+// Handles requests to manage blocklists at runtime on /routedns/blocklist/<id>/<action>.
+// The "rules" action lists (GET), adds (POST) or removes (DELETE) rules added at
+// runtime, "allow" (POST) adds a rule to the allowlist for a limited time,
+// "refresh" (POST) reloads the lists from their sources, and "test" (GET)
+// returns the rule matching the name and type given as query parameters. Blocklists
+// matching IPs only support "test", with the IP given as query parameter.
+func (s *AdminListener) blocklistHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/routedns/blocklist/"), "/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	id, action := parts[0], parts[1]
+	if blocklist, ok := s.opt.IPBlocklists[id]; ok {
+		testIPBlocklist(w, r, blocklist, action)
+		return
+	}
+	blocklist, ok := s.opt.Blocklists[id]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown blocklist '%s'", id), http.StatusNotFound)
+		return
+	}
+	log := Log.WithFields(logrus.Fields{"id": s.id, "client": r.RemoteAddr, "blocklist": id})
+
+	switch {
+	case action == "rules" && r.Method == http.MethodGet:
+		writeJSON(w, blocklistRulesResponse{
+			Blocklist: blocklist.RuntimeRules(false),
+			Allowlist: blocklist.RuntimeRules(true),
+		})
+	case action == "rules" && (r.Method == http.MethodPost || r.Method == http.MethodDelete):
+		var req blocklistRuleRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Rule == "" {
+			http.Error(w, "no rule provided", http.StatusBadRequest)
+			return
+		}
+		log = log.WithFields(logrus.Fields{"rule": req.Rule, "allowlist": req.Allowlist})
+		if r.Method == http.MethodPost {
+			if err := blocklist.AddRule(req.Rule, req.Allowlist); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Info("added blocklist rule")
+		} else {
+			ok, err := blocklist.RemoveRule(req.Rule, req.Allowlist)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !ok {
+				http.Error(w, fmt.Sprintf("rule '%s' not found", req.Rule), http.StatusNotFound)
+				return
+			}
+			log.Info("removed blocklist rule")
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case action == "allow" && r.Method == http.MethodPost:
+		var req blocklistAllowRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Rule == "" {
+			http.Error(w, "no rule provided", http.StatusBadRequest)
+			return
+		}
+		if req.Duration < 0 {
+			http.Error(w, "invalid duration", http.StatusBadRequest)
+			return
+		}
+		duration := time.Duration(req.Duration) * time.Second
+		if duration == 0 {
+			duration = 5 * time.Minute
+		}
+		if err := blocklist.AllowTemporarily(req.Rule, duration); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Blocked responses shouldn't be served from cache
+		name := strings.TrimPrefix(req.Rule, ".")
+		for _, cache := range s.opt.Caches {
+			cache.Evict([]string{name}, strings.HasPrefix(req.Rule, "."))
+		}
+		log.WithFields(logrus.Fields{"rule": req.Rule, "duration": duration}).Info("allowing rule temporarily")
+		w.WriteHeader(http.StatusNoContent)
+	case action == "refresh" && r.Method == http.MethodPost:
+		if err := blocklist.Refresh(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Info("refreshed blocklist")
+		w.WriteHeader(http.StatusNoContent)
+	case action == "test" && r.Method == http.MethodGet:
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			http.Error(w, "no name provided", http.StatusBadRequest)
+			return
+		}
+		qtype := dns.TypeA
+		if t := r.URL.Query().Get("type"); t != "" {
+			var ok bool
+			if qtype, ok = dns.StringToType[strings.ToUpper(t)]; !ok {
+				http.Error(w, fmt.Sprintf("unknown type '%s'", t), http.StatusBadRequest)
+				return
+			}
+		}
+		writeJSON(w, blocklist.Test(dns.Question{
+			Name:   strings.ToLower(dns.Fqdn(name)),
+			Qtype:  qtype,
+			Qclass: dns.ClassINET,
+		}))
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// Handles the "test" action of blocklists that match IPs.
+func testIPBlocklist(w http.ResponseWriter, r *http.Request, blocklist IPBlocklistTester, action string) {
+	if action != "test" || r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	ip := net.ParseIP(r.URL.Query().Get("ip"))
+	if ip == nil {
+		http.Error(w, "no valid ip provided", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, blocklist.TestIP(ip))
+}
+
+// Returns a report of the statistics collected by a client-stats element. The
+// number of entries in the top lists can be limited with the "top" query parameter.
+func (s *AdminListener) statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/routedns/stats/"), "/")
+	stats, ok := s.opt.Stats[id]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown stats element '%s'", id), http.StatusNotFound)
+		return
+	}
+	n := 10
+	if top := r.URL.Query().Get("top"); top != "" {
+		var err error
+		if n, err = strconv.Atoi(top); err != nil || n < 0 {
+			http.Error(w, fmt.Sprintf("invalid value for top '%s'", top), http.StatusBadRequest)
+			return
+		}
+	}
+	writeJSON(w, stats.Report(n))
+}
+
+// Handles requests to manage listeners at runtime on /routedns/listener/<id>.
+// GET without ID lists the running listeners, PUT adds a listener defined in the
+// request body, in the same format as in the configuration file, and DELETE
+// stops and removes a listener.
+func (s *AdminListener) listenerHandler(w http.ResponseWriter, r *http.Request) {
+	if s.opt.Listeners == nil {
+		http.NotFound(w, r)
+		return
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/routedns/listener/"), "/")
+	log := Log.WithFields(logrus.Fields{"id": s.id, "client": r.RemoteAddr, "listener": id})
+
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		writeJSON(w, s.opt.Listeners.IDs())
+	case id != "" && r.Method == http.MethodPut:
+		definition, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.opt.Listeners.AddDefinition(id, definition); err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, ErrListenerExists) {
+				status = http.StatusConflict
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		log.Info("added listener")
+		w.WriteHeader(http.StatusCreated)
+	case id != "" && r.Method == http.MethodDelete:
+		if err := s.opt.Listeners.Remove(id); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrListenerNotFound) {
+				status = http.StatusNotFound
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		log.Info("removed listener")
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// Changes made at runtime through the admin service that differ from the
+// configuration file.
+type runtimeOverrides struct {
+	Blocklists map[string]blocklistRulesResponse `json:"blocklists,omitempty"`
+	Listeners  *ListenerOverrides                `json:"listeners,omitempty"`
+}
+
+// Handles requests on /routedns/overrides. GET exports the blocklist rules and
+// listeners that were added or removed at runtime, PUT imports a previously
+// exported document, for example after an upgrade. Blocklists that aren't in
+// the document are left as they are.
+func (s *AdminListener) overridesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		var o runtimeOverrides
+		for id, blocklist := range s.opt.Blocklists {
+			rules := blocklistRulesResponse{
+				Blocklist: blocklist.PermanentRules(false),
+				Allowlist: blocklist.PermanentRules(true),
+			}
+			if len(rules.Blocklist) == 0 && len(rules.Allowlist) == 0 {
+				continue
+			}
+			if o.Blocklists == nil {
+				o.Blocklists = make(map[string]blocklistRulesResponse)
+			}
+			o.Blocklists[id] = rules
+		}
+		if s.opt.Listeners != nil {
+			if lo := s.opt.Listeners.Overrides(); len(lo.Added) > 0 || len(lo.Removed) > 0 {
+				o.Listeners = &lo
+			}
+		}
+		writeJSON(w, o)
+	case http.MethodPut:
+		var o runtimeOverrides
+		if err := json.NewDecoder(io.LimitReader(r.Body, 16<<20)).Decode(&o); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Check the whole document before changing anything
+		for id, rules := range o.Blocklists {
+			if _, ok := s.opt.Blocklists[id]; !ok {
+				http.Error(w, fmt.Sprintf("unknown blocklist '%s'", id), http.StatusBadRequest)
+				return
+			}
+			for _, list := range [][]string{rules.Blocklist, rules.Allowlist} {
+				if err := checkRuntimeRules(list); err != nil {
+					http.Error(w, fmt.Sprintf("blocklist '%s': %s", id, err), http.StatusBadRequest)
+					return
+				}
+			}
+		}
+		var plan listenerOverridesPlan
+		if o.Listeners != nil {
+			if s.opt.Listeners == nil {
+				http.Error(w, "managing listeners is not supported", http.StatusBadRequest)
+				return
+			}
+			var err error
+			if plan, err = s.opt.Listeners.prepareOverrides(*o.Listeners); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		log := Log.WithFields(logrus.Fields{"id": s.id, "client": r.RemoteAddr})
+		for id, rules := range o.Blocklists {
+			blocklist := s.opt.Blocklists[id]
+			if err := blocklist.SetRules(rules.Blocklist, false); err != nil {
+				plan.discard()
+				http.Error(w, fmt.Sprintf("blocklist '%s': %s", id, err), http.StatusInternalServerError)
+				return
+			}
+			if err := blocklist.SetRules(rules.Allowlist, true); err != nil {
+				plan.discard()
+				http.Error(w, fmt.Sprintf("blocklist '%s': %s", id, err), http.StatusInternalServerError)
+				return
+			}
+		}
+		if o.Listeners != nil {
+			if err := s.opt.Listeners.applyOverrides(plan); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		log.Info("imported runtime overrides")
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// Result of a query sent through an element, with the response decoded.
+type resolveResponse struct {
+	Element    string     `json:"element"`
+	Duration   float64    `json:"duration-ms"`
+	Error      string     `json:"error,omitempty"`
+	Dropped    bool       `json:"dropped,omitempty"` // The element returned no response
+	Rcode      string     `json:"rcode,omitempty"`
+	Flags      []string   `json:"flags,omitempty"`
+	Question   []string   `json:"question,omitempty"`
+	Answer     []string   `json:"answer,omitempty"`
+	Authority  []string   `json:"authority,omitempty"`
+	Additional []string   `json:"additional,omitempty"`
+	EDNS0      *edns0Info `json:"edns0,omitempty"`
+}
+
+type edns0Info struct {
+	UDPSize uint16   `json:"udp-size"`
+	DO      bool     `json:"do"`
+	Options []string `json:"options,omitempty"`
+}
+
+// Handles requests on /routedns/resolve/<id> that resolve a name starting at the
+// given element, for debugging parts of a pipeline. The name and type ("A" by
+// default) are given as query parameters, as well as optionally the client IP
+// and listener ID the query appears to come from, and "do" to set the DNSSEC OK
+// flag. The client IP defaults to the one making the request.
+func (s *AdminListener) resolveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/routedns/resolve/"), "/")
+	resolver, ok := s.opt.Resolvers[id]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown element '%s'", id), http.StatusNotFound)
+		return
+	}
+	params := r.URL.Query()
+	name := params.Get("name")
+	if name == "" {
+		http.Error(w, "no name provided", http.StatusBadRequest)
+		return
+	}
+	qtype := dns.TypeA
+	if t := params.Get("type"); t != "" {
+		if qtype, ok = dns.StringToType[strings.ToUpper(t)]; !ok {
+			http.Error(w, fmt.Sprintf("unknown type '%s'", t), http.StatusBadRequest)
+			return
+		}
+	}
+	var ci ClientInfo
+	if client := params.Get("client"); client != "" {
+		if ci.SourceIP = net.ParseIP(client); ci.SourceIP == nil {
+			http.Error(w, fmt.Sprintf("invalid client ip '%s'", client), http.StatusBadRequest)
+			return
+		}
+	} else {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		ci.SourceIP = net.ParseIP(host)
+	}
+	ci.Listener = params.Get("listener")
+
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(name), qtype)
+	if do, _ := strconv.ParseBool(params.Get("do")); do {
+		q.SetEdns0(4096, true)
+	}
+	Log.WithFields(logrus.Fields{
+		"id":      s.id,
+		"client":  r.RemoteAddr,
+		"element": id,
+		"qname":   qName(q),
+		"qtype":   qType(q),
+	}).Info("resolving query for admin request")
+
+	start := time.Now()
+	a, err := resolver.Resolve(q, ci)
+	resp := resolveResponse{
+		Element:  id,
+		Duration: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	switch {
+	case err != nil:
+		resp.Error = err.Error()
+	case a == nil:
+		resp.Dropped = true
+	default:
+		decodeResponse(a, &resp)
+	}
+	writeJSON(w, resp)
+}
+
+// Fills in the decoded response message, with records in presentation format.
+func decodeResponse(a *dns.Msg, resp *resolveResponse) {
+	resp.Rcode = dns.RcodeToString[a.Rcode]
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{
+		{"qr", a.Response},
+		{"aa", a.Authoritative},
+		{"tc", a.Truncated},
+		{"rd", a.RecursionDesired},
+		{"ra", a.RecursionAvailable},
+		{"ad", a.AuthenticatedData},
+		{"cd", a.CheckingDisabled},
+	} {
+		if f.set {
+			resp.Flags = append(resp.Flags, f.name)
+		}
+	}
+	for _, q := range a.Question {
+		resp.Question = append(resp.Question, fmt.Sprintf("%s %s %s", q.Name, dns.ClassToString[q.Qclass], dns.TypeToString[q.Qtype]))
+	}
+	for _, rr := range a.Answer {
+		resp.Answer = append(resp.Answer, rr.String())
+	}
+	for _, rr := range a.Ns {
+		resp.Authority = append(resp.Authority, rr.String())
+	}
+	for _, rr := range a.Extra {
+		opt, ok := rr.(*dns.OPT)
+		if !ok {
+			resp.Additional = append(resp.Additional, rr.String())
+			continue
+		}
+		resp.EDNS0 = &edns0Info{UDPSize: opt.UDPSize(), DO: opt.Do()}
+		for _, o := range opt.Option {
+			resp.EDNS0.Options = append(resp.EDNS0.Options, o.String())
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
 func (s *AdminListener) String() string {
 	return s.id
 }
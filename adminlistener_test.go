@@ -0,0 +1,327 @@
+package rdns
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminInvalidateAuth(t *testing.T) {
+	invalidate := func(l *AdminListener, token string, peerCerts bool) int {
+		req := httptest.NewRequest(http.MethodPost, "/routedns/cache/invalidate", strings.NewReader(`{"names": ["example.com."]}`))
+		req.RemoteAddr = "192.0.2.10:12345"
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		if peerCerts {
+			req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{}}}
+		}
+		w := httptest.NewRecorder()
+		l.mux.ServeHTTP(w, req)
+		return w.Code
+	}
+	caches := map[string]*Cache{"cache": NewCache("cache", new(TestResolver), CacheOptions{})}
+
+	// Without token or client certificates, mutations are rejected
+	l, err := NewAdminListener("test-admin", "127.0.0.1:0", AdminListenerOptions{Caches: caches})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusForbidden, invalidate(l, "", false))
+
+	// With a token, it has to match
+	l, err = NewAdminListener("test-admin", "127.0.0.1:0", AdminListenerOptions{Caches: caches, AuthToken: "secret"})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusUnauthorized, invalidate(l, "", false))
+	require.Equal(t, http.StatusUnauthorized, invalidate(l, "wrong", false))
+	require.Equal(t, http.StatusOK, invalidate(l, "secret", false))
+
+	// With mutual TLS, clients need to present a certificate
+	l, err = NewAdminListener("test-admin", "127.0.0.1:0", AdminListenerOptions{
+		Caches:    caches,
+		TLSConfig: &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert},
+	})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusUnauthorized, invalidate(l, "", false))
+	require.Equal(t, http.StatusOK, invalidate(l, "", true))
+}
+
+func TestAdminStatsAuthorization(t *testing.T) {
+	_, allowed, _ := net.ParseCIDR("127.0.0.0/8")
+	stats, err := NewClientStats("test-stats", new(TestResolver), ClientStatsOptions{})
+	require.NoError(t, err)
+	l, err := NewAdminListener("test-admin", "127.0.0.1:0", AdminListenerOptions{
+		ListenOptions: ListenOptions{AllowedNet: []*net.IPNet{allowed}},
+		Stats:         map[string]*ClientStats{"stats": stats},
+		AuthToken:     "secret",
+	})
+	require.NoError(t, err)
+
+	get := func(client, token string) int {
+		req := httptest.NewRequest(http.MethodGet, "/routedns/stats/stats", nil)
+		req.RemoteAddr = client
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		l.mux.ServeHTTP(w, req)
+		return w.Code
+	}
+	require.Equal(t, http.StatusForbidden, get("192.0.2.10:12345", "secret"))
+	require.Equal(t, http.StatusUnauthorized, get("127.0.0.1:12345", ""))
+	require.Equal(t, http.StatusOK, get("127.0.0.1:12345", "secret"))
+}
+
+func TestAdminAllowTemporarily(t *testing.T) {
+	db, err := NewDomainDB("test", NewStaticLoader([]string{".blocked.test"}))
+	require.NoError(t, err)
+	b, err := NewBlocklist("test-allow-bl", new(TestResolver), BlocklistOptions{BlocklistDB: db})
+	require.NoError(t, err)
+	l, err := NewAdminListener("test-admin", "127.0.0.1:0", AdminListenerOptions{
+		Blocklists: map[string]*Blocklist{"bl": b},
+		AuthToken:  "secret",
+	})
+	require.NoError(t, err)
+	request := func(token, body string) int {
+		req := httptest.NewRequest(http.MethodPost, "/routedns/blocklist/bl/allow", strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		l.mux.ServeHTTP(w, req)
+		return w.Code
+	}
+	q := dns.Question{Name: "www.blocked.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	require.Equal(t, http.StatusUnauthorized, request("", `{"rule": "www.blocked.test", "duration": 1}`))
+	require.True(t, b.Test(q).Blocked)
+
+	require.Equal(t, http.StatusNoContent, request("secret", `{"rule": "www.blocked.test", "duration": 1}`))
+	require.True(t, b.Test(q).Allowed)
+	time.Sleep(1100 * time.Millisecond)
+	require.True(t, b.Test(q).Blocked)
+	require.Empty(t, b.RuntimeRules(true))
+
+	require.Equal(t, http.StatusBadRequest, request("secret", `{"duration": 1}`))
+	require.Equal(t, http.StatusBadRequest, request("secret", `{"rule": "www.blocked.test", "duration": -1}`))
+}
+
+func TestAdminTestIPBlocklist(t *testing.T) {
+	db, err := NewCidrDB("test-cidr", NewStaticLoader([]string{"192.168.1.0/24"}))
+	require.NoError(t, err)
+	b, err := NewClientBlocklist("test-client-bl", new(TestResolver), ClientBlocklistOptions{BlocklistDB: db})
+	require.NoError(t, err)
+	l, err := NewAdminListener("test-admin", "127.0.0.1:0", AdminListenerOptions{
+		IPBlocklists: map[string]IPBlocklistTester{"clients": b},
+		AuthToken:    "secret",
+	})
+	require.NoError(t, err)
+	request := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		l.mux.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request(http.MethodGet, "/routedns/blocklist/clients/test?ip=192.168.1.10")
+	require.Equal(t, http.StatusOK, w.Code)
+	var result BlocklistTestResult
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&result))
+	require.Equal(t, BlocklistTestResult{Blocked: true, List: "test-cidr", Rule: "192.168.1.0/24"}, result)
+
+	w = request(http.MethodGet, "/routedns/blocklist/clients/test?ip=10.0.0.1")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&result))
+	require.False(t, result.Blocked)
+
+	require.Equal(t, http.StatusBadRequest, request(http.MethodGet, "/routedns/blocklist/clients/test?ip=invalid").Code)
+	require.Equal(t, http.StatusMethodNotAllowed, request(http.MethodPost, "/routedns/blocklist/clients/refresh").Code)
+}
+
+func TestAdminListenerAuthorization(t *testing.T) {
+	var added []string
+	set := NewListenerSet(func(id string, definition []byte) (Listener, error) {
+		added = append(added, id)
+		return newTestListener(id), nil
+	})
+
+	put := func(l *AdminListener, token string) int {
+		req := httptest.NewRequest(http.MethodPut, "/routedns/listener/new", strings.NewReader(`protocol = "udp"`))
+		req.RemoteAddr = "127.0.0.1:12345"
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		l.mux.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Listeners can't be added without authentication configured
+	l, err := NewAdminListener("test-admin", "127.0.0.1:0", AdminListenerOptions{Listeners: set})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusForbidden, put(l, ""))
+
+	l, err = NewAdminListener("test-admin", "127.0.0.1:0", AdminListenerOptions{Listeners: set, AuthToken: "secret"})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusUnauthorized, put(l, ""))
+	require.Empty(t, added)
+	require.Equal(t, http.StatusCreated, put(l, "secret"))
+	require.Equal(t, []string{"new"}, added)
+}
+
+func TestAdminResolve(t *testing.T) {
+	var client net.IP
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			client = ci.SourceIP
+			if q.Question[0].Name == "fail.test." {
+				return nil, errors.New("upstream failed")
+			}
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.RecursionAvailable = true
+			a.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IP{192, 0, 2, 1},
+			}}
+			if edns0 := q.IsEdns0(); edns0 != nil {
+				a.SetEdns0(edns0.UDPSize(), edns0.Do())
+			}
+			return a, nil
+		},
+	}
+	l, err := NewAdminListener("test-admin", "127.0.0.1:0", AdminListenerOptions{
+		Resolvers: map[string]Resolver{"upstream": upstream},
+		AuthToken: "secret",
+	})
+	require.NoError(t, err)
+
+	resolve := func(target string) (int, resolveResponse) {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.RemoteAddr = "192.0.2.10:12345"
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		l.mux.ServeHTTP(w, req)
+		var resp resolveResponse
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		}
+		return w.Code, resp
+	}
+
+	// Decoded response, the client is the one making the request
+	code, resp := resolve("/routedns/resolve/upstream?name=example.com&type=a&do=true")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "upstream", resp.Element)
+	require.Equal(t, "NOERROR", resp.Rcode)
+	require.Equal(t, []string{"qr", "rd", "ra"}, resp.Flags)
+	require.Equal(t, []string{"example.com. IN A"}, resp.Question)
+	require.Equal(t, []string{"example.com.\t60\tIN\tA\t192.0.2.1"}, resp.Answer)
+	require.NotNil(t, resp.EDNS0)
+	require.True(t, resp.EDNS0.DO)
+	require.Equal(t, "192.0.2.10", client.String())
+
+	// Client IP given in the request
+	code, _ = resolve("/routedns/resolve/upstream?name=example.com&client=10.0.0.1")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "10.0.0.1", client.String())
+
+	// Errors are returned in the response
+	code, resp = resolve("/routedns/resolve/upstream?name=fail.test")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "upstream failed", resp.Error)
+
+	// Invalid requests
+	code, _ = resolve("/routedns/resolve/unknown?name=example.com")
+	require.Equal(t, http.StatusNotFound, code)
+	code, _ = resolve("/routedns/resolve/upstream")
+	require.Equal(t, http.StatusBadRequest, code)
+	code, _ = resolve("/routedns/resolve/upstream?name=example.com&type=invalid")
+	require.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestAdminOverrides(t *testing.T) {
+	db, err := NewDomainDB("test", NewStaticLoader([]string{"blocked.test"}))
+	require.NoError(t, err)
+	newBlocklist := func() *Blocklist {
+		b, err := NewBlocklist("test-overrides-bl", new(TestResolver), BlocklistOptions{BlocklistDB: db})
+		require.NoError(t, err)
+		return b
+	}
+	newAdmin := func(b *Blocklist, set *ListenerSet) *AdminListener {
+		l, err := NewAdminListener("test-admin", "127.0.0.1:0", AdminListenerOptions{
+			Blocklists: map[string]*Blocklist{"bl": b},
+			Listeners:  set,
+			AuthToken:  "secret",
+		})
+		require.NoError(t, err)
+		return l
+	}
+	newSet := func() *ListenerSet {
+		set := NewListenerSet(func(id string, definition []byte) (Listener, error) {
+			if string(definition) == "invalid" {
+				return nil, errors.New("invalid definition")
+			}
+			return newTestListener(id), nil
+		})
+		require.NoError(t, set.Add(newTestListener("static")))
+		return set
+	}
+	request := func(l *AdminListener, method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		l.mux.ServeHTTP(w, req)
+		return w
+	}
+
+	// Make changes at runtime, including a temporary rule that isn't exported
+	b, set := newBlocklist(), newSet()
+	l := newAdmin(b, set)
+	require.NoError(t, b.AddRule("ads.test", false))
+	require.NoError(t, b.AllowTemporarily("allowed.test", time.Minute))
+	require.NoError(t, set.AddDefinition("added", []byte(`protocol = "udp"`)))
+	require.NoError(t, set.Remove("static"))
+
+	w := request(l, http.MethodGet, "/routedns/overrides", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	exported := w.Body.String()
+	var o runtimeOverrides
+	require.NoError(t, json.Unmarshal([]byte(exported), &o))
+	require.Equal(t, []string{"ads.test"}, o.Blocklists["bl"].Blocklist)
+	require.Empty(t, o.Blocklists["bl"].Allowlist)
+	require.Equal(t, map[string]string{"added": `protocol = "udp"`}, o.Listeners.Added)
+	require.Equal(t, []string{"static"}, o.Listeners.Removed)
+
+	// Import into a fresh instance, twice since it should be idempotent
+	b, set = newBlocklist(), newSet()
+	l = newAdmin(b, set)
+	for i := 0; i < 2; i++ {
+		w = request(l, http.MethodPut, "/routedns/overrides", exported)
+		require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+	}
+	require.Equal(t, []string{"ads.test"}, b.RuntimeRules(false))
+	require.Equal(t, []string{"added"}, set.IDs())
+	require.Equal(t, *o.Listeners, set.Overrides())
+
+	// Unknown blocklists are rejected
+	w = request(l, http.MethodPut, "/routedns/overrides", `{"blocklists":{"unknown":{}}}`)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Nothing is changed if any part of the document is invalid
+	w = request(l, http.MethodPut, "/routedns/overrides", `{"blocklists":{"bl":{"blocklist":["new.test"]}},"listeners":{"added":{"other":"invalid"}}}`)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	w = request(l, http.MethodPut, "/routedns/overrides", `{"blocklists":{"bl":{"blocklist":["new.test", "a.*.test"]}}}`)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Equal(t, []string{"ads.test"}, b.RuntimeRules(false))
+	require.Equal(t, []string{"added"}, set.IDs())
+}
@@ -0,0 +1,275 @@
+package rdns
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Reasons for refused connections or queries in the audit log.
+const (
+	AuditReasonACL       = "acl"
+	AuditReasonTLS       = "tls"
+	AuditReasonRateLimit = "rate-limit"
+)
+
+// Time allowed for clients to complete the TLS handshake on listeners with
+// an audit log.
+const auditHandshakeTimeout = 10 * time.Second
+
+// AuditLog writes a structured record, one JSON object per line, for every
+// connection accepted by a listener and every connection or query that is
+// refused, together with the reason. Intended to be fed into abuse detection
+// systems by operators of public resolvers.
+type AuditLog struct {
+	listener string
+	protocol string
+	out      *rotatingFile
+	metrics  *AuditLogMetrics
+}
+
+type AuditLogOptions struct {
+	// File the records are written to. Required.
+	File string
+
+	// Size in bytes at which the file is rotated. Default 100MB.
+	MaxSize int64
+
+	// Number of rotated files to keep. Default 5.
+	MaxFiles int
+}
+
+type AuditLogMetrics struct {
+	// Number of records written.
+	logged *expvar.Int
+	// Number of records that could not be written.
+	failed *expvar.Int
+}
+
+// A record in the audit log.
+type auditRecord struct {
+	Time     time.Time `json:"time"`
+	Listener string    `json:"listener"`
+	Protocol string    `json:"protocol"`
+	Client   string    `json:"client"`
+	Event    string    `json:"event"` // "accepted" or "refused"
+	Reason   string    `json:"reason,omitempty"`
+	Name     string    `json:"name,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// Audit logs of running listeners by listener ID, used by elements in the
+// pipeline to record refused queries.
+var (
+	auditLogsMu sync.RWMutex
+	auditLogs   = make(map[string]*AuditLog)
+)
+
+// NewAuditLog returns a new audit log for a listener. Once the listener is
+// started, elements that refuse queries, like rate limiters, record them in
+// the audit log of the listener that received the query.
+func NewAuditLog(listener, protocol string, opt AuditLogOptions) (*AuditLog, error) {
+	if opt.File == "" {
+		return nil, errors.New("no audit log file specified")
+	}
+	if opt.MaxSize == 0 {
+		opt.MaxSize = 100 << 20
+	}
+	if opt.MaxFiles == 0 {
+		opt.MaxFiles = 5
+	}
+	out, err := newRotatingFile(opt.File, opt.MaxSize, opt.MaxFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{
+		listener: listener,
+		protocol: protocol,
+		out:      out,
+		metrics: &AuditLogMetrics{
+			logged: getVarInt("audit-log", listener, "logged"),
+			failed: getVarInt("audit-log", listener, "failed"),
+		},
+	}, nil
+}
+
+// Makes the audit log available to elements in the pipeline. Called when the
+// listener starts, so a listener that is only created, like one that replaces
+// a running listener with the same ID, doesn't take over its audit log. Can be
+// called on a nil audit log.
+func (l *AuditLog) register() {
+	if l == nil {
+		return
+	}
+	auditLogsMu.Lock()
+	auditLogs[l.listener] = l
+	auditLogsMu.Unlock()
+}
+
+// Close the audit log file once the listener stopped. Can be called on a nil
+// audit log.
+func (l *AuditLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	auditLogsMu.Lock()
+	if auditLogs[l.listener] == l {
+		delete(auditLogs, l.listener)
+	}
+	auditLogsMu.Unlock()
+	return l.out.Close()
+}
+
+// Records an accepted connection. Can be called on a nil audit log.
+func (l *AuditLog) accepted(client net.IP) {
+	if l == nil {
+		return
+	}
+	l.write(auditRecord{Client: ipString(client), Event: "accepted"})
+}
+
+// Records a refused connection, or query if q is not nil. Can be called on a
+// nil audit log.
+func (l *AuditLog) refused(client net.IP, reason string, q *dns.Msg, err error) {
+	if l == nil {
+		return
+	}
+	rec := auditRecord{Client: ipString(client), Event: "refused", Reason: reason}
+	if q != nil {
+		rec.Name = qName(q)
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	l.write(rec)
+}
+
+func (l *AuditLog) write(rec auditRecord) {
+	rec.Time = time.Now().UTC()
+	rec.Listener = l.listener
+	rec.Protocol = l.protocol
+	b, err := json.Marshal(rec)
+	if err != nil {
+		l.metrics.failed.Add(1)
+		return
+	}
+	if _, err := l.out.Write(append(b, '\n')); err != nil {
+		l.metrics.failed.Add(1)
+		Log.WithError(err).WithField("listener", l.listener).Error("failed to write audit log")
+		return
+	}
+	l.metrics.logged.Add(1)
+}
+
+// Records a query refused by an element in the pipeline in the audit log of
+// the listener that received it, if it has one.
+func auditRefused(ci ClientInfo, reason string, q *dns.Msg) {
+	auditLogsMu.RLock()
+	l := auditLogs[ci.Listener]
+	auditLogsMu.RUnlock()
+	l.refused(ci.SourceIP, reason, q, nil)
+}
+
+func ipString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// auditListener records accepted connections in the audit log.
+type auditListener struct {
+	net.Listener
+	audit *AuditLog
+}
+
+func (l *auditListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	// Reading the address can block on connections with PROXY protocol header
+	go l.audit.accepted(addrIP(conn.RemoteAddr()))
+	return conn, nil
+}
+
+// auditTLSListener completes the TLS handshake of new connections before
+// returning them, so that failed handshakes can be recorded in the audit log.
+// Handshakes run concurrently to not hold up other clients.
+type auditTLSListener struct {
+	net.Listener
+	config *tls.Config
+	audit  *AuditLog
+
+	conns     chan net.Conn
+	done      chan struct{} // Closed when the listener is closed
+	closeOnce sync.Once
+	stopped   chan struct{} // Closed when the accept loop ends
+	err       error         // Error that ended the accept loop
+}
+
+func newAuditTLSListener(ln net.Listener, config *tls.Config, audit *AuditLog) net.Listener {
+	l := &auditTLSListener{
+		Listener: ln,
+		config:   config,
+		audit:    audit,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *auditTLSListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.stopped:
+		return nil, l.err
+	}
+}
+
+func (l *auditTLSListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+func (l *auditTLSListener) acceptLoop() {
+	defer close(l.stopped)
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			l.err = err
+			return
+		}
+		go l.handshake(conn)
+	}
+}
+
+func (l *auditTLSListener) handshake(conn net.Conn) {
+	tlsConn := tls.Server(conn, l.config)
+	_ = conn.SetDeadline(time.Now().Add(auditHandshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		l.audit.refused(addrIP(conn.RemoteAddr()), AuditReasonTLS, nil, err)
+		conn.Close()
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+	l.audit.accepted(addrIP(conn.RemoteAddr()))
+	select {
+	case l.conns <- tlsConn:
+	case <-l.done:
+		tlsConn.Close()
+	}
+}
@@ -0,0 +1,154 @@
+package rdns
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// Reads all records from an audit log file.
+func readAuditLog(t *testing.T, file string) []auditRecord {
+	content, err := os.ReadFile(file)
+	require.NoError(t, err)
+	var records []auditRecord
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		if line == "" {
+			continue
+		}
+		var rec auditRecord
+		require.NoError(t, json.Unmarshal([]byte(line), &rec))
+		records = append(records, rec)
+	}
+	return records
+}
+
+func TestAuditLogDoT(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := NewAuditLog("test-audit-dot", "dot", AuditLogOptions{File: file})
+	require.NoError(t, err)
+
+	upstream := new(TestResolver)
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	tlsServerConfig, err := TLSServerConfig("", "testdata/server.crt", "testdata/server.key", false)
+	require.NoError(t, err)
+	opt := DoTListenerOptions{
+		ListenOptions: ListenOptions{Audit: audit},
+		TLSConfig:     tlsServerConfig,
+	}
+	s := NewDoTListener("test-audit-dot", addr, opt, upstream)
+	go func() {
+		err := s.Start()
+		require.NoError(t, err)
+	}()
+	defer s.Stop()
+	time.Sleep(time.Second)
+
+	// A client that trusts the server certificate
+	tlsConfig, err := TLSClientConfig("testdata/ca.crt", "", "")
+	require.NoError(t, err)
+	c, _ := NewDoTClient("test-dot", addr, DoTClientOptions{TLSConfig: tlsConfig})
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 1, upstream.HitCount())
+
+	// A client that sends plain DNS fails the handshake
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	co := &dns.Conn{Conn: conn}
+	require.NoError(t, co.WriteMsg(q))
+	_, _ = co.ReadMsg()
+	conn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	records := readAuditLog(t, file)
+	require.Len(t, records, 2)
+	require.Equal(t, "accepted", records[0].Event)
+	require.Equal(t, "test-audit-dot", records[0].Listener)
+	require.Equal(t, "dot", records[0].Protocol)
+	require.Equal(t, "127.0.0.1", records[0].Client)
+	require.Equal(t, "refused", records[1].Event)
+	require.Equal(t, AuditReasonTLS, records[1].Reason)
+	require.NotEmpty(t, records[1].Error)
+}
+
+func TestAuditLogACL(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := NewAuditLog("test-audit-acl", "udp", AuditLogOptions{File: file})
+	require.NoError(t, err)
+
+	upstream := new(TestResolver)
+	addr, err := getUDPLnAddress()
+	require.NoError(t, err)
+	_, allowed, _ := net.ParseCIDR("192.168.0.0/16")
+	opt := ListenOptions{AllowedNet: []*net.IPNet{allowed}, Audit: audit}
+	s := NewDNSListener("test-audit-acl", addr, "udp", opt, upstream)
+	go func() {
+		err := s.Start()
+		require.NoError(t, err)
+	}()
+	defer s.Stop()
+	time.Sleep(time.Second)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	a, err := dns.Exchange(q, addr)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeRefused, a.Rcode)
+	require.Equal(t, 0, upstream.HitCount())
+
+	records := readAuditLog(t, file)
+	require.Len(t, records, 1)
+	require.Equal(t, "refused", records[0].Event)
+	require.Equal(t, AuditReasonACL, records[0].Reason)
+	require.Equal(t, "example.com.", records[0].Name)
+}
+
+func TestAuditLogRateLimit(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := NewAuditLog("test-audit-rrl", "udp", AuditLogOptions{File: file})
+	require.NoError(t, err)
+	audit.register() // Done by the listener when it starts
+
+	// Creating another audit log for the same listener, like when a
+	// replacement is rejected, doesn't take over
+	other, err := NewAuditLog("test-audit-rrl", "udp", AuditLogOptions{File: filepath.Join(t.TempDir(), "other.log")})
+	require.NoError(t, err)
+	require.NoError(t, other.Close())
+
+	upstream := new(TestResolver)
+	r := NewRateLimiter("test-audit-rrl", upstream, RateLimiterOptions{Requests: 1, LimitAction: "refused"})
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	ci := ClientInfo{SourceIP: net.ParseIP("192.168.1.1"), Listener: "test-audit-rrl"}
+	_, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	_, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+
+	// Queries from listeners without audit log aren't recorded
+	_, err = r.Resolve(q, ClientInfo{SourceIP: net.ParseIP("192.168.1.1"), Listener: "other"})
+	require.NoError(t, err)
+
+	records := readAuditLog(t, file)
+	require.Len(t, records, 1)
+	require.Equal(t, "refused", records[0].Event)
+	require.Equal(t, AuditReasonRateLimit, records[0].Reason)
+	require.Equal(t, "192.168.1.1", records[0].Client)
+
+	// Nothing is recorded once the listener stopped and closed the log
+	require.NoError(t, audit.Close())
+	_, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Len(t, readAuditLog(t, file), 1)
+}
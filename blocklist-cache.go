@@ -0,0 +1,108 @@
+package rdns
+
+import (
+	"container/list"
+	"expvar"
+	"net"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Cache of recent blocklist decisions, so repeated queries for the same name
+// don't have to be matched against the lists every time. Both matches and
+// non-matches are cached. Since the response to a match can depend on the
+// query type, for example in hosts lists, the type is part of the key.
+type blocklistCache struct {
+	mu       sync.Mutex
+	capacity int
+	items    map[blocklistCacheKey]*list.Element
+	order    *list.List // Most recently used at the front
+
+	// Incremented whenever the lists or rules change. Decisions that were
+	// made with old lists are not added to the cache.
+	generation uint64
+
+	hit  *expvar.Int
+	miss *expvar.Int
+}
+
+type blocklistCacheKey struct {
+	name  string
+	qtype uint16
+}
+
+// Result of matching a query against the allowlist and blocklist.
+type blocklistDecision struct {
+	allowed bool // Matched the allowlist
+	blocked bool // Matched the blocklist and not the allowlist
+	ip      net.IP
+	name    string
+	match   *BlocklistMatch
+}
+
+type blocklistCacheItem struct {
+	key      blocklistCacheKey
+	decision blocklistDecision
+}
+
+func newBlocklistCache(id string, capacity int) *blocklistCache {
+	return &blocklistCache{
+		capacity: capacity,
+		items:    make(map[blocklistCacheKey]*list.Element),
+		order:    list.New(),
+		hit:      getVarInt("router", id, "match-cache-hit"),
+		miss:     getVarInt("router", id, "match-cache-miss"),
+	}
+}
+
+func blocklistCacheKeyFromQuestion(q dns.Question) blocklistCacheKey {
+	// The lists match names case-sensitively, so the key has to as well
+	return blocklistCacheKey{name: q.Name, qtype: q.Qtype}
+}
+
+// Returns the cached decision for a query if there is one. Also returns the
+// current generation which has to be passed to add() for new decisions.
+func (c *blocklistCache) get(key blocklistCacheKey) (blocklistDecision, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		c.miss.Add(1)
+		return blocklistDecision{}, c.generation, false
+	}
+	c.hit.Add(1)
+	c.order.MoveToFront(e)
+	return e.Value.(*blocklistCacheItem).decision, c.generation, true
+}
+
+// Adds a decision to the cache, unless the lists changed since the
+// decision was made.
+func (c *blocklistCache) add(key blocklistCacheKey, decision blocklistDecision, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if e, ok := c.items[key]; ok {
+		e.Value.(*blocklistCacheItem).decision = decision
+		c.order.MoveToFront(e)
+		return
+	}
+	c.items[key] = c.order.PushFront(&blocklistCacheItem{key: key, decision: decision})
+	for c.order.Len() > c.capacity {
+		e := c.order.Back()
+		c.order.Remove(e)
+		delete(c.items, e.Value.(*blocklistCacheItem).key)
+	}
+}
+
+// Removes all decisions from the cache. Needs to be called whenever the lists
+// or rules change.
+func (c *blocklistCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.items = make(map[blocklistCacheKey]*list.Element)
+	c.order.Init()
+}
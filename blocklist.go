@@ -1,9 +1,11 @@
 package rdns
 
 import (
+	"context"
 	"errors"
 	"expvar"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
@@ -19,6 +21,23 @@ type Blocklist struct {
 	resolver Resolver
 	mu       sync.RWMutex
 	metrics  *BlocklistMetrics
+
+	// Serializes reloads from the refresh loops and Refresh. The loaders keep
+	// state between reloads and only one result can be installed.
+	reloadMu sync.Mutex
+	cache    *blocklistCache // Optional cache of decisions
+
+	// Rules added at runtime, through the admin service, in domain format.
+	// They are checked before the configured lists and not persisted.
+	runtimeBlock, runtimeAllow runtimeRules
+
+	// Allowlist rules added with AllowTemporarily, with the time they expire.
+	temporary map[string]time.Time
+}
+
+type runtimeRules struct {
+	rules []string
+	db    *DomainDB
 }
 
 var _ Resolver = &Blocklist{}
@@ -42,6 +61,21 @@ type BlocklistOptions struct {
 
 	// Refresh period for the allowlist. Disabled if 0.
 	AllowlistRefresh time.Duration
+
+	// Include the list and rule that matched as extra text in the extended
+	// DNS error of blocked responses. Useful to find the cause of false
+	// positives, but reveals details of the lists to clients.
+	EDEText bool
+
+	// Send queries to the upstream resolver while the lists are checked rather
+	// than after, which hides the time it takes to check large lists. The
+	// upstream query is cancelled if the name is blocked.
+	Parallel bool
+
+	// Number of recent decisions to cache, so repeated queries for the same
+	// name skip matching the lists. Useful with large lists of regular
+	// expressions. Disabled if 0.
+	MatchCacheSize int
 }
 
 type BlocklistMetrics struct {
@@ -66,12 +100,16 @@ func NewBlocklist(id string, resolver Resolver, opt BlocklistOptions) (*Blocklis
 		BlocklistOptions: opt,
 		metrics:          NewBlocklistMetrics(id),
 	}
+	if opt.MatchCacheSize > 0 {
+		blocklist.cache = newBlocklistCache(id, opt.MatchCacheSize)
+	}
 
-	// Start the refresh goroutines if we have a list and a refresh period was given
-	if blocklist.BlocklistDB != nil && blocklist.BlocklistRefresh > 0 {
+	// Start the refresh goroutines if we have a list. Lists are reloaded if a
+	// refresh period was given, or if they were loaded from a stale copy.
+	if blocklist.BlocklistDB != nil {
 		go blocklist.refreshLoopBlocklist(blocklist.BlocklistRefresh)
 	}
-	if blocklist.AllowlistDB != nil && blocklist.AllowlistRefresh > 0 {
+	if blocklist.AllowlistDB != nil {
 		go blocklist.refreshLoopAllowlist(blocklist.AllowlistRefresh)
 	}
 	return blocklist, nil
@@ -86,39 +124,46 @@ func (r *Blocklist) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	question := q.Question[0]
 	log := logger(r.id, q, ci)
 
-	r.mu.RLock()
-	blocklistDB := r.BlocklistDB
-	allowlistDB := r.AllowlistDB
-	r.mu.RUnlock()
+	// Start resolving the query upstream while the lists are checked. It's
+	// cancelled if the query is blocked or answered by the allowlist-resolver.
+	var upstream <-chan blocklistResponse
+	if r.Parallel {
+		var cancel context.CancelFunc
+		upstream, cancel = r.resolveAsync(q, ci)
+		defer cancel()
+	}
+
+	d := r.decide(question)
 
 	// Forward to upstream or the optional allowlist-resolver immediately if there's a match in the allowlist
-	if allowlistDB != nil {
-		if _, _, match, ok := allowlistDB.Match(question); ok {
-			log = log.WithFields(logrus.Fields{"list": match.List, "rule": match.Rule})
-			r.metrics.allowed.Add(1)
-			if r.AllowListResolver != nil {
-				log.WithField("resolver", r.AllowListResolver.String()).Debug("matched allowlist, forwarding")
-				return r.AllowListResolver.Resolve(q, ci)
-			}
-			log.WithField("resolver", r.resolver.String()).Debug("matched allowlist, forwarding")
-			return r.resolver.Resolve(q, ci)
+	if d.allowed {
+		log = log.WithFields(logrus.Fields{"list": d.match.List, "rule": d.match.Rule})
+		r.metrics.allowed.Add(1)
+		if r.AllowListResolver != nil {
+			log.WithField("resolver", r.AllowListResolver.String()).Debug("matched allowlist, forwarding")
+			return r.AllowListResolver.Resolve(q, ci)
 		}
+		log.WithField("resolver", r.resolver.String()).Debug("matched allowlist, forwarding")
+		return r.forward(q, ci, upstream)
 	}
 
-	ip, name, match, ok := blocklistDB.Match(question)
-	if !ok {
+	ip, name, match := d.ip, d.name, d.match
+	if !d.blocked {
 		// Didn't match anything, pass it on to the next resolver
 		log.WithField("resolver", r.resolver.String()).Debug("forwarding unmodified query to resolver")
 		r.metrics.allowed.Add(1)
-		return r.resolver.Resolve(q, ci)
+		return r.forward(q, ci, upstream)
 	}
-	log = log.WithFields(logrus.Fields{"list": match.List, "rule": match.Rule})
+	ci.Blocked = match
+	log = logger(r.id, q, ci)
 	r.metrics.blocked.Add(1)
 
 	// If we got a name for the PTR query, respond to it
 	if question.Qtype == dns.TypePTR && name != "" {
 		log.Debug("responding with ptr blocklist from blocklist")
-		return ptr(q, name), nil
+		answer := ptr(q, name)
+		setBlockedEDE(q, answer, blockedEDEText(r.EDEText, match))
+		return answer, nil
 	}
 
 	// If an optional blocklist-resolver was given, send the query to that instead of returning NXDOMAIN.
@@ -129,6 +174,7 @@ func (r *Blocklist) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 
 	answer := new(dns.Msg)
 	answer.SetReply(q)
+	setBlockedEDE(q, answer, blockedEDEText(r.EDEText, match))
 
 	// We have an IP address to return, make sure it's of the right type. If not return NXDOMAIN.
 	if ip4 := ip.To4(); len(ip4) == net.IPv4len && question.Qtype == dns.TypeA {
@@ -171,33 +217,405 @@ func (r *Blocklist) String() string {
 	return r.id
 }
 
+type blocklistResponse struct {
+	a   *dns.Msg
+	err error
+}
+
+// Sends the query to the upstream resolver in the background. The channel is
+// buffered so the response can be abandoned if the query is blocked. Calling
+// the returned function cancels the query if it's still in progress.
+func (r *Blocklist) resolveAsync(q *dns.Msg, ci ClientInfo) (<-chan blocklistResponse, context.CancelFunc) {
+	ch := make(chan blocklistResponse, 1)
+	ctx, cancel := context.WithCancel(ci.ctx())
+	ci.Context = ctx
+	q = q.Copy()
+	go func() {
+		a, err := r.resolver.Resolve(q, ci)
+		ch <- blocklistResponse{a, err}
+	}()
+	return ch, cancel
+}
+
+// Returns the response from the upstream resolver, waiting for the one that
+// was started in parallel if there is one.
+func (r *Blocklist) forward(q *dns.Msg, ci ClientInfo, upstream <-chan blocklistResponse) (*dns.Msg, error) {
+	if upstream != nil {
+		resp := <-upstream
+		return resp.a, resp.err
+	}
+	return r.resolver.Resolve(q, ci)
+}
+
+// Matches a query against the allowlist and blocklist, or returns the cached
+// decision if the cache is enabled.
+func (r *Blocklist) decide(q dns.Question) blocklistDecision {
+	if r.cache == nil {
+		return r.match(q)
+	}
+	key := blocklistCacheKeyFromQuestion(q)
+	d, generation, ok := r.cache.get(key)
+	if ok {
+		return d
+	}
+	d = r.match(q)
+	r.cache.add(key, d, generation)
+	return d
+}
+
+func (r *Blocklist) match(q dns.Question) blocklistDecision {
+	if match, ok := r.matchAllowlist(q); ok {
+		return blocklistDecision{allowed: true, match: match}
+	}
+	if ip, name, match, ok := r.matchBlocklist(q); ok {
+		return blocklistDecision{blocked: true, ip: ip, name: name, match: match}
+	}
+	return blocklistDecision{}
+}
+
+// Returns the matching allowlist rule, if any.
+func (r *Blocklist) matchAllowlist(q dns.Question) (*BlocklistMatch, bool) {
+	r.mu.RLock()
+	runtimeDB := r.runtimeAllow.db
+	allowlistDB := r.AllowlistDB
+	r.mu.RUnlock()
+
+	if runtimeDB != nil {
+		if _, _, match, ok := runtimeDB.Match(q); ok {
+			return match, true
+		}
+	}
+	if allowlistDB != nil {
+		if _, _, match, ok := allowlistDB.Match(q); ok {
+			return match, true
+		}
+	}
+	return nil, false
+}
+
+// Returns the matching blocklist rule, if any.
+func (r *Blocklist) matchBlocklist(q dns.Question) (net.IP, string, *BlocklistMatch, bool) {
+	r.mu.RLock()
+	runtimeDB := r.runtimeBlock.db
+	blocklistDB := r.BlocklistDB
+	r.mu.RUnlock()
+
+	if runtimeDB != nil {
+		if ip, name, match, ok := runtimeDB.Match(q); ok {
+			return ip, name, match, true
+		}
+	}
+	if blocklistDB != nil {
+		return blocklistDB.Match(q)
+	}
+	return nil, "", nil, false
+}
+
+// BlocklistTestResult describes how a query would be handled by a blocklist.
+type BlocklistTestResult struct {
+	Allowed bool   `json:"allowed"` // Matched the allowlist, overrides the blocklist
+	Blocked bool   `json:"blocked"` // Matched the blocklist and not the allowlist
+	List    string `json:"list,omitempty"`
+	Rule    string `json:"rule,omitempty"`
+}
+
+// Test returns which rule, if any, matches a query without resolving it. Used
+// to find out why a name is blocked.
+func (r *Blocklist) Test(q dns.Question) BlocklistTestResult {
+	if match, ok := r.matchAllowlist(q); ok {
+		return BlocklistTestResult{Allowed: true, List: match.List, Rule: match.Rule}
+	}
+	if _, _, match, ok := r.matchBlocklist(q); ok {
+		return BlocklistTestResult{Blocked: true, List: match.List, Rule: match.Rule}
+	}
+	return BlocklistTestResult{}
+}
+
+// AddRule adds a rule in domain format, like "example.com" or ".example.com",
+// to the blocklist, or to the allowlist if allow is true. Rules added at runtime
+// are lost on restart.
+func (r *Blocklist) AddRule(rule string, allow bool) error {
+	rule = strings.ToLower(strings.TrimSpace(rule))
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rr := r.runtimeList(allow)
+	if allow {
+		// Adding a temporary rule again makes it permanent
+		delete(r.temporary, rule)
+	}
+	for _, existing := range rr.rules {
+		if existing == rule {
+			return nil
+		}
+	}
+	return r.setRuntimeRules(allow, append(append([]string{}, rr.rules...), rule))
+}
+
+// RemoveRule removes a rule that was added at runtime. Returns false if the rule
+// doesn't exist.
+func (r *Blocklist) RemoveRule(rule string, allow bool) (bool, error) {
+	rule = strings.ToLower(strings.TrimSpace(rule))
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.removeRuntimeRule(rule, allow)
+}
+
+// Needs to be called with the lock held.
+func (r *Blocklist) removeRuntimeRule(rule string, allow bool) (bool, error) {
+	rr := r.runtimeList(allow)
+	rules := make([]string, 0, len(rr.rules))
+	for _, existing := range rr.rules {
+		if existing != rule {
+			rules = append(rules, existing)
+		}
+	}
+	if len(rules) == len(rr.rules) {
+		return false, nil
+	}
+	if allow {
+		delete(r.temporary, rule)
+	}
+	return true, r.setRuntimeRules(allow, rules)
+}
+
+// AllowTemporarily adds a rule to the allowlist for the given duration. Nothing
+// is changed if the rule is already in the allowlist permanently. Allowing a
+// temporary rule again extends it.
+func (r *Blocklist) AllowTemporarily(rule string, d time.Duration) error {
+	rule = strings.ToLower(strings.TrimSpace(rule))
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.temporary[rule]; !ok {
+		rr := r.runtimeList(true)
+		for _, existing := range rr.rules {
+			if existing == rule {
+				return nil
+			}
+		}
+		if err := r.setRuntimeRules(true, append(append([]string{}, rr.rules...), rule)); err != nil {
+			return err
+		}
+	}
+	if r.temporary == nil {
+		r.temporary = make(map[string]time.Time)
+	}
+	r.temporary[rule] = time.Now().Add(d)
+	time.AfterFunc(d, func() {
+		if err := r.removeTemporary(rule); err != nil {
+			Log.WithFields(logrus.Fields{"id": r.id, "rule": rule}).WithError(err).Error("failed to remove temporary rule")
+		}
+	})
+	return nil
+}
+
+// Removes a temporary rule from the allowlist once it expired, unless it has
+// since been made permanent, removed or extended.
+func (r *Blocklist) removeTemporary(rule string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	expiry, ok := r.temporary[rule]
+	if !ok || time.Now().Before(expiry) {
+		return nil
+	}
+	_, err := r.removeRuntimeRule(rule, true)
+	return err
+}
+
+// RuntimeRules returns the rules that were added at runtime to the blocklist,
+// or the allowlist if allow is true.
+func (r *Blocklist) RuntimeRules(allow bool) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]string{}, r.runtimeList(allow).rules...)
+}
+
+// PermanentRules returns the rules that were added at runtime like
+// RuntimeRules, but without temporary allowlist rules.
+func (r *Blocklist) PermanentRules(allow bool) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	rules := []string{}
+	for _, rule := range r.runtimeList(allow).rules {
+		if _, ok := r.temporary[rule]; allow && ok {
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// SetRules replaces the rules that were added at runtime to the blocklist, or
+// the allowlist if allow is true. Temporary allowlist rules are kept until they
+// expire, unless they're in the new rules, which makes them permanent.
+func (r *Blocklist) SetRules(rules []string, allow bool) error {
+	normalized := normalizeRules(rules)
+	seen := make(map[string]struct{}, len(normalized))
+	for _, rule := range normalized {
+		seen[rule] = struct{}{}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if allow {
+		for rule := range r.temporary {
+			if _, ok := seen[rule]; ok {
+				delete(r.temporary, rule)
+			} else {
+				normalized = append(normalized, rule)
+			}
+		}
+	}
+	return r.setRuntimeRules(allow, normalized)
+}
+
+// Returns the rules in lowercase, without duplicates and empty rules.
+func normalizeRules(rules []string) []string {
+	var normalized []string
+	seen := make(map[string]struct{})
+	for _, rule := range rules {
+		rule = strings.ToLower(strings.TrimSpace(rule))
+		if _, ok := seen[rule]; ok || rule == "" {
+			continue
+		}
+		seen[rule] = struct{}{}
+		normalized = append(normalized, rule)
+	}
+	return normalized
+}
+
+// Returns an error if the rules can't be added at runtime.
+func checkRuntimeRules(rules []string) error {
+	_, err := NewDomainDB("runtime", NewStaticLoader(normalizeRules(rules)))
+	return err
+}
+
+// Needs to be called with the lock held.
+func (r *Blocklist) runtimeList(allow bool) *runtimeRules {
+	if allow {
+		return &r.runtimeAllow
+	}
+	return &r.runtimeBlock
+}
+
+// Replaces the runtime rules and rebuilds the database. Needs to be called
+// with the lock held.
+func (r *Blocklist) setRuntimeRules(allow bool, rules []string) error {
+	name := "runtime-blocklist"
+	if allow {
+		name = "runtime-allowlist"
+	}
+	var db *DomainDB
+	if len(rules) > 0 {
+		var err error
+		db, err = NewDomainDB(name, NewStaticLoader(rules))
+		if err != nil {
+			return err
+		}
+	}
+	*r.runtimeList(allow) = runtimeRules{rules: rules, db: db}
+	r.resetCache()
+	return nil
+}
+
+// Refresh reloads the blocklist and allowlist immediately, without waiting for
+// the refresh period.
+func (r *Blocklist) Refresh() error {
+	r.mu.RLock()
+	hasBlocklist, hasAllowlist := r.BlocklistDB != nil, r.AllowlistDB != nil
+	r.mu.RUnlock()
+	if hasBlocklist {
+		if err := r.reloadBlocklist(); err != nil {
+			return err
+		}
+	}
+	if hasAllowlist {
+		if err := r.reloadAllowlist(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (r *Blocklist) refreshLoopBlocklist(refresh time.Duration) {
 	for {
-		time.Sleep(refresh)
-		log := Log.WithField("id", r.id)
-		log.Debug("reloading blocklist")
-		db, err := r.BlocklistDB.Reload()
-		if err != nil {
-			log.WithError(err).Error("failed to load rules")
-			continue
+		r.mu.RLock()
+		db := r.BlocklistDB
+		r.mu.RUnlock()
+		wait, ok := nextRefresh(db, refresh)
+		if !ok {
+			return
+		}
+		time.Sleep(wait)
+		if err := r.reloadBlocklist(); err != nil {
+			Log.WithField("id", r.id).WithError(err).Error("failed to load rules")
 		}
-		r.mu.Lock()
-		r.BlocklistDB = db
-		r.mu.Unlock()
 	}
 }
+
 func (r *Blocklist) refreshLoopAllowlist(refresh time.Duration) {
 	for {
-		time.Sleep(refresh)
-		log := Log.WithField("id", r.id)
-		log.Debug("reloading allowlist")
-		db, err := r.AllowlistDB.Reload()
-		if err != nil {
-			log.WithError(err).Error("failed to load rules")
-			continue
+		r.mu.RLock()
+		db := r.AllowlistDB
+		r.mu.RUnlock()
+		wait, ok := nextRefresh(db, refresh)
+		if !ok {
+			return
+		}
+		time.Sleep(wait)
+		if err := r.reloadAllowlist(); err != nil {
+			Log.WithField("id", r.id).WithError(err).Error("failed to load rules")
 		}
-		r.mu.Lock()
-		r.AllowlistDB = db
-		r.mu.Unlock()
+	}
+}
+
+func (r *Blocklist) reloadBlocklist() error {
+	r.reloadMu.Lock()
+	defer r.reloadMu.Unlock()
+	log := Log.WithField("id", r.id)
+	log.Debug("reloading blocklist")
+	r.mu.RLock()
+	current := r.BlocklistDB
+	r.mu.RUnlock()
+	db, err := current.Reload()
+	if err == ErrNotModified {
+		log.Debug("list not modified, keeping current rules")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.BlocklistDB = db
+	r.mu.Unlock()
+	r.resetCache()
+	return nil
+}
+
+func (r *Blocklist) reloadAllowlist() error {
+	r.reloadMu.Lock()
+	defer r.reloadMu.Unlock()
+	log := Log.WithField("id", r.id)
+	log.Debug("reloading allowlist")
+	r.mu.RLock()
+	current := r.AllowlistDB
+	r.mu.RUnlock()
+	db, err := current.Reload()
+	if err == ErrNotModified {
+		log.Debug("list not modified, keeping current rules")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.AllowlistDB = db
+	r.mu.Unlock()
+	r.resetCache()
+	return nil
+}
+
+// Drops all cached decisions after the lists or rules changed.
+func (r *Blocklist) resetCache() {
+	if r.cache != nil {
+		r.cache.reset()
 	}
 }
@@ -1,7 +1,11 @@
 package rdns
 
 import (
+	"net"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/require"
@@ -82,3 +86,292 @@ func TestBlocklistAllow(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, 2, r.HitCount())
 }
+
+func TestBlocklistRuntimeRules(t *testing.T) {
+	var ci ClientInfo
+	q := new(dns.Msg)
+	r := new(TestResolver)
+
+	m, err := NewDomainDB("testlist", NewStaticLoader([]string{".evil.test"}))
+	require.NoError(t, err)
+	b, err := NewBlocklist("test-bl", r, BlocklistOptions{BlocklistDB: m})
+	require.NoError(t, err)
+
+	// Block another domain at runtime
+	require.NoError(t, b.AddRule(".bad.test", false))
+	require.Equal(t, []string{".bad.test"}, b.RuntimeRules(false))
+	q.SetQuestion("www.bad.test.", dns.TypeA)
+	a, err := b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+	require.Equal(t, 0, r.HitCount())
+
+	// Make an exception for a name in the configured list
+	require.NoError(t, b.AddRule("good.evil.test", true))
+	q.SetQuestion("good.evil.test.", dns.TypeA)
+	_, err = b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r.HitCount())
+
+	// Find out why names are blocked
+	res := b.Test(dns.Question{Name: "x.evil.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	require.Equal(t, BlocklistTestResult{Blocked: true, List: "testlist", Rule: ".evil.test"}, res)
+	res = b.Test(dns.Question{Name: "good.evil.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	require.Equal(t, BlocklistTestResult{Allowed: true, List: "runtime-allowlist", Rule: "good.evil.test"}, res)
+
+	// Remove the rule again
+	ok, err := b.RemoveRule(".bad.test", false)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Empty(t, b.RuntimeRules(false))
+	q.SetQuestion("www.bad.test.", dns.TypeA)
+	_, err = b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 2, r.HitCount())
+}
+
+func TestBlocklistAllowTemporarily(t *testing.T) {
+	b, err := NewBlocklist("test-bl", new(TestResolver), BlocklistOptions{})
+	require.NoError(t, err)
+
+	// Temporary rules are removed once they expire
+	require.NoError(t, b.AllowTemporarily("temp.test", 50*time.Millisecond))
+	require.Equal(t, []string{"temp.test"}, b.RuntimeRules(true))
+	time.Sleep(100 * time.Millisecond)
+	require.Empty(t, b.RuntimeRules(true))
+
+	// Rules that were added permanently in the meantime are kept
+	require.NoError(t, b.AllowTemporarily("perm.test", 50*time.Millisecond))
+	require.NoError(t, b.AddRule("perm.test", true))
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, []string{"perm.test"}, b.RuntimeRules(true))
+
+	// An earlier timer doesn't remove a rule that was allowed again
+	require.NoError(t, b.AllowTemporarily("again.test", 50*time.Millisecond))
+	ok, err := b.RemoveRule("again.test", true)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.NoError(t, b.AllowTemporarily("again.test", time.Minute))
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, []string{"perm.test", "again.test"}, b.RuntimeRules(true))
+}
+
+func TestBlocklistEDEText(t *testing.T) {
+	var ci ClientInfo
+	r := new(TestResolver)
+
+	ads, err := NewDomainDB("ads", NewStaticLoader([]string{".ads.test"}))
+	require.NoError(t, err)
+	malware, err := NewDomainDB("malware", NewStaticLoader([]string{"evil.test"}))
+	require.NoError(t, err)
+	db, err := NewMultiDB(ads, malware)
+	require.NoError(t, err)
+
+	b, err := NewBlocklist("test-bl-ede", r, BlocklistOptions{BlocklistDB: db, EDEText: true})
+	require.NoError(t, err)
+
+	// Without EDNS0 there's no extended error in the response
+	q := new(dns.Msg)
+	q.SetQuestion("evil.test.", dns.TypeA)
+	a, err := b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+	require.Nil(t, a.IsEdns0())
+
+	// The list and rule that matched are in the extra text
+	q.SetEdns0(4096, false)
+	a, err = b.Resolve(q, ci)
+	require.NoError(t, err)
+	edns0 := a.IsEdns0()
+	require.NotNil(t, edns0)
+	require.Len(t, edns0.Option, 1)
+	ede, ok := edns0.Option[0].(*dns.EDNS0_EDE)
+	require.True(t, ok)
+	require.Equal(t, dns.ExtendedErrorCodeBlocked, ede.InfoCode)
+	require.Equal(t, "malware: evil.test", ede.ExtraText)
+	require.Equal(t, 0, r.HitCount())
+}
+
+func TestBlocklistParallel(t *testing.T) {
+	var ci ClientInfo
+	q := new(dns.Msg)
+
+	// Upstream that waits for blocked names until the query is cancelled
+	cancelled := make(chan struct{})
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			if q.Question[0].Name == "x.evil.test." {
+				<-ci.Context.Done()
+				close(cancelled)
+				return nil, ci.Context.Err()
+			}
+			a := new(dns.Msg)
+			a.SetReply(q)
+			return a, nil
+		},
+	}
+
+	m, err := NewDomainDB("testlist", NewStaticLoader([]string{".evil.test"}))
+	require.NoError(t, err)
+	b, err := NewBlocklist("test-bl", r, BlocklistOptions{BlocklistDB: m, Parallel: true})
+	require.NoError(t, err)
+
+	// Not blocked, the response comes from upstream
+	q.SetQuestion("test.com.", dns.TypeA)
+	a, err := b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Equal(t, 1, r.HitCount())
+
+	// Blocked, the upstream query is cancelled
+	q.SetQuestion("x.evil.test.", dns.TypeA)
+	a, err = b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("upstream query not cancelled")
+	}
+}
+
+// BlocklistDB that counts how often it's used to match queries.
+type countingDB struct {
+	BlocklistDB
+	count int
+}
+
+func (db *countingDB) Match(q dns.Question) (net.IP, string, *BlocklistMatch, bool) {
+	db.count++
+	return db.BlocklistDB.Match(q)
+}
+
+func TestBlocklistMatchCache(t *testing.T) {
+	var ci ClientInfo
+	q := new(dns.Msg)
+	r := new(TestResolver)
+
+	m, err := NewRegexpDB("testlist", NewStaticLoader([]string{`(^|\.)evil\.test`}))
+	require.NoError(t, err)
+	db := &countingDB{BlocklistDB: m}
+	b, err := NewBlocklist("test-bl", r, BlocklistOptions{BlocklistDB: db, MatchCacheSize: 10})
+	require.NoError(t, err)
+
+	// Blocked and allowed names are only matched against the list once
+	for i := 0; i < 3; i++ {
+		q.SetQuestion("x.evil.test.", dns.TypeA)
+		a, err := b.Resolve(q, ci)
+		require.NoError(t, err)
+		require.Equal(t, dns.RcodeNameError, a.Rcode)
+
+		q.SetQuestion("Test.com.", dns.TypeA)
+		_, err = b.Resolve(q, ci)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 2, db.count)
+	require.Equal(t, 3, r.HitCount())
+
+	// The cache is cleared when rules are added
+	require.NoError(t, b.AddRule("test.com", false))
+	q.SetQuestion("test.com.", dns.TypeA)
+	a, err := b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+	require.Equal(t, 3, r.HitCount())
+}
+
+func TestBlocklistMatchCacheCase(t *testing.T) {
+	var ci ClientInfo
+	q := new(dns.Msg)
+	r := new(TestResolver)
+
+	m, err := NewDomainDB("testlist", NewStaticLoader([]string{"evil.test"}))
+	require.NoError(t, err)
+	b, err := NewBlocklist("test-bl-case", r, BlocklistOptions{BlocklistDB: m, MatchCacheSize: 10})
+	require.NoError(t, err)
+
+	// A decision for a mixed-case name isn't used for the lowercase one
+	q.SetQuestion("EVIL.test.", dns.TypeA)
+	_, err = b.Resolve(q, ci)
+	require.NoError(t, err)
+	q.SetQuestion("evil.test.", dns.TypeA)
+	a, err := b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+}
+
+func TestBlocklistMatchMetadata(t *testing.T) {
+	var ci ClientInfo
+	r := new(TestResolver)
+
+	ads, err := NewDomainDB("ads", NewStaticLoader([]string{".ads.test"}))
+	require.NoError(t, err)
+
+	// The blocklist-resolver receives the rule that matched, with the category
+	var blocked *BlocklistMatch
+	blockResolver := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			blocked = ci.Blocked
+			return nxdomain(q), nil
+		},
+	}
+	b, err := NewBlocklist("test-bl-metadata", r, BlocklistOptions{
+		BlocklistDB:       NewCategoryDB("advertising", ads),
+		BlocklistResolver: blockResolver,
+	})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("x.ads.test.", dns.TypeA)
+	_, err = b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.NotNil(t, blocked)
+	require.Equal(t, BlocklistMatch{List: "ads", Rule: ".ads.test", Category: "advertising"}, *blocked)
+	require.Equal(t, "ads (advertising): .ads.test", blocked.String())
+	require.Equal(t, 1, blockResolver.HitCount())
+
+	// Queries that aren't blocked don't have a match
+	blocked = nil
+	q.SetQuestion("test.com.", dns.TypeA)
+	_, err = b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Nil(t, blocked)
+	require.Equal(t, 1, r.HitCount())
+}
+
+// Loader that records how many loads run at the same time.
+type concurrencyLoader struct {
+	active, max int32
+}
+
+func (l *concurrencyLoader) Load() ([]string, error) {
+	n := atomic.AddInt32(&l.active, 1)
+	defer atomic.AddInt32(&l.active, -1)
+	for {
+		m := atomic.LoadInt32(&l.max)
+		if n <= m || atomic.CompareAndSwapInt32(&l.max, m, n) {
+			break
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	return []string{"evil.test"}, nil
+}
+
+func TestBlocklistRefreshSerialized(t *testing.T) {
+	loader := new(concurrencyLoader)
+	db, err := NewDomainDB("test", loader)
+	require.NoError(t, err)
+	b, err := NewBlocklist("test-refresh", new(TestResolver), BlocklistOptions{BlocklistDB: db})
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.NoError(t, b.Refresh())
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int32(1), atomic.LoadInt32(&loader.max))
+}
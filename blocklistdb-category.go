@@ -0,0 +1,95 @@
+package rdns
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// CategoryDB wraps a blocklist DB and adds a category, like "ads" or
+// "malware", to its matches.
+type CategoryDB struct {
+	category string
+	db       BlocklistDB
+}
+
+var _ BlocklistDB = &CategoryDB{}
+
+// NewCategoryDB returns a blocklist DB that adds the category to all matches
+// of the given DB.
+func NewCategoryDB(category string, db BlocklistDB) *CategoryDB {
+	return &CategoryDB{category: category, db: db}
+}
+
+func (m *CategoryDB) Reload() (BlocklistDB, error) {
+	db, err := m.db.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return NewCategoryDB(m.category, db), nil
+}
+
+func (m *CategoryDB) Match(q dns.Question) (net.IP, string, *BlocklistMatch, bool) {
+	ip, name, match, ok := m.db.Match(q)
+	return ip, name, withCategory(match, m.category), ok
+}
+
+func (m *CategoryDB) String() string {
+	return m.db.String()
+}
+
+// Stale returns true if the list was loaded from a stale copy.
+func (m *CategoryDB) Stale() bool {
+	return isStale(m.db)
+}
+
+// CategoryIPDB wraps an IP blocklist DB and adds a category to its matches.
+type CategoryIPDB struct {
+	category string
+	db       IPBlocklistDB
+}
+
+var _ IPBlocklistDB = &CategoryIPDB{}
+
+// NewCategoryIPDB returns an IP blocklist DB that adds the category to all
+// matches of the given DB.
+func NewCategoryIPDB(category string, db IPBlocklistDB) *CategoryIPDB {
+	return &CategoryIPDB{category: category, db: db}
+}
+
+func (m *CategoryIPDB) Reload() (IPBlocklistDB, error) {
+	db, err := m.db.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return NewCategoryIPDB(m.category, db), nil
+}
+
+func (m *CategoryIPDB) Match(ip net.IP) (*BlocklistMatch, bool) {
+	match, ok := m.db.Match(ip)
+	return withCategory(match, m.category), ok
+}
+
+func (m *CategoryIPDB) Close() error {
+	return m.db.Close()
+}
+
+func (m *CategoryIPDB) String() string {
+	return m.db.String()
+}
+
+// Stale returns true if the list was loaded from a stale copy.
+func (m *CategoryIPDB) Stale() bool {
+	return isStale(m.db)
+}
+
+// Returns a copy of the match with the category set. Matches may be shared
+// between queries, so they're not modified.
+func withCategory(match *BlocklistMatch, category string) *BlocklistMatch {
+	if match == nil {
+		return nil
+	}
+	m := *match
+	m.Category = category
+	return &m
+}
@@ -108,6 +108,11 @@ func (m *DomainDB) String() string {
 	return "Domain"
 }
 
+// Stale returns true if the rules were loaded from a stale copy of the list.
+func (m *DomainDB) Stale() bool {
+	return isStale(m.loader)
+}
+
 // Turn a list of matched domain fragments into a domain (rule)
 func matchedDomainParts(prefix string, p []string) string {
 	for i := len(p)/2 - 1; i >= 0; i-- {
@@ -108,3 +108,8 @@ func (m *HostsDB) Match(q dns.Question) (net.IP, string, *BlocklistMatch, bool)
 func (m *HostsDB) String() string {
 	return "Hosts"
 }
+
+// Stale returns true if the rules were loaded from a stale copy of the list.
+func (m *HostsDB) Stale() bool {
+	return isStale(m.loader)
+}
@@ -18,14 +18,35 @@ func NewMultiDB(dbs ...BlocklistDB) (MultiDB, error) {
 	return MultiDB{dbs}, nil
 }
 
+// Reload all lists. Lists that haven't changed since the last load, or that
+// failed to load, are re-used. Returns ErrNotModified if none of the lists
+// changed, or the first error if lists failed to load.
 func (m MultiDB) Reload() (BlocklistDB, error) {
-	var newDBs []BlocklistDB
+	var (
+		newDBs   []BlocklistDB
+		modified bool
+		loadErr  error
+	)
 	for _, db := range m.dbs {
 		n, err := db.Reload()
 		if err != nil {
-			return nil, err
+			if err != ErrNotModified {
+				Log.WithField("list", db.String()).WithError(err).Error("failed to reload list, keeping current rules")
+				if loadErr == nil {
+					loadErr = err
+				}
+			}
+			newDBs = append(newDBs, db)
+			continue
 		}
 		newDBs = append(newDBs, n)
+		modified = true
+	}
+	if !modified {
+		if loadErr != nil {
+			return nil, loadErr
+		}
+		return nil, ErrNotModified
 	}
 	return NewMultiDB(newDBs...)
 }
@@ -42,3 +63,13 @@ func (m MultiDB) Match(q dns.Question) (net.IP, string, *BlocklistMatch, bool) {
 func (m MultiDB) String() string {
 	return "Multi-Blocklist"
 }
+
+// Stale returns true if any of the lists were loaded from a stale copy.
+func (m MultiDB) Stale() bool {
+	for _, db := range m.dbs {
+		if isStale(db) {
+			return true
+		}
+	}
+	return false
+}
@@ -55,3 +55,8 @@ func (m *RegexpDB) Match(q dns.Question) (net.IP, string, *BlocklistMatch, bool)
 func (m *RegexpDB) String() string {
 	return "Regexp"
 }
+
+// Stale returns true if the rules were loaded from a stale copy of the list.
+func (m *RegexpDB) Stale() bool {
+	return isStale(m.loader)
+}
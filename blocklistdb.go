@@ -20,9 +20,20 @@ type BlocklistDB interface {
 }
 
 // BlocklistMatch is returned by blocklists when a match is found. It contains
-// information about what rule matched, what list it was from etc. Used mostly
-// for logging.
+// information about what rule matched, what list it was from etc. Used for
+// logging, extended errors, and passed to the blocklist-resolver in the
+// ClientInfo of blocked queries.
 type BlocklistMatch struct {
-	List string // Identifier or name of the blocklist
-	Rule string // Identifier for the rule that matched
+	List     string // Identifier or name of the blocklist
+	Rule     string // Identifier for the rule that matched
+	Category string // Optional category of the list, like "ads" or "malware"
+}
+
+// String returns the list, category if any, and rule of a match in a form
+// suitable for logs and extended errors.
+func (m *BlocklistMatch) String() string {
+	if m.Category != "" {
+		return fmt.Sprintf("%s (%s): %s", m.List, m.Category, m.Rule)
+	}
+	return fmt.Sprintf("%s: %s", m.List, m.Rule)
 }
@@ -4,11 +4,14 @@ import (
 	"bufio"
 	"context"
 	"crypto/sha256"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -17,19 +20,56 @@ type HTTPLoader struct {
 	url      string
 	opt      HTTPLoaderOptions
 	fromDisk bool
+
+	// The rules were loaded from the copy in the cache-dir, either on startup
+	// or because the download failed. The list is reloaded soon after.
+	stale bool
+
+	// Validators of the last successful download, used to make conditional
+	// requests on refresh.
+	etag         string
+	lastModified string
 }
 
 // HTTPLoaderOptions holds options for HTTP blocklist loaders.
 type HTTPLoaderOptions struct {
 	CacheDir string
+
+	// User-Agent header sent with requests. Defaults to "routedns/<version>".
+	UserAgent string
+
+	// Additional headers sent with requests, like an Authorization header for
+	// lists that require a token.
+	Headers map[string]string
+
+	// Time after which a download is aborted. Defaults to 30 minutes.
+	Timeout time.Duration
 }
 
 var _ BlocklistLoader = &HTTPLoader{}
+var _ staleChecker = &HTTPLoader{}
+
+// ErrNotModified is returned by loaders if the list hasn't changed since it
+// was last loaded. Blocklists keep using the current rules in that case.
+var ErrNotModified = errors.New("list not modified")
 
 const httpTimeout = 30 * time.Minute
 
+// Number of times a download is retried on transient failures, and the delay
+// before the first retry. The delay is doubled on every retry.
+const (
+	httpRetries      = 3
+	httpRetryBackoff = 2 * time.Second
+)
+
 func NewHTTPLoader(url string, opt HTTPLoaderOptions) *HTTPLoader {
-	return &HTTPLoader{url, opt, opt.CacheDir != ""}
+	if opt.UserAgent == "" {
+		opt.UserAgent = "routedns/" + BuildVersion
+	}
+	if opt.Timeout == 0 {
+		opt.Timeout = httpTimeout
+	}
+	return &HTTPLoader{url: url, opt: opt, fromDisk: opt.CacheDir != ""}
 }
 
 func (l *HTTPLoader) Load() ([]string, error) {
@@ -43,45 +83,138 @@ func (l *HTTPLoader) Load() ([]string, error) {
 		rules, err := l.loadFromDisk()
 		if err == nil {
 			log.WithField("load-time", time.Since(start)).Trace("loaded blocklist from cache-dir")
+			l.stale = true
 			return rules, err
 		}
 		log.WithError(err).Warn("unable to load cached list from disk, loading from upstream")
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), httpTimeout)
+	var (
+		rules []string
+		err   error
+	)
+	backoff := httpRetryBackoff
+	for i := 0; ; i++ {
+		var retry bool
+		rules, retry, err = l.download()
+		if err == nil || !retry || i >= httpRetries {
+			break
+		}
+		log.WithError(err).WithField("retry-in", backoff).Warn("failed to load blocklist, retrying")
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	if err == ErrNotModified {
+		log.Trace("blocklist not modified")
+		return nil, err
+	}
+	if err == nil {
+		l.stale = false
+		return rules, nil
+	}
+
+	// Fall back to the copy in the cache-dir if the list couldn't be loaded,
+	// unless that copy is already in use
+	if l.opt.CacheDir != "" && !l.stale {
+		log.WithError(err).Warn("failed to load blocklist, using copy from cache-dir")
+		if cached, diskErr := l.loadFromDisk(); diskErr == nil {
+			l.stale = true
+			return cached, nil
+		}
+	}
+	return nil, err
+}
+
+// Stale returns true if the rules were loaded from the copy in the cache-dir
+// rather than downloaded.
+func (l *HTTPLoader) Stale() bool {
+	return l.stale
+}
+
+// Download the list from the remote server. Sends the validators from a previous
+// download, if any, and returns ErrNotModified if the content hasn't changed. The
+// boolean return value indicates if a failure is transient and the download should
+// be retried.
+func (l *HTTPLoader) download() ([]string, bool, error) {
+	log := Log.WithField("url", l.url)
+
+	ctx, cancel := context.WithTimeout(context.Background(), l.opt.Timeout)
 	defer cancel()
 
 	req, err := http.NewRequestWithContext(ctx, "GET", l.url, nil)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
+	for k, v := range l.opt.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("User-Agent", l.opt.UserAgent)
+	if l.etag != "" {
+		req.Header.Set("If-None-Match", l.etag)
+	}
+	if l.lastModified != "" {
+		req.Header.Set("If-Modified-Since", l.lastModified)
+	}
+	// Setting this header disables transparent decompression in the HTTP client,
+	// the body is decoded below instead.
+	req.Header.Set("Accept-Encoding", "gzip, deflate, zstd")
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, true, err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, false, ErrNotModified
+	}
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		return nil, fmt.Errorf("got unexpected status code %d from %s", resp.StatusCode, l.url)
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return nil, retry, fmt.Errorf("got unexpected status code %d from %s", resp.StatusCode, l.url)
 	}
 
+	body, err := decodeBody(resp)
+	if err != nil {
+		return nil, false, err
+	}
+	defer body.Close()
+
 	start := time.Now()
 	var rules []string
-	scanner := bufio.NewScanner(resp.Body)
+	scanner := bufio.NewScanner(body)
 	for scanner.Scan() {
 		rules = append(rules, scanner.Text())
 	}
+	if err := scanner.Err(); err != nil {
+		return nil, true, err
+	}
 	log.WithField("load-time", time.Since(start)).Trace("completed loading blocklist")
 
+	l.etag = resp.Header.Get("ETag")
+	l.lastModified = resp.Header.Get("Last-Modified")
+
 	// Cache the content to disk if the read from the remote server was successful
-	if scanner.Err() == nil && l.opt.CacheDir != "" {
+	if l.opt.CacheDir != "" {
 		log.Trace("writing rules to cache-dir")
 		if err := l.writeToDisk(rules); err != nil {
 			log.WithError(err).Error("failed to write rules to cache")
 		}
 	}
-	return rules, scanner.Err()
+	return rules, false, nil
+}
+
+// Returns a reader for the response body that decompresses the content based on
+// the content-encoding, or the content-type for lists that are served as compressed
+// files.
+func decodeBody(resp *http.Response) (io.ReadCloser, error) {
+	encoding := strings.ToLower(resp.Header.Get("Content-Encoding"))
+	if encoding == "" {
+		switch strings.ToLower(resp.Header.Get("Content-Type")) {
+		case "application/gzip", "application/x-gzip":
+			encoding = "gzip"
+		}
+	}
+	return decodeContent(resp.Body, encoding)
 }
 
 // Loads a cached version of the list from disk. The filename is made by hashing the URL with SHA256
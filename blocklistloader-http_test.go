@@ -0,0 +1,117 @@
+package rdns
+
+import (
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPLoaderConditional(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		_, _ = zw.Write([]byte("domain1.com\ndomain2.com\n"))
+		zw.Close()
+	}))
+	defer srv.Close()
+
+	l := NewHTTPLoader(srv.URL, HTTPLoaderOptions{})
+
+	// First load should return the decompressed list
+	rules, err := l.Load()
+	require.NoError(t, err)
+	require.Equal(t, []string{"domain1.com", "domain2.com"}, rules)
+
+	// Second load is conditional and should indicate nothing changed
+	_, err = l.Load()
+	require.Equal(t, ErrNotModified, err)
+	require.Equal(t, 2, requests)
+}
+
+func TestHTTPLoaderZstd(t *testing.T) {
+	var acceptEncoding string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acceptEncoding = r.Header.Get("Accept-Encoding")
+		w.Header().Set("Content-Encoding", "zstd")
+		zw, err := zstd.NewWriter(w)
+		require.NoError(t, err)
+		_, _ = zw.Write([]byte("domain1.com\ndomain2.com\n"))
+		zw.Close()
+	}))
+	defer srv.Close()
+
+	rules, err := NewHTTPLoader(srv.URL, HTTPLoaderOptions{}).Load()
+	require.NoError(t, err)
+	require.Equal(t, []string{"domain1.com", "domain2.com"}, rules)
+	require.Contains(t, acceptEncoding, "zstd")
+}
+
+func TestHTTPLoaderHeaders(t *testing.T) {
+	var userAgent, auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.Header.Get("User-Agent")
+		auth = r.Header.Get("Authorization")
+		_, _ = w.Write([]byte("domain1.com\n"))
+	}))
+	defer srv.Close()
+
+	// Default user agent
+	_, err := NewHTTPLoader(srv.URL, HTTPLoaderOptions{}).Load()
+	require.NoError(t, err)
+	require.Equal(t, "routedns/"+BuildVersion, userAgent)
+	require.Empty(t, auth)
+
+	l := NewHTTPLoader(srv.URL, HTTPLoaderOptions{
+		UserAgent: "test-agent",
+		Headers:   map[string]string{"Authorization": "Bearer token"},
+	})
+	rules, err := l.Load()
+	require.NoError(t, err)
+	require.Equal(t, []string{"domain1.com"}, rules)
+	require.Equal(t, "test-agent", userAgent)
+	require.Equal(t, "Bearer token", auth)
+}
+
+func TestHTTPLoaderStale(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("domain1.com\n"))
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+
+	// Download the list once to populate the cache-dir
+	_, err := NewHTTPLoader(srv.URL, HTTPLoaderOptions{CacheDir: dir}).Load()
+	require.NoError(t, err)
+
+	// On startup the copy in the cache-dir is used and marked as stale, so the
+	// list is reloaded soon even without refresh period
+	l := NewHTTPLoader(srv.URL, HTTPLoaderOptions{CacheDir: dir})
+	db, err := NewDomainDB("test", l)
+	require.NoError(t, err)
+	require.True(t, db.Stale())
+	wait, ok := nextRefresh(db, 0)
+	require.True(t, ok)
+	require.Equal(t, staleRefreshInterval, wait)
+
+	// Once the list was downloaded, it's only reloaded with a refresh period
+	db2, err := db.Reload()
+	require.NoError(t, err)
+	require.False(t, isStale(db2))
+	_, ok = nextRefresh(db2, 0)
+	require.False(t, ok)
+	wait, ok = nextRefresh(db2, time.Hour)
+	require.True(t, ok)
+	require.Equal(t, time.Hour, wait)
+}
@@ -1,6 +1,35 @@
 package rdns
 
+import "time"
+
 type BlocklistLoader interface {
 	// Returns a list of rules that can then be stored into a blocklist DB.
 	Load() ([]string, error)
 }
+
+// Interval in which lists that were loaded from a stale copy are reloaded,
+// until the download succeeds.
+const staleRefreshInterval = time.Minute
+
+// Loaders that can fall back to a stale copy of a list, like the HTTP loader
+// with a cache-dir, implement this interface. Databases implement it as well
+// and report if any of their loaders is stale.
+type staleChecker interface {
+	Stale() bool
+}
+
+// Returns true if the loader or database is serving a stale copy of a list.
+func isStale(v interface{}) bool {
+	s, ok := v.(staleChecker)
+	return ok && s.Stale()
+}
+
+// Returns the time to wait before reloading a list. Stale lists are reloaded
+// sooner, even if no refresh period is set. Returns false if the list doesn't
+// need to be reloaded.
+func nextRefresh(db interface{}, refresh time.Duration) (time.Duration, bool) {
+	if isStale(db) && (refresh == 0 || refresh > staleRefreshInterval) {
+		return staleRefreshInterval, true
+	}
+	return refresh, refresh > 0
+}
@@ -0,0 +1,247 @@
+package rdns
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// BlockPageListener is a small HTTP(S) service that shows a page explaining that
+// a name was blocked. It's meant to run on the IP that blocklists return for
+// blocked names, so browsers show the page instead of a connection error. The
+// page can offer to allow the name for a limited time.
+type BlockPageListener struct {
+	httpServer *http.Server
+
+	id   string
+	addr string
+	opt  BlockPageListenerOptions
+
+	mux *http.ServeMux
+}
+
+var _ Listener = &BlockPageListener{}
+
+// BlockPageListenerOptions contains options used by the block page service.
+type BlockPageListenerOptions struct {
+	ListenOptions
+
+	// Blocklists in which blocked names can be allowed temporarily from the
+	// block page. No button is shown if empty. Requires AllowedNet to be set.
+	Blocklists []*Blocklist
+
+	// Caches that names are removed from when they are allowed, so the
+	// blocked response isn't served from cache.
+	Caches []*Cache
+
+	// How long names stay allowed. Default 5 minutes.
+	AllowDuration time.Duration
+
+	// Serve HTTPS if set, plain HTTP otherwise. Since the certificate can't be
+	// valid for the blocked names, browsers will show a warning for HTTPS.
+	TLSConfig *tls.Config
+}
+
+// Path of the request to allow a name temporarily.
+const blockPageAllowPath = "/routedns/allow"
+
+var blockPageTemplate = template.Must(template.New("blockpage").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Blocked</title>
+<style>
+body { font-family: sans-serif; max-width: 40em; margin: 4em auto; padding: 0 1em; color: #333; }
+code { background: #eee; padding: 0.1em 0.3em; }
+</style>
+</head>
+<body>
+{{- if .Allowed}}
+<h1>Allowed</h1>
+<p><code>{{.Name}}</code> is allowed for {{.Duration}}. It may take a moment until your browser stops using the blocked address, <a href="http://{{.Name}}/">try again</a> shortly.</p>
+{{- else}}
+<h1>Blocked</h1>
+{{- if .Name}}
+<p>Access to <code>{{.Name}}</code> was blocked by the DNS resolver.</p>
+{{- else}}
+<p>Access to this site was blocked by the DNS resolver.</p>
+{{- end}}
+{{- if .CanAllow}}
+<form method="POST" action="{{.AllowPath}}">
+<input type="hidden" name="name" value="{{.Name}}">
+<button type="submit">Allow for {{.Duration}}</button>
+</form>
+{{- end}}
+{{- end}}
+</body>
+</html>
+`))
+
+type blockPageData struct {
+	Name      string
+	Allowed   bool
+	CanAllow  bool
+	Duration  time.Duration
+	AllowPath string
+}
+
+// NewBlockPageListener returns an instance of a block page service.
+func NewBlockPageListener(id, addr string, opt BlockPageListenerOptions) (*BlockPageListener, error) {
+	// Anyone who can reach the page could otherwise allow names
+	if len(opt.Blocklists) > 0 && len(opt.AllowedNet) == 0 {
+		return nil, errors.New("allowing names from the block page requires allowed networks")
+	}
+	if opt.AllowDuration == 0 {
+		opt.AllowDuration = 5 * time.Minute
+	}
+	l := &BlockPageListener{
+		id:   id,
+		addr: addr,
+		opt:  opt,
+		mux:  http.NewServeMux(),
+	}
+	l.mux.HandleFunc(blockPageAllowPath, l.allowHandler)
+	l.mux.HandleFunc("/", l.pageHandler)
+	return l, nil
+}
+
+// Start the block page server.
+func (s *BlockPageListener) Start() error {
+	Log.WithFields(logrus.Fields{"id": s.id, "protocol": "block-page", "addr": s.addr}).Info("starting listener")
+	s.httpServer = &http.Server{
+		Addr:         s.addr,
+		TLSConfig:    s.opt.TLSConfig,
+		Handler:      s.mux,
+		ReadTimeout:  adminServerTimeout,
+		WriteTimeout: adminServerTimeout,
+	}
+	ln, err := listenTCP(s.addr, s.opt.ListenOptions)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	if s.opt.TLSConfig != nil {
+		return s.httpServer.ServeTLS(ln, "", "")
+	}
+	return s.httpServer.Serve(ln)
+}
+
+// Stop the server.
+func (s *BlockPageListener) Stop() error {
+	Log.WithFields(logrus.Fields{"id": s.id, "protocol": "block-page", "addr": s.addr}).Info("stopping listener")
+	return s.httpServer.Shutdown(context.Background())
+}
+
+func (s *BlockPageListener) String() string {
+	return s.id
+}
+
+// Shows the block page for the name the client was trying to reach.
+func (s *BlockPageListener) pageHandler(w http.ResponseWriter, r *http.Request) {
+	name := blockPageName(r.Host)
+	s.render(w, http.StatusForbidden, blockPageData{
+		Name:      name,
+		CanAllow:  name != "" && len(s.opt.Blocklists) > 0 && s.clientAllowed(r),
+		Duration:  s.opt.AllowDuration,
+		AllowPath: blockPageAllowPath,
+	})
+}
+
+// Allows the name temporarily in all blocklists that block it, then removes it
+// from the caches.
+func (s *BlockPageListener) allowHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if len(s.opt.Blocklists) == 0 || !s.clientAllowed(r) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	// Only the name the request was sent to can be allowed, and only from the
+	// block page itself. Stops other sites from unblocking arbitrary names.
+	name := blockPageName(r.Host)
+	if name == "" || !strings.EqualFold(r.PostFormValue("name"), name) || !sameOrigin(r) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	q := dns.Question{Name: dns.Fqdn(name), Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	for _, blocklist := range s.opt.Blocklists {
+		if !blocklist.Test(q).Blocked {
+			continue
+		}
+		if err := blocklist.AllowTemporarily(name, s.opt.AllowDuration); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	for _, cache := range s.opt.Caches {
+		cache.Evict([]string{name}, false)
+	}
+	Log.WithFields(logrus.Fields{
+		"id":       s.id,
+		"client":   r.RemoteAddr,
+		"name":     name,
+		"duration": s.opt.AllowDuration,
+	}).Info("allowing name temporarily")
+	s.render(w, http.StatusOK, blockPageData{
+		Name:     name,
+		Allowed:  true,
+		Duration: s.opt.AllowDuration,
+	})
+}
+
+func (s *BlockPageListener) render(w http.ResponseWriter, status int, data blockPageData) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := blockPageTemplate.Execute(w, data); err != nil {
+		Log.WithField("id", s.id).WithError(err).Error("failed to render block page")
+	}
+}
+
+// Returns true if the client is in the allowed networks.
+func (s *BlockPageListener) clientAllowed(r *http.Request) bool {
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	return isAllowed(s.opt.AllowedNet, net.ParseIP(host))
+}
+
+// Returns the name from the Host header of a request, without port. Empty if
+// the host is an IP or not a valid name.
+func blockPageName(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "" || net.ParseIP(host) != nil {
+		return ""
+	}
+	if _, ok := dns.IsDomainName(host); !ok {
+		return ""
+	}
+	return host
+}
+
+// Returns false if the request was sent from a page on a different host, or
+// without Origin header which all current browsers send with form posts.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
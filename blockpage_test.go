@@ -0,0 +1,76 @@
+package rdns
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockPageAllow(t *testing.T) {
+	db, err := NewDomainDB("testlist", NewStaticLoader([]string{"evil.test"}))
+	require.NoError(t, err)
+	b, err := NewBlocklist("test-bl", new(TestResolver), BlocklistOptions{BlocklistDB: db})
+	require.NoError(t, err)
+
+	// Allowing names is only possible with allowed networks
+	_, err = NewBlockPageListener("test-bp", ":0", BlockPageListenerOptions{
+		Blocklists: []*Blocklist{b},
+	})
+	require.Error(t, err)
+
+	_, allowed, err := net.ParseCIDR("192.0.2.0/24") // Address of test requests
+	require.NoError(t, err)
+	l, err := NewBlockPageListener("test-bp", ":0", BlockPageListenerOptions{
+		ListenOptions: ListenOptions{AllowedNet: []*net.IPNet{allowed}},
+		Blocklists:    []*Blocklist{b},
+		AllowDuration: 100 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	q := dns.Question{Name: "evil.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	require.True(t, b.Test(q).Blocked)
+
+	// The page shows the blocked name and the allow button
+	req := httptest.NewRequest(http.MethodGet, "http://evil.test/some/path", nil)
+	w := httptest.NewRecorder()
+	l.mux.ServeHTTP(w, req)
+	require.Equal(t, http.StatusForbidden, w.Code)
+	require.Contains(t, w.Body.String(), "evil.test")
+	require.Contains(t, w.Body.String(), blockPageAllowPath)
+
+	// Requests from other sites are rejected
+	form := url.Values{"name": {"evil.test"}}.Encode()
+	req = httptest.NewRequest(http.MethodPost, "http://evil.test"+blockPageAllowPath, strings.NewReader(form))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Origin", "http://other.test")
+	w = httptest.NewRecorder()
+	l.mux.ServeHTTP(w, req)
+	require.Equal(t, http.StatusForbidden, w.Code)
+	require.True(t, b.Test(q).Blocked)
+
+	// And those without origin
+	req = httptest.NewRequest(http.MethodPost, "http://evil.test"+blockPageAllowPath, strings.NewReader(form))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	l.mux.ServeHTTP(w, req)
+	require.Equal(t, http.StatusForbidden, w.Code)
+	require.True(t, b.Test(q).Blocked)
+
+	// Allow the name from the block page
+	req = httptest.NewRequest(http.MethodPost, "http://evil.test"+blockPageAllowPath, strings.NewReader(form))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Origin", "http://evil.test")
+	w = httptest.NewRecorder()
+	l.mux.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.True(t, b.Test(q).Allowed)
+
+	// It's blocked again once the duration expired
+	require.Eventually(t, func() bool { return b.Test(q).Blocked }, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,50 @@
+package rdns
+
+import (
+	"expvar"
+
+	"github.com/miekg/dns"
+)
+
+// CacheProbe checks if a query would be answered from a cache, without
+// resolving it, and records the result in the client information as "hit" or
+// "miss". Routers after it can then use the cache state to pick a resolver,
+// like sending only cache misses to an expensive upstream.
+type CacheProbe struct {
+	id       string
+	resolver Resolver
+	cache    *Cache
+
+	// Probe result counts.
+	hit, miss *expvar.Int
+}
+
+var _ Resolver = &CacheProbe{}
+
+// NewCacheProbe returns a new instance of a cache probe.
+func NewCacheProbe(id string, resolver Resolver, cache *Cache) *CacheProbe {
+	return &CacheProbe{
+		id:       id,
+		resolver: resolver,
+		cache:    cache,
+		hit:      getVarInt("cache-probe", id, "hit"),
+		miss:     getVarInt("cache-probe", id, "miss"),
+	}
+}
+
+// Resolve a DNS query after probing the cache for it.
+func (r *CacheProbe) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if r.cache.Probe(q, ci) {
+		ci.CacheState = "hit"
+		r.hit.Add(1)
+	} else {
+		ci.CacheState = "miss"
+		r.miss.Add(1)
+	}
+	logger(r.id, q, ci).WithField("cache-state", ci.CacheState).Debug("probed cache")
+	return r.resolver.Resolve(q, ci)
+}
+
+func (r *CacheProbe) String() string {
+	return r.id
+}
@@ -0,0 +1,57 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheProbe(t *testing.T) {
+	var ci ClientInfo
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = []dns.RR{
+				&dns.A{
+					Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600},
+					A:   net.IP{127, 0, 0, 1},
+				},
+			}
+			return a, nil
+		},
+	}
+	cache := NewCache("test-cache", upstream, CacheOptions{})
+
+	// Misses go to r1, hits to r2
+	r1 := new(TestResolver)
+	r2 := new(TestResolver)
+	route1, err := NewRoute("", "", nil, nil, "", "", "", "", r1)
+	require.NoError(t, err)
+	require.NoError(t, route1.SetCacheState("miss"))
+	route2, err := NewRoute("", "", nil, nil, "", "", "", "", r2)
+	require.NoError(t, err)
+	router := NewRouter("test-router")
+	router.Add(route1, route2)
+	probe := NewCacheProbe("test-probe", router, cache)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err = probe.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r1.HitCount())
+	require.Equal(t, 0, r2.HitCount())
+
+	// Put the response into the cache, the next query is a hit
+	_, err = cache.Resolve(q, ci)
+	require.NoError(t, err)
+	_, err = probe.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r1.HitCount())
+	require.Equal(t, 1, r2.HitCount())
+
+	// The probe doesn't count as cache hit
+	require.Equal(t, int64(0), cache.metrics.hit.Value())
+}
@@ -3,8 +3,11 @@ package rdns
 import (
 	"errors"
 	"expvar"
+	"hash/fnv"
 	"math"
-	"math/rand"
+	"net"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -15,15 +18,29 @@ import (
 
 // Cache stores results received from its upstream resolver for
 // up to TTL seconds in memory.
+//
+// If the upstream resolver is another cache, the two form a hierarchy. This
+// cache is then the L1 and the upstream cache the L2. Responses found in the
+// L2 are stored in the L1 (promotion) and responses that are removed from the
+// L1 because it reached its capacity are moved to the L2 (demotion).
 type Cache struct {
 	CacheOptions
 	id       string
 	resolver Resolver
-	mu       sync.Mutex
-	lru      *lruCache
+	l2       *Cache
+	mu       sync.Mutex // protects partitions
+	shared   *cachePartition
+	parts    map[string]*cachePartition
 	metrics  *CacheMetrics
 }
 
+// Part of the cache with its own lock and capacity. There is one shared
+// partition, or one per listener if the PerListener option is set.
+type cachePartition struct {
+	mu  sync.Mutex
+	lru *lruCache
+}
+
 type CacheMetrics struct {
 	// Cache hit count.
 	hit *expvar.Int
@@ -31,6 +48,8 @@ type CacheMetrics struct {
 	miss *expvar.Int
 	// Current cache entry count.
 	entries *expvar.Int
+	// Count of entries moved to the L2 cache.
+	demoted *expvar.Int
 }
 
 var _ Resolver = &Cache{}
@@ -50,6 +69,10 @@ type CacheOptions struct {
 	// the order if nil.
 	ShuffleAnswerFunc AnswerShuffleFunc
 
+	// Like ShuffleAnswerFunc, but with the client information to allow for a
+	// different order per client. Takes precedence over ShuffleAnswerFunc.
+	ShuffleAnswerClientFunc AnswerShuffleClientFunc
+
 	// If enabled, will return NXDOMAIN for every name query under another name that is
 	// already cached as NXDOMAIN. For example, if example.com is in the cache with
 	// NXDOMAIN, a query for www.example.com will also immediately return NXDOMAIN.
@@ -58,6 +81,22 @@ type CacheOptions struct {
 
 	// Query name that will trigger a cache flush. Disabled if empty.
 	FlushQuery string
+
+	// Key responses by the network in the EDNS Client Subnet option of the
+	// query rather than just its address, and store them for the scope prefix
+	// length returned by the upstream resolver. Responses with scope 0 are
+	// shared by all clients, including those without ECS option.
+	ECSScope bool
+
+	// Include the DNSSEC OK (DO) and Checking Disabled (CD) bits of queries in
+	// the cache key, so responses with and without DNSSEC records or
+	// validation are kept apart.
+	KeyDNSSECFlags bool
+
+	// Keep a separate set of responses for every listener, each with its own lock and
+	// up to Capacity entries. Reduces lock contention when the cache is used by many
+	// listeners, typically as small L1 in front of a larger shared cache.
+	PerListener bool
 }
 
 // NewCache returns a new instance of a Cache resolver.
@@ -66,19 +105,25 @@ func NewCache(id string, resolver Resolver, opt CacheOptions) *Cache {
 		CacheOptions: opt,
 		id:           id,
 		resolver:     resolver,
-		lru:          newLRUCache(opt.Capacity),
+		shared:       &cachePartition{lru: newLRUCache(opt.Capacity)},
+		parts:        make(map[string]*cachePartition),
 		metrics: &CacheMetrics{
 			hit:     getVarInt("cache", id, "hit"),
 			miss:    getVarInt("cache", id, "miss"),
 			entries: getVarInt("cache", id, "entries"),
+			demoted: getVarInt("cache", id, "demoted"),
 		},
 	}
+	if l2, ok := resolver.(*Cache); ok {
+		c.l2 = l2
+	}
 	if c.GCPeriod == 0 {
 		c.GCPeriod = time.Minute
 	}
 	if c.NegativeTTL == 0 {
 		c.NegativeTTL = 60
 	}
+	registerHandoffCache(c)
 	go c.startGC(c.GCPeriod)
 	return c
 }
@@ -107,7 +152,7 @@ func (r *Cache) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	}
 
 	// Returned an answer from the cache if one exists
-	a, ok := r.answerFromCache(q)
+	a, ok := r.answerFromCache(q, ci)
 	if ok {
 		log.Debug("cache-hit")
 		r.metrics.hit.Add(1)
@@ -130,7 +175,7 @@ func (r *Cache) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 
 	// Put the upstream response into the cache and return it. Need to store
 	// a copy since other elements might modify the response, like the replacer.
-	r.storeInCache(q, a.Copy())
+	r.storeInCache(q, a.Copy(), ci)
 	return a, nil
 }
 
@@ -138,19 +183,29 @@ func (r *Cache) String() string {
 	return r.id
 }
 
+// Re-orders the answer RRs with the configured shuffle function, if any.
+func (r *Cache) shuffleAnswer(msg *dns.Msg, ci ClientInfo) {
+	switch {
+	case r.ShuffleAnswerClientFunc != nil:
+		r.ShuffleAnswerClientFunc(msg, ci)
+	case r.ShuffleAnswerFunc != nil:
+		r.ShuffleAnswerFunc(msg)
+	}
+}
+
 // Returns an answer from the cache with it's TTL updated or false in case of a cache-miss.
-func (r *Cache) answerFromCache(q *dns.Msg) (*dns.Msg, bool) {
+func (r *Cache) answerFromCache(q *dns.Msg, ci ClientInfo) (*dns.Msg, bool) {
 	var answer *dns.Msg
 	var timestamp time.Time
-	r.mu.Lock()
-	if a := r.lru.get(q); a != nil {
-		if r.ShuffleAnswerFunc != nil {
-			r.ShuffleAnswerFunc(a.Msg)
-		}
+	p := r.partition(ci)
+	p.mu.Lock()
+	key, a := r.lookup(p, q)
+	if a != nil {
+		r.shuffleAnswer(a.Msg, ci)
 		answer = a.Copy()
 		timestamp = a.timestamp
 	}
-	r.mu.Unlock()
+	p.mu.Unlock()
 
 	// We couldn't find it in the cache, but a parent domain may already be with NXDOMAIN.
 	// Return that instead if enabled.
@@ -158,18 +213,18 @@ func (r *Cache) answerFromCache(q *dns.Msg) (*dns.Msg, bool) {
 		name := q.Question[0].Name
 		newQ := q.Copy()
 		fragments := strings.Split(name, ".")
-		r.mu.Lock()
+		p.mu.Lock()
 		for i := 1; i < len(fragments)-1; i++ {
 			newQ.Question[0].Name = strings.Join(fragments[i:], ".")
-			if a := r.lru.get(newQ); a != nil {
+			if _, a := r.lookup(p, newQ); a != nil {
 				if a.Rcode == dns.RcodeNameError {
-					r.mu.Unlock()
+					p.mu.Unlock()
 					return nxdomain(q), true
 				}
 				break
 			}
 		}
-		r.mu.Unlock()
+		p.mu.Unlock()
 	}
 
 	// Return a cache-miss if there's no answer record in the map
@@ -182,6 +237,13 @@ func (r *Cache) answerFromCache(q *dns.Msg) (*dns.Msg, bool) {
 	answer = answer.Copy()
 	answer.Id = q.Id
 
+	// The response may have been stored for another client in the same
+	// network, return it with the ECS option of this query
+	if r.ECSScope {
+		ecs := ecsOption(q)
+		restoreECS(answer, ecs, ecs)
+	}
+
 	// Calculate the time the record spent in the cache. We need to
 	// subtract that from the TTL of each answer record.
 	age := uint32(time.Since(timestamp).Seconds())
@@ -196,7 +258,9 @@ func (r *Cache) answerFromCache(q *dns.Msg) (*dns.Msg, bool) {
 			}
 			h := a.Header()
 			if age >= h.Ttl {
-				r.evictFromCache(q)
+				p.mu.Lock()
+				p.lru.deleteKey(key)
+				p.mu.Unlock()
 				return nil, false
 			}
 			h.Ttl -= age
@@ -206,7 +270,7 @@ func (r *Cache) answerFromCache(q *dns.Msg) (*dns.Msg, bool) {
 	return answer, true
 }
 
-func (r *Cache) storeInCache(query, answer *dns.Msg) {
+func (r *Cache) storeInCache(query, answer *dns.Msg, ci ClientInfo) {
 	now := time.Now()
 
 	// Prepare an item for the cache, without expiry for now
@@ -235,17 +299,142 @@ func (r *Cache) storeInCache(query, answer *dns.Msg) {
 	}
 
 	// Store it in the cache
+	p := r.partition(ci)
+	p.mu.Lock()
+	dropped := p.lru.addKey(r.responseKey(query, answer), item)
+	p.mu.Unlock()
+	r.demote(dropped, ci)
+}
+
+// Returns the cache key for a query. With ECSScope, the subnet in the key is
+// the network of the ECS option with its source prefix length.
+func (r *Cache) queryKey(q *dns.Msg) lruKey {
+	key := lruKeyFromQuery(q)
+	if r.KeyDNSSECFlags {
+		if edns0 := q.IsEdns0(); edns0 != nil {
+			key.do = edns0.Do()
+		}
+		key.cd = q.CheckingDisabled
+	}
+	if r.ECSScope {
+		key.net = ""
+		if ecs := ecsOption(q); ecs != nil {
+			key.net = ecsNetwork(ecs, ecs.SourceNetmask)
+		}
+	}
+	return key
+}
+
+// Returns the key a response is stored under. With ECSScope, that's the
+// network of the query's ECS option with the scope prefix length of the
+// response, limited to the source prefix length.
+func (r *Cache) responseKey(q, a *dns.Msg) lruKey {
+	key := r.queryKey(q)
+	ecs := ecsOption(q)
+	if !r.ECSScope || ecs == nil {
+		return key
+	}
+	var scope uint8
+	if upstream := ecsOption(a); upstream != nil {
+		scope = upstream.SourceScope
+	}
+	if scope > ecs.SourceNetmask {
+		scope = ecs.SourceNetmask
+	}
+	key.net = ecsNetwork(ecs, scope)
+	return key
+}
+
+// Returns the cached response for a query, and the key it's stored under. With
+// ECSScope, responses stored for any scope that contains the network of the
+// query are found, the most specific first. Needs to be called with the lock
+// of the partition held.
+func (r *Cache) lookup(p *cachePartition, q *dns.Msg) (lruKey, *cacheAnswer) {
+	key := r.queryKey(q)
+	ecs := ecsOption(q)
+	if !r.ECSScope || ecs == nil {
+		return key, p.lru.getKey(key)
+	}
+	for prefix := int(ecs.SourceNetmask); prefix >= 0; prefix-- {
+		key.net = ecsNetwork(ecs, uint8(prefix))
+		if a := p.lru.getKey(key); a != nil {
+			return key, a
+		}
+	}
+	return key, nil
+}
+
+// Returns the network of an ECS option with the given prefix length, or an
+// empty string for prefix length 0, which covers all clients.
+func ecsNetwork(ecs *dns.EDNS0_SUBNET, prefix uint8) string {
+	if prefix == 0 {
+		return ""
+	}
+	bits := 32
+	if ecs.Family == 2 {
+		bits = 128
+	}
+	if int(prefix) > bits {
+		prefix = uint8(bits)
+	}
+	ip := ecs.Address.Mask(net.CIDRMask(int(prefix), bits))
+	if ip == nil {
+		return ecs.Address.String()
+	}
+	return ip.String() + "/" + strconv.Itoa(int(prefix))
+}
+
+// Moves items that were removed from the cache due to its capacity to the
+// L2 cache, unless they already expired or the L2 has them already.
+func (r *Cache) demote(items []*cacheItem, ci ClientInfo) {
+	if r.l2 == nil || len(items) == 0 {
+		return
+	}
+	now := time.Now()
+	p := r.l2.partition(ci)
+	p.mu.Lock()
+	var dropped []*cacheItem
+	for _, item := range items {
+		if now.After(item.expiry) {
+			continue
+		}
+		if _, ok := p.lru.items[item.key]; ok {
+			continue
+		}
+		dropped = append(dropped, p.lru.addKey(item.key, item.cacheAnswer)...)
+		r.metrics.demoted.Add(1)
+	}
+	p.mu.Unlock()
+	r.l2.demote(dropped, ci)
+}
+
+// Returns the partition for the listener that received the query.
+func (r *Cache) partition(ci ClientInfo) *cachePartition {
+	if !r.PerListener {
+		return r.shared
+	}
 	r.mu.Lock()
-	r.lru.add(query, item)
-	r.mu.Unlock()
+	defer r.mu.Unlock()
+	p, ok := r.parts[ci.Listener]
+	if !ok {
+		p = &cachePartition{lru: newLRUCache(r.Capacity)}
+		r.parts[ci.Listener] = p
+	}
+	return p
 }
 
-func (r *Cache) evictFromCache(queries ...*dns.Msg) {
+// Returns all partitions of the cache.
+func (r *Cache) partitions() []*cachePartition {
+	if !r.PerListener {
+		return []*cachePartition{r.shared}
+	}
 	r.mu.Lock()
-	for _, query := range queries {
-		r.lru.delete(query)
+	defer r.mu.Unlock()
+	parts := make([]*cachePartition, 0, len(r.parts))
+	for _, p := range r.parts {
+		parts = append(parts, p)
 	}
-	r.mu.Unlock()
+	return parts
 }
 
 // Runs every period time and evicts all items from the cache that are
@@ -258,16 +447,18 @@ func (r *Cache) startGC(period time.Duration) {
 		time.Sleep(period)
 		now := time.Now()
 		var total, removed int
-		r.mu.Lock()
-		r.lru.deleteFunc(func(a *cacheAnswer) bool {
-			if now.After(a.expiry) {
-				removed++
-				return true
-			}
-			return false
-		})
-		total = r.lru.size()
-		r.mu.Unlock()
+		for _, p := range r.partitions() {
+			p.mu.Lock()
+			p.lru.deleteFunc(func(a *cacheAnswer) bool {
+				if now.After(a.expiry) {
+					removed++
+					return true
+				}
+				return false
+			})
+			total += p.lru.size()
+			p.mu.Unlock()
+		}
 
 		r.metrics.entries.Set(int64(total))
 		Log.WithFields(logrus.Fields{"total": total, "removed": removed}).Trace("cache garbage collection")
@@ -276,9 +467,167 @@ func (r *Cache) startGC(period time.Duration) {
 
 // Flush the cache (reset to empty).
 func (r *Cache) flush() {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	r.lru.reset()
+	for _, p := range r.partitions() {
+		p.mu.Lock()
+		p.lru.reset()
+		p.mu.Unlock()
+	}
+	r.metrics.entries.Set(0)
+}
+
+// Cached response in a form that can be passed to another process.
+type cacheSnapshotItem struct {
+	Listener  string    `json:"listener,omitempty"` // Partition if PerListener is set
+	Name      string    `json:"name"`
+	Qtype     uint16    `json:"qtype"`
+	Qclass    uint16    `json:"qclass"`
+	Net       string    `json:"net,omitempty"` // ECS address or network
+	DO        bool      `json:"do,omitempty"`
+	CD        bool      `json:"cd,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	Expiry    time.Time `json:"expiry"`
+	Msg       []byte    `json:"msg"` // Response in wire format
+}
+
+// Returns all responses in the cache that haven't expired, the least recently
+// used first.
+func (r *Cache) snapshot() []cacheSnapshotItem {
+	parts := map[string]*cachePartition{"": r.shared}
+	if r.PerListener {
+		r.mu.Lock()
+		parts = make(map[string]*cachePartition, len(r.parts))
+		for listener, p := range r.parts {
+			parts[listener] = p
+		}
+		r.mu.Unlock()
+	}
+	now := time.Now()
+	var items []cacheSnapshotItem
+	for listener, p := range parts {
+		p.mu.Lock()
+		for item := p.lru.tail.prev; item != p.lru.head; item = item.prev {
+			if now.After(item.expiry) {
+				continue
+			}
+			msg, err := item.Msg.Pack()
+			if err != nil {
+				continue
+			}
+			items = append(items, cacheSnapshotItem{
+				Listener:  listener,
+				Name:      item.key.question.Name,
+				Qtype:     item.key.question.Qtype,
+				Qclass:    item.key.question.Qclass,
+				Net:       item.key.net,
+				DO:        item.key.do,
+				CD:        item.key.cd,
+				Timestamp: item.timestamp,
+				Expiry:    item.expiry,
+				Msg:       msg,
+			})
+		}
+		p.mu.Unlock()
+	}
+	return items
+}
+
+// Adds responses from a snapshot to the cache. Returns the number of responses
+// that were added.
+func (r *Cache) restore(items []cacheSnapshotItem) int {
+	now := time.Now()
+	var added int
+	for _, item := range items {
+		if now.After(item.Expiry) {
+			continue
+		}
+		msg := new(dns.Msg)
+		if err := msg.Unpack(item.Msg); err != nil {
+			continue
+		}
+		key := lruKey{
+			question: dns.Question{Name: item.Name, Qtype: item.Qtype, Qclass: item.Qclass},
+			net:      item.Net,
+			do:       item.DO,
+			cd:       item.CD,
+		}
+		p := r.partition(ClientInfo{Listener: item.Listener})
+		p.mu.Lock()
+		p.lru.addKey(key, &cacheAnswer{timestamp: item.Timestamp, expiry: item.Expiry, Msg: msg})
+		p.mu.Unlock()
+		added++
+	}
+	var total int
+	for _, p := range r.partitions() {
+		p.mu.Lock()
+		total += p.lru.size()
+		p.mu.Unlock()
+	}
+	r.metrics.entries.Set(int64(total))
+	return added
+}
+
+// Probe returns true if the query would be answered from the cache. Unlike
+// Resolve, it doesn't count as hit or miss and doesn't forward the query.
+func (r *Cache) Probe(q *dns.Msg, ci ClientInfo) bool {
+	if len(q.Question) != 1 {
+		return false
+	}
+	p := r.partition(ci)
+	p.mu.Lock()
+	_, a := r.lookup(p, q)
+	var (
+		timestamp time.Time
+		min       uint32
+		ok        bool
+	)
+	if a != nil {
+		timestamp = a.timestamp
+		min, ok = minTTL(a.Msg)
+	}
+	p.mu.Unlock()
+	if a == nil {
+		return false
+	}
+	// Responses without records are kept until they're removed by the GC
+	return !ok || uint32(time.Since(timestamp).Seconds()) < min
+}
+
+// Evict removes all cached responses for the given names, regardless of type.
+// If subdomains is true, responses for names under them are removed as well.
+// Returns the number of removed responses.
+func (r *Cache) Evict(names []string, subdomains bool) int {
+	match := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		match[strings.ToLower(dns.Fqdn(name))] = struct{}{}
+	}
+	var removed, total int
+	for _, p := range r.partitions() {
+		p.mu.Lock()
+		p.lru.deleteFunc(func(a *cacheAnswer) bool {
+			if len(a.Question) < 1 {
+				return false
+			}
+			name := strings.ToLower(a.Question[0].Name)
+			if _, ok := match[name]; ok {
+				removed++
+				return true
+			}
+			if !subdomains {
+				return false
+			}
+			for _, i := range dns.Split(name) {
+				if _, ok := match[name[i:]]; ok {
+					removed++
+					return true
+				}
+			}
+			return false
+		})
+		total += p.lru.size()
+		p.mu.Unlock()
+	}
+	r.metrics.entries.Set(int64(total))
+	return removed
 }
 
 // Find the lowest TTL in all resource records (except OPT).
@@ -306,6 +655,10 @@ func minTTL(answer *dns.Msg) (uint32, bool) {
 // over the records in the cache.
 type AnswerShuffleFunc func(*dns.Msg)
 
+// Shuffles the order of answer A/AAAA RRs like AnswerShuffleFunc, with the
+// client passed to allow for a different order per client.
+type AnswerShuffleClientFunc func(*dns.Msg, ClientInfo)
+
 // Randomly re-order the A/AAAA answer records.
 func AnswerShuffleRandon(msg *dns.Msg) {
 	if len(msg.Answer) < 2 {
@@ -318,7 +671,7 @@ func AnswerShuffleRandon(msg *dns.Msg) {
 			idx = append(idx, i)
 		}
 	}
-	rand.Shuffle(len(idx), func(i, j int) {
+	randShuffle(len(idx), func(i, j int) {
 		msg.Answer[idx[i]], msg.Answer[idx[j]] = msg.Answer[idx[j]], msg.Answer[idx[i]]
 	})
 }
@@ -344,3 +697,40 @@ func AnswerShuffleRoundRobin(msg *dns.Msg) {
 		msg.Answer[dst] = last
 	}
 }
+
+// Order the A/AAAA answer records by a hash of the client address and the
+// record's IP. Each client gets a different, but stable order so that it
+// keeps connecting to the same server behind a name with multiple addresses.
+func AnswerShuffleStable(msg *dns.Msg, ci ClientInfo) {
+	if len(msg.Answer) < 2 {
+		return
+	}
+	// idx holds the indexes of A and AAAA records in the answer
+	idx := make([]int, 0, len(msg.Answer))
+	rrs := make([]dns.RR, 0, len(msg.Answer))
+	for i, rr := range msg.Answer {
+		if rr.Header().Rrtype == dns.TypeA || rr.Header().Rrtype == dns.TypeAAAA {
+			idx = append(idx, i)
+			rrs = append(rrs, rr)
+		}
+	}
+	client := ci.SourceIP
+	if ip4 := client.To4(); ip4 != nil {
+		client = ip4
+	}
+	hash := func(rr dns.RR) uint64 {
+		h := fnv.New64a()
+		h.Write(client)
+		switch rr := rr.(type) {
+		case *dns.A:
+			h.Write(rr.A.To4())
+		case *dns.AAAA:
+			h.Write(rr.AAAA)
+		}
+		return h.Sum64()
+	}
+	sort.SliceStable(rrs, func(i, j int) bool { return hash(rrs[i]) < hash(rrs[j]) })
+	for i, rr := range rrs {
+		msg.Answer[idx[i]] = rr
+	}
+}
@@ -174,6 +174,43 @@ func TestRoundRobinShuffle(t *testing.T) {
 	require.Equal(t, net.IP{0, 0, 0, 1}, a2.A)
 }
 
+func TestAnswerShuffleStable(t *testing.T) {
+	newMsg := func() *dns.Msg {
+		msg := new(dns.Msg)
+		msg.Answer = []dns.RR{&dns.CNAME{Hdr: dns.RR_Header{Name: "test.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET}, Target: "test2."}}
+		for i := byte(1); i <= 8; i++ {
+			msg.Answer = append(msg.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: "test2.", Rrtype: dns.TypeA, Class: dns.ClassINET},
+				A:   net.IP{192, 0, 2, i},
+			})
+		}
+		return msg
+	}
+	order := func(msg *dns.Msg) []string {
+		var ips []string
+		for _, rr := range msg.Answer[1:] {
+			ips = append(ips, rr.(*dns.A).A.String())
+		}
+		return ips
+	}
+	client1 := ClientInfo{SourceIP: net.ParseIP("192.168.1.1")}
+	client2 := ClientInfo{SourceIP: net.ParseIP("192.168.1.2")}
+
+	// The same client always gets the same order, regardless of the order in the input
+	msg1 := newMsg()
+	AnswerShuffleStable(msg1, client1)
+	msg2 := newMsg()
+	AnswerShuffleRandon(msg2)
+	AnswerShuffleStable(msg2, client1)
+	require.Equal(t, order(msg1), order(msg2))
+	require.Equal(t, dns.TypeCNAME, msg1.Answer[0].Header().Rrtype)
+
+	// Another client gets a different order
+	msg3 := newMsg()
+	AnswerShuffleStable(msg3, client2)
+	require.NotEqual(t, order(msg1), order(msg3))
+}
+
 // Truncated responses should not be cached
 func TestCacheNoTruncated(t *testing.T) {
 	var ci ClientInfo
@@ -198,3 +235,228 @@ func TestCacheNoTruncated(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, 2, r.HitCount())
 }
+
+func TestCacheCaseInsensitive(t *testing.T) {
+	var ci ClientInfo
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = []dns.RR{
+				&dns.A{
+					Hdr: dns.RR_Header{
+						Name:   q.Question[0].Name,
+						Rrtype: dns.TypeA,
+						Class:  dns.ClassINET,
+						Ttl:    3600,
+					},
+					A: net.IP{127, 0, 0, 1},
+				},
+			}
+			return a, nil
+		},
+	}
+	c := NewCache("test-cache", r, CacheOptions{})
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err := c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r.HitCount())
+
+	// Same name with a different case should be served from the cache
+	q.SetQuestion("ExAmPlE.cOm.", dns.TypeA)
+	_, err = c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r.HitCount())
+}
+
+func TestCacheEvict(t *testing.T) {
+	var ci ClientInfo
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = []dns.RR{
+				&dns.A{
+					Hdr: dns.RR_Header{
+						Name:   q.Question[0].Name,
+						Rrtype: dns.TypeA,
+						Class:  dns.ClassINET,
+						Ttl:    3600,
+					},
+					A: net.IP{127, 0, 0, 1},
+				},
+			}
+			return a, nil
+		},
+	}
+	c := NewCache("test-cache", r, CacheOptions{})
+	resolve := func(name string) {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		_, err := c.Resolve(q, ci)
+		require.NoError(t, err)
+	}
+
+	// Fill the cache
+	resolve("example.com.")
+	resolve("www.example.com.")
+	resolve("other.com.")
+	require.Equal(t, 3, r.HitCount())
+
+	// Evict a single name, only that one has to be resolved again
+	require.Equal(t, 1, c.Evict([]string{"Example.com"}, false))
+	resolve("example.com.")
+	resolve("www.example.com.")
+	require.Equal(t, 4, r.HitCount())
+
+	// Evict a name including its subdomains
+	require.Equal(t, 2, c.Evict([]string{"example.com."}, true))
+	resolve("example.com.")
+	resolve("www.example.com.")
+	resolve("other.com.")
+	require.Equal(t, 6, r.HitCount())
+}
+
+func TestCacheHierarchy(t *testing.T) {
+	upstream := new(TestResolver)
+	l2 := NewCache("test-l2", upstream, CacheOptions{})
+	l1 := NewCache("test-l1", l2, CacheOptions{Capacity: 1, PerListener: true})
+
+	q1 := new(dns.Msg)
+	q1.SetQuestion("test1.com.", dns.TypeA)
+	q2 := new(dns.Msg)
+	q2.SetQuestion("test2.com.", dns.TypeA)
+
+	// First query goes all the way upstream
+	_, err := l1.Resolve(q1, ClientInfo{Listener: "a"})
+	require.NoError(t, err)
+	require.Equal(t, 1, upstream.HitCount())
+
+	// Another listener has its own L1, the response is promoted from the L2
+	_, err = l1.Resolve(q1, ClientInfo{Listener: "b"})
+	require.NoError(t, err)
+	require.Equal(t, 1, upstream.HitCount())
+	require.True(t, l1.Probe(q1, ClientInfo{Listener: "b"}))
+	require.False(t, l1.Probe(q1, ClientInfo{Listener: "c"}))
+
+	// Clear the L2 and push the first response out of the L1, it should be
+	// demoted to the L2
+	l2.flush()
+	_, err = l1.Resolve(q2, ClientInfo{Listener: "a"})
+	require.NoError(t, err)
+	require.Equal(t, 2, upstream.HitCount())
+	require.False(t, l1.Probe(q1, ClientInfo{Listener: "a"}))
+	require.True(t, l2.Probe(q1, ClientInfo{}))
+
+	// A third listener now gets it from the L2
+	_, err = l1.Resolve(q1, ClientInfo{Listener: "c"})
+	require.NoError(t, err)
+	require.Equal(t, 2, upstream.HitCount())
+}
+
+func TestCacheECSScope(t *testing.T) {
+	var ci ClientInfo
+	// Upstream returns scope /16 for names under geo.test, /0 for anything else
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = []dns.RR{
+				&dns.A{
+					Hdr: dns.RR_Header{
+						Name:   q.Question[0].Name,
+						Rrtype: dns.TypeA,
+						Class:  dns.ClassINET,
+						Ttl:    3600,
+					},
+					A: net.IP{127, 0, 0, 1},
+				},
+			}
+			if ecs := ecsOption(q); ecs != nil {
+				scope := uint8(0)
+				if dns.IsSubDomain("geo.test.", q.Question[0].Name) {
+					scope = 16
+				}
+				a.SetEdns0(4096, false)
+				opt := copyECS(ecs)
+				opt.SourceScope = scope
+				a.IsEdns0().Option = append(a.IsEdns0().Option, opt)
+			}
+			return a, nil
+		},
+	}
+	c := NewCache("test-cache-ecs-scope", r, CacheOptions{ECSScope: true})
+
+	query := func(name, addr string, prefix uint8) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		if addr != "" {
+			q.SetEdns0(4096, false)
+			q.IsEdns0().Option = append(q.IsEdns0().Option, &dns.EDNS0_SUBNET{
+				Code:          dns.EDNS0SUBNET,
+				Family:        1,
+				SourceNetmask: prefix,
+				Address:       net.ParseIP(addr).To4(),
+			})
+		}
+		return q
+	}
+
+	// First query for the name goes upstream
+	_, err := c.Resolve(query("www.geo.test.", "192.0.2.0", 24), ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r.HitCount())
+
+	// Another /24 in the same /16 is served from the cache, with its own ECS option
+	a, err := c.Resolve(query("www.geo.test.", "192.0.3.0", 24), ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r.HitCount())
+	ecs := ecsOption(a)
+	require.NotNil(t, ecs)
+	require.Equal(t, "192.0.3.0", ecs.Address.String())
+	require.Equal(t, uint8(16), ecs.SourceScope)
+
+	// A different /16 needs a new response
+	_, err = c.Resolve(query("www.geo.test.", "198.51.100.0", 24), ci)
+	require.NoError(t, err)
+	require.Equal(t, 2, r.HitCount())
+
+	// Responses with scope /0 are shared by all clients, with or without ECS
+	_, err = c.Resolve(query("www.global.test.", "192.0.2.0", 24), ci)
+	require.NoError(t, err)
+	require.Equal(t, 3, r.HitCount())
+	_, err = c.Resolve(query("www.global.test.", "198.51.100.0", 24), ci)
+	require.NoError(t, err)
+	_, err = c.Resolve(query("www.global.test.", "", 0), ci)
+	require.NoError(t, err)
+	require.Equal(t, 3, r.HitCount())
+}
+
+func TestCacheKeyDNSSECFlags(t *testing.T) {
+	var ci ClientInfo
+	r := new(TestResolver)
+	c := NewCache("test-cache-key-dnssec", r, CacheOptions{KeyDNSSECFlags: true})
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err := c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r.HitCount())
+
+	// The DO bit is part of the key
+	q.SetEdns0(4096, true)
+	_, err = c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 2, r.HitCount())
+
+	// So is the CD bit
+	q.CheckingDisabled = true
+	_, err = c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 3, r.HitCount())
+	_, err = c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 3, r.HitCount())
+}
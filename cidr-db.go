@@ -74,3 +74,8 @@ func (m *CidrDB) Close() error {
 func (m *CidrDB) String() string {
 	return "CIDR-blocklist"
 }
+
+// Stale returns true if the rules were loaded from a stale copy of the list.
+func (m *CidrDB) Stale() bool {
+	return isStale(m.loader)
+}
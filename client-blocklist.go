@@ -1,6 +1,7 @@
 package rdns
 
 import (
+	"net"
 	"sync"
 	"time"
 
@@ -38,8 +39,9 @@ func NewClientBlocklist(id string, resolver Resolver, opt ClientBlocklistOptions
 		metrics:                NewBlocklistMetrics(id),
 	}
 
-	// Start the refresh goroutines if we have a list and a refresh period was given
-	if blocklist.BlocklistDB != nil && blocklist.BlocklistRefresh > 0 {
+	// Start the refresh goroutines if we have a list. Lists are reloaded if a
+	// refresh period was given, or if they were loaded from a stale copy.
+	if blocklist.BlocklistDB != nil {
 		go blocklist.refreshLoopBlocklist(blocklist.BlocklistRefresh)
 	}
 	return blocklist, nil
@@ -49,7 +51,11 @@ func NewClientBlocklist(id string, resolver Resolver, opt ClientBlocklistOptions
 // REFUSED if the client IP is on the blocklist, or sends the query to an alternative
 // resolver if one is configured.
 func (r *ClientBlocklist) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
-	if match, ok := r.BlocklistDB.Match(ci.SourceIP); ok {
+	r.mu.RLock()
+	db := r.BlocklistDB
+	r.mu.RUnlock()
+	ci.recordClientSpecific()
+	if match, ok := db.Match(ci.SourceIP); ok {
 		log := Log.WithFields(logrus.Fields{"id": r.id, "qname": qName(q), "list": match.List, "rule": match.Rule, "ip": ci.SourceIP})
 		r.metrics.blocked.Add(1)
 		if r.BlocklistResolver != nil {
@@ -64,23 +70,44 @@ func (r *ClientBlocklist) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	return r.resolver.Resolve(q, ci)
 }
 
+// TestIP returns which rule, if any, matches a client IP without resolving
+// anything. Used to find out why a client is blocked.
+func (r *ClientBlocklist) TestIP(ip net.IP) BlocklistTestResult {
+	r.mu.RLock()
+	db := r.BlocklistDB
+	r.mu.RUnlock()
+	if match, ok := db.Match(ip); ok {
+		return BlocklistTestResult{Blocked: true, List: match.List, Rule: match.Rule}
+	}
+	return BlocklistTestResult{}
+}
+
 func (r *ClientBlocklist) String() string {
 	return r.id
 }
 
 func (r *ClientBlocklist) refreshLoopBlocklist(refresh time.Duration) {
 	for {
-		time.Sleep(refresh)
+		wait, ok := nextRefresh(r.BlocklistDB, refresh)
+		if !ok {
+			return
+		}
+		time.Sleep(wait)
 		log := Log.WithField("id", r.id)
 		log.Debug("reloading blocklist")
 		db, err := r.BlocklistDB.Reload()
+		if err == ErrNotModified {
+			log.Debug("list not modified, keeping current rules")
+			continue
+		}
 		if err != nil {
 			Log.WithError(err).Error("failed to load rules")
 			continue
 		}
 		r.mu.Lock()
-		r.BlocklistDB.Close()
+		old := r.BlocklistDB
 		r.BlocklistDB = db
 		r.mu.Unlock()
+		closeReplacedIPDB(old, db)
 	}
 }
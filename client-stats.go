@@ -0,0 +1,326 @@
+package rdns
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Number of recent response times used to calculate latency percentiles.
+const clientStatsLatencySamples = 1000
+
+// ClientStats counts queries by client IP and by query name, then forwards
+// them to its resolver. It also keeps track of blocked names, response codes
+// and response times. The counters are available as metrics and can be saved
+// to a file periodically so they are retained across restarts.
+type ClientStats struct {
+	id       string
+	resolver Resolver
+	opt      ClientStatsOptions
+
+	mu      sync.Mutex
+	clients *topCounter // Query count by client IP
+	domains *topCounter // Query count by name, limited to the most frequent
+	blocked *topCounter // Blocked query count by name
+	rcodes  *expvar.Map // Response count by rcode
+	query   *expvar.Int
+
+	latency     []time.Duration // Ring buffer of recent response times
+	latencyNext int
+}
+
+var _ Resolver = &ClientStats{}
+
+type ClientStatsOptions struct {
+	// File the counters are saved to and loaded from on startup. Counters
+	// are not persisted if empty.
+	File string
+
+	// Interval in which the counters are written to the file. Default 1 minute.
+	SaveInterval time.Duration
+
+	// Number of query names to keep counts for. Less frequent names are
+	// dropped periodically. Default 100.
+	TopDomains int
+
+	// Number of client addresses to keep counts for. Default 100.
+	TopClients int
+}
+
+// Content of the file used to persist the counters.
+type clientStatsFile struct {
+	Queries int64            `json:"queries,omitempty"`
+	Clients map[string]int64 `json:"clients"`
+	Domains map[string]int64 `json:"domains"`
+	Blocked map[string]int64 `json:"blocked,omitempty"`
+	Rcodes  map[string]int64 `json:"rcodes,omitempty"`
+}
+
+// ClientStatsReport is a summary of the statistics, with the most frequent
+// names and clients.
+type ClientStatsReport struct {
+	Queries    int64              `json:"queries"`
+	TopDomains []ClientStatsEntry `json:"top-domains"`
+	TopBlocked []ClientStatsEntry `json:"top-blocked"`
+	TopClients []ClientStatsEntry `json:"top-clients"`
+	Rcodes     map[string]int64   `json:"rcodes"`
+	Latency    map[string]float64 `json:"latency-ms"` // Percentiles of recent response times
+}
+
+type ClientStatsEntry struct {
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+}
+
+// NewClientStats returns a new instance of a client statistics element. If a
+// file is configured, existing counters are loaded from it.
+func NewClientStats(id string, resolver Resolver, opt ClientStatsOptions) (*ClientStats, error) {
+	if opt.SaveInterval == 0 {
+		opt.SaveInterval = time.Minute
+	}
+	if opt.TopDomains == 0 {
+		opt.TopDomains = 100
+	}
+	if opt.TopClients == 0 {
+		opt.TopClients = 100
+	}
+	r := &ClientStats{
+		id:       id,
+		resolver: resolver,
+		opt:      opt,
+		clients:  newTopCounter(getVarMap("client-stats", id, "client"), opt.TopClients),
+		domains:  newTopCounter(getVarMap("client-stats", id, "domain"), opt.TopDomains),
+		blocked:  newTopCounter(getVarMap("client-stats", id, "blocked"), opt.TopDomains),
+		rcodes:   getVarMap("client-stats", id, "rcode"),
+		query:    getVarInt("client-stats", id, "query"),
+	}
+	if opt.File != "" {
+		if err := r.load(); err != nil {
+			return nil, err
+		}
+		go r.saveLoop()
+	}
+	return r, nil
+}
+
+// Resolve a DNS query after counting it.
+func (r *ClientStats) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) == 0 {
+		return r.resolver.Resolve(q, ci)
+	}
+	name := strings.ToLower(q.Question[0].Name)
+	r.count(ci.SourceIP, name)
+
+	start := time.Now()
+	return resolveWithEDE(r.resolver, q, ci, func(a *dns.Msg) {
+		r.countResponse(name, a, time.Since(start))
+	})
+}
+
+// Report returns a summary of the statistics with up to n entries in each
+// of the top lists.
+func (r *ClientStats) Report(n int) ClientStatsReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	report := ClientStatsReport{
+		Queries:    r.query.Value(),
+		TopDomains: r.domains.top(n),
+		TopBlocked: r.blocked.top(n),
+		TopClients: r.clients.top(n),
+		Rcodes:     make(map[string]int64),
+		Latency:    make(map[string]float64),
+	}
+	r.rcodes.Do(func(kv expvar.KeyValue) {
+		report.Rcodes[kv.Key] = kv.Value.(*expvar.Int).Value()
+	})
+	if len(r.latency) > 0 {
+		samples := make([]time.Duration, len(r.latency))
+		copy(samples, r.latency)
+		sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+		for _, p := range []int{50, 90, 99} {
+			d := samples[(len(samples)-1)*p/100]
+			report.Latency["p"+strconv.Itoa(p)] = float64(d) / float64(time.Millisecond)
+		}
+	}
+	return report
+}
+
+func (r *ClientStats) String() string {
+	return r.id
+}
+
+// Counts a query. Queries without client address, like from a dnstap
+// listener, are not counted for any client.
+func (r *ClientStats) count(client net.IP, name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.query.Add(1)
+	if client != nil {
+		r.clients.add(client.String(), 1)
+	}
+	r.domains.add(name, 1)
+}
+
+func (r *ClientStats) countResponse(name string, a *dns.Msg, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.latency) < clientStatsLatencySamples {
+		r.latency = append(r.latency, d)
+	} else {
+		r.latency[r.latencyNext] = d
+		r.latencyNext = (r.latencyNext + 1) % clientStatsLatencySamples
+	}
+	if a == nil {
+		r.rcodes.Add("DROP", 1)
+		return
+	}
+	r.rcodes.Add(rCode(a), 1)
+	if blocked, _ := isBlockedResponse(a); blocked {
+		r.blocked.add(name, 1)
+	}
+}
+
+// Loads the counters from file. A missing file is not an error, it'll be
+// created on the first save.
+func (r *ClientStats) load() error {
+	b, err := os.ReadFile(r.opt.File)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var f clientStatsFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.query.Add(f.Queries)
+	for client, n := range f.Clients {
+		r.clients.add(client, n)
+	}
+	for name, n := range f.Domains {
+		r.domains.add(name, n)
+	}
+	for name, n := range f.Blocked {
+		r.blocked.add(name, n)
+	}
+	for rcode, n := range f.Rcodes {
+		r.rcodes.Add(rcode, n)
+	}
+	return nil
+}
+
+// Writes the counters to file. A temporary file is used and renamed to
+// avoid leaving a partial file behind if the process is stopped.
+func (r *ClientStats) save() error {
+	r.mu.Lock()
+	f := clientStatsFile{
+		Queries: r.query.Value(),
+		Clients: r.clients.values(),
+		Domains: r.domains.values(),
+		Blocked: r.blocked.values(),
+		Rcodes:  make(map[string]int64),
+	}
+	r.rcodes.Do(func(kv expvar.KeyValue) {
+		f.Rcodes[kv.Key] = kv.Value.(*expvar.Int).Value()
+	})
+	r.mu.Unlock()
+
+	b, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	tmp := r.opt.File + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.opt.File)
+}
+
+func (r *ClientStats) saveLoop() {
+	for {
+		time.Sleep(r.opt.SaveInterval)
+		if err := r.save(); err != nil {
+			Log.WithField("id", r.id).WithError(err).Error("failed to save client statistics")
+		}
+	}
+}
+
+// topCounter keeps counts by key, but only retains the most frequent keys to
+// limit memory use. Not safe for concurrent use.
+type topCounter struct {
+	m   *expvar.Map
+	n   int // Number of keys in the map
+	max int // Number of keys to retain when pruning
+}
+
+func newTopCounter(m *expvar.Map, max int) *topCounter {
+	return &topCounter{m: m, max: max}
+}
+
+func (c *topCounter) add(key string, delta int64) {
+	if c.m.Get(key) == nil {
+		c.n++
+	}
+	c.m.Add(key, delta)
+
+	// Drop the less frequent keys once there are many more than needed. Keeping
+	// some extra gives new keys a chance to make it into the top list.
+	if c.n > 10*c.max {
+		c.prune()
+	}
+}
+
+// Removes all but the most frequent keys from the counters.
+func (c *topCounter) prune() {
+	entries := c.sorted()
+	for i := c.max; i < len(entries); i++ {
+		c.m.Delete(entries[i].Name)
+	}
+	c.n = len(entries)
+	if c.n > c.max {
+		c.n = c.max
+	}
+}
+
+// Returns up to n of the most frequent keys. All keys are returned if n is 0.
+func (c *topCounter) top(n int) []ClientStatsEntry {
+	entries := c.sorted()
+	if n > 0 && len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
+
+func (c *topCounter) sorted() []ClientStatsEntry {
+	entries := []ClientStatsEntry{}
+	c.m.Do(func(kv expvar.KeyValue) {
+		entries = append(entries, ClientStatsEntry{kv.Key, kv.Value.(*expvar.Int).Value()})
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count == entries[j].Count {
+			return entries[i].Name < entries[j].Name
+		}
+		return entries[i].Count > entries[j].Count
+	})
+	return entries
+}
+
+func (c *topCounter) values() map[string]int64 {
+	values := make(map[string]int64)
+	c.m.Do(func(kv expvar.KeyValue) {
+		values[kv.Key] = kv.Value.(*expvar.Int).Value()
+	})
+	return values
+}
@@ -0,0 +1,99 @@
+package rdns
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientStatsPersist(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "stats.json")
+	r := new(TestResolver)
+	ci := ClientInfo{SourceIP: net.ParseIP("192.168.1.1")}
+
+	g, err := NewClientStats("test-stats-1", r, ClientStatsOptions{File: file})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("Example.com.", dns.TypeA)
+	for i := 0; i < 3; i++ {
+		_, err = g.Resolve(q, ci)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 3, r.HitCount())
+	require.NoError(t, g.save())
+
+	// A new instance should start with the saved counters
+	g, err = NewClientStats("test-stats-2", r, ClientStatsOptions{File: file})
+	require.NoError(t, err)
+	_, err = g.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, "4", g.clients.m.Get("192.168.1.1").String())
+	require.Equal(t, "4", g.domains.m.Get("example.com.").String())
+	require.Equal(t, int64(4), g.query.Value())
+}
+
+func TestClientStatsTopDomains(t *testing.T) {
+	r := new(TestResolver)
+	var ci ClientInfo
+
+	g, err := NewClientStats("test-stats-top", r, ClientStatsOptions{TopDomains: 2})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("popular.com.", dns.TypeA)
+	for i := 0; i < 10; i++ {
+		_, err = g.Resolve(q, ci)
+		require.NoError(t, err)
+	}
+
+	// Query enough other names to trigger pruning
+	for i := 0; i < 20; i++ {
+		q.SetQuestion(dns.Fqdn(string(rune('a'+i))+".com"), dns.TypeA)
+		_, err = g.Resolve(q, ci)
+		require.NoError(t, err)
+	}
+	require.Equal(t, "10", g.domains.m.Get("popular.com.").String())
+	require.LessOrEqual(t, g.domains.n, 20)
+
+	// Queries without client address aren't counted for any client
+	require.Empty(t, g.clients.values())
+}
+
+func TestClientStatsReport(t *testing.T) {
+	r := new(TestResolver)
+	db, err := NewRegexpDB("testlist", NewStaticLoader([]string{`(^|\.)block\.test`}))
+	require.NoError(t, err)
+	b, err := NewBlocklist("test-stats-bl", r, BlocklistOptions{BlocklistDB: db})
+	require.NoError(t, err)
+
+	g, err := NewClientStats("test-stats-report", b, ClientStatsOptions{})
+	require.NoError(t, err)
+
+	ci := ClientInfo{SourceIP: net.ParseIP("192.168.1.1")}
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	for i := 0; i < 2; i++ {
+		_, err = g.Resolve(q, ci)
+		require.NoError(t, err)
+	}
+
+	// Blocked queries are counted even if the client doesn't support EDNS0,
+	// but the response to the client shouldn't have an OPT record
+	q.SetQuestion("www.block.test.", dns.TypeA)
+	a, err := g.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+	require.Nil(t, a.IsEdns0())
+
+	report := g.Report(1)
+	require.Equal(t, int64(3), report.Queries)
+	require.Equal(t, []ClientStatsEntry{{"example.com.", 2}}, report.TopDomains)
+	require.Equal(t, []ClientStatsEntry{{"www.block.test.", 1}}, report.TopBlocked)
+	require.Equal(t, []ClientStatsEntry{{"192.168.1.1", 3}}, report.TopClients)
+	require.Equal(t, map[string]int64{"NOERROR": 2, "NXDOMAIN": 1}, report.Rcodes)
+	require.Contains(t, report.Latency, "p99")
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	rdns "github.com/folbricht/routedns"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+type checkOptions struct {
+	graph string
+}
+
+func newCheckCommand() *cobra.Command {
+	var opt checkOptions
+	cmd := &cobra.Command{
+		Use:   "check <config> [<config>..]",
+		Short: "Validate the configuration",
+		Long: `Validate the configuration.
+
+Parses the configuration and instantiates all elements
+without starting the listeners. Reports references to
+elements that don't exist, as well as elements that can't
+be reached from any listener.
+
+Optionally prints the graph of listeners, routers, groups
+and resolvers in Graphviz DOT or Mermaid format.
+`,
+		Example: `  routedns check config.toml
+  routedns check --graph dot config.toml | dot -Tsvg > config.svg`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return check(opt, args)
+		},
+		SilenceUsage: true,
+	}
+	cmd.Flags().StringVarP(&opt.graph, "graph", "g", "", "Print the pipeline graph; dot or mermaid")
+	return cmd
+}
+
+func check(opt checkOptions, args []string) error {
+	if opt.graph != "" && opt.graph != "dot" && opt.graph != "mermaid" {
+		return fmt.Errorf("unsupported graph format '%s'", opt.graph)
+	}
+	// Only log problems that come up while instantiating the elements
+	rdns.Log.SetLevel(logrus.WarnLevel)
+
+	config, err := loadConfig(args...)
+	if err != nil {
+		return err
+	}
+	rdns.SetLabels(config.Labels)
+
+	g := newConfigGraph(config)
+	for _, id := range g.unused() {
+		fmt.Fprintf(os.Stderr, "warning: %s '%s' is not used by any listener\n", g.nodes[id].kind, g.nodes[id].id)
+	}
+	errs := g.errors
+
+	// Instantiate the elements to find invalid options. This is only meaningful
+	// if all references are valid.
+	if len(errs) == 0 {
+		if _, _, err := instantiate(config); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+	}
+
+	switch opt.graph {
+	case "dot":
+		g.writeDOT(os.Stdout)
+	case "mermaid":
+		g.writeMermaid(os.Stdout)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("found %d error(s) in the configuration", len(errs))
+	}
+	return nil
+}
+
+// Element of the configuration in the graph.
+type configNode struct {
+	kind string // "listener", "router", "group" or "resolver"
+	id   string
+	typ  string // Protocol or type of the element
+}
+
+// Graph of all elements in the configuration. Listeners have their own
+// namespace, so their keys are prefixed to keep them apart from the others.
+type configGraph struct {
+	nodes  map[string]configNode
+	edges  map[string][]string
+	errors []string
+}
+
+func newConfigGraph(config config) *configGraph {
+	g := &configGraph{
+		nodes: make(map[string]configNode),
+		edges: make(map[string][]string),
+	}
+	for id, r := range config.Resolvers {
+		g.addNode(id, configNode{kind: "resolver", id: id, typ: r.Protocol})
+	}
+	for id, gr := range config.Groups {
+		g.addNode(id, configNode{kind: "group", id: id, typ: gr.Type})
+	}
+	for id := range config.Routers {
+		g.addNode(id, configNode{kind: "router", id: id, typ: "router"})
+	}
+	for id, l := range config.Listeners {
+		g.addNode(listenerKey(id), configNode{kind: "listener", id: id, typ: l.Protocol})
+	}
+
+	for id, deps := range configEdges(config) {
+		g.addEdges(id, deps)
+	}
+	for id, l := range config.Listeners {
+		deps := append([]string{l.Resolver}, l.Blocklists...)
+		if l.Resolver == "" && l.HealthName == "" && l.Protocol != "admin" && l.Protocol != "block-page" {
+			g.errors = append(g.errors, fmt.Sprintf("listener '%s' has no resolver", id))
+		}
+		g.addEdges(listenerKey(id), deps)
+	}
+	sort.Strings(g.errors)
+	return g
+}
+
+func listenerKey(id string) string {
+	return "listener:" + id
+}
+
+func (g *configGraph) addNode(key string, n configNode) {
+	if existing, ok := g.nodes[key]; ok {
+		g.errors = append(g.errors, fmt.Sprintf("duplicate id '%s' used by %s and %s", n.id, existing.kind, n.kind))
+		return
+	}
+	g.nodes[key] = n
+}
+
+// Adds edges to other elements, ignoring empty and repeated references.
+func (g *configGraph) addEdges(key string, deps []string) {
+	from := g.nodes[key]
+	seen := make(map[string]struct{})
+	for _, dep := range deps {
+		if dep == "" {
+			continue
+		}
+		if _, ok := seen[dep]; ok {
+			continue
+		}
+		seen[dep] = struct{}{}
+		if _, ok := g.nodes[dep]; !ok {
+			g.errors = append(g.errors, fmt.Sprintf("%s '%s' references non-existent element '%s'", from.kind, from.id, dep))
+			continue
+		}
+		g.edges[key] = append(g.edges[key], dep)
+	}
+	sort.Strings(g.edges[key])
+}
+
+// Returns the keys of all elements that can't be reached from any listener.
+func (g *configGraph) unused() []string {
+	reached := make(map[string]struct{})
+	var walk func(key string)
+	walk = func(key string) {
+		if _, ok := reached[key]; ok {
+			return
+		}
+		reached[key] = struct{}{}
+		for _, dep := range g.edges[key] {
+			walk(dep)
+		}
+	}
+	for key, n := range g.nodes {
+		if n.kind == "listener" {
+			walk(key)
+		}
+	}
+	var unused []string
+	for _, key := range g.keys() {
+		if _, ok := reached[key]; !ok {
+			unused = append(unused, key)
+		}
+	}
+	return unused
+}
+
+// Returns the keys of all nodes, sorted for stable output.
+func (g *configGraph) keys() []string {
+	keys := make([]string, 0, len(g.nodes))
+	for key := range g.nodes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (n configNode) label() string {
+	switch n.kind {
+	case "listener", "resolver":
+		return fmt.Sprintf("%s\n%s %s", n.id, n.typ, n.kind)
+	default:
+		return fmt.Sprintf("%s\n%s", n.id, n.typ)
+	}
+}
+
+// Writes the graph in Graphviz DOT format.
+func (g *configGraph) writeDOT(w io.Writer) {
+	shapes := map[string]string{
+		"listener": "box",
+		"router":   "diamond",
+		"group":    "ellipse",
+		"resolver": "cylinder",
+	}
+	quote := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	fmt.Fprintln(w, "digraph routedns {")
+	fmt.Fprintln(w, "  rankdir=LR;")
+	for _, key := range g.keys() {
+		n := g.nodes[key]
+		fmt.Fprintf(w, "  \"%s\" [label=\"%s\", shape=%s];\n", quote.Replace(key), quote.Replace(n.label()), shapes[n.kind])
+	}
+	for _, key := range g.keys() {
+		for _, dep := range g.edges[key] {
+			fmt.Fprintf(w, "  \"%s\" -> \"%s\";\n", quote.Replace(key), quote.Replace(dep))
+		}
+	}
+	fmt.Fprintln(w, "}")
+}
+
+// Writes the graph as Mermaid flowchart. Element IDs can contain characters
+// that Mermaid doesn't allow in node IDs, so the nodes are numbered.
+func (g *configGraph) writeMermaid(w io.Writer) {
+	shapes := map[string][2]string{
+		"listener": {"([", "])"},
+		"router":   {"{", "}"},
+		"group":    {"[", "]"},
+		"resolver": {"[(", ")]"},
+	}
+	quote := strings.NewReplacer(`"`, "#quot;", "\n", "<br>")
+	ids := make(map[string]string)
+	fmt.Fprintln(w, "flowchart LR")
+	for i, key := range g.keys() {
+		n := g.nodes[key]
+		ids[key] = fmt.Sprintf("n%d", i)
+		shape := shapes[n.kind]
+		fmt.Fprintf(w, "  %s%s\"%s\"%s\n", ids[key], shape[0], quote.Replace(n.label()), shape[1])
+	}
+	for _, key := range g.keys() {
+		for _, dep := range g.edges[key] {
+			fmt.Fprintf(w, "  %s --> %s\n", ids[key], ids[dep])
+		}
+	}
+}
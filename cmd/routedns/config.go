@@ -1,10 +1,10 @@
 package main
 
 import (
-	"bytes"
-	"io"
+	"fmt"
 	"net"
-	"os"
+	"reflect"
+	"strings"
 
 	"github.com/BurntSushi/toml"
 	rdns "github.com/folbricht/routedns"
@@ -17,6 +17,12 @@ type config struct {
 	Resolvers         map[string]resolver
 	Groups            map[string]group
 	Routers           map[string]router
+	Labels            map[string]string // Static labels added to logs and metrics, like site or environment
+	RandomSeed        int64             `toml:"random-seed"` // Fixed seed for random decisions, for reproducible tests
+	Watchdog          *watchdog         // Monitoring of resource usage, not enabled if nil
+
+	// Files the elements and options are defined in, by key like "groups.<id>"
+	sources map[string]string
 }
 
 type listener struct {
@@ -30,11 +36,61 @@ type listener struct {
 	MutualTLS  bool     `toml:"mutual-tls"`
 	AllowedNet []string `toml:"allowed-net"`
 	Frontend   dohFrontend
+
+	// Don't restore the case of the query name in responses to what the client sent
+	DisableCaseRestore bool `toml:"disable-case-restore"`
+
+	// Handling of queries with zero or multiple questions, or unusual classes
+	QueryPolicy queryPolicy `toml:"query-policy"`
+
+	// Strictness of EDNS0 handling, for conformance checks
+	Compliance compliance
+
+	// Number of UDP sockets to open on the same address with SO_REUSEPORT
+	Sockets int
+
+	// Token required by the admin listener for requests that change the configuration
+	AdminToken string `toml:"admin-token"`
+
+	// Accept PROXY protocol headers from load balancers on TCP, DoT and DoH listeners
+	ProxyProtocol        bool     `toml:"proxy-protocol"`
+	ProxyProtocolTrusted []string `toml:"proxy-protocol-trusted"`
+
+	// Bind to the address even if it isn't assigned to the host yet, like a floating VRRP address
+	Freebind bool
+
+	// Blocklists the block page listener can allow names in, and for how long (seconds)
+	Blocklists    []string
+	AllowDuration int `toml:"allow-duration"`
+
+	// Query name answered locally with the status of the instance, for health-checks
+	HealthName string `toml:"health-name"`
+
+	// File to record accepted and refused connections and queries in, as JSON lines
+	AuditLog         string `toml:"audit-log"`
+	AuditLogMaxSize  int64  `toml:"audit-log-max-size"`  // Size in MB at which the file is rotated, default 100
+	AuditLogMaxFiles int    `toml:"audit-log-max-files"` // Number of rotated files to keep, default 5
+}
+
+// Listener query policy, values can be "pass", "formerr", "refused" or "drop"
+type queryPolicy struct {
+	NoQuestion    string `toml:"no-question"`    // Default "formerr", "pass" is not supported
+	MultiQuestion string `toml:"multi-question"` // Default "formerr"
+	UnusualClass  string `toml:"unusual-class"`  // Any class other than IN, default "pass"
+}
+
+type compliance struct {
+	Strict             bool // Enable the strict profile
+	TolerateMissingOPT bool `toml:"tolerate-missing-opt"` // Don't add missing OPT records to responses to EDNS queries
+	PassUnknownVersion bool `toml:"pass-unknown-version"` // Pass queries with EDNS version > 0 on instead of responding with BADVERS
 }
 
 // DoH listener frontend options
 type dohFrontend struct {
-	HTTPProxyNet string `toml:"trusted-proxy"`
+	HTTPProxyNet    string   `toml:"trusted-proxy"`
+	HTTPProxyNets   []string `toml:"trusted-proxies"`
+	ClientIPHeaders []string `toml:"client-ip-headers"`
+	Compression     bool     `toml:"compression"` // Compress large responses if the client supports it
 }
 
 type resolver struct {
@@ -47,12 +103,61 @@ type resolver struct {
 	ClientCrt     string `toml:"client-crt"`
 	BootstrapAddr string `toml:"bootstrap-address"`
 	LocalAddr     string `toml:"local-address"`
+	Proxy         string `toml:"proxy"`          // Proxy URL for DoT and DoH resolvers, "socks5://" or "http://"
 	EDNS0UDPSize  uint16 `toml:"edns0-udp-size"` // UDP resolver option
+	TCPFallback   bool   `toml:"tcp-fallback"`   // UDP resolver option, repeat truncated queries over TCP
+	StrictCase    bool   `toml:"strict-case"`    // UDP, TCP and stub resolver option, reject responses that don't preserve the case of the name
+	Interface     string `toml:"interface"`      // mDNS resolver option, network interface to send queries on
+	Connections   int    `toml:"connections"`    // Number of upstream connections for TCP, UDP and DoT resolvers
+
+	// Stub resolver options, zones to resolve and servers to learn their name servers from
+	StubZones      []string `toml:"stub-zones"`
+	StubHints      []string `toml:"stub-hints"`
+	StubMaxRefresh int      `toml:"stub-max-refresh"` // Maximum time in seconds name servers are used before they're refreshed, default 3600
+
+	// TLS options for DoT, DoH and DoQ resolvers
+	SPKIPins        []string `toml:"spki-pins"`         // Base64 SHA256 hashes of public keys, one of which must be in the server's chain
+	TLSMinVersion   string   `toml:"tls-min-version"`   // "1.2" (default) or "1.3"
+	TLSCipherSuites []string `toml:"tls-cipher-suites"` // TLS 1.2 cipher suites to offer, by name
+
+	// Flags to set or clear in queries before they are sent upstream, "rd", "cd" or "ad"
+	SetFlags   []string `toml:"set-flags"`
+	ClearFlags []string `toml:"clear-flags"`
+
+	// Timeout and retry options
+	QueryTimeout         int    `toml:"query-timeout"`          // Time in milliseconds to wait for a response
+	Retries              int    `toml:"retries"`                // Number of times failed queries are repeated
+	RetryBackoff         int    `toml:"retry-backoff"`          // Time in milliseconds to wait before the first retry, default 100
+	RetryBackoffStrategy string `toml:"retry-backoff-strategy"` // "constant" (default) or "exponential"
+	RetryBackoffMax      int    `toml:"retry-backoff-max"`      // Upper limit in milliseconds for exponential backoff
+
+	// Other transports to the same server, tried in order when the protocol is blocked
+	TransportFallback      []transport `toml:"transport-fallback"`
+	TransportFallbackReset int         `toml:"transport-fallback-reset"` // Time in seconds before going back to the first transport, default 300
+}
+
+// Resource usage limits of the process and what to do when they're exceeded
+type watchdog struct {
+	Interval      int     // Time in seconds between checks, default 10
+	MaxHeap       uint64  `toml:"max-heap"` // Heap size in MB
+	MaxGoroutines int     `toml:"max-goroutines"`
+	MaxFDs        int     `toml:"max-fds"`
+	LowWater      float64 `toml:"low-water"`    // Fraction of the limits usage has to drop below to lift the safeguards, default 0.9
+	ShedLoad      bool    `toml:"shed-load"`    // Refuse queries while a limit is exceeded
+	FlushCaches   bool    `toml:"flush-caches"` // Flush all caches when the heap limit is exceeded
+}
+
+// Alternative transport of a resolver. All other options are inherited.
+type transport struct {
+	Protocol  string
+	Address   string
+	Transport string
 }
 
 // DoH-specific resolver options
 type doh struct {
-	Method string
+	Method      string
+	Compression bool // Ask the server for compressed responses
 }
 
 type group struct {
@@ -66,13 +171,28 @@ type group struct {
 	ECSPrefix6 uint8                   `toml:"ecs-prefix6"` // ECS IPv6 address prefix, 0-128. Used for "add" and "privacy"
 	TTLMin     uint32                  `toml:"ttl-min"`     // TTL minimum to apply to responses in the TTL-modifier
 	TTLMax     uint32                  `toml:"ttl-max"`     // TTL maximum to apply to responses in the TTL-modifier
+	TTLRules   []ttlRule               `toml:"ttl-rules"`   // Rules to set the TTL based on the response in the TTL-modifier
 	EDNS0Op    string                  `toml:"edns0-op"`    // EDNS0 modifier operation, "add" or "delete"
 	EDNS0Code  uint16                  `toml:"edns0-code"`  // EDNS0 modifier option code
 	EDNS0Data  []byte                  `toml:"edns0-data"`  // EDNS0 modifier option data
 
+	// Only apply ttl-modifier, ecs-modifier, edns0-modifier and tee to queries for these domains and their sub-domains
+	Domains []string
+
 	// Failover/Failback options
-	ResetAfter    int  `toml:"reset-after"`    // Time in seconds after which to reset resolvers in fail-back and random groups, default 60.
-	ServfailError bool `toml:"servfail-error"` // If true, SERVFAIL responses are considered errors and cause failover etc.
+	ResetAfter    int         `toml:"reset-after"`     // Time in seconds after which to reset resolvers in fail-back and random groups, default 60.
+	ServfailError bool        `toml:"servfail-error"`  // If true, SERVFAIL responses are considered errors and cause failover etc.
+	HealthCheck   healthCheck `toml:"health-check"`    // Active health checks of the resolvers in fail-rotate and fail-back groups
+	WarmStandby   bool        `toml:"warm-standby"`    // Keep connections to standby resolvers in fail-rotate and fail-back groups open
+	HoldTime      int         `toml:"hold-time"`       // Minimum time in seconds a resolver stays active in fail-rotate and fail-back groups
+	MaxResetAfter int         `toml:"max-reset-after"` // Upper limit in seconds for reset-after when the first resolver in a fail-back group flaps
+
+	// Fastest group options
+	FastestCount int `toml:"fastest-count"` // Only query the N resolvers that were fastest recently, default 0 (all)
+
+	// Adaptive group options
+	ProbeRate  *float64 `toml:"probe-rate"` // Fraction of queries sent to other resolvers to measure them, default 0.05
+	Hysteresis *float64 `toml:"hysteresis"` // Fraction by which another resolver has to be better before switching, default 0.2
 
 	// Cache options
 	CacheSize                int    `toml:"cache-size"`                  // Max number of items to keep in the cache. Default 0 == unlimited
@@ -80,6 +200,9 @@ type group struct {
 	CacheAnswerShuffle       string `toml:"cache-answer-shuffle"`        // Algorithm to use for modifying the response order of cached items
 	CacheHardenBelowNXDOMAIN bool   `toml:"cache-harden-below-nxdomain"` // Return NXDOMAIN if an NXDOMAIN is cached for a parent domain
 	CacheFlushQuery          string `toml:"cache-flush-query"`           // Flush the cache when a query for this name is received
+	CacheECSScope            bool   `toml:"cache-ecs-scope"`             // Key responses by ECS network and store them for the scope returned upstream
+	CacheKeyDNSSEC           bool   `toml:"cache-key-dnssec"`            // Include the DO and CD bits of queries in the cache key
+	CachePerListener         bool   `toml:"cache-per-listener"`          // Keep separate cache entries, with their own capacity, for every listener
 
 	// Blocklist options
 	Blocklist []string // Blocklist rules, only used by "blocklist" type
@@ -98,21 +221,40 @@ type group struct {
 	AllowlistFormat   string   `toml:"allowlist-format"` // only used for static allowlists in the config
 	AllowlistSource   []list   `toml:"allowlist-source"`
 	AllowlistRefresh  int      `toml:"allowlist-refresh"`
-	LocationDB        string   `toml:"location-db"` // GeoIP database file for response blocklist. Default "/usr/share/GeoIP/GeoLite2-City.mmdb"
+	EDEText           bool     `toml:"ede-text"`           // Add the matching list and rule to extended errors in blocked responses
+	BlocklistParallel bool     `toml:"blocklist-parallel"` // Resolve queries upstream while the lists are checked
+	BlocklistCache    int      `toml:"blocklist-cache"`    // Number of recent blocklist decisions to cache, disabled if 0
+	LocationDB        string   `toml:"location-db"`        // GeoIP database file for response blocklist. Default "/usr/share/GeoIP/GeoLite2-City.mmdb"
+	ASNDB             string   `toml:"asn-db"`             // GeoIP ASN database file for matching AS numbers in location blocklists
 
 	// Static responder options
-	Answer   []string
-	NS       []string
-	Extra    []string
-	RCode    int
-	Truncate bool `toml:"truncate"` // When true, TC-Bit is set
+	Answer       []string
+	NS           []string
+	Extra        []string
+	RCode        int
+	Truncate     bool `toml:"truncate"`       // When true, TC-Bit is set
+	AnswerByType bool `toml:"answer-by-type"` // Only return answer records matching the query type
+
+	// Zone resolver options
+	ZoneFiles   []string `toml:"zone-files"`   // Zone files in RFC 1035 format, one zone per file
+	ZoneRefresh int      `toml:"zone-refresh"` // Time interval in seconds in which zone files are reloaded
 
-	// Rate-limiting options
+	// Rate-limiting options, also used by the domain-limiter
 	Requests      uint   // Number of requests allowed
 	Window        uint   // Time period in seconds for the requests
 	Prefix4       uint8  // Prefix bits to identify IPv4 client
 	Prefix6       uint8  // Prefix bits to identify IPv6 client
 	LimitResolver string `toml:"limit-resolver"` // Resolver to use when rate-limit exceeded
+	LimitAction   string `toml:"limit-action"`   // "drop", "refused" or "truncate" when rate-limit exceeded, default "drop"
+	Slip          uint   // Respond with a truncated response to every n-th rate-limited query
+	StateFile     string `toml:"state-file"` // File to persist rate-limiter counters in, not persisted if empty
+
+	// Additional rate-limiter tiers for networks of different sizes, evaluated together
+	RateLimits []rateLimit `toml:"rate-limits"`
+
+	// Concurrency limiter options, the limit-resolver is shared with the rate-limiter
+	MaxConcurrent   int `toml:"max-concurrent"`   // Number of queries in progress upstream at the same time, default 100
+	ConcurrencyWait int `toml:"concurrency-wait"` // Time in milliseconds to wait for a free slot when the limit is reached
 
 	// Fastest-TCP probe options
 	Port          int
@@ -125,6 +267,91 @@ type group struct {
 	// Truncate-Retry options
 	RetryResolver string `toml:"retry-resolver"`
 
+	// Hosts resolver options
+	HostsFiles   []string `toml:"hosts-files"`   // Files in /etc/hosts format
+	HostsRefresh int      `toml:"hosts-refresh"` // Interval in seconds in which files are checked for changes, default 10
+	HostsTTL     uint32   `toml:"hosts-ttl"`     // TTL of records in responses, default 300
+
+	// Mock resolver options
+	MockRecords []string   `toml:"mock-records"` // Records in zone-file format
+	MockDelay   int        `toml:"mock-delay"`   // Delay in milliseconds applied to all queries
+	MockRules   []mockRule `toml:"mock-rules"`
+
+	// Fault-injector options, rates are fractions between 0 and 1
+	FaultLatency      int     `toml:"fault-latency"`       // Latency added to queries in milliseconds
+	FaultLatencyRate  float64 `toml:"fault-latency-rate"`  // Rate of queries that are delayed
+	FaultTimeout      int     `toml:"fault-timeout"`       // Time in milliseconds before a simulated timeout fails, default 2000
+	FaultTimeoutRate  float64 `toml:"fault-timeout-rate"`  // Rate of queries that time out
+	FaultServfailRate float64 `toml:"fault-servfail-rate"` // Rate of queries answered with SERVFAIL
+	FaultTruncateRate float64 `toml:"fault-truncate-rate"` // Rate of queries answered with a truncated response
+
+	// Client statistics options
+	StatsFile         string `toml:"stats-file"`          // File to persist counters in, not persisted if empty
+	StatsSaveInterval int    `toml:"stats-save-interval"` // Interval in seconds in which counters are saved, default 60
+	StatsTopDomains   int    `toml:"stats-top-domains"`   // Number of query names to keep counts for, default 100
+	StatsTopClients   int    `toml:"stats-top-clients"`   // Number of client addresses to keep counts for, default 100
+
+	// Cache-probe options
+	ProbeCache string `toml:"probe-cache"` // ID of the cache to probe
+
+	// Type filter options
+	TypeFilterRules []typeFilterRule `toml:"type-filter-rules"`
+
+	// SVCB/HTTPS filter options
+	SVCBDrop       bool     `toml:"svcb-drop"`        // Remove SVCB and HTTPS records from responses
+	SVCBRemoveKeys []string `toml:"svcb-remove-keys"` // Parameters to remove from records, like "ech" or "ipv6hint"
+
+	// Query normalizer options
+	NormalizeStrict      bool   `toml:"normalize-strict"`      // Reject malformed names instead of cleaning them up
+	NormalizeUnderscores string `toml:"normalize-underscores"` // Underscore policy; allow, leading or reject
+	NormalizeAction      string `toml:"normalize-action"`      // Response to rejected queries; formerr, refused or drop
+
+	// Script options
+	ScriptRules []scriptRule `toml:"script-rules"`
+
+	// CNAME modifier options
+	CNAMEFlatten  bool                    `toml:"cname-flatten"`   // Replace CNAME chains with the final records
+	CNAMERewrite  []rdns.ReplaceOperation `toml:"cname-rewrite"`   // Regexp replacements applied to CNAME targets
+	CNAMEResolver string                  `toml:"cname-resolver"`  // Resolver used to follow chains, defaults to the group's resolver
+	CNAMEMaxDepth int                     `toml:"cname-max-depth"` // Maximum number of CNAMEs to follow, default 8
+
+	// Forward-confirmed reverse DNS options
+	FCrDNSDomains  []string `toml:"fcrdns-domains"`  // Domains for which responses are validated
+	FCrDNSBlock    bool     `toml:"fcrdns-block"`    // Respond with SERVFAIL if validation fails, otherwise only log
+	FCrDNSResolver string   `toml:"fcrdns-resolver"` // Resolver used for PTR and forward lookups, defaults to the group's resolver
+
+	// Latency budget options
+	LatencyBudget      int    `toml:"latency-budget"`        // Time in milliseconds to wait for a response before responding early
+	LatencyStale       bool   `toml:"latency-stale"`         // Respond with the last response for the query instead of SERVFAIL
+	LatencyStaleTTL    uint32 `toml:"latency-stale-ttl"`     // TTL of records in stale responses, default 30
+	LatencyStaleMaxAge int    `toml:"latency-stale-max-age"` // Maximum age in seconds of stale responses, default 86400
+	LatencyStaleSize   int    `toml:"latency-stale-size"`    // Number of responses kept for stale responses, default 10000
+
+	// NAT reflection options
+	NATRules   []natRule `toml:"nat-rules"`
+	NATClients []string  `toml:"nat-clients"` // Networks of clients inside the network, all if empty
+
+	// IPv6 prefix rewrite options
+	PrefixRewrite                []prefixRule `toml:"prefix-rewrite"`
+	PrefixRewriteClients         []string     `toml:"prefix-rewrite-clients"`          // Client networks that get translated addresses, all if empty
+	PrefixRewriteChecksumNeutral bool         `toml:"prefix-rewrite-checksum-neutral"` // Translate like NPTv6 (RFC 6296)
+
+	// DNSSEC policy options
+	DNSSECAction  string   `toml:"dnssec-action"`  // "strip" (default) or "refuse"
+	DNSSECClients []string `toml:"dnssec-clients"` // Client networks the policy applies to, all if empty
+
+	// Tee options
+	TeeResolver    string  `toml:"tee-resolver"`     // Resolver that receives copies of the queries
+	TeeSampleRate  float64 `toml:"tee-sample-rate"`  // Fraction of queries to mirror, default 1 (all)
+	TeeMaxInFlight int     `toml:"tee-max-inflight"` // Maximum number of mirrored queries in flight, default 100
+
+	// Query log options
+	LogFile       string  `toml:"log-file"`        // File to write query records to
+	LogFormat     string  `toml:"log-format"`      // "json" or "tsv", default "json"
+	LogMaxSize    int64   `toml:"log-max-size"`    // Size in MB at which the file is rotated, default 100
+	LogMaxFiles   int     `toml:"log-max-files"`   // Number of rotated files to keep, default 5
+	LogSampleRate float64 `toml:"log-sample-rate"` // Fraction of queries to log in query-log and syslog, default 1 (all)
+
 	// Syslog options
 	Network     string `toml:"network"`  // "udp", "tcp", "unix"
 	Address     string `toml:"address"`  // Endpoint address, defaults to local syslog server
@@ -135,16 +362,87 @@ type group struct {
 	Verbose     bool   `toml:"verbose"`      // When logging responses, include types that don't match the query type
 }
 
+// Health check options for failover groups
+type healthCheck struct {
+	Interval int    // Time in seconds between test queries, disabled if 0
+	Name     string // Query name, default "."
+	Type     string // Query type, default "NS"
+}
+
+// Script group rule
+type scriptRule struct {
+	If       string   // Condition, the rule always applies if empty
+	On       string   // "query" or "response", default "query"
+	Action   string   // "pass", "drop", "route", "rcode", "answer" or "ttl"
+	Resolver string   // Resolver for the "route" action
+	RCode    int      // Response code for the "rcode" and "answer" actions
+	Records  []string // Records in zone-file format for the "answer" action
+	TTL      uint32   // TTL for the "ttl" action
+}
+
+// TTL-modifier rule
+type ttlRule struct {
+	If     string // Condition in script group syntax, the rule always applies if empty
+	TTL    uint32 // TTL to set on all records
+	TTLMin uint32 `toml:"ttl-min"` // TTL minimum, if TTL isn't set
+	TTLMax uint32 `toml:"ttl-max"` // TTL maximum, if TTL isn't set
+}
+
+// Type filter rule
+// Mapping of a public to an internal address in NAT reflection groups
+type natRule struct {
+	Public   string   // Public address in responses
+	Internal string   // Internal address to respond with instead
+	Domains  []string // Only apply the rule to these domains and their sub-domains, optional
+}
+
+// Pair of IPv6 prefixes of the same length in prefix-rewrite groups
+type prefixRule struct {
+	From string
+	To   string
+}
+
+type typeFilterRule struct {
+	Types       []string // Query types, like "ANY" or "AAAA", all types if empty
+	ReverseNets []string `toml:"reverse-nets"` // Only match reverse lookups for addresses in these networks
+	Action      string   // "nodata", "rcode" or "drop", default "nodata"
+	RCode       int      // Response code for the "rcode" action
+}
+
+// Rate-limiter tier
+type rateLimit struct {
+	Requests uint
+	Prefix4  uint8
+	Prefix6  uint8
+}
+
+// Mock resolver rule, delay is in milliseconds
+type mockRule struct {
+	Name  string
+	Type  string
+	Count int
+	Delay int
+	Error bool
+	RCode int
+}
+
 // Block/Allowlist items for blocklist-v2
 type list struct {
 	Name     string
+	Category string // Added to matches, shown in logs and extended errors and passed to the blocklist-resolver
 	Format   string
 	Source   string
 	CacheDir string `toml:"cache-dir"` // Where to store copies of remote blocklists for faster startup
+
+	// HTTP options for remote lists
+	UserAgent string            `toml:"user-agent"` // Defaults to "routedns/<version>"
+	Headers   map[string]string // Additional request headers, like "Authorization"
+	Timeout   int               // Time in seconds after which a download is aborted, default 1800
 }
 
 type router struct {
-	Routes []route
+	Routes  []route
+	NoMatch string `toml:"no-match"` // Response if no route matches, "error" (default), "refused", "nxdomain", or "drop"
 }
 
 type route struct {
@@ -152,38 +450,132 @@ type route struct {
 	Types         []string
 	Class         string
 	Name          string
+	Domains       []string // Domains and their sub-domains this route applies to, indexed for fast lookup
 	Source        string
 	Weekdays      []string // 'mon', 'tue', 'wed', 'thu', 'fri', 'sat', 'sun'
 	After, Before string   // Hour:Minute in 24h format, for example "14:30"
 	Invert        bool     // Invert the result of the match
-	DoHPath       string   `toml:"doh-path"` // DoH query path if received over DoH (regexp)
+	DoHPath       string   `toml:"doh-path"`        // DoH query path if received over DoH (regexp)
+	Listener      string   `toml:"listener"`        // ID of the listener that received the query (regexp)
+	TLSClientName string   `toml:"tls-client-name"` // Common name or SAN in the client certificate when using mutual TLS (regexp)
+	CacheState    string   `toml:"cache-state"`     // "hit" or "miss", requires a cache-probe before the router
+	ClientAuth    string   `toml:"client-auth"`     // "authenticated" for clients with a verified certificate, or "anonymous"
+	ClientPercent *float64 `toml:"client-percent"`  // Percentage of clients, selected by a hash of their address
+	ClientSalt    string   `toml:"client-salt"`     // Changes which clients are selected by client-percent
 	Resolver      string
 }
 
-// LoadConfig reads a config file and returns the decoded structure.
+// Loads the configuration from one or more files. Every file is decoded on its
+// own and merged into the result, so errors refer to the correct file and line.
+// Elements and top-level options can only be defined in one file, definitions
+// in more than one are reported as conflicts rather than one overriding the
+// other. The configuration is only returned if all files load without error.
 func loadConfig(name ...string) (config, error) {
-	b := new(bytes.Buffer)
-	var c config
+	c := config{sources: make(map[string]string)}
 	for _, fn := range name {
-		if err := loadFile(b, fn); err != nil {
-			return c, err
+		var fc config
+		md, err := toml.DecodeFile(fn, &fc)
+		if err != nil {
+			return config{}, fmt.Errorf("%s: %w", fn, err)
+		}
+		if err := c.merge(fn, fc, md); err != nil {
+			return config{}, err
+		}
+	}
+	return c, nil
+}
+
+// Adds the definitions from a file to the configuration. Maps are merged by
+// key, all other fields are copied if they're set in the file.
+func (c *config) merge(file string, fc config, md toml.MetaData) error {
+	dst := reflect.ValueOf(c).Elem()
+	src := reflect.ValueOf(fc)
+	for i := 0; i < dst.NumField(); i++ {
+		f := dst.Type().Field(i)
+		if f.PkgPath != "" { // Unexported
+			continue
+		}
+		key := tomlKey(f)
+		if f.Type.Kind() != reflect.Map {
+			if !isDefined(md, key) {
+				continue
+			}
+			if prev, ok := c.sources[key]; ok {
+				return fmt.Errorf("%s: '%s' is already defined in %s", file, key, prev)
+			}
+			c.sources[key] = file
+			dst.Field(i).Set(src.Field(i))
+			continue
+		}
+		if src.Field(i).Len() == 0 {
+			continue
+		}
+		if dst.Field(i).IsNil() {
+			dst.Field(i).Set(reflect.MakeMap(f.Type))
+		}
+		iter := src.Field(i).MapRange()
+		for iter.Next() {
+			id := iter.Key().String()
+			if prev, ok := c.sources[key+"."+id]; ok {
+				return fmt.Errorf("%s: %s '%s' is already defined in %s", file, singular(key), id, prev)
+			}
+			// Resolvers, groups and routers share the same IDs
+			if section := c.elementSection(id); section != "" && isElementSection(key) {
+				return fmt.Errorf("%s: %s '%s' conflicts with %s '%s' in %s", file, singular(key), id, singular(section), id, c.sources[section+"."+id])
+			}
+			c.sources[key+"."+id] = file
+			dst.Field(i).SetMapIndex(iter.Key(), iter.Value())
+		}
+	}
+	return nil
+}
+
+// Returns the section ("resolvers", "groups" or "routers") an element is
+// defined in, or an empty string if it's not defined.
+func (c config) elementSection(id string) string {
+	for _, section := range []string{"resolvers", "groups", "routers"} {
+		if _, ok := c.sources[section+"."+id]; ok {
+			return section
 		}
-		b.WriteString("\n")
 	}
-	_, err := toml.DecodeReader(b, &c)
-	return c, err
+	return ""
 }
 
-func loadFile(w io.Writer, name string) error {
-	f, err := os.Open(name)
-	if err != nil {
-		return err
+// Adds the file an element is defined in to an error.
+func (c config) withSource(section, id string, err error) error {
+	if file, ok := c.sources[section+"."+id]; ok {
+		return fmt.Errorf("%s: %w", file, err)
 	}
-	defer f.Close()
-	_, err = io.Copy(w, f)
 	return err
 }
 
+func isElementSection(key string) bool {
+	return key == "resolvers" || key == "groups" || key == "routers"
+}
+
+func singular(section string) string {
+	return strings.TrimSuffix(section, "s")
+}
+
+// Returns the key of a field in the config file. Keys are matched without
+// regard to case, like the decoder does.
+func tomlKey(f reflect.StructField) string {
+	if tag := f.Tag.Get("toml"); tag != "" {
+		return strings.Split(tag, ",")[0]
+	}
+	return strings.ToLower(f.Name)
+}
+
+// Returns true if a top-level key is set in a file.
+func isDefined(md toml.MetaData, key string) bool {
+	for _, k := range md.Keys() {
+		if len(k) > 0 && strings.EqualFold(k[0], key) {
+			return true
+		}
+	}
+	return false
+}
+
 func parseCIDRList(networks []string) ([]*net.IPNet, error) {
 	var out []*net.IPNet
 	for _, s := range networks {
@@ -1,23 +1,29 @@
 package main
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
 	"net/url"
 	"os"
+	"strings"
 	"time"
 
+	"github.com/BurntSushi/toml"
 	syslog "github.com/RackSec/srslog"
 	rdns "github.com/folbricht/routedns"
 	"github.com/heimdalr/dag"
+	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
 type options struct {
-	logLevel uint32
-	version  bool
+	logLevel  uint32
+	version   bool
+	tlsKeyLog string
+	handoff   string
 }
 
 func main() {
@@ -50,6 +56,11 @@ arguments.
 
 	cmd.Flags().Uint32VarP(&opt.logLevel, "log-level", "l", 4, "log level; 0=None .. 6=Trace")
 	cmd.Flags().BoolVarP(&opt.version, "version", "v", false, "Prints code version string")
+	cmd.Flags().StringVar(&opt.tlsKeyLog, "tls-key-log", "", "Write TLS session keys to this file, for debugging only")
+	cmd.Flags().StringVar(&opt.handoff, "handoff-socket", "", "Unix socket to take over listeners and caches from a running instance, and to hand them over to the next")
+
+	cmd.AddCommand(newCheckCommand())
+	cmd.AddCommand(newRaceCommand())
 
 	if err := cmd.Execute(); err != nil {
 		os.Exit(1)
@@ -84,11 +95,70 @@ func start(opt options, args []string) error {
 	}
 	rdns.Log.SetLevel(logrus.Level(opt.logLevel))
 
+	// Log TLS session keys if requested. Only meant for debugging, it allows
+	// anyone with access to the file to decrypt the traffic.
+	if opt.tlsKeyLog != "" {
+		f, err := os.OpenFile(opt.tlsKeyLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to open tls key log: %w", err)
+		}
+		defer f.Close()
+		rdns.TLSKeyLogWriter = f
+		rdns.Log.WithField("file", opt.tlsKeyLog).Warn("logging tls session keys, connections are not secure")
+	}
+
 	config, err := loadConfig(args...)
 	if err != nil {
 		return err
 	}
+	rdns.SetLabels(config.Labels)
+	if config.RandomSeed != 0 {
+		rdns.SetRandomSeed(config.RandomSeed)
+	}
+
+	// Take over the sockets and caches of a running instance, if there is one
+	var handoff *rdns.Handoff
+	if opt.handoff != "" {
+		rdns.EnableHandoff()
+		handoff, err = rdns.ReceiveHandoff(opt.handoff)
+		if err != nil {
+			return fmt.Errorf("failed to receive handoff: %w", err)
+		}
+	}
+
+	listeners, watchdog, err := instantiate(config)
+	if err != nil {
+		return err
+	}
+	if watchdog != nil {
+		watchdog.Start()
+	}
+	listeners.Start()
 
+	if opt.handoff != "" {
+		if handoff != nil {
+			// The listeners are running at this point, keep going even if the
+			// previous instance doesn't respond
+			if err := handoff.Complete(); err != nil {
+				rdns.Log.WithError(err).Warn("failed to complete handoff")
+			}
+		}
+		go func() {
+			err := rdns.ServeHandoff(opt.handoff, rdns.HandoffOptions{Listeners: listeners})
+			if err != nil {
+				rdns.Log.WithError(err).Error("failed to listen for handoff")
+				return
+			}
+			os.Exit(0)
+		}()
+	}
+
+	select {}
+}
+
+// Instantiates all elements and listeners in the configuration, and the
+// watchdog if one is configured. They are returned without being started.
+func instantiate(config config) (*rdns.ListenerSet, *rdns.Watchdog, error) {
 	// Map to hold all the resolvers extracted from the config, key'ed by resolver ID. It
 	// holds configured resolvers, groups, as well as routers (since they all implement
 	// rdns.Resolver)
@@ -99,42 +169,36 @@ func start(opt options, args []string) error {
 	// for all other entities to use.
 	if config.BootstrapResolver.Address != "" {
 		if err := instantiateResolver("bootstrap-resolver", config.BootstrapResolver, resolvers); err != nil {
-			return fmt.Errorf("failed to instantiate bootstrap-resolver: %w", err)
+			err = fmt.Errorf("failed to instantiate bootstrap-resolver: %w", err)
+			if file, ok := config.sources["bootstrap-resolver"]; ok {
+				err = fmt.Errorf("%s: %w", file, err)
+			}
+			return nil, nil, err
 		}
 		net.DefaultResolver = rdns.NewNetResolver(resolvers["bootstrap-resolver"])
 	}
 	// Add all types of nodes to a DAG, this is to find duplicates. Then populate the edges (dependencies).
 	graph := dag.NewDAG()
-	edges := make(map[string][]string)
+	edges := configEdges(config)
 	for id, v := range config.Resolvers {
 		node := &Node{id, v}
 		_, err := graph.AddVertex(node)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 	}
 	for id, v := range config.Groups {
 		node := &Node{id, v}
 		_, err := graph.AddVertex(node)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
-		edges[id] = append(v.Resolvers, v.AllowListResolver, v.BlockListResolver, v.LimitResolver, v.RetryResolver)
 	}
 	for id, v := range config.Routers {
 		node := &Node{id, v}
 		_, err := graph.AddVertex(node)
 		if err != nil {
-			return err
-		}
-		// One router can have multiple edges to the same resolver.
-		// Dedup them before adding to the list of edges.
-		dep := make(map[string]struct{})
-		for _, route := range v.Routes {
-			dep[route.Resolver] = struct{}{}
-		}
-		for r := range dep {
-			edges[id] = append(edges[id], r)
+			return nil, nil, err
 		}
 	}
 	// Add the edges to the DAG. This will fail if there are duplicate edges, recursion or missing nodes
@@ -144,7 +208,7 @@ func start(opt options, args []string) error {
 				continue
 			}
 			if err := graph.AddEdge(id, e); err != nil {
-				return err
+				return nil, nil, config.withSource(config.elementSection(id), id, err)
 			}
 		}
 	}
@@ -156,132 +220,354 @@ func start(opt options, args []string) error {
 			node := v.(*Node)
 			if r, ok := node.value.(resolver); ok {
 				if err := instantiateResolver(id, r, resolvers); err != nil {
-					return err
+					return nil, nil, config.withSource("resolvers", id, err)
 				}
 			}
 			if g, ok := node.value.(group); ok {
 				if err := instantiateGroup(id, g, resolvers); err != nil {
-					return err
+					return nil, nil, config.withSource("groups", id, err)
 				}
 			}
 			if r, ok := node.value.(router); ok {
 				if err := instantiateRouter(id, r, resolvers); err != nil {
-					return err
+					return nil, nil, config.withSource("routers", id, err)
 				}
 			}
 			if err := graph.DeleteVertex(id); err != nil {
-				return err
+				return nil, nil, err
 			}
 		}
 	}
 
 	// Build the Listeners last as they can point to routers, groups or resolvers directly.
-	var listeners []rdns.Listener
-	for id, l := range config.Listeners {
-		resolver, ok := resolvers[l.Resolver]
-		// All Listeners should route queries (except the admin service).
-		if !ok && l.Protocol != "admin" {
-			return fmt.Errorf("listener '%s' references non-existant resolver, group or router '%s'", id, l.Resolver)
+	// More listeners can be added through the admin service at runtime, defined the
+	// same way as in the config file.
+	var listeners *rdns.ListenerSet
+	listeners = rdns.NewListenerSet(func(id string, definition []byte) (rdns.Listener, error) {
+		var l listener
+		md, err := toml.Decode(string(definition), &l)
+		if err != nil {
+			return nil, err
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return nil, fmt.Errorf("listener '%s': unknown option '%s'", id, undecoded[0])
 		}
-		allowedNet, err := parseCIDRList(l.AllowedNet)
+		// Audit logs write to arbitrary files, they can only be set up in the config file
+		if l.AuditLog != "" || l.AuditLogMaxSize != 0 || l.AuditLogMaxFiles != 0 {
+			return nil, fmt.Errorf("listener '%s': audit-log options can not be set at runtime", id)
+		}
+		return instantiateListener(id, l, resolvers, listeners)
+	})
+	for id, l := range config.Listeners {
+		ln, err := instantiateListener(id, l, resolvers, listeners)
 		if err != nil {
-			return err
+			return nil, nil, config.withSource("listeners", id, err)
+		}
+		if err := listeners.Add(ln); err != nil {
+			return nil, nil, err
+		}
+	}
+	if config.Watchdog == nil {
+		return listeners, nil, nil
+	}
+	return listeners, instantiateWatchdog(*config.Watchdog, resolvers), nil
+}
+
+// Instantiates the watchdog. With flush-caches, all caches are flushed when the
+// heap limit is exceeded.
+func instantiateWatchdog(w watchdog, resolvers map[string]rdns.Resolver) *rdns.Watchdog {
+	opt := rdns.WatchdogOptions{
+		Interval:      time.Duration(w.Interval) * time.Second,
+		MaxHeap:       w.MaxHeap << 20,
+		MaxGoroutines: w.MaxGoroutines,
+		MaxFDs:        w.MaxFDs,
+		LowWater:      w.LowWater,
+		ShedLoad:      w.ShedLoad,
+	}
+	if w.FlushCaches {
+		for _, r := range resolvers {
+			if c, ok := r.(*rdns.Cache); ok {
+				opt.Caches = append(opt.Caches, c)
+			}
 		}
+	}
+	return rdns.NewWatchdog(opt)
+}
+
+// Instantiates a listener. It's returned without being started.
+func instantiateListener(id string, l listener, resolvers map[string]rdns.Resolver, listeners *rdns.ListenerSet) (_ rdns.Listener, err error) {
+	resolver, ok := resolvers[l.Resolver]
+	// All Listeners should route queries (except the admin and block page services,
+	// and listeners that only answer health-checks).
+	if !ok && l.Protocol != "admin" && l.Protocol != "block-page" && (l.Resolver != "" || l.HealthName == "") {
+		return nil, fmt.Errorf("listener '%s' references non-existant resolver, group or router '%s'", id, l.Resolver)
+	}
+	if l.HealthName != "" {
+		if l.Protocol == "admin" || l.Protocol == "block-page" {
+			return nil, fmt.Errorf("listener '%s': health-name is not supported for protocol '%s'", id, l.Protocol)
+		}
+		resolver = rdns.NewHealthResponder(id, resolver, rdns.HealthResponderOptions{Name: l.HealthName})
+	}
+	allowedNet, err := parseCIDRList(l.AllowedNet)
+	if err != nil {
+		return nil, err
+	}
+
+	queryPolicy, err := parseQueryPolicy(l.QueryPolicy)
+	if err != nil {
+		return nil, fmt.Errorf("listener '%s': %w", id, err)
+	}
+
+	if l.Sockets > 1 && l.Protocol != "udp" {
+		return nil, fmt.Errorf("listener '%s': sockets is only supported for protocol 'udp'", id)
+	}
+	if l.ProxyProtocol && l.Protocol != "tcp" && l.Protocol != "dot" && !(l.Protocol == "doh" && l.Transport != "quic") {
+		return nil, fmt.Errorf("listener '%s': proxy-protocol is only supported for protocols 'tcp', 'dot' and 'doh' over tcp", id)
+	}
+	proxyProtocolTrusted, err := parseCIDRList(l.ProxyProtocolTrusted)
+	if err != nil {
+		return nil, err
+	}
+	if l.Freebind && (l.Protocol == "doq" || l.Protocol == "dtls" || l.Transport == "quic") {
+		return nil, fmt.Errorf("listener '%s': freebind is not supported for quic and dtls", id)
+	}
+
+	opt := rdns.ListenOptions{
+		AllowedNet:         allowedNet,
+		DisableCaseRestore: l.DisableCaseRestore,
+		QueryPolicy:        queryPolicy,
+		Compliance: rdns.Compliance{
+			Strict:             l.Compliance.Strict,
+			TolerateMissingOPT: l.Compliance.TolerateMissingOPT,
+			PassUnknownVersion: l.Compliance.PassUnknownVersion,
+		},
 
-		opt := rdns.ListenOptions{AllowedNet: allowedNet}
+		ProxyProtocol:        l.ProxyProtocol,
+		ProxyProtocolTrusted: proxyProtocolTrusted,
 
+		Freebind: l.Freebind,
+	}
+
+	if l.AuditLog != "" {
 		switch l.Protocol {
-		case "tcp":
-			l.Address = rdns.AddressWithDefault(l.Address, rdns.PlainDNSPort)
-			listeners = append(listeners, rdns.NewDNSListener(id, l.Address, "tcp", opt, resolver))
-		case "udp":
-			l.Address = rdns.AddressWithDefault(l.Address, rdns.PlainDNSPort)
-			listeners = append(listeners, rdns.NewDNSListener(id, l.Address, "udp", opt, resolver))
-		case "admin":
-			tlsConfig, err := rdns.TLSServerConfig(l.CA, l.ServerCrt, l.ServerKey, l.MutualTLS)
+		case "admin", "block-page", "dnstap":
+			return nil, fmt.Errorf("listener '%s': audit-log is not supported for protocol '%s'", id, l.Protocol)
+		}
+		protocol := l.Protocol
+		if l.Protocol == "doh" && l.Transport == "quic" {
+			protocol = "doh-quic"
+		}
+		opt.Audit, err = rdns.NewAuditLog(id, protocol, rdns.AuditLogOptions{
+			File:     l.AuditLog,
+			MaxSize:  l.AuditLogMaxSize << 20,
+			MaxFiles: l.AuditLogMaxFiles,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("listener '%s': %w", id, err)
+		}
+		// Close the audit log if the listener can't be created
+		defer func() {
 			if err != nil {
-				return err
+				_ = opt.Audit.Close()
 			}
-			opt := rdns.AdminListenerOptions{
-				TLSConfig:     tlsConfig,
-				ListenOptions: opt,
-				Transport:     l.Transport,
-			}
-			ln, err := rdns.NewAdminListener(id, l.Address, opt)
-			if err != nil {
-				return err
+		}()
+	}
+
+	switch l.Protocol {
+	case "tcp":
+		l.Address = rdns.AddressWithDefault(l.Address, rdns.PlainDNSPort)
+		return rdns.NewDNSListener(id, l.Address, "tcp", opt, resolver), nil
+	case "udp":
+		l.Address = rdns.AddressWithDefault(l.Address, rdns.PlainDNSPort)
+		dnsOpt := rdns.DNSListenerOptions{
+			ListenOptions: opt,
+			Sockets:       l.Sockets,
+		}
+		return rdns.NewDNSListenerWithOptions(id, l.Address, "udp", dnsOpt, resolver), nil
+	case "admin":
+		tlsConfig, err := rdns.TLSServerConfig(l.CA, l.ServerCrt, l.ServerKey, l.MutualTLS)
+		if err != nil {
+			return nil, err
+		}
+		// Make all caches, blocklists and statistics, and all elements for resolving
+		// names, available through the admin service
+		caches := make(map[string]*rdns.Cache)
+		blocklists := make(map[string]*rdns.Blocklist)
+		ipBlocklists := make(map[string]rdns.IPBlocklistTester)
+		stats := make(map[string]*rdns.ClientStats)
+		for id, r := range resolvers {
+			switch r := r.(type) {
+			case *rdns.Cache:
+				caches[id] = r
+			case *rdns.Blocklist:
+				blocklists[id] = r
+			case *rdns.ResponseBlocklistIP:
+				ipBlocklists[id] = r
+			case *rdns.ClientBlocklist:
+				ipBlocklists[id] = r
+			case *rdns.ClientStats:
+				stats[id] = r
 			}
-			listeners = append(listeners, ln)
-		case "dot":
-			l.Address = rdns.AddressWithDefault(l.Address, rdns.DoTPort)
-			tlsConfig, err := rdns.TLSServerConfig(l.CA, l.ServerCrt, l.ServerKey, l.MutualTLS)
+		}
+		opt := rdns.AdminListenerOptions{
+			TLSConfig:     tlsConfig,
+			ListenOptions: opt,
+			Transport:     l.Transport,
+			Caches:        caches,
+			Blocklists:    blocklists,
+			IPBlocklists:  ipBlocklists,
+			Stats:         stats,
+			Resolvers:     resolvers,
+			AuthToken:     l.AdminToken,
+			Listeners:     listeners,
+		}
+		ln, err := rdns.NewAdminListener(id, l.Address, opt)
+		if err != nil {
+			return nil, err
+		}
+		return ln, nil
+	case "block-page":
+		// Plain HTTP on port 80, unless a certificate is configured
+		var tlsConfig *tls.Config
+		port := "80"
+		if l.ServerCrt != "" || l.ServerKey != "" {
+			port = rdns.DoHPort
+			tlsConfig, err = rdns.TLSServerConfig(l.CA, l.ServerCrt, l.ServerKey, l.MutualTLS)
 			if err != nil {
-				return err
+				return nil, err
 			}
-			ln := rdns.NewDoTListener(id, l.Address, rdns.DoTListenerOptions{TLSConfig: tlsConfig, ListenOptions: opt}, resolver)
-			listeners = append(listeners, ln)
-		case "dtls":
-			l.Address = rdns.AddressWithDefault(l.Address, rdns.DTLSPort)
-			dtlsConfig, err := rdns.DTLSServerConfig(l.CA, l.ServerCrt, l.ServerKey, l.MutualTLS)
-			if err != nil {
-				return err
+		}
+		var blocklists []*rdns.Blocklist
+		for _, blocklistID := range l.Blocklists {
+			blocklist, ok := resolvers[blocklistID].(*rdns.Blocklist)
+			if !ok {
+				return nil, fmt.Errorf("listener '%s' references non-existant blocklist '%s'", id, blocklistID)
 			}
-			ln := rdns.NewDTLSListener(id, l.Address, rdns.DTLSListenerOptions{DTLSConfig: dtlsConfig, ListenOptions: opt}, resolver)
-			listeners = append(listeners, ln)
-		case "doh":
-			if l.Transport != "quic" {
-				l.Address = rdns.AddressWithDefault(l.Address, rdns.DoHPort)
-			} else if l.Transport == "quic" {
-				l.Address = rdns.AddressWithDefault(l.Address, rdns.DohQuicPort)
+			blocklists = append(blocklists, blocklist)
+		}
+		// Allowed names are removed from all caches
+		var caches []*rdns.Cache
+		for _, r := range resolvers {
+			if cache, ok := r.(*rdns.Cache); ok {
+				caches = append(caches, cache)
 			}
-			tlsConfig, err := rdns.TLSServerConfig(l.CA, l.ServerCrt, l.ServerKey, l.MutualTLS)
+		}
+		l.Address = rdns.AddressWithDefault(l.Address, port)
+		opt := rdns.BlockPageListenerOptions{
+			ListenOptions: opt,
+			Blocklists:    blocklists,
+			Caches:        caches,
+			AllowDuration: time.Duration(l.AllowDuration) * time.Second,
+			TLSConfig:     tlsConfig,
+		}
+		ln, err := rdns.NewBlockPageListener(id, l.Address, opt)
+		if err != nil {
+			return nil, fmt.Errorf("listener '%s': %w", id, err)
+		}
+		return ln, nil
+	case "dot":
+		l.Address = rdns.AddressWithDefault(l.Address, rdns.DoTPort)
+		tlsConfig, err := rdns.TLSServerConfig(l.CA, l.ServerCrt, l.ServerKey, l.MutualTLS)
+		if err != nil {
+			return nil, err
+		}
+		ln := rdns.NewDoTListener(id, l.Address, rdns.DoTListenerOptions{TLSConfig: tlsConfig, ListenOptions: opt}, resolver)
+		return ln, nil
+	case "dtls":
+		l.Address = rdns.AddressWithDefault(l.Address, rdns.DTLSPort)
+		dtlsConfig, err := rdns.DTLSServerConfig(l.CA, l.ServerCrt, l.ServerKey, l.MutualTLS)
+		if err != nil {
+			return nil, err
+		}
+		ln := rdns.NewDTLSListener(id, l.Address, rdns.DTLSListenerOptions{DTLSConfig: dtlsConfig, ListenOptions: opt}, resolver)
+		return ln, nil
+	case "doh":
+		if l.Transport != "quic" {
+			l.Address = rdns.AddressWithDefault(l.Address, rdns.DoHPort)
+		} else if l.Transport == "quic" {
+			l.Address = rdns.AddressWithDefault(l.Address, rdns.DohQuicPort)
+		}
+		tlsConfig, err := rdns.TLSServerConfig(l.CA, l.ServerCrt, l.ServerKey, l.MutualTLS)
+		if err != nil {
+			return nil, err
+		}
+		var httpProxyNet *net.IPNet
+		if l.Frontend.HTTPProxyNet != "" {
+			_, httpProxyNet, err = net.ParseCIDR(l.Frontend.HTTPProxyNet)
 			if err != nil {
-				return err
-			}
-			var httpProxyNet *net.IPNet
-			if l.Frontend.HTTPProxyNet != "" {
-				_, httpProxyNet, err = net.ParseCIDR(l.Frontend.HTTPProxyNet)
-				if err != nil {
-					return fmt.Errorf("listener '%s' trusted-proxy '%s': %v", id, l.Frontend.HTTPProxyNet, err)
-				}
-			}
-			opt := rdns.DoHListenerOptions{
-				TLSConfig:     tlsConfig,
-				ListenOptions: opt,
-				Transport:     l.Transport,
-				HTTPProxyNet:  httpProxyNet,
+				return nil, fmt.Errorf("listener '%s' trusted-proxy '%s': %v", id, l.Frontend.HTTPProxyNet, err)
 			}
-			ln, err := rdns.NewDoHListener(id, l.Address, opt, resolver)
+		}
+		var httpProxyNets []*net.IPNet
+		for _, s := range l.Frontend.HTTPProxyNets {
+			_, n, err := net.ParseCIDR(s)
 			if err != nil {
-				return err
+				return nil, fmt.Errorf("listener '%s' trusted-proxies '%s': %v", id, s, err)
 			}
-			listeners = append(listeners, ln)
-		case "doq":
-			l.Address = rdns.AddressWithDefault(l.Address, rdns.DoQPort)
+			httpProxyNets = append(httpProxyNets, n)
+		}
+		opt := rdns.DoHListenerOptions{
+			TLSConfig:     tlsConfig,
+			ListenOptions: opt,
+			Transport:     l.Transport,
+			HTTPProxyNet:  httpProxyNet,
+			HTTPProxyNets: httpProxyNets,
 
-			tlsConfig, err := rdns.TLSServerConfig(l.CA, l.ServerCrt, l.ServerKey, l.MutualTLS)
-			if err != nil {
-				return err
-			}
-			ln := rdns.NewQUICListener(id, l.Address, rdns.DoQListenerOptions{TLSConfig: tlsConfig, ListenOptions: opt}, resolver)
-			listeners = append(listeners, ln)
+			ClientIPHeaders: l.Frontend.ClientIPHeaders,
+			Compression:     l.Frontend.Compression,
+		}
+		ln, err := rdns.NewDoHListener(id, l.Address, opt, resolver)
+		if err != nil {
+			return nil, err
+		}
+		return ln, nil
+	case "doq":
+		l.Address = rdns.AddressWithDefault(l.Address, rdns.DoQPort)
+
+		tlsConfig, err := rdns.TLSServerConfig(l.CA, l.ServerCrt, l.ServerKey, l.MutualTLS)
+		if err != nil {
+			return nil, err
+		}
+		ln := rdns.NewQUICListener(id, l.Address, rdns.DoQListenerOptions{TLSConfig: tlsConfig, ListenOptions: opt}, resolver)
+		return ln, nil
+	case "dnstap":
+		if l.Address == "" {
+			return nil, fmt.Errorf("listener '%s': dnstap requires an address", id)
+		}
+		switch l.Transport {
+		case "", "tcp", "unix":
 		default:
-			return fmt.Errorf("unsupported protocol '%s' for listener '%s'", l.Protocol, id)
+			return nil, fmt.Errorf("listener '%s': unsupported transport '%s' for dnstap", id, l.Transport)
 		}
+		ln := rdns.NewDnstapListener(id, l.Address, rdns.DnstapListenerOptions{ListenOptions: opt, Network: l.Transport}, resolver)
+		return ln, nil
+	default:
+		return nil, fmt.Errorf("unsupported protocol '%s' for listener '%s'", l.Protocol, id)
 	}
+}
 
-	// Start the listeners
-	for _, l := range listeners {
-		go func(l rdns.Listener) {
-			for {
-				err := l.Start()
-				rdns.Log.WithError(err).Error("listener failed")
-				time.Sleep(time.Second)
-			}
-		}(l)
+// Returns the IDs of the resolvers, groups and routers each group and router
+// depends on. IDs can be repeated or empty.
+func configEdges(config config) map[string][]string {
+	edges := make(map[string][]string)
+	for id, v := range config.Groups {
+		edges[id] = append(v.Resolvers, v.AllowListResolver, v.BlockListResolver, v.LimitResolver, v.RetryResolver, v.CNAMEResolver, v.FCrDNSResolver, v.TeeResolver, v.ProbeCache)
+		for _, rule := range v.ScriptRules {
+			edges[id] = append(edges[id], rule.Resolver)
+		}
 	}
-
-	select {}
+	for id, v := range config.Routers {
+		// One router can have multiple edges to the same resolver.
+		// Dedup them before adding to the list of edges.
+		dep := make(map[string]struct{})
+		for _, route := range v.Routes {
+			dep[route.Resolver] = struct{}{}
+		}
+		for r := range dep {
+			edges[id] = append(edges[id], r)
+		}
+	}
+	return edges
 }
 
 // Instantiate a group object based on configuration and add to the map of resolvers by ID.
@@ -299,21 +585,46 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 	case "round-robin":
 		resolvers[id] = rdns.NewRoundRobin(id, gr...)
 	case "fail-rotate":
+		healthCheck, err := parseHealthCheck(g.HealthCheck)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
 		opt := rdns.FailRotateOptions{
 			ServfailError: g.ServfailError,
+			HealthCheck:   healthCheck,
+			WarmStandby:   g.WarmStandby,
+			HoldTime:      time.Duration(g.HoldTime) * time.Second,
 		}
 		resolvers[id] = rdns.NewFailRotate(id, opt, gr...)
 	case "fail-back":
+		healthCheck, err := parseHealthCheck(g.HealthCheck)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
 		opt := rdns.FailBackOptions{
-			ResetAfter:    time.Duration(g.ResetAfter),
+			ResetAfter:    time.Duration(g.ResetAfter) * time.Second,
 			ServfailError: g.ServfailError,
+			HealthCheck:   healthCheck,
+			WarmStandby:   g.WarmStandby,
+			HoldTime:      time.Duration(g.HoldTime) * time.Second,
+			MaxResetAfter: time.Duration(g.MaxResetAfter) * time.Second,
 		}
 		resolvers[id] = rdns.NewFailBack(id, opt, gr...)
 	case "fastest":
-		resolvers[id] = rdns.NewFastest(id, gr...)
+		opt := rdns.FastestOptions{
+			Count: g.FastestCount,
+		}
+		resolvers[id] = rdns.NewFastestWithOptions(id, opt, gr...)
+	case "adaptive":
+		opt := rdns.AdaptiveOptions{
+			ProbeRate:     g.ProbeRate,
+			Hysteresis:    g.Hysteresis,
+			ServfailError: g.ServfailError,
+		}
+		resolvers[id] = rdns.NewAdaptive(id, opt, gr...)
 	case "random":
 		opt := rdns.RandomOptions{
-			ResetAfter:    time.Duration(g.ResetAfter),
+			ResetAfter:    time.Duration(g.ResetAfter) * time.Second,
 			ServfailError: g.ServfailError,
 		}
 		resolvers[id] = rdns.NewRandom(id, opt, gr...)
@@ -393,6 +704,9 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 			AllowListResolver: resolvers[g.AllowListResolver],
 			AllowlistDB:       allowlistDB,
 			AllowlistRefresh:  time.Duration(g.AllowlistRefresh) * time.Second,
+			EDEText:           g.EDEText,
+			Parallel:          g.BlocklistParallel,
+			MatchCacheSize:    g.BlocklistCache,
 		}
 		resolvers[id], err = rdns.NewBlocklist(id, gr[0], opt)
 		if err != nil {
@@ -411,10 +725,24 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 			return fmt.Errorf("type ttl-modifier only supports one resolver in '%s'", id)
 		}
 		opt := rdns.TTLModifierOptions{
-			MinTTL: g.TTLMin,
-			MaxTTL: g.TTLMax,
-		}
-		resolvers[id] = rdns.NewTTLModifier(id, gr[0], opt)
+			MinTTL:  g.TTLMin,
+			MaxTTL:  g.TTLMax,
+			Domains: g.Domains,
+		}
+		var rules []rdns.TTLRule
+		for _, rule := range g.TTLRules {
+			rules = append(rules, rdns.TTLRule{
+				If:     rule.If,
+				TTL:    rule.TTL,
+				MinTTL: rule.TTLMin,
+				MaxTTL: rule.TTLMax,
+			})
+		}
+		modifier := rdns.NewTTLModifier(id, gr[0], opt)
+		if err := modifier.SetRules(rules); err != nil {
+			return fmt.Errorf("ttl-modifier '%s': %w", id, err)
+		}
+		resolvers[id] = modifier
 	case "truncate-retry":
 		if len(gr) != 1 {
 			return fmt.Errorf("type truncate-retry only supports one resolver in '%s'", id)
@@ -430,6 +758,123 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 			return fmt.Errorf("type request-dedup only supports one resolver in '%s'", id)
 		}
 		resolvers[id] = rdns.NewRequestDedup(id, gr[0])
+	case "latency-budget":
+		if len(gr) != 1 {
+			return fmt.Errorf("type latency-budget only supports one resolver in '%s'", id)
+		}
+		opt := rdns.LatencyBudgetOptions{
+			Budget:        time.Duration(g.LatencyBudget) * time.Millisecond,
+			ServeStale:    g.LatencyStale,
+			StaleTTL:      g.LatencyStaleTTL,
+			StaleMaxAge:   time.Duration(g.LatencyStaleMaxAge) * time.Second,
+			StaleCapacity: g.LatencyStaleSize,
+		}
+		resolvers[id], err = rdns.NewLatencyBudget(id, gr[0], opt)
+		if err != nil {
+			return err
+		}
+	case "nat-reflection":
+		if len(gr) != 1 {
+			return fmt.Errorf("type nat-reflection only supports one resolver in '%s'", id)
+		}
+		clientNets, err := parseCIDRList(g.NATClients)
+		if err != nil {
+			return fmt.Errorf("failed to parse nat-clients in '%s': %w", id, err)
+		}
+		opt := rdns.NATReflectionOptions{ClientNets: clientNets}
+		for _, rule := range g.NATRules {
+			public := net.ParseIP(rule.Public)
+			if public == nil {
+				return fmt.Errorf("invalid public address '%s' in '%s'", rule.Public, id)
+			}
+			internal := net.ParseIP(rule.Internal)
+			if internal == nil {
+				return fmt.Errorf("invalid internal address '%s' in '%s'", rule.Internal, id)
+			}
+			opt.Rules = append(opt.Rules, rdns.NATReflectionRule{
+				Public:   public,
+				Internal: internal,
+				Domains:  rule.Domains,
+			})
+		}
+		resolvers[id], err = rdns.NewNATReflection(id, gr[0], opt)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+	case "prefix-rewrite":
+		if len(gr) != 1 {
+			return fmt.Errorf("type prefix-rewrite only supports one resolver in '%s'", id)
+		}
+		clientNets, err := parseCIDRList(g.PrefixRewriteClients)
+		if err != nil {
+			return fmt.Errorf("failed to parse prefix-rewrite-clients in '%s': %w", id, err)
+		}
+		opt := rdns.PrefixRewriteOptions{
+			ClientNets:      clientNets,
+			ChecksumNeutral: g.PrefixRewriteChecksumNeutral,
+		}
+		for _, rule := range g.PrefixRewrite {
+			_, from, err := net.ParseCIDR(rule.From)
+			if err != nil {
+				return fmt.Errorf("failed to parse prefix-rewrite in '%s': %w", id, err)
+			}
+			_, to, err := net.ParseCIDR(rule.To)
+			if err != nil {
+				return fmt.Errorf("failed to parse prefix-rewrite in '%s': %w", id, err)
+			}
+			opt.Rules = append(opt.Rules, rdns.PrefixRewriteRule{From: from, To: to})
+		}
+		resolvers[id], err = rdns.NewPrefixRewriter(id, gr[0], opt)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+	case "dnssec-policy":
+		if len(gr) != 1 {
+			return fmt.Errorf("type dnssec-policy only supports one resolver in '%s'", id)
+		}
+		clientNets, err := parseCIDRList(g.DNSSECClients)
+		if err != nil {
+			return fmt.Errorf("failed to parse dnssec-clients in '%s': %w", id, err)
+		}
+		opt := rdns.DNSSECPolicyOptions{
+			Action:     g.DNSSECAction,
+			ClientNets: clientNets,
+		}
+		resolvers[id], err = rdns.NewDNSSECPolicy(id, gr[0], opt)
+		if err != nil {
+			return err
+		}
+	case "tee":
+		if len(gr) != 1 {
+			return fmt.Errorf("type tee only supports one resolver in '%s'", id)
+		}
+		if g.TeeResolver == "" {
+			return fmt.Errorf("type tee requires tee-resolver in '%s'", id)
+		}
+		opt := rdns.TeeOptions{
+			Resolver:    resolvers[g.TeeResolver],
+			Domains:     g.Domains,
+			SampleRate:  g.TeeSampleRate,
+			MaxInFlight: g.TeeMaxInFlight,
+		}
+		resolvers[id], err = rdns.NewTee(id, gr[0], opt)
+		if err != nil {
+			return err
+		}
+	case "client-stats":
+		if len(gr) != 1 {
+			return fmt.Errorf("type client-stats only supports one resolver in '%s'", id)
+		}
+		opt := rdns.ClientStatsOptions{
+			File:         g.StatsFile,
+			SaveInterval: time.Duration(g.StatsSaveInterval) * time.Second,
+			TopDomains:   g.StatsTopDomains,
+			TopClients:   g.StatsTopClients,
+		}
+		resolvers[id], err = rdns.NewClientStats(id, gr[0], opt)
+		if err != nil {
+			return err
+		}
 	case "fastest-tcp":
 		if len(gr) != 1 {
 			return fmt.Errorf("type fastest-tcp only supports one resolver in '%s'", id)
@@ -456,10 +901,14 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 		default:
 			return fmt.Errorf("unsupported ecs-modifier operation '%s'", g.ECSOp)
 		}
-		resolvers[id], err = rdns.NewECSModifier(id, gr[0], f)
+		ecs, err := rdns.NewECSModifier(id, gr[0], f)
 		if err != nil {
 			return err
 		}
+		if len(g.Domains) > 0 {
+			ecs.SetDomains(g.Domains)
+		}
+		resolvers[id] = ecs
 	case "edns0-modifier":
 		if len(gr) != 1 {
 			return fmt.Errorf("type edns0-modifier only supports one resolver in '%s'", id)
@@ -474,10 +923,83 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 		default:
 			return fmt.Errorf("unsupported edns0-modifier operation '%s'", g.EDNS0Op)
 		}
-		resolvers[id], err = rdns.NewEDNS0Modifier(id, gr[0], f)
+		edns0, err := rdns.NewEDNS0Modifier(id, gr[0], f)
 		if err != nil {
 			return err
 		}
+		if len(g.Domains) > 0 {
+			edns0.SetDomains(g.Domains)
+		}
+		resolvers[id] = edns0
+	case "script":
+		if len(gr) != 1 {
+			return fmt.Errorf("type script only supports one resolver in '%s'", id)
+		}
+		var opt rdns.ScriptOptions
+		for _, rule := range g.ScriptRules {
+			var resolver rdns.Resolver
+			if rule.Resolver != "" {
+				var ok bool
+				if resolver, ok = resolvers[rule.Resolver]; !ok {
+					return fmt.Errorf("%s: unknown resolver '%s' in script rule", id, rule.Resolver)
+				}
+			}
+			opt.Rules = append(opt.Rules, rdns.ScriptRule{
+				If:       rule.If,
+				On:       rule.On,
+				Action:   rule.Action,
+				Resolver: resolver,
+				RCode:    rule.RCode,
+				Records:  rule.Records,
+				TTL:      rule.TTL,
+			})
+		}
+		resolvers[id], err = rdns.NewScript(id, gr[0], opt)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+	case "cname":
+		if len(gr) != 1 {
+			return fmt.Errorf("type cname only supports one resolver in '%s'", id)
+		}
+		opt := rdns.CNAMEOptions{
+			Flatten:       g.CNAMEFlatten,
+			Rewrite:       g.CNAMERewrite,
+			ChainResolver: resolvers[g.CNAMEResolver],
+			MaxDepth:      g.CNAMEMaxDepth,
+		}
+		resolvers[id], err = rdns.NewCNAME(id, gr[0], opt)
+		if err != nil {
+			return err
+		}
+	case "fcrdns":
+		if len(gr) != 1 {
+			return fmt.Errorf("type fcrdns only supports one resolver in '%s'", id)
+		}
+		if len(g.FCrDNSDomains) == 0 {
+			return fmt.Errorf("type fcrdns requires fcrdns-domains in '%s'", id)
+		}
+		opt := rdns.FCrDNSOptions{
+			Domains:        g.FCrDNSDomains,
+			Block:          g.FCrDNSBlock,
+			LookupResolver: resolvers[g.FCrDNSResolver],
+		}
+		resolvers[id] = rdns.NewFCrDNS(id, gr[0], opt)
+	case "query-log":
+		if len(gr) != 1 {
+			return fmt.Errorf("type query-log only supports one resolver in '%s'", id)
+		}
+		opt := rdns.QueryLogOptions{
+			File:       g.LogFile,
+			Format:     g.LogFormat,
+			MaxSize:    g.LogMaxSize << 20,
+			MaxFiles:   g.LogMaxFiles,
+			SampleRate: g.LogSampleRate,
+		}
+		resolvers[id], err = rdns.NewQueryLog(id, gr[0], opt)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
 	case "syslog":
 		if len(gr) != 1 {
 			return fmt.Errorf("type syslog only supports one resolver in '%s'", id)
@@ -511,26 +1033,39 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 			LogRequest:  g.LogRequest,
 			LogResponse: g.LogResponse,
 			Verbose:     g.Verbose,
+			SampleRate:  g.LogSampleRate,
+		}
+		if opt.SampleRate < 0 || opt.SampleRate > 1 {
+			return fmt.Errorf("invalid log-sample-rate %v in '%s'", opt.SampleRate, id)
 		}
 		resolvers[id] = rdns.NewSyslog(id, gr[0], opt)
 	case "cache":
-		var shuffleFunc rdns.AnswerShuffleFunc
+		var (
+			shuffleFunc       rdns.AnswerShuffleFunc
+			shuffleClientFunc rdns.AnswerShuffleClientFunc
+		)
 		switch g.CacheAnswerShuffle {
 		case "": // default
 		case "random":
 			shuffleFunc = rdns.AnswerShuffleRandon
 		case "round-robin":
 			shuffleFunc = rdns.AnswerShuffleRoundRobin
+		case "stable":
+			shuffleClientFunc = rdns.AnswerShuffleStable
 		default:
 			return fmt.Errorf("unsupported shuffle function %q", g.CacheAnswerShuffle)
 		}
 		opt := rdns.CacheOptions{
-			GCPeriod:            time.Duration(g.GCPeriod) * time.Second,
-			Capacity:            g.CacheSize,
-			NegativeTTL:         g.CacheNegativeTTL,
-			ShuffleAnswerFunc:   shuffleFunc,
-			HardenBelowNXDOMAIN: g.CacheHardenBelowNXDOMAIN,
-			FlushQuery:          g.CacheFlushQuery,
+			GCPeriod:                time.Duration(g.GCPeriod) * time.Second,
+			Capacity:                g.CacheSize,
+			NegativeTTL:             g.CacheNegativeTTL,
+			ShuffleAnswerFunc:       shuffleFunc,
+			ShuffleAnswerClientFunc: shuffleClientFunc,
+			HardenBelowNXDOMAIN:     g.CacheHardenBelowNXDOMAIN,
+			FlushQuery:              g.CacheFlushQuery,
+			ECSScope:                g.CacheECSScope,
+			KeyDNSSECFlags:          g.CacheKeyDNSSEC,
+			PerListener:             g.CachePerListener,
 		}
 		resolvers[id] = rdns.NewCache(id, gr[0], opt)
 	case "response-blocklist-ip", "response-blocklist-cidr": // "response-blocklist-cidr" has been retired/renamed to "response-blocklist-ip"
@@ -540,16 +1075,19 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 		if len(g.Blocklist) > 0 && len(g.BlocklistSource) > 0 {
 			return fmt.Errorf("static blocklist can't be used with 'blocklist-source' in '%s'", id)
 		}
+		if len(g.Allowlist) > 0 && len(g.AllowlistSource) > 0 {
+			return fmt.Errorf("static allowlist can't be used with 'allowlist-source' in '%s'", id)
+		}
 		var blocklistDB rdns.IPBlocklistDB
 		if len(g.Blocklist) > 0 {
-			blocklistDB, err = newIPBlocklistDB(list{Name: id, Format: g.BlocklistFormat}, g.LocationDB, g.Blocklist)
+			blocklistDB, err = newIPBlocklistDB(list{Name: id, Format: g.BlocklistFormat}, g.LocationDB, g.ASNDB, g.Blocklist)
 			if err != nil {
 				return err
 			}
 		} else {
 			var dbs []rdns.IPBlocklistDB
 			for _, s := range g.BlocklistSource {
-				db, err := newIPBlocklistDB(s, g.LocationDB, nil)
+				db, err := newIPBlocklistDB(s, g.LocationDB, g.ASNDB, nil)
 				if err != nil {
 					return fmt.Errorf("%s: %w", id, err)
 				}
@@ -560,11 +1098,34 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 				return err
 			}
 		}
+		var allowlistDB rdns.IPBlocklistDB
+		if len(g.Allowlist) > 0 {
+			allowlistDB, err = newIPBlocklistDB(list{Name: id, Format: g.AllowlistFormat}, g.LocationDB, g.ASNDB, g.Allowlist)
+			if err != nil {
+				return err
+			}
+		} else if len(g.AllowlistSource) > 0 {
+			var dbs []rdns.IPBlocklistDB
+			for _, s := range g.AllowlistSource {
+				db, err := newIPBlocklistDB(s, g.LocationDB, g.ASNDB, nil)
+				if err != nil {
+					return fmt.Errorf("%s: %w", id, err)
+				}
+				dbs = append(dbs, db)
+			}
+			allowlistDB, err = rdns.NewMultiIPDB(dbs...)
+			if err != nil {
+				return err
+			}
+		}
 		opt := rdns.ResponseBlocklistIPOptions{
 			BlocklistResolver: resolvers[g.BlockListResolver],
 			BlocklistDB:       blocklistDB,
 			BlocklistRefresh:  time.Duration(g.BlocklistRefresh) * time.Second,
+			AllowlistDB:       allowlistDB,
+			AllowlistRefresh:  time.Duration(g.AllowlistRefresh) * time.Second,
 			Filter:            g.Filter,
+			EDEText:           g.EDEText,
 		}
 		resolvers[id], err = rdns.NewResponseBlocklistIP(id, gr[0], opt)
 		if err != nil {
@@ -577,6 +1138,9 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 		if len(g.Blocklist) > 0 && len(g.BlocklistSource) > 0 {
 			return fmt.Errorf("static blocklist can't be used with 'blocklist-source' in '%s'", id)
 		}
+		if len(g.Allowlist) > 0 && len(g.AllowlistSource) > 0 {
+			return fmt.Errorf("static allowlist can't be used with 'allowlist-source' in '%s'", id)
+		}
 		var blocklistDB rdns.BlocklistDB
 		if len(g.Blocklist) > 0 {
 			blocklistDB, err = newBlocklistDB(list{Format: g.BlocklistFormat}, g.Blocklist)
@@ -597,10 +1161,33 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 				return err
 			}
 		}
+		var allowlistDB rdns.BlocklistDB
+		if len(g.Allowlist) > 0 {
+			allowlistDB, err = newBlocklistDB(list{Format: g.AllowlistFormat}, g.Allowlist)
+			if err != nil {
+				return err
+			}
+		} else if len(g.AllowlistSource) > 0 {
+			var dbs []rdns.BlocklistDB
+			for _, s := range g.AllowlistSource {
+				db, err := newBlocklistDB(s, nil)
+				if err != nil {
+					return fmt.Errorf("%s: %w", id, err)
+				}
+				dbs = append(dbs, db)
+			}
+			allowlistDB, err = rdns.NewMultiDB(dbs...)
+			if err != nil {
+				return err
+			}
+		}
 		opt := rdns.ResponseBlocklistNameOptions{
 			BlocklistResolver: resolvers[g.BlockListResolver],
 			BlocklistDB:       blocklistDB,
 			BlocklistRefresh:  time.Duration(g.BlocklistRefresh) * time.Second,
+			AllowlistDB:       allowlistDB,
+			AllowlistRefresh:  time.Duration(g.AllowlistRefresh) * time.Second,
+			EDEText:           g.EDEText,
 		}
 		resolvers[id], err = rdns.NewResponseBlocklistName(id, gr[0], opt)
 		if err != nil {
@@ -615,14 +1202,14 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 		}
 		var blocklistDB rdns.IPBlocklistDB
 		if len(g.Blocklist) > 0 {
-			blocklistDB, err = newIPBlocklistDB(list{Name: id, Format: g.BlocklistFormat}, g.LocationDB, g.Blocklist)
+			blocklistDB, err = newIPBlocklistDB(list{Name: id, Format: g.BlocklistFormat}, g.LocationDB, g.ASNDB, g.Blocklist)
 			if err != nil {
 				return err
 			}
 		} else {
 			var dbs []rdns.IPBlocklistDB
 			for _, s := range g.BlocklistSource {
-				db, err := newIPBlocklistDB(s, g.LocationDB, nil)
+				db, err := newIPBlocklistDB(s, g.LocationDB, g.ASNDB, nil)
 				if err != nil {
 					return fmt.Errorf("%s: %w", id, err)
 				}
@@ -645,21 +1232,145 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 
 	case "static-responder":
 		opt := rdns.StaticResolverOptions{
-			Answer:   g.Answer,
-			NS:       g.NS,
-			Extra:    g.Extra,
-			RCode:    g.RCode,
-			Truncate: g.Truncate,
+			Answer:       g.Answer,
+			NS:           g.NS,
+			Extra:        g.Extra,
+			RCode:        g.RCode,
+			Truncate:     g.Truncate,
+			AnswerByType: g.AnswerByType,
+			EDEText:      g.EDEText,
 		}
 		resolvers[id], err = rdns.NewStaticResolver(id, opt)
 		if err != nil {
 			return err
 		}
+	case "hosts":
+		if len(gr) > 1 {
+			return fmt.Errorf("type hosts only supports one resolver in '%s'", id)
+		}
+		var resolver rdns.Resolver
+		if len(gr) == 1 {
+			resolver = gr[0]
+		}
+		opt := rdns.HostsResolverOptions{
+			Files:   g.HostsFiles,
+			Refresh: time.Duration(g.HostsRefresh) * time.Second,
+			TTL:     g.HostsTTL,
+		}
+		resolvers[id], err = rdns.NewHostsResolver(id, resolver, opt)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+	case "mock":
+		opt := rdns.MockResolverOptions{
+			Records: g.MockRecords,
+			Delay:   time.Duration(g.MockDelay) * time.Millisecond,
+		}
+		for _, rule := range g.MockRules {
+			opt.Rules = append(opt.Rules, rdns.MockRule{
+				Name:  rule.Name,
+				Type:  rule.Type,
+				Count: rule.Count,
+				Delay: time.Duration(rule.Delay) * time.Millisecond,
+				Error: rule.Error,
+				RCode: rule.RCode,
+			})
+		}
+		resolvers[id], err = rdns.NewMockResolver(id, opt)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+	case "fault-injector":
+		if len(gr) != 1 {
+			return fmt.Errorf("type fault-injector only supports one resolver in '%s'", id)
+		}
+		opt := rdns.FaultInjectorOptions{
+			Latency:      time.Duration(g.FaultLatency) * time.Millisecond,
+			LatencyRate:  g.FaultLatencyRate,
+			Timeout:      time.Duration(g.FaultTimeout) * time.Millisecond,
+			TimeoutRate:  g.FaultTimeoutRate,
+			ServfailRate: g.FaultServfailRate,
+			TruncateRate: g.FaultTruncateRate,
+		}
+		resolvers[id] = rdns.NewFaultInjector(id, gr[0], opt)
+	case "zone":
+		opt := rdns.ZoneResolverOptions{
+			Files:   g.ZoneFiles,
+			Refresh: time.Duration(g.ZoneRefresh) * time.Second,
+		}
+		resolvers[id], err = rdns.NewZoneResolver(id, opt)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
 	case "response-minimize":
 		if len(gr) != 1 {
 			return fmt.Errorf("type response-minimize only supports one resolver in '%s'", id)
 		}
 		resolvers[id] = rdns.NewResponseMinimize(id, gr[0])
+	case "cache-probe":
+		if len(gr) != 1 {
+			return fmt.Errorf("type cache-probe only supports one resolver in '%s'", id)
+		}
+		cache, ok := resolvers[g.ProbeCache].(*rdns.Cache)
+		if !ok {
+			return fmt.Errorf("%s: probe-cache '%s' is not a cache", id, g.ProbeCache)
+		}
+		resolvers[id] = rdns.NewCacheProbe(id, gr[0], cache)
+	case "type-filter":
+		if len(gr) != 1 {
+			return fmt.Errorf("type type-filter only supports one resolver in '%s'", id)
+		}
+		var opt rdns.TypeFilterOptions
+		for _, rule := range g.TypeFilterRules {
+			reverseNets, err := parseCIDRList(rule.ReverseNets)
+			if err != nil {
+				return err
+			}
+			opt.Rules = append(opt.Rules, rdns.TypeFilterRule{
+				Types:       rule.Types,
+				ReverseNets: reverseNets,
+				Action:      rule.Action,
+				RCode:       rule.RCode,
+			})
+		}
+		resolvers[id], err = rdns.NewTypeFilter(id, gr[0], opt)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+	case "svcb-filter":
+		if len(gr) != 1 {
+			return fmt.Errorf("type svcb-filter only supports one resolver in '%s'", id)
+		}
+		opt := rdns.SVCBFilterOptions{
+			Drop:       g.SVCBDrop,
+			RemoveKeys: g.SVCBRemoveKeys,
+		}
+		resolvers[id], err = rdns.NewSVCBFilter(id, gr[0], opt)
+		if err != nil {
+			return err
+		}
+	case "query-normalize":
+		if len(gr) != 1 {
+			return fmt.Errorf("type query-normalize only supports one resolver in '%s'", id)
+		}
+		action, err := rdns.ParseQueryPolicyAction(g.NormalizeAction)
+		if err != nil {
+			return fmt.Errorf("failed to parse normalize-action in '%s': %w", id, err)
+		}
+		opt := rdns.QueryNormalizeOptions{
+			Strict:      g.NormalizeStrict,
+			Underscores: g.NormalizeUnderscores,
+			Action:      action,
+		}
+		resolvers[id], err = rdns.NewQueryNormalize(id, gr[0], opt)
+		if err != nil {
+			return err
+		}
+	case "response-normalize":
+		if len(gr) != 1 {
+			return fmt.Errorf("type response-normalize only supports one resolver in '%s'", id)
+		}
+		resolvers[id] = rdns.NewResponseNormalize(id, gr[0])
 	case "response-collapse":
 		if len(gr) != 1 {
 			return fmt.Errorf("type response-collapse only supports one resolver in '%s'", id)
@@ -674,14 +1385,49 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 		if len(gr) != 1 {
 			return fmt.Errorf("type rate-limiter only supports one resolver in '%s'", id)
 		}
+		switch g.LimitAction {
+		case "", "drop", "refused", "truncate":
+		default:
+			return fmt.Errorf("unsupported limit-action '%s' in '%s'", g.LimitAction, id)
+		}
 		opt := rdns.RateLimiterOptions{
 			Requests:      g.Requests,
 			Window:        g.Window,
 			Prefix4:       g.Prefix4,
 			Prefix6:       g.Prefix6,
 			LimitResolver: resolvers[g.LimitResolver],
+			LimitAction:   g.LimitAction,
+			Slip:          g.Slip,
+			StateFile:     g.StateFile,
+		}
+		for _, limit := range g.RateLimits {
+			opt.Tiers = append(opt.Tiers, rdns.RateLimiterTier{
+				Requests: limit.Requests,
+				Prefix4:  limit.Prefix4,
+				Prefix6:  limit.Prefix6,
+			})
 		}
 		resolvers[id] = rdns.NewRateLimiter(id, gr[0], opt)
+	case "concurrency-limiter":
+		if len(gr) != 1 {
+			return fmt.Errorf("type concurrency-limiter only supports one resolver in '%s'", id)
+		}
+		opt := rdns.ConcurrencyLimiterOptions{
+			MaxConcurrent: g.MaxConcurrent,
+			Wait:          time.Duration(g.ConcurrencyWait) * time.Millisecond,
+			LimitResolver: resolvers[g.LimitResolver],
+		}
+		resolvers[id] = rdns.NewConcurrencyLimiter(id, gr[0], opt)
+	case "domain-limiter":
+		if len(gr) != 1 {
+			return fmt.Errorf("type domain-limiter only supports one resolver in '%s'", id)
+		}
+		opt := rdns.DomainLimiterOptions{
+			Requests:      g.Requests,
+			Window:        g.Window,
+			LimitResolver: resolvers[g.LimitResolver],
+		}
+		resolvers[id] = rdns.NewDomainLimiter(id, gr[0], opt)
 
 	default:
 		return fmt.Errorf("unsupported group type '%s' for group '%s'", g.Type, id)
@@ -691,7 +1437,11 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 
 // Instantiate a router object based on configuration and add to the map of resolvers by ID.
 func instantiateRouter(id string, r router, resolvers map[string]rdns.Resolver) error {
-	router := rdns.NewRouter(id)
+	noMatch, err := rdns.ParseRouterNoMatch(r.NoMatch)
+	if err != nil {
+		return fmt.Errorf("router '%s': %w", id, err)
+	}
+	router := rdns.NewRouterWithOptions(id, rdns.RouterOptions{NoMatch: noMatch})
 	for _, route := range r.Routes {
 		resolver, ok := resolvers[route.Resolver]
 		if !ok {
@@ -705,9 +1455,32 @@ func instantiateRouter(id string, r router, resolvers map[string]rdns.Resolver)
 		if err != nil {
 			return fmt.Errorf("failure parsing routes for router '%s' : %s", id, err.Error())
 		}
+		if len(route.Domains) > 0 {
+			r.SetDomains(route.Domains)
+		}
+		if err := r.SetListener(route.Listener); err != nil {
+			return fmt.Errorf("failure parsing routes for router '%s' : %s", id, err.Error())
+		}
+		if err := r.SetTLSClientName(route.TLSClientName); err != nil {
+			return fmt.Errorf("failure parsing routes for router '%s' : %s", id, err.Error())
+		}
+		if err := r.SetCacheState(route.CacheState); err != nil {
+			return fmt.Errorf("failure parsing routes for router '%s' : %s", id, err.Error())
+		}
+		if err := r.SetClientAuth(route.ClientAuth); err != nil {
+			return fmt.Errorf("failure parsing routes for router '%s' : %s", id, err.Error())
+		}
+		if route.ClientPercent != nil {
+			if err := r.SetClientPercent(*route.ClientPercent, route.ClientSalt); err != nil {
+				return fmt.Errorf("failure parsing routes for router '%s' : %s", id, err.Error())
+			}
+		}
 		r.Invert(route.Invert)
 		router.Add(r)
 	}
+	if !router.HasDefaultRoute() && r.NoMatch == "" {
+		rdns.Log.WithField("id", id).Warn("router has no default route, queries that don't match any route fail with SERVFAIL, set 'no-match' to change this")
+	}
 	resolvers[id] = router
 	return nil
 }
@@ -728,7 +1501,10 @@ func newBlocklistDB(l list, rules []string) (rdns.BlocklistDB, error) {
 		switch loc.Scheme {
 		case "http", "https":
 			opt := rdns.HTTPLoaderOptions{
-				CacheDir: l.CacheDir,
+				CacheDir:  l.CacheDir,
+				UserAgent: l.UserAgent,
+				Headers:   l.Headers,
+				Timeout:   time.Duration(l.Timeout) * time.Second,
 			}
 			loader = rdns.NewHTTPLoader(l.Source, opt)
 		case "":
@@ -737,19 +1513,24 @@ func newBlocklistDB(l list, rules []string) (rdns.BlocklistDB, error) {
 			return nil, fmt.Errorf("unsupported scheme '%s' in '%s'", loc.Scheme, l.Source)
 		}
 	}
+	var db rdns.BlocklistDB
 	switch l.Format {
 	case "regexp", "":
-		return rdns.NewRegexpDB(name, loader)
+		db, err = rdns.NewRegexpDB(name, loader)
 	case "domain":
-		return rdns.NewDomainDB(name, loader)
+		db, err = rdns.NewDomainDB(name, loader)
 	case "hosts":
-		return rdns.NewHostsDB(name, loader)
+		db, err = rdns.NewHostsDB(name, loader)
 	default:
 		return nil, fmt.Errorf("unsupported format '%s'", l.Format)
 	}
+	if err != nil || l.Category == "" {
+		return db, err
+	}
+	return rdns.NewCategoryDB(l.Category, db), nil
 }
 
-func newIPBlocklistDB(l list, locationDB string, rules []string) (rdns.IPBlocklistDB, error) {
+func newIPBlocklistDB(l list, locationDB, asnDB string, rules []string) (rdns.IPBlocklistDB, error) {
 	loc, err := url.Parse(l.Source)
 	if err != nil {
 		return nil, err
@@ -765,7 +1546,10 @@ func newIPBlocklistDB(l list, locationDB string, rules []string) (rdns.IPBlockli
 		switch loc.Scheme {
 		case "http", "https":
 			opt := rdns.HTTPLoaderOptions{
-				CacheDir: l.CacheDir,
+				CacheDir:  l.CacheDir,
+				UserAgent: l.UserAgent,
+				Headers:   l.Headers,
+				Timeout:   time.Duration(l.Timeout) * time.Second,
 			}
 			loader = rdns.NewHTTPLoader(l.Source, opt)
 		case "":
@@ -775,14 +1559,58 @@ func newIPBlocklistDB(l list, locationDB string, rules []string) (rdns.IPBlockli
 		}
 	}
 
+	var db rdns.IPBlocklistDB
 	switch l.Format {
 	case "cidr", "":
-		return rdns.NewCidrDB(name, loader)
+		db, err = rdns.NewCidrDB(name, loader)
 	case "location":
-		return rdns.NewGeoIPDB(name, loader, locationDB)
+		var geoDBFiles []string
+		for _, f := range []string{locationDB, asnDB} {
+			if f != "" {
+				geoDBFiles = append(geoDBFiles, f)
+			}
+		}
+		db, err = rdns.NewGeoIPDB(name, loader, geoDBFiles...)
 	default:
 		return nil, fmt.Errorf("unsupported format '%s'", l.Format)
 	}
+	if err != nil || l.Category == "" {
+		return db, err
+	}
+	return rdns.NewCategoryIPDB(l.Category, db), nil
+}
+
+func parseHealthCheck(h healthCheck) (rdns.HealthCheckOptions, error) {
+	opt := rdns.HealthCheckOptions{
+		Interval: time.Duration(h.Interval) * time.Second,
+		Name:     h.Name,
+	}
+	if h.Type != "" {
+		qtype, ok := dns.StringToType[strings.ToUpper(h.Type)]
+		if !ok {
+			return opt, fmt.Errorf("unsupported health-check query type '%s'", h.Type)
+		}
+		opt.Type = qtype
+	}
+	return opt, nil
+}
+
+func parseQueryPolicy(p queryPolicy) (rdns.QueryPolicy, error) {
+	var (
+		policy rdns.QueryPolicy
+		err    error
+	)
+	if policy.NoQuestion, err = rdns.ParseQueryPolicyAction(p.NoQuestion); err != nil {
+		return policy, err
+	}
+	if policy.NoQuestion == rdns.PolicyPass {
+		return policy, errors.New("queries without question can not be passed on to resolvers")
+	}
+	if policy.MultiQuestion, err = rdns.ParseQueryPolicyAction(p.MultiQuestion); err != nil {
+		return policy, err
+	}
+	policy.UnusualClass, err = rdns.ParseQueryPolicyAction(p.UnusualClass)
+	return policy, err
 }
 
 func printVersion() {
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	rdns "github.com/folbricht/routedns"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Public resolvers use the DoQ port from RFC 9250, not the default port of the
+// DoQ resolver.
+const raceDoQPort = "853"
+
+type raceOptions struct {
+	transports []string
+	names      []string
+	count      int
+	timeout    time.Duration
+	top        int
+}
+
+func newRaceCommand() *cobra.Command {
+	var opt raceOptions
+	cmd := &cobra.Command{
+		Use:   "race <upstream> [<upstream>..]",
+		Short: "Benchmark upstream resolvers",
+		Long: `Benchmark upstream resolvers.
+
+Sends the same queries to all candidate upstreams, over
+DNS-over-TLS, DNS-over-HTTPS and DNS-over-QUIC, and ranks
+them by error rate and median response time as seen from
+this host. Upstreams given as hostname or IP are tried
+over every transport selected with --transport, while
+"tls://", "https://" and "quic://" select a single one.
+
+The results are printed to stderr, a configuration snippet
+with the fastest upstreams is written to stdout.
+`,
+		Example: `  routedns race cloudflare-dns.com dns.google dns.quad9.net
+  routedns race -n 50 --transport dot,doh 1.1.1.1 9.9.9.9 > upstreams.toml
+  routedns race https://dns.google/dns-query tls://1.1.1.1:853`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return race(opt, args)
+		},
+		SilenceUsage: true,
+	}
+	cmd.Flags().StringSliceVarP(&opt.transports, "transport", "t", []string{"dot", "doh", "doq"}, "Transports to try for upstreams given as hostname or IP")
+	cmd.Flags().StringSliceVar(&opt.names, "name", []string{"example.com.", "wikipedia.org.", "github.com.", "cloudflare.com.", "google.com.", "amazon.com."}, "Names to query, used in turn")
+	cmd.Flags().IntVarP(&opt.count, "count", "n", 20, "Number of queries per upstream")
+	cmd.Flags().DurationVar(&opt.timeout, "timeout", 2*time.Second, "Query timeout")
+	cmd.Flags().IntVar(&opt.top, "top", 3, "Number of upstreams in the configuration snippet")
+	return cmd
+}
+
+// Upstream being benchmarked, with its results.
+type raceCandidate struct {
+	id       string
+	resolver resolver
+	client   rdns.Resolver
+
+	// Time of the first query, which includes setting up the connection
+	first     time.Duration
+	durations []time.Duration
+	errors    int
+}
+
+func race(opt raceOptions, args []string) error {
+	if opt.count < 2 {
+		return errors.New("count needs to be at least 2")
+	}
+	if opt.top < 1 {
+		return errors.New("top needs to be at least 1")
+	}
+	if len(opt.names) == 0 {
+		return errors.New("no names to query")
+	}
+	// Failures are reported in the results
+	rdns.Log.SetLevel(logrus.FatalLevel)
+
+	candidates, err := raceCandidates(args, opt.transports)
+	if err != nil {
+		return err
+	}
+	resolvers := make(map[string]rdns.Resolver)
+	for _, c := range candidates {
+		c.resolver.QueryTimeout = int(opt.timeout / time.Millisecond)
+		if err := instantiateResolver(c.id, c.resolver, resolvers); err != nil {
+			return err
+		}
+		c.client = resolvers[c.id]
+	}
+
+	// Send the queries in turn, so all upstreams see the same network
+	// conditions, rather than finishing one upstream before the next.
+	for i := 0; i < opt.count; i++ {
+		q := new(dns.Msg)
+		q.SetQuestion(dns.Fqdn(opt.names[i%len(opt.names)]), dns.TypeA)
+		for _, c := range candidates {
+			start := time.Now()
+			a, err := c.client.Resolve(q.Copy(), rdns.ClientInfo{})
+			d := time.Since(start)
+			if err != nil || a == nil || (a.Rcode != dns.RcodeSuccess && a.Rcode != dns.RcodeNameError) {
+				c.errors++
+				continue
+			}
+			if i == 0 {
+				c.first = d
+				continue
+			}
+			c.durations = append(c.durations, d)
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.errors != b.errors {
+			return a.errors < b.errors
+		}
+		return a.median() < b.median()
+	})
+	writeRaceResults(os.Stderr, candidates, opt.count)
+	writeRaceConfig(os.Stdout, candidates, opt.top)
+	return nil
+}
+
+// Returns the candidates for the upstreams given on the command line.
+func raceCandidates(args []string, transports []string) ([]*raceCandidate, error) {
+	var candidates []*raceCandidate
+	ids := make(map[string]int)
+	add := func(host, protocol, address string) {
+		id := raceID(host) + "-" + protocol
+		ids[id]++
+		if n := ids[id]; n > 1 {
+			id = fmt.Sprintf("%s-%d", id, n)
+		}
+		candidates = append(candidates, &raceCandidate{
+			id:       id,
+			resolver: resolver{Address: address, Protocol: protocol},
+		})
+	}
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "https://"):
+			u, err := url.Parse(arg)
+			if err != nil {
+				return nil, err
+			}
+			add(u.Hostname(), "doh", arg)
+		case strings.HasPrefix(arg, "tls://"):
+			address := strings.TrimPrefix(arg, "tls://")
+			add(raceHost(address), "dot", address)
+		case strings.HasPrefix(arg, "quic://"):
+			address := rdns.AddressWithDefault(strings.TrimPrefix(arg, "quic://"), raceDoQPort)
+			add(raceHost(address), "doq", address)
+		default:
+			if _, _, err := net.SplitHostPort(arg); err == nil {
+				return nil, fmt.Errorf("upstream '%s' has a port, use tls://, https:// or quic:// to select the transport", arg)
+			}
+			for _, transport := range transports {
+				switch transport {
+				case "dot":
+					add(arg, "dot", net.JoinHostPort(arg, rdns.DoTPort))
+				case "doh":
+					host := arg
+					if strings.Contains(host, ":") {
+						host = "[" + host + "]"
+					}
+					add(arg, "doh", "https://"+host+"/dns-query")
+				case "doq":
+					add(arg, "doq", net.JoinHostPort(arg, raceDoQPort))
+				default:
+					return nil, fmt.Errorf("unsupported transport '%s'", transport)
+				}
+			}
+		}
+	}
+	return candidates, nil
+}
+
+// Returns the host of an address that may or may not have a port.
+func raceHost(address string) string {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return address
+}
+
+// Turns a hostname or IP into something that can be used as resolver ID.
+func raceID(host string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(host) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteRune('-')
+			dash = true
+		}
+	}
+	return strings.TrimSuffix(b.String(), "-")
+}
+
+// Returns the response time at the given percentile of the queries after the
+// first, or 0 if none were successful.
+func (c *raceCandidate) percentile(p float64) time.Duration {
+	if len(c.durations) == 0 {
+		return 0
+	}
+	d := append([]time.Duration{}, c.durations...)
+	sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+	return d[int(p*float64(len(d)-1)+0.5)]
+}
+
+// Median response time, candidates without successful queries are sorted last.
+func (c *raceCandidate) median() time.Duration {
+	if len(c.durations) == 0 {
+		return time.Duration(1<<63 - 1)
+	}
+	return c.percentile(0.5)
+}
+
+func writeRaceResults(w io.Writer, candidates []*raceCandidate, count int) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "RANK\tID\tADDRESS\tFIRST\tMEDIAN\tP90\tERRORS")
+	ms := func(d time.Duration) string {
+		if d == 0 {
+			return "-"
+		}
+		return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 1, 64) + "ms"
+	}
+	for i, c := range candidates {
+		median := c.percentile(0.5)
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%d/%d\n", i+1, c.id, c.resolver.Address, ms(c.first), ms(median), ms(c.percentile(0.9)), c.errors, count)
+	}
+	tw.Flush()
+}
+
+// Writes the resolvers of the fastest candidates, and a group that uses them
+// in order, in the format of the configuration file.
+func writeRaceConfig(w io.Writer, candidates []*raceCandidate, top int) {
+	var selected []*raceCandidate
+	for _, c := range candidates {
+		if len(selected) == top {
+			break
+		}
+		if len(c.durations) > 0 {
+			selected = append(selected, c)
+		}
+	}
+	if len(selected) == 0 {
+		fmt.Fprintln(w, "# No upstream answered the queries")
+		return
+	}
+	fmt.Fprintln(w, "# Fastest upstreams from this host, ranked by error rate and median response time")
+	ids := make([]string, 0, len(selected))
+	for _, c := range selected {
+		fmt.Fprintf(w, "\n# Median %s, %d error(s)\n", c.percentile(0.5).Round(100*time.Microsecond), c.errors)
+		fmt.Fprintf(w, "[resolvers.%s]\n", c.id)
+		fmt.Fprintf(w, "address = %s\n", strconv.Quote(c.resolver.Address))
+		fmt.Fprintf(w, "protocol = %s\n", strconv.Quote(c.resolver.Protocol))
+		ids = append(ids, strconv.Quote(c.id))
+	}
+	if len(selected) > 1 {
+		fmt.Fprintln(w, "\n# Use the fastest upstream, fail over to the next ones in order")
+		fmt.Fprintln(w, "[groups.fastest-upstream]")
+		fmt.Fprintln(w, `type = "fail-back"`)
+		fmt.Fprintf(w, "resolvers = [%s]\n", strings.Join(ids, ", "))
+	}
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
+	"time"
 
 	rdns "github.com/folbricht/routedns"
 )
@@ -10,6 +12,34 @@ import (
 // Instantiates an rdns.Resolver from a resolver config
 func instantiateResolver(id string, r resolver, resolvers map[string]rdns.Resolver) error {
 	var err error
+	if r.Proxy != "" && r.Protocol != "dot" && r.Protocol != "doh" && r.Protocol != "doq" {
+		return fmt.Errorf("proxy is not supported for protocol '%s' in resolver '%s'", r.Protocol, id)
+	}
+	if r.Connections > 0 && r.Protocol != "tcp" && r.Protocol != "udp" && r.Protocol != "dot" {
+		return fmt.Errorf("connections is not supported for protocol '%s' in resolver '%s'", r.Protocol, id)
+	}
+	if r.TCPFallback && r.Protocol != "udp" {
+		return fmt.Errorf("tcp-fallback is only supported for protocol 'udp' in resolver '%s'", id)
+	}
+	if r.StrictCase && r.Protocol != "udp" && r.Protocol != "tcp" && r.Protocol != "stub" {
+		return fmt.Errorf("strict-case is only supported for protocols 'udp', 'tcp' and 'stub' in resolver '%s'", id)
+	}
+	if r.Interface != "" && r.Protocol != "mdns" {
+		return fmt.Errorf("interface is only supported for protocol 'mdns' in resolver '%s'", id)
+	}
+	if (len(r.StubZones) > 0 || len(r.StubHints) > 0) && r.Protocol != "stub" {
+		return fmt.Errorf("stub options are only supported for protocol 'stub' in resolver '%s'", id)
+	}
+	if (len(r.SPKIPins) > 0 || r.TLSMinVersion != "" || len(r.TLSCipherSuites) > 0) && r.Protocol != "dot" && r.Protocol != "doh" && r.Protocol != "doq" {
+		return fmt.Errorf("tls options are only supported for protocols 'dot', 'doh' and 'doq' in resolver '%s'", id)
+	}
+	if len(r.TransportFallback) > 0 {
+		if err := instantiateTransportFallback(id, r, resolvers); err != nil {
+			return err
+		}
+		return wrapResolver(id, r, resolvers)
+	}
+	queryTimeout := time.Duration(r.QueryTimeout) * time.Millisecond
 	switch r.Protocol {
 
 	case "doq":
@@ -19,9 +49,14 @@ func instantiateResolver(id string, r resolver, resolvers map[string]rdns.Resolv
 		if err != nil {
 			return err
 		}
+		if err := setTLSOptions(tlsConfig, r); err != nil {
+			return fmt.Errorf("resolver '%s': %w", id, err)
+		}
 		opt := rdns.DoQClientOptions{
 			BootstrapAddr: r.BootstrapAddr,
 			LocalAddr:     net.ParseIP(r.LocalAddr),
+			Proxy:         r.Proxy,
+			QueryTimeout:  queryTimeout,
 			TLSConfig:     tlsConfig,
 		}
 		resolvers[id], err = rdns.NewDoQClient(id, r.Address, opt)
@@ -35,9 +70,15 @@ func instantiateResolver(id string, r resolver, resolvers map[string]rdns.Resolv
 		if err != nil {
 			return err
 		}
+		if err := setTLSOptions(tlsConfig, r); err != nil {
+			return fmt.Errorf("resolver '%s': %w", id, err)
+		}
 		opt := rdns.DoTClientOptions{
 			BootstrapAddr: r.BootstrapAddr,
 			LocalAddr:     net.ParseIP(r.LocalAddr),
+			Proxy:         r.Proxy,
+			QueryTimeout:  queryTimeout,
+			Connections:   r.Connections,
 			TLSConfig:     tlsConfig,
 		}
 		resolvers[id], err = rdns.NewDoTClient(id, r.Address, opt)
@@ -56,6 +97,7 @@ func instantiateResolver(id string, r resolver, resolvers map[string]rdns.Resolv
 			LocalAddr:     net.ParseIP(r.LocalAddr),
 			DTLSConfig:    dtlsConfig,
 			UDPSize:       r.EDNS0UDPSize,
+			QueryTimeout:  queryTimeout,
 		}
 		resolvers[id], err = rdns.NewDTLSClient(id, r.Address, opt)
 		if err != nil {
@@ -68,12 +110,18 @@ func instantiateResolver(id string, r resolver, resolvers map[string]rdns.Resolv
 		if err != nil {
 			return err
 		}
+		if err := setTLSOptions(tlsConfig, r); err != nil {
+			return fmt.Errorf("resolver '%s': %w", id, err)
+		}
 		opt := rdns.DoHClientOptions{
 			Method:        r.DoH.Method,
 			TLSConfig:     tlsConfig,
 			BootstrapAddr: r.BootstrapAddr,
 			Transport:     r.Transport,
 			LocalAddr:     net.ParseIP(r.LocalAddr),
+			Proxy:         r.Proxy,
+			QueryTimeout:  queryTimeout,
+			Compression:   r.DoH.Compression,
 		}
 		resolvers[id], err = rdns.NewDoHClient(id, r.Address, opt)
 		if err != nil {
@@ -83,15 +131,154 @@ func instantiateResolver(id string, r resolver, resolvers map[string]rdns.Resolv
 		r.Address = rdns.AddressWithDefault(r.Address, rdns.PlainDNSPort)
 
 		opt := rdns.DNSClientOptions{
-			LocalAddr: net.ParseIP(r.LocalAddr),
-			UDPSize:   r.EDNS0UDPSize,
+			LocalAddr:    net.ParseIP(r.LocalAddr),
+			UDPSize:      r.EDNS0UDPSize,
+			QueryTimeout: queryTimeout,
+			TCPFallback:  r.TCPFallback,
+			Connections:  r.Connections,
+			StrictCase:   r.StrictCase,
 		}
 		resolvers[id], err = rdns.NewDNSClient(id, r.Address, r.Protocol, opt)
 		if err != nil {
 			return err
 		}
+	case "mdns":
+		// Default to the IPv4 group, IPv6 addresses like ff02::fb don't need brackets
+		switch {
+		case r.Address == "":
+			r.Address = net.JoinHostPort("224.0.0.251", rdns.MDNSPort)
+		case net.ParseIP(r.Address) != nil:
+			r.Address = net.JoinHostPort(r.Address, rdns.MDNSPort)
+		}
+
+		opt := rdns.MDNSClientOptions{
+			Interface:    r.Interface,
+			LocalAddr:    net.ParseIP(r.LocalAddr),
+			QueryTimeout: queryTimeout,
+		}
+		resolvers[id], err = rdns.NewMDNSClient(id, r.Address, opt)
+		if err != nil {
+			return err
+		}
+	case "stub":
+		opt := rdns.StubResolverOptions{
+			Zones:        r.StubZones,
+			Hints:        r.StubHints,
+			LocalAddr:    net.ParseIP(r.LocalAddr),
+			QueryTimeout: queryTimeout,
+			MaxRefresh:   time.Duration(r.StubMaxRefresh) * time.Second,
+			StrictCase:   r.StrictCase,
+		}
+		resolvers[id], err = rdns.NewStubResolver(id, opt)
+		if err != nil {
+			return fmt.Errorf("resolver '%s': %w", id, err)
+		}
 	default:
 		return fmt.Errorf("unsupported protocol '%s' for resolver '%s'", r.Protocol, id)
 	}
+	return wrapResolver(id, r, resolvers)
+}
+
+// Instantiates a resolver for each transport of a resolver with fallback
+// transports, and a fail-back group that uses them in order. The first
+// transport is tried again after the reset time.
+func instantiateTransportFallback(id string, r resolver, resolvers map[string]rdns.Resolver) error {
+	// The options that wrap the resolver are applied to the group
+	primary := r
+	primary.TransportFallback = nil
+	primary.SetFlags, primary.ClearFlags = nil, nil
+	primary.Retries = 0
+
+	transports := []resolver{primary}
+	for _, t := range r.TransportFallback {
+		alt := primary
+		if t.Address == "" {
+			return fmt.Errorf("transport-fallback '%s' requires an address in resolver '%s'", t.Protocol, id)
+		}
+		alt.Protocol, alt.Address, alt.Transport = t.Protocol, t.Address, t.Transport
+		transports = append(transports, alt)
+	}
+
+	var chain []rdns.Resolver
+	seen := make(map[string]struct{})
+	for _, t := range transports {
+		tid := id + "-" + t.Protocol
+		if t.Transport != "" {
+			tid += "-" + t.Transport
+		}
+		if _, ok := seen[tid]; ok {
+			return fmt.Errorf("duplicate transport '%s' in resolver '%s'", t.Protocol, id)
+		}
+		seen[tid] = struct{}{}
+		m := make(map[string]rdns.Resolver)
+		if err := instantiateResolver(tid, t, m); err != nil {
+			return err
+		}
+		chain = append(chain, m[tid])
+	}
+
+	resetAfter := 5 * time.Minute
+	if r.TransportFallbackReset > 0 {
+		resetAfter = time.Duration(r.TransportFallbackReset) * time.Second
+	}
+	resolvers[id] = rdns.NewFailBack(id, rdns.FailBackOptions{ResetAfter: resetAfter}, chain...)
+	return nil
+}
+
+// Wraps a resolver with elements that modify flags or retry queries if
+// configured.
+func wrapResolver(id string, r resolver, resolvers map[string]rdns.Resolver) error {
+	var err error
+
+	// Wrap the resolver if flags in queries need to be modified
+	if len(r.SetFlags) > 0 || len(r.ClearFlags) > 0 {
+		resolvers[id], err = rdns.NewQueryFlags(id, resolvers[id], rdns.QueryFlagsOptions{
+			Set:   r.SetFlags,
+			Clear: r.ClearFlags,
+		})
+		if err != nil {
+			return fmt.Errorf("resolver '%s': %w", id, err)
+		}
+	}
+
+	// Wrap the resolver if failed queries should be retried
+	if r.Retries > 0 {
+		strategy, err := rdns.ParseBackoffStrategy(r.RetryBackoffStrategy)
+		if err != nil {
+			return fmt.Errorf("resolver '%s': %w", id, err)
+		}
+		opt := rdns.RetryOptions{
+			Retries:         r.Retries,
+			Backoff:         time.Duration(r.RetryBackoff) * time.Millisecond,
+			BackoffStrategy: strategy,
+			BackoffMax:      time.Duration(r.RetryBackoffMax) * time.Millisecond,
+		}
+		resolvers[id] = rdns.NewRetry(id, resolvers[id], opt)
+	}
+	return nil
+}
+
+// Applies the pinning, version and cipher suite options of a resolver to its
+// TLS config.
+func setTLSOptions(tlsConfig *tls.Config, r resolver) error {
+	var err error
+	if len(r.SPKIPins) > 0 {
+		tlsConfig.VerifyPeerCertificate, err = rdns.TLSPinning(r.SPKIPins)
+		if err != nil {
+			return err
+		}
+	}
+	if r.TLSMinVersion != "" {
+		tlsConfig.MinVersion, err = rdns.ParseTLSVersion(r.TLSMinVersion)
+		if err != nil {
+			return err
+		}
+	}
+	if len(r.TLSCipherSuites) > 0 {
+		tlsConfig.CipherSuites, err = rdns.ParseTLSCipherSuites(r.TLSCipherSuites)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
@@ -0,0 +1,172 @@
+package rdns
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// CNAME is a modifier that processes CNAME chains in responses. It can rewrite
+// the targets of CNAME records and follow the chain to the new target, and it
+// can flatten chains by replacing them with the final records, using the query
+// name as owner. This helps clients that can't handle long CNAME chains.
+type CNAME struct {
+	id       string
+	resolver Resolver
+	opt      CNAMEOptions
+	rewrite  replaceExpressions
+}
+
+var _ Resolver = &CNAME{}
+
+type CNAMEOptions struct {
+	// Replace CNAME chains in responses with the records at the end of the
+	// chain, renamed to the query name.
+	Flatten bool
+
+	// Regular expressions applied to CNAME targets. If a target is modified,
+	// the rest of the chain is resolved again for the new target.
+	Rewrite []ReplaceOperation
+
+	// Optional resolver used to follow incomplete or rewritten chains. Uses
+	// the upstream resolver of the group if not set.
+	ChainResolver Resolver
+
+	// Maximum number of CNAME records to follow. Default 8.
+	MaxDepth int
+}
+
+// NewCNAME returns a new instance of a CNAME modifier.
+func NewCNAME(id string, resolver Resolver, opt CNAMEOptions) (*CNAME, error) {
+	if opt.ChainResolver == nil {
+		opt.ChainResolver = resolver
+	}
+	if opt.MaxDepth == 0 {
+		opt.MaxDepth = 8
+	}
+	var rewrite replaceExpressions
+	for _, o := range opt.Rewrite {
+		re, err := regexp.Compile(o.From)
+		if err != nil {
+			return nil, err
+		}
+		rewrite = append(rewrite, replaceExp{re, o.To})
+	}
+	return &CNAME{id: id, resolver: resolver, opt: opt, rewrite: rewrite}, nil
+}
+
+// Resolve a DNS query, then rewrite and flatten any CNAME chain in the response.
+func (r *CNAME) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return nil, errors.New("no question in query")
+	}
+	a, err := r.resolver.Resolve(q, ci)
+	if err != nil || a == nil || a.Rcode != dns.RcodeSuccess {
+		return a, err
+	}
+	question := q.Question[0]
+	if question.Qtype == dns.TypeCNAME || findCNAME(a.Answer, question.Name) == nil {
+		return a, nil
+	}
+	log := logger(r.id, q, ci)
+
+	var (
+		chain    []dns.RR // CNAME records from the query name to the final name
+		final    []dns.RR // Records at the end of the chain
+		answer   = a.Answer
+		name     = question.Name
+		resolved bool // The current name was resolved separately
+	)
+	for {
+		if cname := findCNAME(answer, name); cname != nil {
+			if len(chain) >= r.opt.MaxDepth {
+				log.WithField("depth", len(chain)).Debug("cname chain too long, returning response unmodified")
+				return a, nil
+			}
+			chain = append(chain, cname)
+			if target := r.rewrite.apply(cname.Target); target != cname.Target {
+				log.WithFields(logrus.Fields{"target": cname.Target, "new-target": target}).Debug("rewriting cname target")
+				cname.Target = target
+				// The records for the old target don't apply anymore
+				answer = nil
+			}
+			name = cname.Target
+			resolved = false
+			continue
+		}
+		final = recordsForName(answer, name, question.Qtype)
+		if len(final) > 0 || resolved {
+			break
+		}
+		// The chain is incomplete, or was rewritten, so look up the current name.
+		log.WithField("name", name).Debug("resolving cname target")
+		sub := q.Copy()
+		sub.Id = dns.Id()
+		sub.Question[0].Name = name
+		resp, err := r.opt.ChainResolver.Resolve(sub, ci)
+		if err != nil || resp == nil {
+			return resp, err
+		}
+		if resp.Rcode != dns.RcodeSuccess {
+			a.Rcode = resp.Rcode
+		}
+		a.Ns = resp.Ns
+		answer = resp.Answer
+		resolved = true
+	}
+
+	if r.opt.Flatten {
+		ttl := lowestTTL(chain)
+		a.Answer = make([]dns.RR, 0, len(final))
+		for _, rr := range final {
+			rr = dns.Copy(rr)
+			rr.Header().Name = question.Name
+			if rr.Header().Ttl > ttl {
+				rr.Header().Ttl = ttl
+			}
+			a.Answer = append(a.Answer, rr)
+		}
+		return a, nil
+	}
+	a.Answer = append(chain, final...)
+	return a, nil
+}
+
+func (r *CNAME) String() string {
+	return r.id
+}
+
+// Returns the CNAME record for a name, or nil if there isn't one.
+func findCNAME(records []dns.RR, name string) *dns.CNAME {
+	for _, rr := range records {
+		if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+			return cname
+		}
+	}
+	return nil
+}
+
+// Returns all records of a type for a name.
+func recordsForName(records []dns.RR, name string, qtype uint16) []dns.RR {
+	var out []dns.RR
+	for _, rr := range records {
+		if rr.Header().Rrtype == qtype && strings.EqualFold(rr.Header().Name, name) {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+// Returns the lowest TTL of a list of records.
+func lowestTTL(records []dns.RR) uint32 {
+	ttl := ^uint32(0)
+	for _, rr := range records {
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	return ttl
+}
@@ -0,0 +1,65 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCNAME(t *testing.T) {
+	var ci ClientInfo
+
+	// Upstream that returns an incomplete chain for www.test.
+	records := map[string][]string{
+		"www.test.": {
+			"www.test. 60 IN CNAME a.cdn.test.",
+			"a.cdn.test. 300 IN CNAME b.cdn.test.",
+		},
+		"b.cdn.test.":     {"b.cdn.test. 600 IN A 192.0.2.1"},
+		"other.cdn.test.": {"other.cdn.test. 600 IN A 192.0.2.2"},
+	}
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			for _, s := range records[q.Question[0].Name] {
+				rr, err := dns.NewRR(s)
+				require.NoError(t, err)
+				a.Answer = append(a.Answer, rr)
+			}
+			return a, nil
+		},
+	}
+
+	// Flatten the chain, the missing part is resolved separately
+	r, err := NewCNAME("test-cname", upstream, CNAMEOptions{Flatten: true})
+	require.NoError(t, err)
+	q := new(dns.Msg)
+	q.SetQuestion("www.test.", dns.TypeA)
+	a, err := r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 2, upstream.HitCount())
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, "www.test.", a.Answer[0].Header().Name)
+	require.Equal(t, uint32(60), a.Answer[0].Header().Ttl)
+	require.Equal(t, "192.0.2.1", a.Answer[0].(*dns.A).A.String())
+
+	// Rewrite the end of the chain without flattening
+	r, err = NewCNAME("test-cname", upstream, CNAMEOptions{
+		Rewrite: []ReplaceOperation{{From: `^b\.cdn\.test\.$`, To: "other.cdn.test."}},
+	})
+	require.NoError(t, err)
+	a, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Len(t, a.Answer, 3)
+	require.Equal(t, "other.cdn.test.", a.Answer[1].(*dns.CNAME).Target)
+	require.Equal(t, "other.cdn.test.", a.Answer[2].Header().Name)
+	require.Equal(t, "192.0.2.2", a.Answer[2].(*dns.A).A.String())
+
+	// Responses without CNAME are passed through
+	q.SetQuestion("b.cdn.test.", dns.TypeA)
+	a, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Len(t, a.Answer, 1)
+}
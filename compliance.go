@@ -0,0 +1,103 @@
+package rdns
+
+import (
+	"github.com/miekg/dns"
+)
+
+// Compliance defines how strictly listeners follow the EDNS0 specification
+// (RFC 6891) when handling queries and responses. By default, queries and
+// responses are passed through mostly as they are. The strict profile makes
+// listeners behave like conformance checks, such as the EDNS compliance tests
+// used by DNS Flag Day and OS vendors, expect. Individual checks can be relaxed
+// for clients or resolvers that don't cope with them.
+type Compliance struct {
+	// Enables the strict profile:
+	//  - Queries with more than one OPT record are answered with FORMERR.
+	//  - Queries with an EDNS version other than 0 are answered with BADVERS
+	//    and an OPT record with version 0, the highest supported version.
+	//  - Responses to queries without OPT record don't have one either.
+	//  - Responses to queries with OPT record have one, with version 0, the
+	//    DO bit copied from the query and the other flags cleared.
+	Strict bool
+
+	// Don't add an OPT record to responses to EDNS queries if the resolver
+	// didn't return one. Only used in strict mode.
+	TolerateMissingOPT bool
+
+	// Pass queries with EDNS versions other than 0 on to the resolver instead
+	// of responding with BADVERS. Only used in strict mode.
+	PassUnknownVersion bool
+}
+
+// Checks a query for compliance. If the query should not be passed on to the
+// resolver, the response and true is returned.
+func (c Compliance) apply(q *dns.Msg) (*dns.Msg, bool) {
+	if !c.Strict {
+		return nil, false
+	}
+	opts := optRecords(q)
+	switch {
+	case len(opts) > 1:
+		return responseWithCode(q, dns.RcodeFormatError), true
+	case len(opts) == 1 && opts[0].Version() != 0 && !c.PassUnknownVersion:
+		a := new(dns.Msg)
+		a.SetReply(q)
+		a.SetEdns0(opts[0].UDPSize(), opts[0].Do())
+		a.Rcode = dns.RcodeBadVers // The extended part is set in the OPT record when packing
+		return a, true
+	}
+	return nil, false
+}
+
+// Makes the OPT record of a response compliant with the query in strict mode.
+func (c Compliance) fixResponse(q, a *dns.Msg) {
+	if !c.Strict {
+		return
+	}
+	// Queries with more than one OPT record are malformed, the FORMERR
+	// response doesn't get an OPT record either
+	if len(optRecords(q)) > 1 {
+		return
+	}
+	edns0q := q.IsEdns0()
+	if edns0q == nil {
+		// The extended response code requires an OPT record
+		if a.Rcode <= 0xF {
+			stripEdns0(a)
+		}
+		return
+	}
+	edns0a := a.IsEdns0()
+	if edns0a == nil {
+		if c.TolerateMissingOPT {
+			return
+		}
+		a.SetEdns0(edns0q.UDPSize(), edns0q.Do())
+		return
+	}
+	edns0a.SetVersion(0)
+	// Clear all flags other than DO, which is copied from the query
+	edns0a.Hdr.Ttl &^= 0xFFFF
+	edns0a.SetDo(edns0q.Do())
+}
+
+// Returns all OPT records of a message.
+func optRecords(msg *dns.Msg) []*dns.OPT {
+	var opts []*dns.OPT
+	for _, rr := range msg.Extra {
+		if opt, ok := rr.(*dns.OPT); ok {
+			opts = append(opts, opt)
+		}
+	}
+	return opts
+}
+
+// Checks a query against the query policy and compliance settings of a
+// listener. If the query should not be passed on to the resolver, the response
+// and true is returned. A nil response means the query should be dropped.
+func (o ListenOptions) checkQuery(q *dns.Msg) (*dns.Msg, bool) {
+	if a, reject := o.QueryPolicy.apply(q); reject {
+		return a, true
+	}
+	return o.Compliance.apply(q)
+}
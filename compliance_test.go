@@ -0,0 +1,148 @@
+package rdns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// Runs queries modeled after the EDNS compliance tests (https://ednscomp.isc.org)
+// against a UDP listener in strict mode.
+func TestComplianceStrict(t *testing.T) {
+	// Upstream that copies the OPT record of the query into the response as is,
+	// including unknown versions and flags
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			if opt := q.IsEdns0(); opt != nil {
+				a.Extra = append(a.Extra, dns.Copy(opt))
+			}
+			return a, nil
+		},
+	}
+	addr, err := getUDPLnAddress()
+	require.NoError(t, err)
+	opt := ListenOptions{Compliance: Compliance{Strict: true}}
+	s := NewDNSListener("test-compliance", addr, "udp", opt, upstream)
+	go func() { _ = s.Start() }()
+	defer s.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	newQuery := func(edns bool) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeSOA)
+		if edns {
+			q.SetEdns0(4096, false)
+		}
+		return q
+	}
+
+	tests := []struct {
+		name    string
+		query   func() *dns.Msg
+		rcode   int
+		opt     bool // OPT record expected in the response
+		checkFn func(t *testing.T, opt *dns.OPT)
+	}{
+		{
+			name:  "plain",
+			query: func() *dns.Msg { return newQuery(false) },
+			rcode: dns.RcodeSuccess,
+		},
+		{
+			name:  "edns",
+			query: func() *dns.Msg { return newQuery(true) },
+			rcode: dns.RcodeSuccess,
+			opt:   true,
+			checkFn: func(t *testing.T, opt *dns.OPT) {
+				require.Equal(t, uint8(0), opt.Version())
+			},
+		},
+		{
+			name: "edns1",
+			query: func() *dns.Msg {
+				q := newQuery(true)
+				q.IsEdns0().SetVersion(1)
+				return q
+			},
+			rcode: dns.RcodeBadVers,
+			opt:   true,
+			checkFn: func(t *testing.T, opt *dns.OPT) {
+				require.Equal(t, uint8(0), opt.Version())
+			},
+		},
+		{
+			name: "ednsflags",
+			query: func() *dns.Msg {
+				q := newQuery(true)
+				q.IsEdns0().Hdr.Ttl |= 0x80 // Unknown flag
+				return q
+			},
+			rcode: dns.RcodeSuccess,
+			opt:   true,
+			checkFn: func(t *testing.T, opt *dns.OPT) {
+				require.Equal(t, uint32(0), opt.Hdr.Ttl&0xFFFF)
+			},
+		},
+		{
+			name: "do",
+			query: func() *dns.Msg {
+				q := newQuery(true)
+				q.IsEdns0().SetDo()
+				return q
+			},
+			rcode: dns.RcodeSuccess,
+			opt:   true,
+			checkFn: func(t *testing.T, opt *dns.OPT) {
+				require.True(t, opt.Do())
+			},
+		},
+		{
+			name: "duplicate opt",
+			query: func() *dns.Msg {
+				q := newQuery(true)
+				q.Extra = append(q.Extra, dns.Copy(q.IsEdns0()))
+				return q
+			},
+			rcode: dns.RcodeFormatError,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, err := dns.Exchange(test.query(), addr)
+			require.NoError(t, err)
+			require.Equal(t, test.rcode, a.Rcode)
+			opt := a.IsEdns0()
+			require.Equal(t, test.opt, opt != nil)
+			if test.checkFn != nil {
+				test.checkFn(t, opt)
+			}
+		})
+	}
+}
+
+func TestComplianceDefault(t *testing.T) {
+	// Without the strict profile, queries with unknown versions are passed on
+	var c Compliance
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.SetEdns0(4096, false)
+	q.IsEdns0().SetVersion(1)
+	_, reject := c.apply(q)
+	require.False(t, reject)
+
+	// Strict mode with the compatibility flag passes them on as well
+	c = Compliance{Strict: true, PassUnknownVersion: true}
+	_, reject = c.apply(q)
+	require.False(t, reject)
+
+	// Responses without OPT record are left alone when tolerated
+	c = Compliance{Strict: true, TolerateMissingOPT: true}
+	a := new(dns.Msg)
+	a.SetReply(q)
+	c.fixResponse(q, a)
+	require.Nil(t, a.IsEdns0())
+}
@@ -0,0 +1,113 @@
+package rdns
+
+import (
+	"expvar"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ConcurrencyLimiter is a resolver that limits the number of queries that are
+// being processed by the upstream resolver at the same time. Queries exceeding
+// the limit can wait for a while, and are then dropped or sent to an alternate
+// resolver. This protects upstream links with limited capacity from floods of
+// queries.
+type ConcurrencyLimiter struct {
+	id       string
+	resolver Resolver
+	ConcurrencyLimiterOptions
+
+	slots   chan struct{}
+	metrics *ConcurrencyLimiterMetrics
+}
+
+var _ Resolver = &ConcurrencyLimiter{}
+
+type ConcurrencyLimiterOptions struct {
+	MaxConcurrent int           // Number of queries allowed to be in progress upstream
+	Wait          time.Duration // Time to wait for a query to finish when the limit is reached, 0 to not wait
+	LimitResolver Resolver      // Alternate resolver for queries exceeding the limit
+}
+
+type ConcurrencyLimiterMetrics struct {
+	// Count of queries.
+	query *expvar.Int
+	// Count of queries that have exceeded the limit.
+	exceed *expvar.Int
+	// Count of dropped queries.
+	drop *expvar.Int
+	// Number of queries currently in progress.
+	concurrent *expvar.Int
+}
+
+// NewConcurrencyLimiter returns a new instance of a concurrency limiter.
+func NewConcurrencyLimiter(id string, resolver Resolver, opt ConcurrencyLimiterOptions) *ConcurrencyLimiter {
+	if opt.MaxConcurrent <= 0 {
+		opt.MaxConcurrent = 100
+	}
+	return &ConcurrencyLimiter{
+		id:                        id,
+		resolver:                  resolver,
+		ConcurrencyLimiterOptions: opt,
+		slots:                     make(chan struct{}, opt.MaxConcurrent),
+		metrics: &ConcurrencyLimiterMetrics{
+			query:      getVarInt("router", id, "query"),
+			exceed:     getVarInt("router", id, "exceed"),
+			drop:       getVarInt("router", id, "drop"),
+			concurrent: getVarInt("router", id, "concurrent"),
+		},
+	}
+}
+
+// Resolve a DNS query if the number of queries in progress is below the limit.
+func (r *ConcurrencyLimiter) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	log := logger(r.id, q, ci)
+	r.metrics.query.Add(1)
+
+	if !r.acquire() {
+		r.metrics.exceed.Add(1)
+		if r.LimitResolver != nil {
+			log.WithField("resolver", r.LimitResolver).Debug("concurrency limit exceeded, forwarding to limit-resolver")
+			return r.LimitResolver.Resolve(q, ci)
+		}
+		r.metrics.drop.Add(1)
+		log.Debug("concurrency limit reached, dropping")
+		return nil, nil
+	}
+	defer r.release()
+
+	log.WithField("resolver", r.resolver).Debug("forwarding query to resolver")
+	return r.resolver.Resolve(q, ci)
+}
+
+func (r *ConcurrencyLimiter) String() string {
+	return r.id
+}
+
+// Takes a slot for a query, waiting for one to become available for up to the
+// configured time. Returns false if no slot is available.
+func (r *ConcurrencyLimiter) acquire() bool {
+	select {
+	case r.slots <- struct{}{}:
+		r.metrics.concurrent.Add(1)
+		return true
+	default:
+	}
+	if r.Wait <= 0 {
+		return false
+	}
+	timer := time.NewTimer(r.Wait)
+	defer timer.Stop()
+	select {
+	case r.slots <- struct{}{}:
+		r.metrics.concurrent.Add(1)
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (r *ConcurrencyLimiter) release() {
+	<-r.slots
+	r.metrics.concurrent.Add(-1)
+}
@@ -0,0 +1,58 @@
+package rdns
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcurrencyLimiter(t *testing.T) {
+	var ci ClientInfo
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			time.Sleep(200 * time.Millisecond)
+			return q, nil
+		},
+	}
+	limitResolver := new(TestResolver)
+	r := NewConcurrencyLimiter("test-limit", upstream, ConcurrencyLimiterOptions{
+		MaxConcurrent: 2,
+		LimitResolver: limitResolver,
+	})
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// Send more queries at the same time than allowed
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := r.Resolve(q, ci)
+			require.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, 2, upstream.HitCount())
+	require.Equal(t, 3, limitResolver.HitCount())
+
+	// With enough wait time, all queries go upstream
+	r = NewConcurrencyLimiter("test-limit-wait", upstream, ConcurrencyLimiterOptions{
+		MaxConcurrent: 2,
+		Wait:          time.Second,
+	})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a, err := r.Resolve(q, ci)
+			require.NoError(t, err)
+			require.NotNil(t, a)
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, 6, upstream.HitCount())
+}
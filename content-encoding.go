@@ -0,0 +1,33 @@
+package rdns
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Returns a reader that decodes content with the given HTTP content encoding.
+// Content without encoding is returned as is. Closing the reader releases
+// the decoder, but doesn't close r.
+func decodeContent(r io.Reader, encoding string) (io.ReadCloser, error) {
+	switch strings.ToLower(encoding) {
+	case "", "identity":
+		return ioutil.NopCloser(r), nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "deflate":
+		return zlib.NewReader(r)
+	case "zstd":
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unsupported content-encoding '%s'", encoding)
+}
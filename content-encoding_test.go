@@ -0,0 +1,55 @@
+package rdns
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeContent(t *testing.T) {
+	encoders := map[string]func(io.Writer) (io.WriteCloser, error){
+		"": func(w io.Writer) (io.WriteCloser, error) {
+			return nopWriteCloser{w}, nil
+		},
+		"gzip": func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+		"deflate": func(w io.Writer) (io.WriteCloser, error) {
+			return zlib.NewWriter(w), nil
+		},
+		"zstd": func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w)
+		},
+	}
+	for encoding, newEncoder := range encoders {
+		var buf bytes.Buffer
+		w, err := newEncoder(&buf)
+		require.NoError(t, err)
+		_, err = w.Write([]byte("test"))
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+
+		r, err := decodeContent(&buf, strings.ToUpper(encoding))
+		require.NoError(t, err, encoding)
+		out, err := ioutil.ReadAll(r)
+		require.NoError(t, err, encoding)
+		require.NoError(t, r.Close())
+		require.Equal(t, "test", string(out), encoding)
+	}
+
+	_, err := decodeContent(strings.NewReader("test"), "br")
+	require.Error(t, err)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
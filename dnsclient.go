@@ -3,6 +3,7 @@ package rdns
 import (
 	"crypto/tls"
 	"net"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
@@ -13,7 +14,8 @@ type DNSClient struct {
 	id       string
 	endpoint string
 	net      string
-	pipeline *Pipeline // Pipeline also provides operation metrics.
+	pipeline *PipelinePool // Pipeline also provides operation metrics.
+	fallback *Pipeline     // TCP pipeline used to retry truncated UDP responses, nil if disabled
 	opt      DNSClientOptions
 }
 
@@ -24,6 +26,20 @@ type DNSClientOptions struct {
 	// Sets the EDNS0 UDP size for all queries sent upstream. If set to 0, queries
 	// are not changed.
 	UDPSize uint16
+
+	// Time to wait for a response before the query fails. Default 1 second.
+	QueryTimeout time.Duration
+
+	// Repeat queries over TCP if the UDP response is truncated. Only used with UDP.
+	TCPFallback bool
+
+	// Number of connections to open to the upstream resolver. Queries are
+	// spread across them. Default 1.
+	Connections int
+
+	// Only accept responses with exactly the same case in the question name as
+	// the query. Not all servers preserve the case.
+	StrictCase bool
 }
 
 var _ Resolver = &DNSClient{}
@@ -51,13 +67,30 @@ func NewDNSClient(id, endpoint, network string, opt DNSClientOptions) (*DNSClien
 		TLSConfig: &tls.Config{},
 		UDPSize:   4096,
 	}
-	return &DNSClient{
+	d := &DNSClient{
 		id:       id,
 		net:      network,
 		endpoint: endpoint,
-		pipeline: NewPipeline(id, endpoint, client),
+		pipeline: NewPipelinePool(id, endpoint, client, opt.QueryTimeout, opt.Connections),
 		opt:      opt,
-	}, nil
+	}
+	d.pipeline.SetStrictCase(opt.StrictCase)
+
+	// Use a separate TCP connection for queries that need to be repeated because
+	// the UDP response was truncated
+	if opt.TCPFallback && network == "udp" {
+		if dialer != nil {
+			dialer = &net.Dialer{LocalAddr: &net.TCPAddr{IP: opt.LocalAddr}}
+		}
+		tcpClient := &dns.Client{
+			Net:       "tcp",
+			Dialer:    dialer,
+			TLSConfig: &tls.Config{},
+		}
+		d.fallback = NewPipelineWithTimeout(id, endpoint, tcpClient, opt.QueryTimeout)
+		d.fallback.SetStrictCase(opt.StrictCase)
+	}
+	return d, nil
 }
 
 // Resolve a DNS query.
@@ -71,7 +104,15 @@ func (d *DNSClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 
 	// Remove padding before sending over the wire in plain
 	stripPadding(q)
-	return d.pipeline.Resolve(q)
+	a, err := d.pipeline.ResolveContext(ci.ctx(), q)
+	if err == nil && a != nil && a.Truncated && d.fallback != nil {
+		logger(d.id, q, ci).WithField("resolver", d.endpoint).Debug("truncated response, repeating query over tcp")
+		a, err = d.fallback.ResolveContext(ci.ctx(), q)
+	}
+	if err == nil {
+		ci.recordUpstream(d.id)
+	}
+	return a, err
 }
 
 func (d *DNSClient) String() string {
@@ -1,6 +1,7 @@
 package rdns
 
 import (
+	"net"
 	"testing"
 
 	"github.com/miekg/dns"
@@ -24,3 +25,42 @@ func TestDNSClientSimpleUDP(t *testing.T) {
 	require.NoError(t, err)
 	require.NotEmpty(t, r.Answer)
 }
+
+func TestDNSClientTCPFallback(t *testing.T) {
+	// Start a server that truncates all responses over UDP but not over TCP
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	require.NoError(t, err)
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		a := new(dns.Msg)
+		a.SetReply(q)
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			a.Truncated = true
+		}
+		w.WriteMsg(a)
+	})
+	udpServer := &dns.Server{PacketConn: pc, Handler: handler}
+	tcpServer := &dns.Server{Listener: l, Handler: handler}
+	go udpServer.ActivateAndServe()
+	go tcpServer.ActivateAndServe()
+	defer udpServer.Shutdown()
+	defer tcpServer.Shutdown()
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeTXT)
+
+	// Without fallback, the truncated response is returned
+	d, err := NewDNSClient("test-dns", pc.LocalAddr().String(), "udp", DNSClientOptions{})
+	require.NoError(t, err)
+	a, err := d.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.True(t, a.Truncated)
+
+	// With fallback, the query is repeated over TCP
+	d, err = NewDNSClient("test-dns-fallback", pc.LocalAddr().String(), "udp", DNSClientOptions{TCPFallback: true})
+	require.NoError(t, err)
+	a, err = d.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.False(t, a.Truncated)
+}
@@ -2,6 +2,7 @@ package rdns
 
 import (
 	"net"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
@@ -10,7 +11,11 @@ import (
 // DNSListener is a standard DNS listener for UDP or TCP.
 type DNSListener struct {
 	*dns.Server
-	id string
+	id  string
+	opt DNSListenerOptions
+
+	// Additional servers sharing the same address when multiple sockets are used
+	servers []*dns.Server
 }
 
 var _ Listener = &DNSListener{}
@@ -18,18 +23,77 @@ var _ Listener = &DNSListener{}
 type ListenOptions struct {
 	// Network allowed to query this listener.
 	AllowedNet []*net.IPNet
+
+	// Disable restoring the case of the query name as sent by the client
+	// in the response. By default, names in the response are changed back
+	// to match the (possibly randomized) case of the original query.
+	DisableCaseRestore bool
+
+	// Defines how queries with zero or multiple questions, or unusual
+	// classes are handled.
+	QueryPolicy QueryPolicy
+
+	// Defines how strictly the EDNS0 specification is followed for queries
+	// and responses.
+	Compliance Compliance
+
+	// Expect connections to start with a PROXY protocol (v1 or v2) header
+	// and use the client address from it. Only supported on TCP, DoT and
+	// DoH listeners.
+	ProxyProtocol bool
+
+	// Networks of load balancers that send PROXY protocol headers. If set,
+	// connections from other addresses are used without a header.
+	ProxyProtocolTrusted []*net.IPNet
+
+	// Allow binding to an address that isn't assigned to the host yet, like
+	// a floating VRRP address on a standby node. Uses IP_FREEBIND on Linux
+	// and IP_BINDANY on FreeBSD. Not supported for QUIC and DTLS listeners.
+	Freebind bool
+
+	// Record accepted and refused connections and queries in a structured
+	// log. Connections are only recorded on TCP, DoT, DoH and DoQ listeners,
+	// TLS handshake failures only on DoT and DoH over TCP.
+	Audit *AuditLog
+}
+
+// DNSListenerOptions contains options used by the UDP and TCP listeners.
+type DNSListenerOptions struct {
+	ListenOptions
+
+	// Number of sockets to open on the same address using SO_REUSEPORT. Each
+	// socket has its own read loop and the kernel distributes incoming packets
+	// between them. Only supported for UDP on Linux and BSD. Default 1.
+	Sockets int
 }
 
 // NewDNSListener returns an instance of either a UDP or TCP DNS listener.
 func NewDNSListener(id, addr, net string, opt ListenOptions, resolver Resolver) *DNSListener {
-	return &DNSListener{
-		id: id,
-		Server: &dns.Server{
-			Addr:    addr,
-			Net:     net,
-			Handler: listenHandler(id, net, addr, resolver, opt.AllowedNet),
-		},
+	return NewDNSListenerWithOptions(id, addr, net, DNSListenerOptions{ListenOptions: opt}, resolver)
+}
+
+// NewDNSListenerWithOptions returns a UDP or TCP DNS listener like NewDNSListener,
+// with options specific to these protocols.
+func NewDNSListenerWithOptions(id, addr, net string, opt DNSListenerOptions, resolver Resolver) *DNSListener {
+	handler := listenHandler(id, net, addr, resolver, opt.ListenOptions)
+	newServer := func() *dns.Server {
+		return &dns.Server{
+			Addr:          addr,
+			Net:           net,
+			Handler:       handler,
+			MsgAcceptFunc: policyMsgAcceptFunc,
+			ReusePort:     opt.Sockets > 1,
+		}
+	}
+	l := &DNSListener{
+		id:     id,
+		opt:    opt,
+		Server: newServer(),
+	}
+	for i := 1; i < opt.Sockets; i++ {
+		l.servers = append(l.servers, newServer())
 	}
+	return l
 }
 
 // Start the DNS listener.
@@ -37,8 +101,82 @@ func (s DNSListener) Start() error {
 	Log.WithFields(logrus.Fields{
 		"id":       s.id,
 		"protocol": s.Net,
-		"addr":     s.Addr}).Info("starting listener")
-	return s.ListenAndServe()
+		"addr":     s.Addr,
+		"sockets":  len(s.servers) + 1}).Info("starting listener")
+	s.opt.Audit.register()
+	// Open the sockets here since the server can't set IP_FREEBIND, and so
+	// they can be handed over to a new instance
+	if s.Net == "tcp" {
+		ln, err := listenTCP(s.Addr, s.opt.ListenOptions)
+		if err != nil {
+			return err
+		}
+		if s.opt.Audit != nil {
+			ln = &auditListener{Listener: ln, audit: s.opt.Audit}
+		}
+		s.Listener = ln
+		return s.ActivateAndServe()
+	}
+	servers := append([]*dns.Server{s.Server}, s.servers...)
+	for i, srv := range servers {
+		pc, err := listenUDP(s.Addr, s.opt.ListenOptions, len(servers) > 1)
+		if err != nil {
+			for _, srv := range servers[:i] {
+				srv.PacketConn.Close()
+			}
+			return err
+		}
+		srv.PacketConn = pc
+	}
+	if len(servers) == 1 {
+		return s.ActivateAndServe()
+	}
+
+	// Run all servers and stop the others when one of them fails, so the
+	// listener can be restarted on all sockets
+	errCh := make(chan error, len(servers))
+	done := make([]chan struct{}, len(servers))
+	for i, srv := range servers {
+		done[i] = make(chan struct{})
+		go func(srv *dns.Server, done chan struct{}) {
+			errCh <- srv.ActivateAndServe()
+			close(done)
+		}(srv, done[i])
+	}
+	err := <-errCh
+	for i, srv := range servers {
+		shutdownServer(srv, done[i])
+	}
+	return err
+}
+
+// Stops a server that may still be starting up, which can only be shut down
+// once it's running.
+func shutdownServer(srv *dns.Server, done <-chan struct{}) {
+	for srv.Shutdown() != nil {
+		select {
+		case <-done:
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// Stop the listener, including all sockets if there are multiple.
+func (s DNSListener) Stop() error {
+	Log.WithFields(logrus.Fields{"id": s.id, "protocol": s.Net, "addr": s.Addr}).Info("stopping listener")
+	var firstErr error
+	for _, srv := range append([]*dns.Server{s.Server}, s.servers...) {
+		if err := srv.Shutdown(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Close releases the audit log of the listener after it stopped.
+func (s DNSListener) Close() error {
+	return s.opt.Audit.Close()
 }
 
 func (s DNSListener) String() string {
@@ -46,7 +184,7 @@ func (s DNSListener) String() string {
 }
 
 // DNS handler to forward all incoming requests to a given resolver.
-func listenHandler(id, protocol, addr string, r Resolver, allowedNet []*net.IPNet) dns.HandlerFunc {
+func listenHandler(id, protocol, addr string, r Resolver, opt ListenOptions) dns.HandlerFunc {
 	metrics := NewListenerMetrics("listener", id)
 	return func(w dns.ResponseWriter, req *dns.Msg) {
 		var (
@@ -60,13 +198,34 @@ func listenHandler(id, protocol, addr string, r Resolver, allowedNet []*net.IPNe
 		case *net.UDPAddr:
 			ci.SourceIP = addr.IP
 		}
+		ci.Listener = id
+		if cs, ok := w.(dns.ConnectionStater); ok {
+			ci.TLSClientCert = peerCertificate(cs.ConnectionState())
+		}
 
 		log := Log.WithFields(logrus.Fields{"id": id, "client": ci.SourceIP, "qname": qName(req), "protocol": protocol, "addr": addr})
 		log.Debug("received query")
 		metrics.query.Add(1)
 
+		// Remember the name as sent by the client, elements in the pipeline
+		// may modify the query
+		origName := qName(req)
+
 		a := new(dns.Msg)
-		if isAllowed(allowedNet, ci.SourceIP) {
+		if !isAllowed(opt.AllowedNet, ci.SourceIP) {
+			metrics.err.Add("acl", 1)
+			log.Debug("refusing client ip")
+			opt.Audit.refused(ci.SourceIP, AuditReasonACL, req, nil)
+			a.SetRcode(req, dns.RcodeRefused)
+		} else if sheddingLoad() {
+			metrics.err.Add("overload", 1)
+			log.Debug("refusing query, over watchdog limits")
+			a.SetRcode(req, dns.RcodeRefused)
+		} else if resp, reject := opt.checkQuery(req); reject {
+			metrics.err.Add("policy", 1)
+			log.Debug("query rejected by policy")
+			a = resp
+		} else {
 			log.WithField("resolver", r.String()).Trace("forwarding query to resolver")
 			a, err = r.Resolve(req, ci)
 			if err != nil {
@@ -74,10 +233,6 @@ func listenHandler(id, protocol, addr string, r Resolver, allowedNet []*net.IPNe
 				log.WithError(err).Error("failed to resolve")
 				a = servfail(req)
 			}
-		} else {
-			metrics.err.Add("acl", 1)
-			log.Debug("refusing client ip")
-			a.SetRcode(req, dns.RcodeRefused)
 		}
 
 		// A nil response from the resolvers means "drop", close the connection
@@ -87,6 +242,11 @@ func listenHandler(id, protocol, addr string, r Resolver, allowedNet []*net.IPNe
 			return
 		}
 
+		if !opt.DisableCaseRestore {
+			restoreQueryCase(origName, a)
+		}
+		opt.Compliance.fixResponse(req, a)
+
 		// If the client asked via DoT and EDNS0 is enabled, the response should be padded for extra security.
 		// See rfc7830 and rfc8467.
 		if protocol == "dot" || protocol == "dtls" {
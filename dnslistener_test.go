@@ -0,0 +1,29 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSListenerSocketsStop(t *testing.T) {
+	addr, err := getUDPLnAddress()
+	require.NoError(t, err)
+	s := NewDNSListenerWithOptions("test-sockets-ln", addr, "udp", DNSListenerOptions{Sockets: 3}, new(TestResolver))
+	done := make(chan error)
+	go func() { done <- s.Start() }()
+	time.Sleep(100 * time.Millisecond)
+
+	// One of the sockets stops, the others are closed as well
+	require.NoError(t, s.Server.Shutdown())
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("listener didn't stop")
+	}
+	pc, err := net.ListenPacket("udp", addr)
+	require.NoError(t, err)
+	pc.Close()
+}
@@ -0,0 +1,120 @@
+package rdns
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// DNSSECPolicy controls DNSSEC for a set of clients. Queries from these
+// clients with the DO bit set are either passed on without it, or refused.
+// Queries from all other clients are passed through unchanged. Used to roll
+// out DNSSEC to some clients while others that don't handle it well yet
+// continue to get plain responses.
+type DNSSECPolicy struct {
+	id       string
+	resolver Resolver
+	opt      DNSSECPolicyOptions
+	metrics  *DNSSECPolicyMetrics
+}
+
+type DNSSECPolicyMetrics struct {
+	// Count of queries with the DO bit removed.
+	stripped *expvar.Int
+	// Count of refused queries.
+	refused *expvar.Int
+}
+
+var _ Resolver = &DNSSECPolicy{}
+
+type DNSSECPolicyOptions struct {
+	// "strip" (default) to clear the DO bit in queries and remove DNSSEC
+	// records from responses, or "refuse" to answer with REFUSED.
+	Action string
+
+	// Networks of the clients the policy applies to. Applies to all clients
+	// if empty.
+	ClientNets []*net.IPNet
+}
+
+// NewDNSSECPolicy returns a new instance of a DNSSEC policy element.
+func NewDNSSECPolicy(id string, resolver Resolver, opt DNSSECPolicyOptions) (*DNSSECPolicy, error) {
+	switch opt.Action {
+	case "":
+		opt.Action = "strip"
+	case "strip", "refuse":
+	default:
+		return nil, fmt.Errorf("unsupported dnssec action '%s'", opt.Action)
+	}
+	return &DNSSECPolicy{
+		id:       id,
+		resolver: resolver,
+		opt:      opt,
+		metrics: &DNSSECPolicyMetrics{
+			stripped: getVarInt("dnssec-policy", id, "stripped"),
+			refused:  getVarInt("dnssec-policy", id, "refused"),
+		},
+	}, nil
+}
+
+// Resolve a DNS query after applying the DNSSEC policy.
+func (r *DNSSECPolicy) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return nil, errors.New("no question in query")
+	}
+	edns0 := q.IsEdns0()
+	if edns0 == nil || !edns0.Do() || !isAllowed(r.opt.ClientNets, ci.SourceIP) {
+		return r.resolver.Resolve(q, ci)
+	}
+	log := logger(r.id, q, ci)
+
+	if r.opt.Action == "refuse" {
+		r.metrics.refused.Add(1)
+		log.Debug("refusing dnssec query")
+		return refused(q), nil
+	}
+
+	r.metrics.stripped.Add(1)
+	log.Debug("removing do bit from query")
+	newQ := q.Copy()
+	newQ.IsEdns0().SetDo(false)
+	a, err := r.resolver.Resolve(newQ, ci)
+	if err != nil || a == nil {
+		return a, err
+	}
+
+	// Upstream resolvers shouldn't send DNSSEC records without the DO bit,
+	// but they could still come from a cache
+	qtype := q.Question[0].Qtype
+	a.Answer = stripDNSSEC(a.Answer, qtype)
+	a.Ns = stripDNSSEC(a.Ns, qtype)
+	a.Extra = stripDNSSEC(a.Extra, qtype)
+	a.AuthenticatedData = false
+	if opt := a.IsEdns0(); opt != nil {
+		opt.SetDo(false)
+	}
+	return a, nil
+}
+
+func (r *DNSSECPolicy) String() string {
+	return r.id
+}
+
+// Removes DNSSEC records from a section of a response, other than those of
+// the queried type.
+func stripDNSSEC(rrs []dns.RR, qtype uint16) []dns.RR {
+	out := rrs[:0]
+	for _, rr := range rrs {
+		switch t := rr.Header().Rrtype; t {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+			if t != qtype {
+				continue
+			}
+		}
+		out = append(out, rr)
+	}
+	return out
+}
@@ -0,0 +1,75 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSSECPolicyStrip(t *testing.T) {
+	var doReceived bool
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			doReceived = q.IsEdns0() != nil && q.IsEdns0().Do()
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.AuthenticatedData = true
+			a.Answer = []dns.RR{
+				&dns.A{Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET}, A: net.IP{1, 2, 3, 4}},
+				&dns.RRSIG{Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET}, TypeCovered: dns.TypeA},
+			}
+			return a, nil
+		},
+	}
+	_, ipNet, _ := net.ParseCIDR("192.168.10.0/24")
+	g, err := NewDNSSECPolicy("test-dnssec-strip", upstream, DNSSECPolicyOptions{
+		ClientNets: []*net.IPNet{ipNet},
+	})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.SetEdns0(4096, true)
+
+	// Clients in the network get responses without DNSSEC records
+	a, err := g.Resolve(q, ClientInfo{SourceIP: net.ParseIP("192.168.10.1")})
+	require.NoError(t, err)
+	require.False(t, doReceived)
+	require.False(t, a.AuthenticatedData)
+	require.Len(t, a.Answer, 1)
+	require.True(t, q.IsEdns0().Do(), "original query must not be modified")
+
+	// Other clients get the query passed through unchanged
+	a, err = g.Resolve(q, ClientInfo{SourceIP: net.ParseIP("192.168.20.1")})
+	require.NoError(t, err)
+	require.True(t, doReceived)
+	require.True(t, a.AuthenticatedData)
+	require.Len(t, a.Answer, 2)
+}
+
+func TestDNSSECPolicyRefuse(t *testing.T) {
+	upstream := new(TestResolver)
+	g, err := NewDNSSECPolicy("test-dnssec-refuse", upstream, DNSSECPolicyOptions{
+		Action: "refuse",
+	})
+	require.NoError(t, err)
+
+	// Queries without the DO bit are passed through
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err = g.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 1, upstream.HitCount())
+
+	// Queries with the DO bit are refused
+	q.SetEdns0(4096, true)
+	a, err := g.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeRefused, a.Rcode)
+	require.Equal(t, 1, upstream.HitCount())
+
+	_, err = NewDNSSECPolicy("test-dnssec-invalid", upstream, DNSSECPolicyOptions{Action: "invalid"})
+	require.Error(t, err)
+}
@@ -0,0 +1,182 @@
+package rdns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// Minimal implementation of the Frame Streams protocol and the dnstap
+// protobuf schema, just enough to read the client queries sent by other
+// DNS servers. See https://dnstap.info and
+// https://github.com/farsightsec/fstrm for the specifications.
+
+// Content type of dnstap frame streams.
+const dnstapContentType = "protobuf:dnstap.Dnstap"
+
+// Frame Streams control frame types.
+const (
+	fstrmControlAccept = 0x01
+	fstrmControlStart  = 0x02
+	fstrmControlStop   = 0x03
+	fstrmControlReady  = 0x04
+	fstrmControlFinish = 0x05
+)
+
+const (
+	// Field type of the content type in control frames.
+	fstrmFieldContentType = 0x01
+
+	// Control frames larger than this are invalid.
+	fstrmMaxControlFrameSize = 512
+
+	// Data frames larger than this are rejected, a dnstap message carries at
+	// most two DNS messages.
+	fstrmMaxDataFrameSize = 256 * 1024
+)
+
+// Dnstap message type of queries received from clients.
+const dnstapClientQuery = 5
+
+// A frame read from a Frame Streams connection. Control frames have a
+// non-zero control type, data frames have a payload.
+type fstrmFrame struct {
+	control uint32
+	data    []byte
+}
+
+// Reads the next frame from a Frame Streams connection.
+func readFstrmFrame(r io.Reader) (fstrmFrame, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return fstrmFrame{}, err
+	}
+	if length > 0 {
+		if length > fstrmMaxDataFrameSize {
+			return fstrmFrame{}, fmt.Errorf("data frame of %d bytes exceeds the maximum size", length)
+		}
+		b := make([]byte, length)
+		_, err := io.ReadFull(r, b)
+		return fstrmFrame{data: b}, err
+	}
+
+	// A length of 0 is the escape sequence for control frames
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return fstrmFrame{}, err
+	}
+	if length < 4 || length > fstrmMaxControlFrameSize {
+		return fstrmFrame{}, fmt.Errorf("invalid control frame length %d", length)
+	}
+	b := make([]byte, length)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return fstrmFrame{}, err
+	}
+	// The content type fields are ignored, only dnstap is supported
+	return fstrmFrame{control: binary.BigEndian.Uint32(b)}, nil
+}
+
+// Writes a control frame with the dnstap content type.
+func writeFstrmControl(w io.Writer, control uint32) error {
+	b := make([]byte, 0, 20+len(dnstapContentType))
+	b = appendUint32(b, 0)
+	b = appendUint32(b, uint32(12+len(dnstapContentType)))
+	b = appendUint32(b, control)
+	b = appendUint32(b, fstrmFieldContentType)
+	b = appendUint32(b, uint32(len(dnstapContentType)))
+	b = append(b, dnstapContentType...)
+	_, err := w.Write(b)
+	return err
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// The parts of a dnstap message needed to replay queries.
+type dnstapMessage struct {
+	typ          uint64
+	queryAddress net.IP
+	queryMessage []byte
+}
+
+// Decodes a dnstap protobuf message. Fields that aren't needed are skipped.
+func parseDnstap(b []byte) (dnstapMessage, error) {
+	var (
+		msg   dnstapMessage
+		found bool
+	)
+	err := protoFields(b, func(num int, v uint64, data []byte) error {
+		if num != 14 { // Dnstap.message
+			return nil
+		}
+		found = true
+		return protoFields(data, func(num int, v uint64, data []byte) error {
+			switch num {
+			case 1: // Message.type
+				msg.typ = v
+			case 4: // Message.query_address
+				msg.queryAddress = net.IP(data)
+			case 10: // Message.query_message
+				msg.queryMessage = data
+			}
+			return nil
+		})
+	})
+	if err == nil && !found {
+		err = errors.New("no message in dnstap frame")
+	}
+	return msg, err
+}
+
+// Calls fn for every field in a protobuf message, with the value for varint
+// fields, or the data for length-delimited fields.
+func protoFields(b []byte, fn func(num int, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errors.New("invalid protobuf field key")
+		}
+		b = b[n:]
+		var (
+			v    uint64
+			data []byte
+		)
+		switch key & 0x7 {
+		case 0: // varint
+			v, n = binary.Uvarint(b)
+			if n <= 0 {
+				return errors.New("invalid protobuf varint")
+			}
+			b = b[n:]
+		case 1: // 64-bit
+			if len(b) < 8 {
+				return io.ErrUnexpectedEOF
+			}
+			v = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case 2: // length-delimited
+			length, n := binary.Uvarint(b)
+			if n <= 0 || length > uint64(len(b)-n) {
+				return errors.New("invalid protobuf field length")
+			}
+			data = b[n : n+int(length)]
+			b = b[n+int(length):]
+		case 5: // 32-bit
+			if len(b) < 4 {
+				return io.ErrUnexpectedEOF
+			}
+			v = uint64(binary.LittleEndian.Uint32(b))
+			b = b[4:]
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d", key&0x7)
+		}
+		if err := fn(int(key>>3), v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
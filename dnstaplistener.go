@@ -0,0 +1,204 @@
+package rdns
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// Maximum number of replayed queries resolved at the same time. Queries
+// arriving while the limit is reached are dropped rather than slowing down
+// the sender.
+const dnstapMaxInFlight = 256
+
+// DnstapListener accepts dnstap streams from other DNS servers and runs the
+// client queries in them through the pipeline. The responses are discarded,
+// the queries are only replayed, for example to log them or to test a
+// configuration against real traffic without serving it.
+type DnstapListener struct {
+	id       string
+	addr     string
+	opt      DnstapListenerOptions
+	resolver Resolver
+	metrics  *ListenerMetrics
+	inFlight chan struct{}
+
+	mu sync.Mutex // protects ln
+	ln net.Listener
+}
+
+var _ Listener = &DnstapListener{}
+
+// DnstapListenerOptions contains options used by the dnstap listener.
+type DnstapListenerOptions struct {
+	ListenOptions
+
+	// Network to listen on, "tcp" (default) or "unix" in which case the
+	// address is the path of the socket.
+	Network string
+}
+
+// NewDnstapListener returns an instance of a dnstap listener.
+func NewDnstapListener(id, addr string, opt DnstapListenerOptions, resolver Resolver) *DnstapListener {
+	if opt.Network == "" {
+		opt.Network = "tcp"
+	}
+	return &DnstapListener{
+		id:       id,
+		addr:     addr,
+		opt:      opt,
+		resolver: resolver,
+		metrics:  NewListenerMetrics("listener", id),
+		inFlight: make(chan struct{}, dnstapMaxInFlight),
+	}
+}
+
+// Start the dnstap listener.
+func (s *DnstapListener) Start() error {
+	Log.WithFields(logrus.Fields{"id": s.id, "protocol": "dnstap", "network": s.opt.Network, "addr": s.addr}).Info("starting listener")
+	var (
+		ln  net.Listener
+		err error
+	)
+	if s.opt.Network == "tcp" {
+		ln, err = listenTCP(s.addr, s.opt.ListenOptions)
+	} else {
+		ln, err = net.Listen(s.opt.Network, s.addr)
+	}
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.ln = ln
+	s.mu.Unlock()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serve(conn)
+	}
+}
+
+// Stop the listener. Connections from senders that are already established
+// are served until they're closed.
+func (s *DnstapListener) Stop() error {
+	Log.WithFields(logrus.Fields{"id": s.id, "protocol": "dnstap", "addr": s.addr}).Info("stopping listener")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ln == nil {
+		return nil
+	}
+	return s.ln.Close()
+}
+
+func (s *DnstapListener) String() string {
+	return s.id
+}
+
+// Reads frames from a dnstap sender until it closes the stream.
+func (s *DnstapListener) serve(conn net.Conn) {
+	defer conn.Close()
+	log := Log.WithFields(logrus.Fields{"id": s.id, "protocol": "dnstap", "sender": conn.RemoteAddr().String()})
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && !isAllowed(s.opt.AllowedNet, addr.IP) {
+		log.Debug("refusing sender ip")
+		return
+	}
+	log.Debug("accepted dnstap connection")
+	if err := s.readStream(bufio.NewReader(conn), conn); err != nil && err != io.EOF {
+		log.WithError(err).Warn("failed to read dnstap stream")
+	}
+}
+
+// Handles the Frame Streams handshake and the data frames. Senders in
+// bi-directional mode start with a READY frame and expect an ACCEPT, and a
+// FINISH after they send STOP. Senders in uni-directional mode start with
+// START right away.
+func (s *DnstapListener) readStream(r io.Reader, w io.Writer) error {
+	var bidirectional, started bool
+	for {
+		f, err := readFstrmFrame(r)
+		if err != nil {
+			return err
+		}
+		switch f.control {
+		case 0:
+			if !started {
+				return errors.New("data frame before START")
+			}
+			s.handleFrame(f.data)
+		case fstrmControlReady:
+			bidirectional = true
+			if err := writeFstrmControl(w, fstrmControlAccept); err != nil {
+				return err
+			}
+		case fstrmControlStart:
+			started = true
+		case fstrmControlStop:
+			if bidirectional {
+				return writeFstrmControl(w, fstrmControlFinish)
+			}
+			return nil
+		default:
+			return fmt.Errorf("unexpected control frame type %d", f.control)
+		}
+	}
+}
+
+// Replays the client query in a dnstap frame, all other message types
+// are ignored.
+func (s *DnstapListener) handleFrame(b []byte) {
+	m, err := parseDnstap(b)
+	if err != nil {
+		s.metrics.err.Add("dnstap", 1)
+		Log.WithField("id", s.id).WithError(err).Debug("failed to decode dnstap frame")
+		return
+	}
+	if m.typ != dnstapClientQuery || m.queryMessage == nil {
+		return
+	}
+	q := new(dns.Msg)
+	if err := q.Unpack(m.queryMessage); err != nil {
+		s.metrics.err.Add("unpack", 1)
+		Log.WithField("id", s.id).WithError(err).Debug("failed to decode query in dnstap frame")
+		return
+	}
+	s.metrics.query.Add(1)
+
+	select {
+	case s.inFlight <- struct{}{}:
+	default:
+		s.metrics.drop.Add(1)
+		return
+	}
+	go func() {
+		defer func() { <-s.inFlight }()
+		s.resolve(q, ClientInfo{SourceIP: m.queryAddress, Listener: s.id})
+	}()
+}
+
+func (s *DnstapListener) resolve(q *dns.Msg, ci ClientInfo) {
+	log := Log.WithFields(logrus.Fields{"id": s.id, "client": ci.SourceIP, "qname": qName(q), "protocol": "dnstap"})
+	log.Debug("replaying query")
+	if _, reject := s.opt.checkQuery(q); reject {
+		s.metrics.err.Add("policy", 1)
+		return
+	}
+	a, err := s.resolver.Resolve(q, ci)
+	if err != nil {
+		s.metrics.err.Add("resolve", 1)
+		log.WithError(err).Debug("failed to resolve")
+		return
+	}
+	if a == nil {
+		s.metrics.drop.Add(1)
+		return
+	}
+	s.metrics.response.Add(rCode(a), 1)
+}
@@ -0,0 +1,89 @@
+package rdns
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDnstapListener(t *testing.T) {
+	received := make(chan ClientInfo, 1)
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			require.Equal(t, "example.com.", q.Question[0].Name)
+			received <- ci
+			return new(dns.Msg).SetReply(q), nil
+		},
+	}
+	l := NewDnstapListener("test-dnstap", "", DnstapListenerOptions{}, r)
+
+	sender, receiver := net.Pipe()
+	defer sender.Close()
+	done := make(chan error)
+	go func() {
+		done <- l.readStream(bufio.NewReader(receiver), receiver)
+	}()
+
+	// Bi-directional handshake
+	require.NoError(t, writeFstrmControl(sender, fstrmControlReady))
+	f, err := readFstrmFrame(sender)
+	require.NoError(t, err)
+	require.Equal(t, uint32(fstrmControlAccept), f.control)
+	require.NoError(t, writeFstrmControl(sender, fstrmControlStart))
+
+	// A response is ignored, the client query is replayed
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	packed, err := q.Pack()
+	require.NoError(t, err)
+	writeTestDnstap(t, sender, 6, net.ParseIP("192.0.2.1").To4(), packed)
+	writeTestDnstap(t, sender, dnstapClientQuery, net.ParseIP("192.0.2.1").To4(), packed)
+
+	ci := <-received
+	require.Equal(t, "192.0.2.1", ci.SourceIP.String())
+	require.Equal(t, "test-dnstap", ci.Listener)
+
+	// The stream ends with STOP and FINISH
+	require.NoError(t, writeFstrmControl(sender, fstrmControlStop))
+	f, err = readFstrmFrame(sender)
+	require.NoError(t, err)
+	require.Equal(t, uint32(fstrmControlFinish), f.control)
+	require.NoError(t, <-done)
+	require.Equal(t, 1, r.HitCount())
+}
+
+// Writes a data frame with a dnstap message.
+func writeTestDnstap(t *testing.T, w net.Conn, typ uint64, addr net.IP, query []byte) {
+	var msg []byte
+	msg = appendTestProtoVarint(msg, 1, typ)
+	msg = appendTestProtoBytes(msg, 4, addr)
+	msg = appendTestProtoBytes(msg, 10, query)
+	var b []byte
+	b = appendTestProtoBytes(b, 1, []byte("test"))
+	b = appendTestProtoBytes(b, 14, msg)
+	b = appendTestProtoVarint(b, 15, 1)
+
+	_, err := w.Write(append(appendUint32(nil, uint32(len(b))), b...))
+	require.NoError(t, err)
+}
+
+func appendTestProtoVarint(b []byte, num int, v uint64) []byte {
+	b = appendTestUvarint(b, uint64(num)<<3)
+	return appendTestUvarint(b, v)
+}
+
+func appendTestProtoBytes(b []byte, num int, data []byte) []byte {
+	b = appendTestUvarint(b, uint64(num)<<3|2)
+	b = appendTestUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+func appendTestUvarint(b []byte, v uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, v)
+	return append(b, buf[:n]...)
+}
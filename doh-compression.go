@@ -0,0 +1,74 @@
+package rdns
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Responses smaller than this are sent uncompressed by DoH listeners, the
+// savings would be eaten up by the overhead of the encoding.
+const dohCompressionMinSize = 512
+
+// Value of the Accept-Encoding header sent by DoH clients with compression.
+const dohAcceptEncoding = "gzip, deflate"
+
+// Returns the content encoding to use for a response, "gzip" or "deflate",
+// based on the Accept-Encoding header of the request. Returns an empty
+// string if the client doesn't support either.
+func dohContentEncoding(acceptEncoding string) string {
+	var gzipOK, deflateOK bool
+	for _, value := range strings.Split(acceptEncoding, ",") {
+		fields := strings.SplitN(value, ";", 2)
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		// An encoding with a quality of 0 is not acceptable
+		if len(fields) > 1 {
+			params := strings.TrimSpace(fields[1])
+			if strings.HasPrefix(params, "q=") {
+				if q, err := strconv.ParseFloat(params[2:], 64); err == nil && q == 0 {
+					continue
+				}
+			}
+		}
+		switch coding {
+		case "gzip", "*":
+			gzipOK = true
+		case "deflate":
+			deflateOK = true
+		}
+	}
+	switch {
+	case gzipOK:
+		return "gzip"
+	case deflateOK:
+		return "deflate"
+	}
+	return ""
+}
+
+// Compresses a response body with the given content encoding.
+func dohCompress(b []byte, encoding string) ([]byte, error) {
+	var (
+		buf bytes.Buffer
+		w   io.WriteCloser
+	)
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	default:
+		return nil, fmt.Errorf("unsupported content encoding '%s'", encoding)
+	}
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -7,6 +7,7 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -37,6 +38,19 @@ type DoHClientOptions struct {
 	// Local IP to use for outbound connections. If nil, a local address is chosen.
 	LocalAddr net.IP
 
+	// Proxy URL to tunnel connections through. Supported are "socks5://"
+	// and "http://". Only available with TCP transport and can't be used
+	// together with BootstrapAddr.
+	Proxy string
+
+	// Time to wait for a response before the query fails, including the time
+	// to establish a connection. No limit if 0.
+	QueryTimeout time.Duration
+
+	// Ask the server for compressed responses with the Accept-Encoding header.
+	// Compressed responses are accepted even if not enabled.
+	Compression bool
+
 	TLSConfig *tls.Config
 }
 
@@ -74,6 +88,7 @@ func NewDoHClient(id, endpoint string, opt DoHClientOptions) (*DoHClient, error)
 
 	client := &http.Client{
 		Transport: tr,
+		Timeout:   opt.QueryTimeout,
 	}
 
 	if opt.Method == "" {
@@ -105,17 +120,30 @@ func (d *DoHClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	padQuery(q)
 
 	d.metrics.query.Add(1)
+	var (
+		a   *dns.Msg
+		err error
+	)
 	switch d.opt.Method {
 	case "POST":
-		return d.ResolvePOST(q)
+		a, err = d.resolvePOST(ci.ctx(), q)
 	case "GET":
-		return d.ResolveGET(q)
+		a, err = d.resolveGET(ci.ctx(), q)
+	default:
+		return nil, errors.New("unsupported method")
+	}
+	if err == nil {
+		ci.recordUpstream(d.id)
 	}
-	return nil, errors.New("unsupported method")
+	return a, err
 }
 
 // ResolvePOST resolves a DNS query via DNS-over-HTTP using the POST method.
 func (d *DoHClient) ResolvePOST(q *dns.Msg) (*dns.Msg, error) {
+	return d.resolvePOST(context.Background(), q)
+}
+
+func (d *DoHClient) resolvePOST(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
 	// Pack the DNS query into wire format
 	b, err := q.Pack()
 	if err != nil {
@@ -128,13 +156,16 @@ func (d *DoHClient) ResolvePOST(q *dns.Msg) (*dns.Msg, error) {
 		d.metrics.err.Add("template", 1)
 		return nil, err
 	}
-	req, err := http.NewRequest("POST", u, bytes.NewReader(b))
+	req, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewReader(b))
 	if err != nil {
 		d.metrics.err.Add("http", 1)
 		return nil, err
 	}
 	req.Header.Add("accept", "application/dns-message")
 	req.Header.Add("content-type", "application/dns-message")
+	if d.opt.Compression {
+		req.Header.Add("accept-encoding", dohAcceptEncoding)
+	}
 	resp, err := d.client.Do(req)
 	if err != nil {
 		d.metrics.err.Add("post", 1)
@@ -146,6 +177,10 @@ func (d *DoHClient) ResolvePOST(q *dns.Msg) (*dns.Msg, error) {
 
 // ResolveGET resolves a DNS query via DNS-over-HTTP using the GET method.
 func (d *DoHClient) ResolveGET(q *dns.Msg) (*dns.Msg, error) {
+	return d.resolveGET(context.Background(), q)
+}
+
+func (d *DoHClient) resolveGET(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
 	// Pack the DNS query into wire format
 	b, err := q.Pack()
 	if err != nil {
@@ -161,12 +196,15 @@ func (d *DoHClient) ResolveGET(q *dns.Msg) (*dns.Msg, error) {
 		d.metrics.err.Add("template", 1)
 		return nil, err
 	}
-	req, err := http.NewRequest("GET", u, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
 	if err != nil {
 		d.metrics.err.Add("http", 1)
 		return nil, err
 	}
 	req.Header.Add("accept", "application/dns-message")
+	if d.opt.Compression {
+		req.Header.Add("accept-encoding", dohAcceptEncoding)
+	}
 	resp, err := d.client.Do(req)
 	if err != nil {
 		d.metrics.err.Add("get", 1)
@@ -186,11 +224,22 @@ func (d *DoHClient) responseFromHTTP(resp *http.Response) (*dns.Msg, error) {
 		d.metrics.err.Add(fmt.Sprintf("http%d", resp.StatusCode), 1)
 		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
 	}
-	rb, err := ioutil.ReadAll(resp.Body)
+	body, err := decodeContent(resp.Body, resp.Header.Get("content-encoding"))
+	if err != nil {
+		d.metrics.err.Add("decompress", 1)
+		return nil, err
+	}
+	defer body.Close()
+	// Limit the size, a small compressed body could otherwise expand to any size
+	rb, err := ioutil.ReadAll(io.LimitReader(body, dns.MaxMsgSize+1))
 	if err != nil {
 		d.metrics.err.Add("read", 1)
 		return nil, err
 	}
+	if len(rb) > dns.MaxMsgSize {
+		d.metrics.err.Add("read", 1)
+		return nil, errors.New("response exceeds maximum message size")
+	}
 	a := new(dns.Msg)
 	err = a.Unpack(rb)
 	if err != nil {
@@ -217,6 +266,22 @@ func dohTcpTransport(opt DoHClientOptions) (http.RoundTripper, error) {
 		}
 	}
 
+	// Connect through the configured proxy instead of one that may be set in
+	// the environment.
+	if opt.Proxy != "" {
+		if opt.BootstrapAddr != "" {
+			return nil, errors.New("bootstrap address can not be used with a proxy")
+		}
+		dial, err := proxyDialer(opt.Proxy, &net.Dialer{LocalAddr: &net.TCPAddr{IP: opt.LocalAddr}})
+		if err != nil {
+			return nil, err
+		}
+		tr.Proxy = nil
+		tr.DialContext = dial
+		watchNetworkTCP(tr)
+		return tr, nil
+	}
+
 	// Use a custom dialer if a bootstrap address or local address was provided
 	if opt.BootstrapAddr != "" || opt.LocalAddr != nil {
 		d := net.Dialer{LocalAddr: &net.TCPAddr{IP: opt.LocalAddr}}
@@ -231,10 +296,36 @@ func dohTcpTransport(opt DoHClientOptions) (http.RoundTripper, error) {
 			return d.DialContext(ctx, network, addr)
 		}
 	}
+	watchNetworkTCP(tr)
 	return tr, nil
 }
 
+// Closes idle connections of the transport when a network change leaves them
+// stale, new ones are then opened for the next queries.
+func watchNetworkTCP(tr *http.Transport) {
+	dial := tr.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	var addrs upstreamConn
+	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err == nil {
+			addrs.dialed(conn.LocalAddr(), conn.RemoteAddr(), tr.CloseIdleConnections)
+		}
+		return conn, err
+	}
+}
+
 func dohQuicTransport(endpoint string, opt DoHClientOptions) (http.RoundTripper, error) {
+	if opt.Proxy != "" {
+		if opt.BootstrapAddr != "" {
+			return nil, errors.New("bootstrap address can not be used with a proxy")
+		}
+		if err := validPacketProxy(opt.Proxy); err != nil {
+			return nil, err
+		}
+	}
 	var tlsConfig *tls.Config
 	if opt.TLSConfig == nil {
 		tlsConfig = new(tls.Config)
@@ -252,22 +343,30 @@ func dohQuicTransport(endpoint string, opt DoHClientOptions) (http.RoundTripper,
 	}
 
 	// When using a custom dialer, we have to track/close connections ourselves
-	pool := new(udpConnPool)
+	var (
+		pool  = new(udpConnPool)
+		tr    *http3.RoundTripper
+		addrs upstreamConn
+	)
 	dialer := func(ctx context.Context, network, addr string, tlsConfig *tls.Config, config *quic.Config) (quic.EarlyConnection, error) {
-		return quicDial(u.Hostname(), addr, lAddr, tlsConfig, config, pool)
-	}
-	if opt.BootstrapAddr != "" {
-		dialer = func(ctx context.Context, network, addr string, tlsConfig *tls.Config, config *quic.Config) (quic.EarlyConnection, error) {
+		if opt.BootstrapAddr != "" {
 			_, port, err := net.SplitHostPort(addr)
 			if err != nil {
 				return nil, err
 			}
 			addr = net.JoinHostPort(opt.BootstrapAddr, port)
-			return quicDial(u.Hostname(), addr, lAddr, tlsConfig, config, pool)
 		}
+		conn, err := quicDial(u.Hostname(), addr, lAddr, tlsConfig, config, pool, opt.Proxy)
+		if err == nil {
+			addrs.dialed(conn.LocalAddr(), conn.RemoteAddr(), func() {
+				pool.closeAll()
+				tr.Close()
+			})
+		}
+		return conn, err
 	}
 
-	tr := &http3.RoundTripper{
+	tr = &http3.RoundTripper{
 		TLSClientConfig: tlsConfig,
 		QuicConfig: &quic.Config{
 			TokenStore: quic.NewLRUTokenStore(10, 10),
@@ -277,7 +376,17 @@ func dohQuicTransport(endpoint string, opt DoHClientOptions) (http.RoundTripper,
 	return &http3ReliableRoundTripper{tr, pool}, nil
 }
 
-func quicDial(hostname, rAddr string, lAddr net.IP, tlsConfig *tls.Config, config *quic.Config, pool *udpConnPool) (quic.EarlyConnection, error) {
+// Opens a QUIC connection. If a proxy is given, the datagrams are relayed
+// through it and the remote address is resolved by the proxy.
+func quicDial(hostname, rAddr string, lAddr net.IP, tlsConfig *tls.Config, config *quic.Config, pool *udpConnPool, proxy string) (quic.EarlyConnection, error) {
+	if proxy != "" {
+		conn, err := proxyPacketConn(proxy, lAddr)
+		if err != nil {
+			return nil, err
+		}
+		pool.add(conn)
+		return quic.DialEarly(conn, socks5Addr(rAddr), hostname, tlsConfig, config)
+	}
 	udpAddr, err := net.ResolveUDPAddr("udp", rAddr)
 	if err != nil {
 		return nil, err
@@ -313,11 +422,11 @@ func (r *http3ReliableRoundTripper) RoundTrip(req *http.Request) (*http.Response
 // remote terminates a connection, or when calling Close(). So we have to keep track of the
 // connections and close them all before calling Close() on the http3.RoundTripper.
 type udpConnPool struct {
-	conns []*net.UDPConn
+	conns []net.PacketConn
 	mu    sync.Mutex
 }
 
-func (p *udpConnPool) add(conn *net.UDPConn) {
+func (p *udpConnPool) add(conn net.PacketConn) {
 	if p == nil {
 		return
 	}
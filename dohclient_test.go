@@ -1,6 +1,10 @@
 package rdns
 
 import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
 	"testing"
 
 	"github.com/miekg/dns"
@@ -26,3 +30,33 @@ func TestDoHClientSimpleGET(t *testing.T) {
 	require.NoError(t, err)
 	require.NotEmpty(t, r.Answer)
 }
+
+func TestDoHClientResponseSize(t *testing.T) {
+	d, err := NewDoHClient("test-doh-size", "https://127.0.0.1/dns-query{?dns}", DoHClientOptions{})
+	require.NoError(t, err)
+	response := func(body []byte) *http.Response {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		_, err := w.Write(body)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Encoding": []string{"gzip"}},
+			Body:       ioutil.NopCloser(&buf),
+		}
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	a := new(dns.Msg)
+	a.SetReply(q)
+	b, err := a.Pack()
+	require.NoError(t, err)
+	_, err = d.responseFromHTTP(response(b))
+	require.NoError(t, err)
+
+	// Compressed body that expands beyond the maximum size of a DNS message
+	_, err = d.responseFromHTTP(response(make([]byte, dns.MaxMsgSize+1)))
+	require.Error(t, err)
+}
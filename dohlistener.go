@@ -25,6 +25,7 @@ const dohServerTimeout = 10 * time.Second
 type DoHListener struct {
 	httpServer *http.Server
 	quicServer *http3.Server
+	quicConn   net.PacketConn
 
 	id   string
 	addr string
@@ -49,6 +50,18 @@ type DoHListenerOptions struct {
 
 	// IP(v4/v6) subnet of known reverse proxies in front of this server.
 	HTTPProxyNet *net.IPNet
+
+	// Additional subnets of trusted reverse proxies or CDNs, like Cloudflare.
+	HTTPProxyNets []*net.IPNet
+
+	// HTTP headers that carry the original client address when the request
+	// comes from a trusted proxy. They are tried in order, the first one with
+	// a valid address is used. Defaults to X-Forwarded-For.
+	ClientIPHeaders []string
+
+	// Compress large responses with gzip or deflate if the client supports
+	// it, as indicated by the Accept-Encoding header.
+	Compression bool
 }
 
 type DoHListenerMetrics struct {
@@ -97,6 +110,7 @@ func NewDoHListener(id, addr string, opt DoHListenerOptions, resolver Resolver)
 // Start the DoH server.
 func (s *DoHListener) Start() error {
 	Log.WithFields(logrus.Fields{"id": s.id, "protocol": "doh", "addr": s.addr}).Info("starting listener")
+	s.opt.Audit.register()
 	if s.opt.Transport == "quic" {
 		return s.startQUIC()
 	}
@@ -113,11 +127,21 @@ func (s *DoHListener) startTCP() error {
 		WriteTimeout: dohServerTimeout,
 	}
 
-	ln, err := net.Listen("tcp", s.addr)
+	ln, err := listenTCP(s.addr, s.opt.ListenOptions)
 	if err != nil {
 		return err
 	}
 	defer ln.Close()
+	if s.opt.Audit != nil {
+		// Complete the handshake in the listener to record failures, the
+		// protocols need to be negotiated there as well
+		cfg := s.opt.TLSConfig.Clone()
+		if len(cfg.NextProtos) == 0 {
+			cfg.NextProtos = []string{"h2", "http/1.1"}
+		}
+		s.httpServer.TLSConfig = cfg
+		return s.httpServer.Serve(newAuditTLSListener(ln, cfg, s.opt.Audit))
+	}
 	return s.httpServer.ServeTLS(ln, "", "")
 }
 
@@ -133,18 +157,36 @@ func (s *DoHListener) startQUIC() error {
 		},
 		QuicConfig: &quic.Config{},
 	}
-	return s.quicServer.ListenAndServe()
+	// Open the socket here so it can be handed over to a new instance
+	pc, err := listenUDP(s.addr, s.opt.ListenOptions, false)
+	if err != nil {
+		return err
+	}
+	s.quicConn = pc
+	return s.quicServer.Serve(pc)
 }
 
 // Stop the server.
 func (s *DoHListener) Stop() error {
 	Log.WithFields(logrus.Fields{"id": s.id, "protocol": "doh", "addr": s.addr}).Info("stopping listener")
 	if s.opt.Transport == "quic" {
-		return s.quicServer.Close()
+		err := s.quicServer.Close()
+		// The server doesn't close sockets it didn't open
+		if s.quicConn != nil {
+			if cerr := s.quicConn.Close(); err == nil {
+				err = cerr
+			}
+		}
+		return err
 	}
 	return s.httpServer.Shutdown(context.Background())
 }
 
+// Close releases the audit log of the listener after it stopped.
+func (s *DoHListener) Close() error {
+	return s.opt.Audit.Close()
+}
+
 func (s *DoHListener) String() string {
 	return s.id
 }
@@ -196,31 +238,59 @@ func (s *DoHListener) extractClientAddress(r *http.Request) net.IP {
 	client, _, _ := net.SplitHostPort(r.RemoteAddr)
 	clientIP := net.ParseIP(client)
 
-	// TODO: Prefer RFC 7239 Forwarded once https://github.com/golang/go/issues/30963
-	//       is resolved and provides a safe parser.
-	xForwardedFor := r.Header.Get("X-Forwarded-For")
-
-	// Simple case: No proxy (or empty/long X-Forwarded-For).
-	if s.opt.HTTPProxyNet == nil || xForwardedFor == "" || len(xForwardedFor) >= 1024 {
+	// Simple case: No proxy, or the client isn't one of the trusted proxies.
+	if clientIP == nil || !s.trustedProxy(clientIP) {
 		return clientIP
 	}
 
-	// If our client is a reverse proxy then use the last entry in X-Forwarded-For.
-	chain := strings.Split(xForwardedFor, ", ")
-	if clientIP != nil && s.opt.HTTPProxyNet.Contains(clientIP) {
-		if ip := net.ParseIP(chain[len(chain)-1]); ip != nil {
-			// Ignore XFF whe the client is local to the proxy.
-			if !ip.IsLoopback() {
-				return ip
-			}
+	headers := s.opt.ClientIPHeaders
+	if len(headers) == 0 {
+		headers = []string{"X-Forwarded-For"}
+	}
+	for _, header := range headers {
+		if ip := clientAddressFromHeader(r, header); ip != nil {
+			return ip
+		}
+	}
+	return clientIP
+}
+
+// Returns true if the address belongs to one of the trusted reverse proxies.
+func (s *DoHListener) trustedProxy(ip net.IP) bool {
+	if s.opt.HTTPProxyNet != nil && s.opt.HTTPProxyNet.Contains(ip) {
+		return true
+	}
+	for _, n := range s.opt.HTTPProxyNets {
+		if n.Contains(ip) {
+			return true
 		}
 	}
+	return false
+}
 
+// Reads the client address from an HTTP header set by a reverse proxy. Returns
+// nil if the header is missing or invalid.
+func clientAddressFromHeader(r *http.Request, header string) net.IP {
+	// TODO: Prefer RFC 7239 Forwarded once https://github.com/golang/go/issues/30963
+	//       is resolved and provides a safe parser.
+	value := r.Header.Get(header)
+	if value == "" || len(value) >= 1024 {
+		return nil
+	}
+
+	// Headers like X-Forwarded-For contain a chain of addresses. Use the last
+	// entry which was added by our proxy.
 	// TODO: Decide whether to go deeper into the XFF chain (eg. two reverse proxies).
 	//       We have to be careful if we do, because then we're trusting an XFF that
 	//       may have been provided externally.
+	chain := strings.Split(value, ",")
+	ip := net.ParseIP(strings.TrimSpace(chain[len(chain)-1]))
 
-	return clientIP
+	// Ignore the header when the client is local to the proxy.
+	if ip == nil || ip.IsLoopback() {
+		return nil
+	}
+	return ip
 }
 
 func (s *DoHListener) parseAndRespond(b []byte, w http.ResponseWriter, r *http.Request) {
@@ -239,8 +309,10 @@ func (s *DoHListener) parseAndRespond(b []byte, w http.ResponseWriter, r *http.R
 		return
 	}
 	ci := ClientInfo{
-		SourceIP: clientIP,
-		DoHPath:  r.URL.Path,
+		SourceIP:      clientIP,
+		DoHPath:       r.URL.Path,
+		Listener:      s.id,
+		TLSClientCert: peerCertificate(r.TLS),
 	}
 	log := Log.WithFields(logrus.Fields{
 		"id":       s.id,
@@ -253,9 +325,30 @@ func (s *DoHListener) parseAndRespond(b []byte, w http.ResponseWriter, r *http.R
 	})
 	log.Debug("received query")
 
+	// Remember the name as sent by the client, elements in the pipeline
+	// may modify the query
+	origName := qName(q)
+
 	var err error
 	a := new(dns.Msg)
-	if isAllowed(s.opt.AllowedNet, ci.SourceIP) {
+	if !isAllowed(s.opt.AllowedNet, ci.SourceIP) {
+		log.Debug("refusing client ip")
+		s.opt.Audit.refused(ci.SourceIP, AuditReasonACL, q, nil)
+		a.SetRcode(q, dns.RcodeRefused)
+	} else if sheddingLoad() {
+		s.metrics.err.Add("overload", 1)
+		log.Debug("refusing query, over watchdog limits")
+		a.SetRcode(q, dns.RcodeRefused)
+	} else if resp, reject := s.opt.checkQuery(q); reject {
+		s.metrics.err.Add("policy", 1)
+		log.Debug("query rejected by policy")
+		a = resp
+	} else {
+		// Find out if the response depends on the client, it's cached
+		// differently
+		if r.Method == http.MethodGet {
+			ci.trace = new(queryTrace)
+		}
 		log.WithField("resolver", s.r.String()).Debug("forwarding query to resolver")
 		a, err = s.r.Resolve(q, ci)
 		if err != nil {
@@ -263,9 +356,6 @@ func (s *DoHListener) parseAndRespond(b []byte, w http.ResponseWriter, r *http.R
 			a = new(dns.Msg)
 			a.SetRcode(q, dns.RcodeServerFailure)
 		}
-	} else {
-		log.Debug("refusing client ip")
-		a.SetRcode(q, dns.RcodeRefused)
 	}
 
 	// A nil response from the resolvers means "drop", return blank response
@@ -275,6 +365,11 @@ func (s *DoHListener) parseAndRespond(b []byte, w http.ResponseWriter, r *http.R
 		return
 	}
 
+	if !s.opt.DisableCaseRestore {
+		restoreQueryCase(origName, a)
+	}
+	s.opt.Compliance.fixResponse(q, a)
+
 	// Pad the packet according to rfc8467 and rfc7830
 	padAnswer(q, a)
 
@@ -286,5 +381,50 @@ func (s *DoHListener) parseAndRespond(b []byte, w http.ResponseWriter, r *http.R
 		return
 	}
 	w.Header().Set("content-type", "application/dns-message")
+
+	// Responses to GET requests can be cached by HTTP caches, the freshness is
+	// derived from the TTL of the records. See rfc8484#section-5.1.
+	if r.Method == http.MethodGet {
+		private := ci.trace != nil && ci.trace.isClientSpecific()
+		cacheControl := dohCacheControl(a, private)
+		w.Header().Set("cache-control", cacheControl)
+		if cacheControl != "no-store" {
+			w.Header().Set("age", "0")
+		}
+	}
+	if s.opt.Compression {
+		w.Header().Set("vary", "accept-encoding")
+		if encoding := dohContentEncoding(r.Header.Get("accept-encoding")); encoding != "" && len(out) >= dohCompressionMinSize {
+			compressed, err := dohCompress(out, encoding)
+			if err != nil {
+				s.metrics.err.Add("compress", 1)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("content-encoding", encoding)
+			out = compressed
+		}
+	}
 	_, _ = w.Write(out)
 }
+
+// Returns the value of the Cache-Control header for a response. The lifetime
+// of successful and negative responses is the lowest TTL in the response.
+// Responses that depend on the client, because they were routed by client or
+// tailored to its subnet with ECS, can only be cached by the client itself.
+func dohCacheControl(a *dns.Msg, private bool) string {
+	if a.Rcode != dns.RcodeSuccess && a.Rcode != dns.RcodeNameError {
+		return "no-store"
+	}
+	ttl, ok := minTTL(a)
+	if !ok {
+		return "no-store"
+	}
+	if ecs := ecsOption(a); ecs != nil && ecs.SourceScope > 0 {
+		private = true
+	}
+	if private {
+		return fmt.Sprintf("private, max-age=%d", ttl)
+	}
+	return fmt.Sprintf("max-age=%d", ttl)
+}
@@ -1,8 +1,13 @@
 package rdns
 
 import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -256,3 +261,171 @@ func TestIPv6Proxy(t *testing.T) {
 	client = s.extractClientAddress(r)
 	require.Equal(t, net.IPv4(10, 0, 1, 5), client)
 }
+
+func TestClientBehindCDN(t *testing.T) {
+	_, cdn1, err := net.ParseCIDR("173.245.48.0/20")
+	require.NoError(t, err)
+	_, cdn2, err := net.ParseCIDR("2400:cb00::/32")
+	require.NoError(t, err)
+	s, err := NewDoHListener("test-doh", "127.0.0.1:0", DoHListenerOptions{
+		HTTPProxyNets:   []*net.IPNet{cdn1, cdn2},
+		ClientIPHeaders: []string{"CF-Connecting-IP", "X-Forwarded-For"},
+	}, new(TestResolver))
+	require.NoError(t, err)
+
+	// The header is used when the request comes from the CDN.
+	r, _ := http.NewRequest("GET", "https://www.example.com", nil)
+	r.RemoteAddr = "173.245.48.1:1234"
+	r.Header.Add("CF-Connecting-IP", "192.0.2.1")
+	r.Header.Add("X-Forwarded-For", "192.0.2.2")
+	require.Equal(t, "192.0.2.1", s.extractClientAddress(r).String())
+
+	// Fall back to the next header if the first is missing.
+	r, _ = http.NewRequest("GET", "https://www.example.com", nil)
+	r.RemoteAddr = "[2400:cb00::1]:1234"
+	r.Header.Add("X-Forwarded-For", "192.0.2.3, 192.0.2.2")
+	require.Equal(t, "192.0.2.2", s.extractClientAddress(r).String())
+
+	// The header is ignored if the request doesn't come from the CDN.
+	r, _ = http.NewRequest("GET", "https://www.example.com", nil)
+	r.RemoteAddr = "198.51.100.1:1234"
+	r.Header.Add("CF-Connecting-IP", "192.0.2.1")
+	require.Equal(t, "198.51.100.1", s.extractClientAddress(r).String())
+
+	// Invalid header values are ignored.
+	r, _ = http.NewRequest("GET", "https://www.example.com", nil)
+	r.RemoteAddr = "173.245.48.1:1234"
+	r.Header.Add("CF-Connecting-IP", "not-an-ip")
+	require.Equal(t, "173.245.48.1", s.extractClientAddress(r).String())
+}
+
+func TestDoHCacheControl(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// Lowest TTL in the response
+	a := new(dns.Msg)
+	a.SetReply(q)
+	a.Answer = []dns.RR{
+		&dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.IP{192, 0, 2, 1}},
+		&dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 120}, A: net.IP{192, 0, 2, 2}},
+	}
+	require.Equal(t, "max-age=120", dohCacheControl(a, false))
+
+	// Responses that depend on the client are private
+	require.Equal(t, "private, max-age=120", dohCacheControl(a, true))
+
+	// As are responses tailored to the subnet of the client
+	a.SetEdns0(4096, false)
+	a.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: 24,
+		SourceScope:   24,
+		Address:       net.IP{192, 0, 2, 0},
+	}}
+	require.Equal(t, "private, max-age=120", dohCacheControl(a, false))
+
+	// Errors are not cached
+	require.Equal(t, "no-store", dohCacheControl(servfail(q), false))
+
+	// Neither are responses without records
+	require.Equal(t, "no-store", dohCacheControl(nxdomain(q), false))
+}
+
+func TestDoHCacheControlClientSpecific(t *testing.T) {
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IP{192, 0, 2, 1},
+			}}
+			return a, nil
+		},
+	}
+	request := func(r Resolver, name string) http.Header {
+		s, err := NewDoHListener("test-doh-private", ":0", DoHListenerOptions{}, r)
+		require.NoError(t, err)
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		b, err := q.Pack()
+		require.NoError(t, err)
+		req := httptest.NewRequest(http.MethodGet, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(b), nil)
+		w := httptest.NewRecorder()
+		s.dohHandler(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		return w.Header()
+	}
+
+	h := request(upstream, "example.com.")
+	require.Equal(t, "max-age=60", h.Get("cache-control"))
+	require.Equal(t, "0", h.Get("age"))
+
+	// Routed by the address of the client
+	route, err := NewRoute("", "", nil, nil, "", "", "192.0.2.0/24", "", upstream) // Address of test requests
+	require.NoError(t, err)
+	router := NewRouter("test-doh-private-router")
+	router.Add(route)
+	h = request(router, "example.com.")
+	require.Equal(t, "private, max-age=60", h.Get("cache-control"))
+}
+
+func TestDoHCompression(t *testing.T) {
+	// Large TXT response that is worth compressing
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = []dns.RR{
+				&dns.TXT{
+					Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+					Txt: []string{strings.Repeat("a", 250), strings.Repeat("b", 250), strings.Repeat("c", 250)},
+				},
+			}
+			return a, nil
+		},
+	}
+
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	tlsServerConfig, err := TLSServerConfig("", "testdata/server.crt", "testdata/server.key", false)
+	require.NoError(t, err)
+	s, err := NewDoHListener("test-doh-compression", addr, DoHListenerOptions{TLSConfig: tlsServerConfig, Compression: true}, upstream)
+	require.NoError(t, err)
+	go s.Start()
+	defer s.Stop()
+	time.Sleep(time.Second)
+
+	tlsConfig, err := TLSClientConfig("testdata/ca.crt", "", "")
+	require.NoError(t, err)
+	c, err := NewDoHClient("test-doh-compression", "https://"+addr+"/dns-query", DoHClientOptions{TLSConfig: tlsConfig, Compression: true})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeTXT)
+	a, err := c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, strings.Repeat("c", 250), a.Answer[0].(*dns.TXT).Txt[2])
+}
+
+func TestDoHContentEncoding(t *testing.T) {
+	require.Equal(t, "gzip", dohContentEncoding("gzip, deflate, br"))
+	require.Equal(t, "deflate", dohContentEncoding("deflate"))
+	require.Equal(t, "deflate", dohContentEncoding("gzip;q=0, deflate;q=0.5"))
+	require.Equal(t, "gzip", dohContentEncoding("*"))
+	require.Equal(t, "", dohContentEncoding("br"))
+	require.Equal(t, "", dohContentEncoding(""))
+
+	for _, encoding := range []string{"gzip", "deflate"} {
+		b, err := dohCompress([]byte("test"), encoding)
+		require.NoError(t, err)
+		r, err := decodeContent(bytes.NewReader(b), encoding)
+		require.NoError(t, err)
+		out, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, "test", string(out))
+	}
+}
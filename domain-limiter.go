@@ -0,0 +1,158 @@
+package rdns
+
+import (
+	"expvar"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/publicsuffix"
+)
+
+// DomainLimiter is a resolver that limits the number of NXDOMAIN responses per
+// registered domain, like example.com, in a timeframe. This mitigates random
+// subdomain attacks where many clients query non-existent names under a victim
+// domain which per-client rate limits don't catch. Once the limit is reached,
+// all queries for the domain are dropped or sent to an alternate resolver for
+// the rest of the timeframe.
+type DomainLimiter struct {
+	id       string
+	resolver Resolver
+	DomainLimiterOptions
+
+	mu            sync.Mutex
+	currWinID     int64
+	counters      map[string]uint
+	metricDomains int // number of domains in the per-domain metrics
+	metrics       *DomainLimiterMetrics
+}
+
+var _ Resolver = &DomainLimiter{}
+
+type DomainLimiterOptions struct {
+	Requests      uint     // Number of NXDOMAIN responses allowed per domain and time period
+	Window        uint     // Time period in seconds
+	LimitResolver Resolver // Alternate resolver for rate-limited requests
+}
+
+type DomainLimiterMetrics struct {
+	// Count of queries.
+	query *expvar.Int
+	// Count of queries that have exceeded the limit.
+	exceed *expvar.Int
+	// Count of dropped queries.
+	drop *expvar.Int
+	// Count of queries that exceeded the limit by domain.
+	domain *expvar.Map
+}
+
+// Maximum number of domains in the metrics of a domain limiter. Queries for
+// further domains are counted under "other" so an attack on many domains can't
+// grow the metrics without bounds.
+const domainLimiterMaxMetrics = 1000
+
+// NewDomainLimiter returns a new instance of a domain rate limiter.
+func NewDomainLimiter(id string, resolver Resolver, opt DomainLimiterOptions) *DomainLimiter {
+	if opt.Window == 0 {
+		opt.Window = 60
+	}
+	if opt.Requests == 0 {
+		opt.Requests = 100
+	}
+	return &DomainLimiter{
+		id:                   id,
+		resolver:             resolver,
+		DomainLimiterOptions: opt,
+		metrics: &DomainLimiterMetrics{
+			query:  getVarInt("router", id, "query"),
+			exceed: getVarInt("router", id, "exceed"),
+			drop:   getVarInt("router", id, "drop"),
+			domain: getVarMap("router", id, "domain"),
+		},
+	}
+}
+
+// Resolve a DNS query while limiting the rate of NXDOMAIN responses per domain.
+func (r *DomainLimiter) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return r.resolver.Resolve(q, ci)
+	}
+	log := logger(r.id, q, ci)
+	r.metrics.query.Add(1)
+
+	domain := registeredDomain(q.Question[0].Name)
+
+	// Calculate the current (fixed) window
+	windowID := time.Now().Unix() / int64(r.Window)
+
+	r.mu.Lock()
+	// If we have moved on to the next window, re-initialize the counters
+	if windowID != r.currWinID {
+		r.currWinID = windowID
+		r.counters = make(map[string]uint)
+	}
+	reject := r.counters[domain] >= r.Requests
+	var metricKey string
+	if reject {
+		metricKey = r.metricKey(domain)
+	}
+	r.mu.Unlock()
+
+	if reject {
+		r.metrics.exceed.Add(1)
+		r.metrics.domain.Add(metricKey, 1)
+		if r.LimitResolver != nil {
+			log.WithField("resolver", r.LimitResolver).Debug("domain rate-limit exceeded, forwarding to limit-resolver")
+			return r.LimitResolver.Resolve(q, ci)
+		}
+		r.metrics.drop.Add(1)
+		log.WithField("domain", domain).Debug("domain rate-limit reached, dropping")
+		return nil, nil
+	}
+
+	log.WithField("resolver", r.resolver).Debug("forwarding query to resolver")
+	a, err := r.resolver.Resolve(q, ci)
+	if err != nil || a == nil || a.Rcode != dns.RcodeNameError {
+		return a, err
+	}
+
+	// Count the NXDOMAIN response against the domain, unless the window has
+	// changed in the meantime
+	r.mu.Lock()
+	if windowID == r.currWinID {
+		r.counters[domain]++
+	}
+	r.mu.Unlock()
+	return a, err
+}
+
+// Returns the key in the per-domain metrics for a domain. Must be called
+// with the lock held.
+func (r *DomainLimiter) metricKey(domain string) string {
+	if r.metrics.domain.Get(domain) != nil {
+		return domain
+	}
+	if r.metricDomains >= domainLimiterMaxMetrics {
+		return "other"
+	}
+	r.metricDomains++
+	return domain
+}
+
+func (r *DomainLimiter) String() string {
+	return r.id
+}
+
+// Returns the registered domain of a query name, the public suffix plus one
+// label, like "example.com." for "www.example.com.". If the name doesn't have
+// a registered domain, for example because it is a public suffix itself, the
+// name is returned as is.
+func registeredDomain(name string) string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	domain, err := publicsuffix.EffectiveTLDPlusOne(name)
+	if err != nil {
+		return dns.Fqdn(name)
+	}
+	return dns.Fqdn(domain)
+}
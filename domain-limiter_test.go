@@ -0,0 +1,68 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDomainLimiter(t *testing.T) {
+	var ci ClientInfo
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetRcode(q, dns.RcodeNameError)
+			return a, nil
+		},
+	}
+	limitResolver := new(TestResolver)
+	r := NewDomainLimiter("test-domain-limit", upstream, DomainLimiterOptions{
+		Requests:      2,
+		Window:        3600,
+		LimitResolver: limitResolver,
+	})
+	resolve := func(name string) {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		_, err := r.Resolve(q, ci)
+		require.NoError(t, err)
+	}
+
+	// Random names under the same registered domain are counted together
+	resolve("abc.example.com.")
+	resolve("def.www.example.com.")
+	resolve("ghi.example.com.")
+	require.Equal(t, 2, upstream.HitCount())
+	require.Equal(t, 1, limitResolver.HitCount())
+
+	// Other domains are not affected
+	resolve("abc.example.co.uk.")
+	resolve("abc.other.example.co.uk.")
+	require.Equal(t, 4, upstream.HitCount())
+	require.Equal(t, 1, limitResolver.HitCount())
+}
+
+func TestDomainLimiterDefault(t *testing.T) {
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetRcode(q, dns.RcodeNameError)
+			return a, nil
+		},
+	}
+	// Without a limit, the default applies instead of rejecting everything
+	r := NewDomainLimiter("test-domain-limit-default", upstream, DomainLimiterOptions{})
+	q := new(dns.Msg)
+	q.SetQuestion("abc.example.com.", dns.TypeA)
+	a, err := r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.NotNil(t, a)
+	require.Equal(t, 1, upstream.HitCount())
+}
+
+func TestRegisteredDomain(t *testing.T) {
+	require.Equal(t, "example.com.", registeredDomain("www.Example.COM."))
+	require.Equal(t, "example.co.uk.", registeredDomain("a.b.example.co.uk."))
+	require.Equal(t, "com.", registeredDomain("com."))
+}
@@ -0,0 +1,38 @@
+package rdns
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Set of domains, stored as lowercase FQDNs. A name matches if it is one of
+// the domains or any of their sub-domains.
+type domainSet map[string]struct{}
+
+func newDomainSet(domains []string) domainSet {
+	s := make(domainSet, len(domains))
+	for _, d := range domains {
+		s[strings.ToLower(dns.Fqdn(d))] = struct{}{}
+	}
+	return s
+}
+
+// Returns true if the name is one of the domains in the set or a sub-domain
+// of one of them.
+func (s domainSet) match(name string) bool {
+	name = strings.ToLower(name)
+	for {
+		if _, ok := s[name]; ok {
+			return true
+		}
+		i := strings.Index(name, ".")
+		if i < 0 || name == "." {
+			return false
+		}
+		name = name[i+1:]
+		if name == "" {
+			name = "."
+		}
+	}
+}
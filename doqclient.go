@@ -38,6 +38,13 @@ type DoQClientOptions struct {
 	// Local IP to use for outbound connections. If nil, a local address is chosen.
 	LocalAddr net.IP
 
+	// Proxy URL to relay the QUIC datagrams through. Only SOCKS5 proxies
+	// ("socks5://") are supported. Can't be used together with BootstrapAddr.
+	Proxy string
+
+	// Time to wait for a response before the query fails. Default 1 second.
+	QueryTimeout time.Duration
+
 	TLSConfig *tls.Config
 }
 
@@ -48,6 +55,17 @@ func NewDoQClient(id, endpoint string, opt DoQClientOptions) (*DoQClient, error)
 	if err := validEndpoint(endpoint); err != nil {
 		return nil, err
 	}
+	if opt.QueryTimeout == 0 {
+		opt.QueryTimeout = queryTimeout
+	}
+	if opt.Proxy != "" {
+		if opt.BootstrapAddr != "" {
+			return nil, errors.New("bootstrap address can not be used with a proxy")
+		}
+		if err := validPacketProxy(opt.Proxy); err != nil {
+			return nil, err
+		}
+	}
 	var tlsConfig *tls.Config
 	if opt.TLSConfig == nil {
 		tlsConfig = new(tls.Config)
@@ -83,6 +101,7 @@ func NewDoQClient(id, endpoint string, opt DoQClientOptions) (*DoQClient, error)
 			endpoint:  endpoint,
 			lAddr:     lAddr,
 			tlsConfig: tlsConfig,
+			proxy:     opt.Proxy,
 			config: &quic.Config{
 				TokenStore: quic.NewLRUTokenStore(10, 10),
 			},
@@ -129,6 +148,13 @@ func (d *DoQClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 		return nil, err
 	}
 
+	// Don't open a stream for queries that were abandoned already
+	ctx := ci.ctx()
+	if err := ctx.Err(); err != nil {
+		d.metrics.err.Add("cancel", 1)
+		return nil, err
+	}
+
 	// Get a new stream in the connection
 	stream, err := d.connection.getStream()
 	if err != nil {
@@ -136,8 +162,26 @@ func (d *DoQClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 		return nil, err
 	}
 
+	// Abort reading and writing if the context is done before the timeout
+	deadline := time.Now().Add(d.QueryTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	if done := ctx.Done(); done != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-done:
+				stream.CancelRead(DOQNoError)
+				stream.CancelWrite(DOQNoError)
+			case <-stop:
+			}
+		}()
+	}
+
 	// Write the query into the stream and close is. Only one stream per query/response
-	_ = stream.SetWriteDeadline(time.Now().Add(time.Second))
+	_ = stream.SetWriteDeadline(deadline)
 	if _, err = stream.Write(b); err != nil {
 		d.metrics.err.Add("write", 1)
 		return nil, err
@@ -148,7 +192,7 @@ func (d *DoQClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	}
 
 	// Read the response
-	_ = stream.SetReadDeadline(time.Now().Add(time.Second))
+	_ = stream.SetReadDeadline(deadline)
 	b, err = ioutil.ReadAll(stream)
 	if err != nil {
 		d.metrics.err.Add("read", 1)
@@ -172,7 +216,9 @@ func (d *DoQClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 		}
 	}
 	d.metrics.response.Add(rCode(a), 1)
-
+	if err == nil {
+		ci.recordUpstream(d.id)
+	}
 	return a, err
 }
 
@@ -185,9 +231,11 @@ type doqConnection struct {
 	endpoint  string
 	lAddr     net.IP
 	tlsConfig *tls.Config
+	proxy     string
 	config    *quic.Config
 	log       *logrus.Entry
 	pool      *udpConnPool
+	addrs     upstreamConn
 
 	connection quic.Connection
 
@@ -201,22 +249,24 @@ func (s *doqConnection) getStream() (quic.Stream, error) {
 	// If we don't have a connection yet, make one
 	if s.connection == nil {
 		var err error
-		s.connection, err = quicDial(s.hostname, s.endpoint, s.lAddr, s.tlsConfig, s.config, s.pool)
+		s.connection, err = quicDial(s.hostname, s.endpoint, s.lAddr, s.tlsConfig, s.config, s.pool, s.proxy)
 		if err != nil {
 			s.log.WithError(err).Error("failed to open connection")
 			return nil, err
 		}
+		s.addrs.dialed(s.connection.LocalAddr(), s.connection.RemoteAddr(), s.closeStale)
 	}
 
 	stream, err := s.connection.OpenStream()
 	if netErr, ok := err.(net.Error); ok && (netErr.Timeout() || netErr.Temporary()) {
 		// Try to open a new connection
 		_ = s.connection.CloseWithError(DOQNoError, "")
-		s.connection, err = quicDial(s.hostname, s.endpoint, s.lAddr, s.tlsConfig, s.config, s.pool)
+		s.connection, err = quicDial(s.hostname, s.endpoint, s.lAddr, s.tlsConfig, s.config, s.pool, s.proxy)
 		if err != nil {
 			s.log.WithError(err).Error("failed to open connection")
 			return nil, err
 		}
+		s.addrs.dialed(s.connection.LocalAddr(), s.connection.RemoteAddr(), s.closeStale)
 		stream, err = s.connection.OpenStream()
 		if err != nil {
 			s.log.WithError(err).Error("failed to open stream")
@@ -225,3 +275,14 @@ func (s *doqConnection) getStream() (quic.Stream, error) {
 	}
 	return stream, err
 }
+
+// Closes the connection after a network change, the next query opens a new one.
+func (s *doqConnection) closeStale() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.connection != nil {
+		_ = s.connection.CloseWithError(DOQNoError, "")
+		s.connection = nil
+	}
+	s.pool.closeAll()
+}
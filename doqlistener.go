@@ -3,9 +3,11 @@ package rdns
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"expvar"
 	"io/ioutil"
 	"net"
+	"sync"
 	"time"
 
 	quic "github.com/lucas-clemente/quic-go"
@@ -19,9 +21,13 @@ type DoQListener struct {
 	addr    string
 	r       Resolver
 	opt     DoQListenerOptions
-	ln      quic.Listener
 	log     *logrus.Entry
 	metrics *DoQListenerMetrics
+
+	mu      sync.Mutex // protects pc, ln and stopped
+	pc      net.PacketConn
+	ln      quic.Listener
+	stopped bool
 }
 
 var _ Listener = &DoQListener{}
@@ -73,19 +79,35 @@ func NewQUICListener(id, addr string, opt DoQListenerOptions, resolver Resolver)
 }
 
 // Start the QUIC server.
-func (s DoQListener) Start() error {
-	var err error
-	s.ln, err = quic.ListenAddr(s.addr, s.opt.TLSConfig, &quic.Config{})
+func (s *DoQListener) Start() error {
+	s.opt.Audit.register()
+	// Open the socket here so it can be handed over to a new instance
+	pc, err := listenUDP(s.addr, s.opt.ListenOptions, false)
 	if err != nil {
 		return err
 	}
+	ln, err := quic.Listen(pc, s.opt.TLSConfig, &quic.Config{})
+	if err != nil {
+		pc.Close()
+		return err
+	}
+	s.mu.Lock()
+	if s.stopped {
+		// Stopped while the socket was being opened
+		s.mu.Unlock()
+		ln.Close()
+		pc.Close()
+		return errors.New("listener stopped")
+	}
+	s.pc, s.ln = pc, ln
+	s.mu.Unlock()
 	s.log.Info("starting listener")
 
 	for {
-		connection, err := s.ln.Accept(context.Background())
+		connection, err := ln.Accept(context.Background())
 		if err != nil {
-			s.log.WithError(err).Warn("failed to accept")
-			continue
+			// Only fails once the listener is closed
+			return err
 		}
 		s.log.Trace("started connection")
 
@@ -98,12 +120,28 @@ func (s DoQListener) Start() error {
 }
 
 // Stop the server.
-func (s DoQListener) Stop() error {
+func (s *DoQListener) Stop() error {
 	Log.WithFields(logrus.Fields{"protocol": "quic", "addr": s.addr}).Info("stopping listener")
-	return s.ln.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopped = true
+	if s.ln == nil {
+		return nil
+	}
+	err := s.ln.Close()
+	// The listener doesn't close sockets it didn't open
+	if cerr := s.pc.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
 
-func (s DoQListener) handleConnection(connection quic.Connection) {
+// Close releases the audit log of the listener after it stopped.
+func (s *DoQListener) Close() error {
+	return s.opt.Audit.Close()
+}
+
+func (s *DoQListener) handleConnection(connection quic.Connection) {
 	var ci ClientInfo
 	switch addr := connection.RemoteAddr().(type) {
 	case *net.TCPAddr:
@@ -111,14 +149,19 @@ func (s DoQListener) handleConnection(connection quic.Connection) {
 	case *net.UDPAddr:
 		ci.SourceIP = addr.IP
 	}
+	ci.Listener = s.id
+	tlsState := connection.ConnectionState().TLS.ConnectionState
+	ci.TLSClientCert = peerCertificate(&tlsState)
 	log := s.log.WithField("client", connection.RemoteAddr())
 
 	if !isAllowed(s.opt.AllowedNet, ci.SourceIP) {
 		log.Debug("rejecting incoming connection")
 		s.metrics.drop.Add(1)
+		s.opt.Audit.refused(ci.SourceIP, AuditReasonACL, nil, nil)
 		return
 	}
 	log.Trace("accepting incoming connection")
+	s.opt.Audit.accepted(ci.SourceIP)
 	s.metrics.connection.Add(1)
 
 	for {
@@ -137,7 +180,7 @@ func (s DoQListener) handleConnection(connection quic.Connection) {
 	}
 }
 
-func (s DoQListener) handleStream(stream quic.Stream, log *logrus.Entry, ci ClientInfo) {
+func (s *DoQListener) handleStream(stream quic.Stream, log *logrus.Entry, ci ClientInfo) {
 	// DNS over QUIC uses one stream per query/response.
 	defer stream.Close()
 	s.metrics.stream.Add(1)
@@ -174,13 +217,37 @@ func (s DoQListener) handleStream(stream quic.Stream, log *logrus.Entry, ci Clie
 		}
 	}
 
-	// Resolve the query using the next hop
-	a, err := s.r.Resolve(q, ci)
-	if err != nil {
-		log.WithError(err).Error("failed to resolve")
+	// Remember the name as sent by the client, elements in the pipeline
+	// may modify the query
+	origName := qName(q)
+
+	// Check the query against the policy before resolving it using the next hop
+	a, reject := s.opt.checkQuery(q)
+	if reject {
+		s.metrics.err.Add("policy", 1)
+		log.Debug("query rejected by policy")
+		if a == nil {
+			s.metrics.drop.Add(1)
+			return
+		}
+	} else if sheddingLoad() {
+		s.metrics.err.Add("overload", 1)
+		log.Debug("refusing query, over watchdog limits")
 		a = new(dns.Msg)
-		a.SetRcode(q, dns.RcodeServerFailure)
+		a.SetRcode(q, dns.RcodeRefused)
+	} else {
+		a, err = s.r.Resolve(q, ci)
+		if err != nil {
+			log.WithError(err).Error("failed to resolve")
+			a = new(dns.Msg)
+			a.SetRcode(q, dns.RcodeServerFailure)
+		}
+	}
+
+	if !s.opt.DisableCaseRestore {
+		restoreQueryCase(origName, a)
 	}
+	s.opt.Compliance.fixResponse(q, a)
 
 	out, err := a.Pack()
 	if err != nil {
@@ -198,6 +265,6 @@ func (s DoQListener) handleStream(stream quic.Stream, log *logrus.Entry, ci Clie
 	s.metrics.response.Add(rCode(a), 1)
 }
 
-func (s DoQListener) String() string {
+func (s *DoQListener) String() string {
 	return s.id
 }
@@ -3,6 +3,7 @@ package rdns
 import (
 	"crypto/tls"
 	"net"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/pkg/errors"
@@ -13,7 +14,7 @@ import (
 type DoTClient struct {
 	id       string
 	endpoint string
-	pipeline *Pipeline
+	pipeline *PipelinePool
 	// Pipeline also provides operation metrics.
 }
 
@@ -26,6 +27,17 @@ type DoTClientOptions struct {
 	// Local IP to use for outbound connections. If nil, a local address is chosen.
 	LocalAddr net.IP
 
+	// Proxy URL to tunnel connections through. Supported are "socks5://"
+	// and "http://". Can't be used together with BootstrapAddr.
+	Proxy string
+
+	// Time to wait for a response before the query fails. Default 1 second.
+	QueryTimeout time.Duration
+
+	// Number of connections to open to the upstream resolver. Queries are
+	// spread across them. Default 1.
+	Connections int
+
 	TLSConfig *tls.Config
 }
 
@@ -42,6 +54,28 @@ func NewDoTClient(id, endpoint string, opt DoTClientOptions) (*DoTClient, error)
 	if opt.LocalAddr != nil {
 		dialer = &net.Dialer{LocalAddr: &net.TCPAddr{IP: opt.LocalAddr}}
 	}
+
+	// Connect through a proxy if one is configured. The name of the resolver
+	// is then resolved by the proxy, so a bootstrap address can't be used.
+	if opt.Proxy != "" {
+		if opt.BootstrapAddr != "" {
+			return nil, errors.New("bootstrap address can not be used with a proxy")
+		}
+		if dialer == nil {
+			dialer = &net.Dialer{}
+		}
+		dial, err := proxyDialer(opt.Proxy, dialer)
+		if err != nil {
+			return nil, err
+		}
+		client := proxyTLSDialer{dial: dial, tlsConfig: opt.TLSConfig}
+		return &DoTClient{
+			id:       id,
+			endpoint: endpoint,
+			pipeline: NewPipelinePool(id, endpoint, client, opt.QueryTimeout, opt.Connections),
+		}, nil
+	}
+
 	client := &dns.Client{
 		Net:       "tcp-tls",
 		TLSConfig: opt.TLSConfig,
@@ -62,7 +96,7 @@ func NewDoTClient(id, endpoint string, opt DoTClientOptions) (*DoTClient, error)
 	return &DoTClient{
 		id:       id,
 		endpoint: endpoint,
-		pipeline: NewPipeline(id, endpoint, client),
+		pipeline: NewPipelinePool(id, endpoint, client, opt.QueryTimeout, opt.Connections),
 	}, nil
 }
 
@@ -75,7 +109,11 @@ func (d *DoTClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 
 	// Add padding to the query before sending over TLS
 	padQuery(q)
-	return d.pipeline.Resolve(q)
+	a, err := d.pipeline.ResolveContext(ci.ctx(), q)
+	if err == nil {
+		ci.recordUpstream(d.id)
+	}
+	return a, err
 }
 
 func (d *DoTClient) String() string {
@@ -10,7 +10,8 @@ import (
 // DoTListener is a DNS listener/server for DNS-over-TLS.
 type DoTListener struct {
 	*dns.Server
-	id string
+	id  string
+	opt DoTListenerOptions
 }
 
 var _ Listener = &DoTListener{}
@@ -25,12 +26,14 @@ type DoTListenerOptions struct {
 // NewDoTListener returns an instance of a DNS-over-TLS listener.
 func NewDoTListener(id, addr string, opt DoTListenerOptions, resolver Resolver) *DoTListener {
 	return &DoTListener{
-		id: id,
+		id:  id,
+		opt: opt,
 		Server: &dns.Server{
-			Addr:      addr,
-			Net:       "tcp-tls",
-			TLSConfig: opt.TLSConfig,
-			Handler:   listenHandler(id, "dot", addr, resolver, opt.AllowedNet),
+			Addr:          addr,
+			Net:           "tcp-tls",
+			TLSConfig:     opt.TLSConfig,
+			Handler:       listenHandler(id, "dot", addr, resolver, opt.ListenOptions),
+			MsgAcceptFunc: policyMsgAcceptFunc,
 		},
 	}
 }
@@ -38,7 +41,17 @@ func NewDoTListener(id, addr string, opt DoTListenerOptions, resolver Resolver)
 // Start the Dot server.
 func (s DoTListener) Start() error {
 	Log.WithFields(logrus.Fields{"id": s.id, "protocol": "dot", "addr": s.Addr}).Info("starting listener")
-	return s.ListenAndServe()
+	s.opt.Audit.register()
+	ln, err := listenTCP(s.Addr, s.opt.ListenOptions)
+	if err != nil {
+		return err
+	}
+	if s.opt.Audit != nil {
+		s.Listener = newAuditTLSListener(ln, s.TLSConfig, s.opt.Audit)
+	} else {
+		s.Listener = tls.NewListener(ln, s.TLSConfig)
+	}
+	return s.ActivateAndServe()
 }
 
 // Stop the server.
@@ -47,6 +60,11 @@ func (s DoTListener) Stop() error {
 	return s.Shutdown()
 }
 
+// Close releases the audit log of the listener after it stopped.
+func (s DoTListener) Close() error {
+	return s.opt.Audit.Close()
+}
+
 func (s DoTListener) String() string {
 	return s.id
 }
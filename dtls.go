@@ -12,7 +12,9 @@ import (
 // DTLSServerConfig is a convenience function that builds a dtls.Config instance for DTLS servers
 // based on common options and certificate+key files.
 func DTLSServerConfig(caFile, crtFile, keyFile string, mutualTLS bool) (*dtls.Config, error) {
-	dtlsConfig := &dtls.Config{}
+	dtlsConfig := &dtls.Config{
+		KeyLogWriter: TLSKeyLogWriter,
+	}
 	if mutualTLS {
 		dtlsConfig.ClientAuth = dtls.RequireAndVerifyClientCert
 	}
@@ -42,7 +44,9 @@ func DTLSServerConfig(caFile, crtFile, keyFile string, mutualTLS bool) (*dtls.Co
 // DTLSClientConfig is a convenience function that builds a dtls.Config instance for TLS clients
 // based on common options and certificate+key files.
 func DTLSClientConfig(caFile, crtFile, keyFile string) (*dtls.Config, error) {
-	dtlsConfig := &dtls.Config{}
+	dtlsConfig := &dtls.Config{
+		KeyLogWriter: TLSKeyLogWriter,
+	}
 
 	// Add client key/cert if provided
 	if crtFile != "" && keyFile != "" {
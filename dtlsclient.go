@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net"
 	"strconv"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/pion/dtls/v2"
@@ -31,6 +32,9 @@ type DTLSClientOptions struct {
 	// are not changed.
 	UDPSize uint16
 
+	// Time to wait for a response before the query fails. Default 1 second.
+	QueryTimeout time.Duration
+
 	DTLSConfig *dtls.Config
 }
 
@@ -83,7 +87,7 @@ func NewDTLSClient(id, endpoint string, opt DTLSClientOptions) (*DTLSClient, err
 	return &DTLSClient{
 		id:       id,
 		endpoint: endpoint,
-		pipeline: NewPipeline(id, endpoint, client),
+		pipeline: NewPipelineWithTimeout(id, endpoint, client, opt.QueryTimeout),
 		opt:      opt,
 	}, nil
 }
@@ -99,7 +103,11 @@ func (d *DTLSClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 
 	// Add padding to the query before sending over TLS
 	padQuery(q)
-	return d.pipeline.Resolve(q)
+	a, err := d.pipeline.ResolveContext(ci.ctx(), q)
+	if err == nil {
+		ci.recordUpstream(d.id)
+	}
+	return a, err
 }
 
 func (d *DTLSClient) String() string {
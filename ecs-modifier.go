@@ -13,6 +13,7 @@ type ECSModifier struct {
 	id       string
 	resolver Resolver
 	modifier ECSModifierFunc
+	domains  domainSet
 }
 
 var _ Resolver = &ECSModifier{}
@@ -32,19 +33,43 @@ func (r *ECSModifier) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 		return nil, errors.New("no question in query")
 	}
 
+	// Remember the ECS option sent by the client, it's needed to build the
+	// option in the response
+	clientECS := copyECS(ecsOption(q))
+
 	// Modify the query
-	if r.modifier != nil {
+	if r.modifier != nil && r.matchDomain(q) {
 		r.modifier(r.id, q, ci)
 	}
+	forwardedECS := ecsOption(q)
 
 	// Pass it on upstream
-	return r.resolver.Resolve(q, ci)
+	a, err := r.resolver.Resolve(q, ci)
+	if err != nil || a == nil {
+		return a, err
+	}
+	// A response for the forwarded subnet may differ between clients
+	if ecs := ecsOption(a); ecs != nil && ecs.SourceScope > 0 {
+		ci.recordClientSpecific()
+	}
+	restoreECS(a, clientECS, forwardedECS)
+	return a, nil
 }
 
 func (r *ECSModifier) String() string {
 	return r.id
 }
 
+// SetDomains limits the modifier to queries for names in the given domains or
+// any of their sub-domains. Other queries are passed on unmodified.
+func (r *ECSModifier) SetDomains(domains []string) {
+	r.domains = newDomainSet(domains)
+}
+
+func (r *ECSModifier) matchDomain(q *dns.Msg) bool {
+	return len(r.domains) == 0 || r.domains.match(q.Question[0].Name)
+}
+
 func ECSModifierDelete(id string, q *dns.Msg, ci ClientInfo) {
 	edns0 := q.IsEdns0()
 	if edns0 == nil {
@@ -162,3 +187,74 @@ func ECSModifierPrivacy(prefix4, prefix6 uint8) ECSModifierFunc {
 		}
 	}
 }
+
+// Returns the ECS option of a message or nil if there is none.
+func ecsOption(m *dns.Msg) *dns.EDNS0_SUBNET {
+	edns0 := m.IsEdns0()
+	if edns0 == nil {
+		return nil
+	}
+	for _, opt := range edns0.Option {
+		if ecs, ok := opt.(*dns.EDNS0_SUBNET); ok {
+			return ecs
+		}
+	}
+	return nil
+}
+
+func copyECS(ecs *dns.EDNS0_SUBNET) *dns.EDNS0_SUBNET {
+	if ecs == nil {
+		return nil
+	}
+	c := *ecs
+	c.Address = append(net.IP(nil), ecs.Address...)
+	return &c
+}
+
+// Replaces the ECS option in a response with the one the client sent, as
+// required by RFC7871. The scope prefix length returned by the upstream
+// resolver applies to the forwarded option, it's passed on to the client if
+// the forwarded address is within the client's subnet, limited to the
+// forwarded source prefix length. If the client didn't send an ECS option,
+// any ECS option is removed from the response.
+func restoreECS(a *dns.Msg, client, forwarded *dns.EDNS0_SUBNET) {
+	edns0 := a.IsEdns0()
+	if edns0 == nil {
+		return
+	}
+	var scope uint8
+	if upstream := ecsOption(a); upstream != nil && forwarded != nil {
+		scope = upstream.SourceScope
+		if scope > forwarded.SourceNetmask {
+			scope = forwarded.SourceNetmask
+		}
+	}
+	ECSModifierDelete("", a, ClientInfo{})
+	if client == nil {
+		return
+	}
+	ecs := copyECS(client)
+	ecs.SourceScope = 0
+	if forwarded != nil && sameECSNetwork(client, forwarded) {
+		ecs.SourceScope = scope
+	}
+	edns0.Option = append(edns0.Option, ecs)
+}
+
+// Returns true if two ECS options share the same network, up to the shorter
+// of the two source prefix lengths.
+func sameECSNetwork(a, b *dns.EDNS0_SUBNET) bool {
+	if a.Family != b.Family {
+		return false
+	}
+	bits := 32
+	if a.Family == 2 {
+		bits = 128
+	}
+	prefix := a.SourceNetmask
+	if b.SourceNetmask < prefix {
+		prefix = b.SourceNetmask
+	}
+	mask := net.CIDRMask(int(prefix), bits)
+	return a.Address.Mask(mask).Equal(b.Address.Mask(mask))
+}
@@ -0,0 +1,73 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestECSModifierScope(t *testing.T) {
+	var ci ClientInfo
+
+	// Upstream that responds with a scope equal to the source prefix length
+	var forwarded *dns.EDNS0_SUBNET
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			forwarded = copyECS(ecsOption(q))
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.SetEdns0(4096, false)
+			if forwarded != nil {
+				ecs := copyECS(forwarded)
+				ecs.SourceScope = forwarded.SourceNetmask
+				a.IsEdns0().Option = append(a.IsEdns0().Option, ecs)
+			}
+			return a, nil
+		},
+	}
+
+	newQuery := func() *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		q.SetEdns0(4096, false)
+		q.IsEdns0().Option = append(q.IsEdns0().Option, &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        1,
+			SourceNetmask: 32,
+			Address:       net.ParseIP("192.0.2.10").To4(),
+		})
+		return q
+	}
+
+	// Privacy masks the client's address, the response should contain the
+	// client's original option with the scope from upstream.
+	r, err := NewECSModifier("test-ecs", upstream, ECSModifierPrivacy(24, 56))
+	require.NoError(t, err)
+	a, err := r.Resolve(newQuery(), ci)
+	require.NoError(t, err)
+	require.Equal(t, uint8(24), forwarded.SourceNetmask)
+	ecs := ecsOption(a)
+	require.NotNil(t, ecs)
+	require.Equal(t, uint8(32), ecs.SourceNetmask)
+	require.Equal(t, uint8(24), ecs.SourceScope)
+	require.Equal(t, "192.0.2.10", ecs.Address.String())
+
+	// Replacing the address with a different network returns scope 0
+	r, err = NewECSModifier("test-ecs", upstream, ECSModifierAdd(net.ParseIP("198.51.100.1"), 24, 56))
+	require.NoError(t, err)
+	a, err = r.Resolve(newQuery(), ci)
+	require.NoError(t, err)
+	ecs = ecsOption(a)
+	require.NotNil(t, ecs)
+	require.Equal(t, uint8(0), ecs.SourceScope)
+	require.Equal(t, "192.0.2.10", ecs.Address.String())
+
+	// No ECS in the response if the client didn't send one
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	a, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Nil(t, ecsOption(a))
+}
@@ -11,6 +11,7 @@ type EDNS0Modifier struct {
 	id       string
 	resolver Resolver
 	modifier EDNS0ModifierFunc
+	domains  domainSet
 }
 
 var _ Resolver = &EDNS0Modifier{}
@@ -31,7 +32,7 @@ func (r *EDNS0Modifier) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	}
 
 	// Modify the query
-	if r.modifier != nil {
+	if r.modifier != nil && r.matchDomain(q) {
 		r.modifier(q, ci)
 	}
 
@@ -43,6 +44,16 @@ func (r *EDNS0Modifier) String() string {
 	return r.id
 }
 
+// SetDomains limits the modifier to queries for names in the given domains or
+// any of their sub-domains. Other queries are passed on unmodified.
+func (r *EDNS0Modifier) SetDomains(domains []string) {
+	r.domains = newDomainSet(domains)
+}
+
+func (r *EDNS0Modifier) matchDomain(q *dns.Msg) bool {
+	return len(r.domains) == 0 || r.domains.match(q.Question[0].Name)
+}
+
 func EDNS0ModifierDelete(code uint16) EDNS0ModifierFunc {
 	return func(q *dns.Msg, ci ClientInfo) {
 		edns0 := q.IsEdns0()
@@ -1,6 +1,7 @@
 package rdns
 
 import (
+	"errors"
 	"expvar"
 	"sync"
 	"time"
@@ -17,13 +18,16 @@ import (
 // active again. This group prefers the resolvers in the order they were added
 // but fails over as necessary with regular retry of the higher-priority ones.
 type FailBack struct {
-	id        string
-	resolvers []Resolver
-	mu        sync.RWMutex
-	failCh    chan struct{} // signal the timer to reset on failure
-	active    int
-	opt       FailBackOptions
-	metrics   *FailRouterMetrics
+	id         string
+	resolvers  []Resolver
+	mu         sync.RWMutex
+	failCh     chan time.Duration // signal the timer to reset on failure, with the time to wait
+	active     int
+	switched   time.Time     // time the active resolver last changed
+	resetAfter time.Duration // current time before failing back, grows if the first resolver flaps
+	opt        FailBackOptions
+	metrics    *FailRouterMetrics
+	health     *healthChecker
 }
 
 // FailBackOptions contain group-specific options.
@@ -35,6 +39,23 @@ type FailBackOptions struct {
 	// Determines if a SERVFAIL returned by a resolver should be considered an
 	// error response and trigger a failover.
 	ServfailError bool
+
+	// Actively probe resolvers and skip those that fail the health check.
+	HealthCheck HealthCheckOptions
+
+	// Keep the connections to the standby resolvers open so that failing
+	// over doesn't add the latency of opening a new connection.
+	WarmStandby bool
+
+	// Minimum time a resolver stays active after the group switched to it.
+	// Failures within this time don't cause another failover, but queries are
+	// still retried on the other resolvers. Disabled if 0.
+	HoldTime time.Duration
+
+	// If the first resolver fails again before it was active for ResetAfter,
+	// the time before the next fail-back is doubled, up to this limit. Goes
+	// back to ResetAfter once the first resolver stays up. Disabled if 0.
+	MaxResetAfter time.Duration
 }
 
 var _ Resolver = &FailBack{}
@@ -43,6 +64,8 @@ type FailRouterMetrics struct {
 	RouterMetrics
 	// Failover count
 	failover *expvar.Int
+	// Failovers suppressed by the hold time
+	suppressed *expvar.Int
 }
 
 func NewFailRouterMetrics(id string, available int) *FailRouterMetrics {
@@ -54,7 +77,8 @@ func NewFailRouterMetrics(id string, available int) *FailRouterMetrics {
 			failure:   getVarMap("router", id, "failure"),
 			available: avail,
 		},
-		failover: getVarInt("router", id, "failover"),
+		failover:   getVarInt("router", id, "failover"),
+		suppressed: getVarInt("router", id, "suppressed"),
 	}
 }
 
@@ -63,12 +87,21 @@ func NewFailBack(id string, opt FailBackOptions, resolvers ...Resolver) *FailBac
 	if opt.ResetAfter == 0 {
 		opt.ResetAfter = time.Minute
 	}
-	return &FailBack{
-		id:        id,
-		resolvers: resolvers,
-		opt:       opt,
-		metrics:   NewFailRouterMetrics(id, len(resolvers)),
+	if opt.MaxResetAfter > 0 && opt.MaxResetAfter < opt.ResetAfter {
+		opt.MaxResetAfter = opt.ResetAfter
+	}
+	r := &FailBack{
+		id:         id,
+		resolvers:  resolvers,
+		resetAfter: opt.ResetAfter,
+		opt:        opt,
+		metrics:    NewFailRouterMetrics(id, len(resolvers)),
+		health:     newHealthChecker(id, opt.HealthCheck, resolvers),
 	}
+	if opt.WarmStandby {
+		startWarmStandby(id, resolvers, r.activeIndex)
+	}
+	return r
 }
 
 // Resolve a DNS query using a failover resolver group that switches to the next
@@ -79,8 +112,19 @@ func (r *FailBack) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 		err error
 		a   *dns.Msg
 	)
+	_, start := r.current()
 	for i := 0; i < len(r.resolvers); i++ {
-		resolver, active := r.current()
+		// Go through the resolvers starting with the active one. If the group
+		// doesn't fail over because of the hold time, the query is still retried
+		// on the next resolver.
+		active := (start + i) % len(r.resolvers)
+		resolver := r.resolvers[active]
+		if !r.health.isHealthy(active) {
+			// Skip it without recording an error, the health check already
+			// tracks its state and failing over here would inflate the metrics.
+			log.WithField("resolver", resolver.String()).Debug("skipping unhealthy resolver")
+			continue
+		}
 		log.WithField("resolver", resolver.String()).Debug("forwarding query to resolver")
 		r.metrics.route.Add(resolver.String(), 1)
 		a, err = resolver.Resolve(q, ci)
@@ -92,6 +136,9 @@ func (r *FailBack) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 
 		r.errorFrom(active)
 	}
+	if a == nil && err == nil {
+		return nil, errors.New("no healthy resolver available")
+	}
 	return a, err
 }
 
@@ -106,6 +153,11 @@ func (r *FailBack) current() (Resolver, int) {
 	return r.resolvers[r.active], r.active
 }
 
+func (r *FailBack) activeIndex() int {
+	_, i := r.current()
+	return i
+}
+
 // Fail over to the next available resolver after receiving an error from i (the active). We
 // need i to know which store returned the error as there could be failures from concurrent
 // requests. Another request could have initiated the failover already. So ignore if i is not
@@ -116,41 +168,76 @@ func (r *FailBack) errorFrom(i int) {
 	if i != r.active {
 		return
 	}
+	if time.Since(r.switched) < r.opt.HoldTime {
+		r.metrics.suppressed.Add(1)
+		return
+	}
 	if r.failCh == nil { // lazy start the reset timer
 		r.failCh = r.startResetTimer()
 	}
+	// If the first resolver failed again shortly after failing back to it, it's
+	// flapping. Wait longer before the next fail-back.
+	if r.active == 0 && r.opt.MaxResetAfter > 0 {
+		if !r.switched.IsZero() && time.Since(r.switched) < r.resetAfter {
+			r.resetAfter *= 2
+			if r.resetAfter > r.opt.MaxResetAfter {
+				r.resetAfter = r.opt.MaxResetAfter
+			}
+		} else {
+			r.resetAfter = r.opt.ResetAfter
+		}
+	}
 	r.active = (r.active + 1) % len(r.resolvers)
+	r.switched = time.Now()
 	Log.WithFields(logrus.Fields{
-		"id":       r.id,
-		"resolver": r.resolvers[r.active].String(),
-	}).Debug("failing over to resolver")
+		"id":          r.id,
+		"resolver":    r.resolvers[r.active].String(),
+		"reset-after": r.resetAfter,
+	}).Info("failing over to resolver")
 	r.metrics.failover.Add(1)
 	r.metrics.available.Add(-1)
-	r.failCh <- struct{}{} // signal the timer to wait some more before switching back
+
+	// Signal the timer to wait some more before switching back. This must not
+	// block while holding the lock. If a signal is still pending, replace it
+	// so the timer uses the latest duration.
+	select {
+	case r.failCh <- r.resetAfter:
+	default:
+		select {
+		case <-r.failCh:
+		default:
+		}
+		r.failCh <- r.resetAfter
+	}
 }
 
 // Set active=0 regularly after the reset timer has expired without further failures. Any failure,
-// as signalled by the channel resets the timer again.
-func (r *FailBack) startResetTimer() chan struct{} {
-	failCh := make(chan struct{}, 1)
+// as signalled by the channel resets the timer again. The channel carries the time to wait.
+func (r *FailBack) startResetTimer() chan time.Duration {
+	failCh := make(chan time.Duration, 1)
 	go func() {
-		timer := time.NewTimer(r.opt.ResetAfter)
+		resetAfter := <-failCh
+		timer := time.NewTimer(resetAfter)
 		for {
 			select {
-			case <-failCh:
+			case resetAfter = <-failCh:
 				if !timer.Stop() {
 					<-timer.C
 				}
 			case <-timer.C:
 				r.mu.Lock()
 				r.active = 0
-				Log.WithField("resolver", r.resolvers[r.active].String()).Debug("failing back to resolver")
+				r.switched = time.Now()
+				Log.WithFields(logrus.Fields{
+					"id":       r.id,
+					"resolver": r.resolvers[r.active].String(),
+				}).Info("failing back to resolver")
 				r.mu.Unlock()
 				r.metrics.available.Add(1)
 				// we just reset to the first resolver, let's wait for another failure before running again
-				<-failCh
+				resetAfter = <-failCh
 			}
-			timer.Reset(r.opt.ResetAfter)
+			timer.Reset(resetAfter)
 		}
 	}()
 	return failCh
@@ -130,3 +130,65 @@ func TestFailBackServfailOKOption(t *testing.T) {
 	require.NotEqual(t, dns.RcodeServerFailure, a.Rcode)
 	require.Equal(t, 1, goodResolver.hitCount)
 }
+
+func TestFailBackHoldDown(t *testing.T) {
+	var ci ClientInfo
+	r1 := new(TestResolver)
+	r2 := new(TestResolver)
+
+	opt := FailBackOptions{ResetAfter: 200 * time.Millisecond, MaxResetAfter: time.Second}
+	g := NewFailBack("test-fb-hold-down", opt, r1, r2)
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+
+	// Fail over to the 2nd resolver, then wait for the fail-back
+	r1.SetFail(true)
+	_, err := g.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r2.HitCount())
+	r1.SetFail(false)
+	time.Sleep(300 * time.Millisecond)
+	_, active := g.current()
+	require.Equal(t, 0, active)
+
+	// The 1st resolver fails again right away, it's flapping. The time before
+	// the next fail-back should be doubled.
+	r1.SetFail(true)
+	_, err = g.Resolve(q, ci)
+	require.NoError(t, err)
+	r1.SetFail(false)
+	time.Sleep(300 * time.Millisecond)
+	_, active = g.current()
+	require.Equal(t, 1, active)
+	time.Sleep(200 * time.Millisecond)
+	_, active = g.current()
+	require.Equal(t, 0, active)
+}
+
+func TestFailBackRapidFailover(t *testing.T) {
+	var ci ClientInfo
+	r1 := new(TestResolver)
+	r2 := new(TestResolver)
+	r3 := new(TestResolver)
+	r1.SetFail(true)
+	r2.SetFail(true)
+	r3.SetFail(true)
+
+	g := NewFailBack("test-fb", FailBackOptions{ResetAfter: time.Millisecond}, r1, r2, r3)
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+
+	// Many failovers in quick succession must not block the group
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			_, _ = g.Resolve(q, ci)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("failover blocked")
+	}
+}
@@ -1,7 +1,9 @@
 package rdns
 
 import (
+	"errors"
 	"sync"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
@@ -17,7 +19,9 @@ type FailRotate struct {
 	resolvers []Resolver
 	mu        sync.RWMutex
 	active    int
+	switched  time.Time // time the active resolver last changed
 	metrics   *FailRouterMetrics
+	health    *healthChecker
 	opt       FailRotateOptions
 }
 
@@ -26,18 +30,35 @@ type FailRotateOptions struct {
 	// Determines if a SERVFAIL returned by a resolver should be considered an
 	// error response and trigger a failover.
 	ServfailError bool
+
+	// Actively probe resolvers and skip those that fail the health check.
+	HealthCheck HealthCheckOptions
+
+	// Keep the connections to the standby resolvers open so that failing
+	// over doesn't add the latency of opening a new connection.
+	WarmStandby bool
+
+	// Minimum time a resolver stays active after the group switched to it.
+	// Failures within this time don't cause another failover, but queries are
+	// still retried on the other resolvers. Disabled if 0.
+	HoldTime time.Duration
 }
 
 var _ Resolver = &FailRotate{}
 
 // NewFailRotate returns a new instance of a failover resolver group.
 func NewFailRotate(id string, opt FailRotateOptions, resolvers ...Resolver) *FailRotate {
-	return &FailRotate{
+	r := &FailRotate{
 		id:        id,
 		resolvers: resolvers,
 		opt:       opt,
 		metrics:   NewFailRouterMetrics(id, len(resolvers)),
+		health:    newHealthChecker(id, opt.HealthCheck, resolvers),
 	}
+	if opt.WarmStandby {
+		startWarmStandby(id, resolvers, r.activeIndex)
+	}
+	return r
 }
 
 // Resolve a DNS query using a failover resolver group that switches to the next
@@ -48,8 +69,19 @@ func (r *FailRotate) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 		err error
 		a   *dns.Msg
 	)
+	_, start := r.current()
 	for i := 0; i < len(r.resolvers); i++ {
-		resolver, active := r.current()
+		// Go through the resolvers starting with the active one. If the group
+		// doesn't fail over because of the hold time, the query is still retried
+		// on the next resolver.
+		active := (start + i) % len(r.resolvers)
+		resolver := r.resolvers[active]
+		if !r.health.isHealthy(active) {
+			// Skip it without recording an error, the health check already
+			// tracks its state and failing over here would inflate the metrics.
+			log.WithField("resolver", resolver.String()).Debug("skipping unhealthy resolver")
+			continue
+		}
 		log.WithField("resolver", resolver.String()).Trace("forwarding query to resolver")
 		r.metrics.route.Add(resolver.String(), 1)
 		a, err = resolver.Resolve(q, ci)
@@ -61,6 +93,9 @@ func (r *FailRotate) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 
 		r.errorFrom(active)
 	}
+	if a == nil && err == nil {
+		return nil, errors.New("no healthy resolver available")
+	}
 	return a, err
 }
 
@@ -75,6 +110,11 @@ func (r *FailRotate) current() (Resolver, int) {
 	return r.resolvers[r.active], r.active
 }
 
+func (r *FailRotate) activeIndex() int {
+	_, i := r.current()
+	return i
+}
+
 // Fail over to the next available resolver after receiving an error from i (the active). We
 // need i to know which store returned the error as there could be failures from concurrent
 // requests. Another request could have initiated the failover already. So ignore if i is not
@@ -85,12 +125,17 @@ func (r *FailRotate) errorFrom(i int) {
 	if i != r.active {
 		return
 	}
+	if time.Since(r.switched) < r.opt.HoldTime {
+		r.metrics.suppressed.Add(1)
+		return
+	}
 	r.metrics.failover.Add(1)
 	r.active = (r.active + 1) % len(r.resolvers)
+	r.switched = time.Now()
 	Log.WithFields(logrus.Fields{
 		"id":       r.id,
 		"resolver": r.resolvers[r.active].String(),
-	}).Debug("failing over to resolver")
+	}).Info("failing over to resolver")
 }
 
 // Returns true is the response is considered successful given the options.
@@ -1,7 +1,10 @@
 package rdns
 
 import (
+	"errors"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/require"
@@ -114,3 +117,80 @@ func TestFailRotateSERVFAILAll(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, dns.RcodeServerFailure, a.Rcode)
 }
+
+func TestFailRotateHealthCheck(t *testing.T) {
+	var ci ClientInfo
+
+	// Resolver that fails all queries, client queries are counted separately
+	// from health checks
+	var clientQueries int32
+	r1 := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			if q.Question[0].Name != "." {
+				atomic.AddInt32(&clientQueries, 1)
+			}
+			return nil, errors.New("failed")
+		},
+	}
+	r2 := new(TestResolver)
+
+	opt := FailRotateOptions{
+		HealthCheck: HealthCheckOptions{Interval: 5 * time.Millisecond},
+	}
+	g := NewFailRotate("test-rotate-health", opt, r1, r2)
+
+	// Wait for the health check to mark the first resolver as unhealthy
+	time.Sleep(50 * time.Millisecond)
+	require.False(t, g.health.isHealthy(0))
+
+	// The query should go to the healthy resolver directly
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+	_, err := g.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, int32(0), atomic.LoadInt32(&clientQueries))
+
+	// Skipping the unhealthy resolver is not counted as a failure or failover
+	require.Equal(t, int64(0), g.metrics.failover.Value())
+	require.Nil(t, g.metrics.failure.Get(r1.String()))
+	_, active := g.current()
+	require.Equal(t, 0, active)
+}
+
+func TestFailRotateWarmStandby(t *testing.T) {
+	r1 := new(TestResolver)
+	r2 := new(TestResolver)
+
+	NewFailRotate("test-rotate-standby", FailRotateOptions{WarmStandby: true}, r1, r2)
+
+	// Only the standby resolver should receive a query to open its connection
+	require.Eventually(t, func() bool { return r2.HitCount() == 1 }, time.Second, 10*time.Millisecond)
+	require.Equal(t, 0, r1.HitCount())
+}
+
+func TestFailRotateHoldTime(t *testing.T) {
+	var ci ClientInfo
+	r1 := new(TestResolver)
+	r2 := new(TestResolver)
+	r3 := new(TestResolver)
+
+	g := NewFailRotate("test-rotate-hold", FailRotateOptions{HoldTime: time.Minute}, r1, r2, r3)
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+
+	// Fail over to the 2nd resolver
+	r1.SetFail(true)
+	_, err := g.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r2.HitCount())
+
+	// The 2nd fails as well, but the group was just switched to it. The query
+	// is answered by the 3rd, without failing over.
+	r2.SetFail(true)
+	_, err = g.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 2, r2.HitCount())
+	require.Equal(t, 1, r3.HitCount())
+	_, active := g.current()
+	require.Equal(t, 1, active)
+}
@@ -1,24 +1,56 @@
 package rdns
 
 import (
+	"sort"
+	"sync"
+	"time"
+
 	"github.com/miekg/dns"
 )
 
 // Fastest is a resolver group that queries all resolvers concurrently for
-// the same query, then returns the fastest response only.
+// the same query, then returns the fastest response only. Optionally, only
+// the resolvers that were fastest recently are queried.
 type Fastest struct {
 	id        string
 	resolvers []Resolver
+	opt       FastestOptions
+	mu        sync.Mutex
+	latency   []time.Duration // Average response time by resolver, 0 if unknown
+	queries   uint64
 }
 
-var _ Resolver = &FailRotate{}
+var _ Resolver = &Fastest{}
+
+// FastestOptions contain group-specific options.
+type FastestOptions struct {
+	// Only send queries to the N resolvers with the lowest average response
+	// time. Other resolvers are still queried occasionally to keep their
+	// response times up-to-date. All resolvers are queried if 0.
+	Count int
+}
+
+// Response time recorded for resolvers that fail or respond with SERVFAIL.
+const fastestFailurePenalty = 5 * time.Second
+
+// When only the N fastest resolvers are used, one of the others is added to
+// every Nth query to measure its response time.
+const fastestProbeInterval = 10
 
 // NewFastest returns a new instance of a resolver group that returns the fastest
 // response from all its resolvers.
 func NewFastest(id string, resolvers ...Resolver) *Fastest {
+	return NewFastestWithOptions(id, FastestOptions{}, resolvers...)
+}
+
+// NewFastestWithOptions returns a new instance of a fastest group with
+// group-specific options.
+func NewFastestWithOptions(id string, opt FastestOptions, resolvers ...Resolver) *Fastest {
 	return &Fastest{
 		id:        id,
 		resolvers: resolvers,
+		opt:       opt,
+		latency:   make([]time.Duration, len(resolvers)),
 	}
 }
 
@@ -33,13 +65,22 @@ func (r *Fastest) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 		err error
 	}
 
-	responseCh := make(chan response, len(r.resolvers))
+	selected := r.pick()
+	responseCh := make(chan response, len(selected))
 
-	// Send the query to all resolvers. The responses are collected in a buffered channel
-	for _, resolver := range r.resolvers {
-		resolver := resolver
+	// Send the query to all selected resolvers. The responses are collected in a buffered
+	// channel. The response times are recorded even after a response was returned.
+	for _, i := range selected {
+		i := i
+		resolver := r.resolvers[i]
 		go func() {
+			start := time.Now()
 			a, err := resolver.Resolve(q, ci)
+			duration := time.Since(start)
+			if err != nil || (a != nil && a.Rcode == dns.RcodeServerFailure) {
+				duration = fastestFailurePenalty
+			}
+			r.record(i, duration)
 			responseCh <- response{resolver, a, err}
 		}()
 	}
@@ -56,7 +97,7 @@ func (r *Fastest) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 		log.WithField("resolver", resolver.String()).WithError(err).Debug("resolver returned failure, waiting for next response")
 
 		// If all responses were bad, return the last one
-		if i++; i >= len(r.resolvers) {
+		if i++; i >= len(selected) {
 			return a, err
 		}
 	}
@@ -66,3 +107,44 @@ func (r *Fastest) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 func (r *Fastest) String() string {
 	return r.id
 }
+
+// Returns the indexes of the resolvers to send a query to.
+func (r *Fastest) pick() []int {
+	all := make([]int, len(r.resolvers))
+	for i := range all {
+		all[i] = i
+	}
+	if r.opt.Count <= 0 || r.opt.Count >= len(r.resolvers) {
+		return all
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Order by response time, resolvers without measurements first
+	sort.SliceStable(all, func(i, j int) bool {
+		return r.latency[all[i]] < r.latency[all[j]]
+	})
+	selected := make([]int, r.opt.Count, r.opt.Count+1)
+	copy(selected, all)
+
+	// Regularly add one of the slower resolvers to give it a chance to
+	// show that it got faster.
+	r.queries++
+	if r.queries%fastestProbeInterval == 0 {
+		others := all[r.opt.Count:]
+		selected = append(selected, others[int(r.queries/fastestProbeInterval)%len(others)])
+	}
+	return selected
+}
+
+// Updates the average response time of a resolver.
+func (r *Fastest) record(i int, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.latency[i] == 0 {
+		r.latency[i] = d
+		return
+	}
+	r.latency[i] += (d - r.latency[i]) / 4
+}
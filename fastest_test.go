@@ -124,3 +124,44 @@ func TestFastestFailAll(t *testing.T) {
 	require.Equal(t, 1, r2.HitCount())
 	require.Equal(t, dns.RcodeServerFailure, a.Rcode)
 }
+
+func TestFastestCount(t *testing.T) {
+	var ci ClientInfo
+
+	// Slow resolver
+	r1 := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			time.Sleep(10 * time.Millisecond)
+			return q, nil
+		},
+	}
+	// Fast resolver
+	r2 := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			time.Sleep(time.Millisecond)
+			return q, nil
+		},
+	}
+
+	g := NewFastestWithOptions("fastest", FastestOptions{Count: 1}, r1, r2)
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+
+	// Measure both resolvers first, without response times they're
+	// queried in order.
+	_, err := g.Resolve(q, ci)
+	require.NoError(t, err)
+	_, err = g.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r1.HitCount())
+	require.Equal(t, 1, r2.HitCount())
+
+	// Only the fast resolver should be used now, with the exception of the
+	// 10th query that includes the slow one.
+	for i := 0; i < 7; i++ {
+		_, err = g.Resolve(q, ci)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 1, r1.HitCount())
+	require.Equal(t, 8, r2.HitCount())
+}
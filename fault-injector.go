@@ -0,0 +1,106 @@
+package rdns
+
+import (
+	"errors"
+	"expvar"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// FaultInjector is a resolver that introduces failures into a pipeline at a
+// configurable rate. It can add latency, simulate timeouts, or respond with
+// SERVFAIL or truncated responses instead of forwarding the query. It is
+// meant for testing failover, retry and cache configurations.
+type FaultInjector struct {
+	id       string
+	resolver Resolver
+	opt      FaultInjectorOptions
+	metrics  *FaultInjectorMetrics
+}
+
+var _ Resolver = &FaultInjector{}
+
+// FaultInjectorOptions define the types of faults and the rate at which they
+// are injected. Rates are fractions between 0 and 1. Latency is added
+// independently of the other faults, at most one of timeout, SERVFAIL or
+// truncation is applied to a query.
+type FaultInjectorOptions struct {
+	// Delay added to queries at the latency rate.
+	Latency     time.Duration
+	LatencyRate float64
+
+	// Queries that time out wait for the timeout duration and then return an
+	// error. Default timeout 2 seconds.
+	Timeout     time.Duration
+	TimeoutRate float64
+
+	// Rate of queries answered with SERVFAIL.
+	ServfailRate float64
+
+	// Rate of queries answered with an empty, truncated response.
+	TruncateRate float64
+}
+
+type FaultInjectorMetrics struct {
+	// Count of injected faults by type.
+	fault *expvar.Map
+}
+
+func NewFaultInjectorMetrics(id string) *FaultInjectorMetrics {
+	return &FaultInjectorMetrics{
+		fault: getVarMap("router", id, "fault"),
+	}
+}
+
+// NewFaultInjector returns a new instance of a fault injector.
+func NewFaultInjector(id string, resolver Resolver, opt FaultInjectorOptions) *FaultInjector {
+	if opt.Timeout == 0 {
+		opt.Timeout = 2 * time.Second
+	}
+	return &FaultInjector{
+		id:       id,
+		resolver: resolver,
+		opt:      opt,
+		metrics:  NewFaultInjectorMetrics(id),
+	}
+}
+
+// Resolve a DNS query, possibly injecting a fault instead of or in addition to
+// forwarding it.
+func (r *FaultInjector) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	log := logger(r.id, q, ci)
+
+	if randFloat64() < r.opt.LatencyRate {
+		log.WithField("latency", r.opt.Latency).Debug("injecting latency")
+		r.metrics.fault.Add("latency", 1)
+		time.Sleep(r.opt.Latency)
+	}
+
+	n := randFloat64()
+	switch {
+	case n < r.opt.TimeoutRate:
+		log.Debug("injecting timeout")
+		r.metrics.fault.Add("timeout", 1)
+		time.Sleep(r.opt.Timeout)
+		return nil, errors.New("injected timeout")
+	case n < r.opt.TimeoutRate+r.opt.ServfailRate:
+		log.Debug("injecting servfail")
+		r.metrics.fault.Add("servfail", 1)
+		return servfail(q), nil
+	case n < r.opt.TimeoutRate+r.opt.ServfailRate+r.opt.TruncateRate:
+		log.Debug("injecting truncated response")
+		r.metrics.fault.Add("truncate", 1)
+		a := new(dns.Msg)
+		a.SetReply(q)
+		a.Truncated = true
+		return a, nil
+	}
+
+	log.WithField("resolver", r.resolver.String()).Debug("forwarding query to resolver")
+	return r.resolver.Resolve(q, ci)
+}
+
+func (r *FaultInjector) String() string {
+	return r.id
+}
@@ -0,0 +1,42 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFaultInjector(t *testing.T) {
+	var ci ClientInfo
+	upstream := new(TestResolver)
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// No faults configured, everything is forwarded
+	r := NewFaultInjector("test-fault", upstream, FaultInjectorOptions{})
+	a, err := r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Equal(t, 1, upstream.HitCount())
+
+	// All queries fail with SERVFAIL
+	r = NewFaultInjector("test-fault", upstream, FaultInjectorOptions{ServfailRate: 1})
+	a, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeServerFailure, a.Rcode)
+	require.Equal(t, 1, upstream.HitCount())
+
+	// All queries are truncated
+	r = NewFaultInjector("test-fault", upstream, FaultInjectorOptions{TruncateRate: 1})
+	a, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.True(t, a.Truncated)
+	require.Equal(t, 1, upstream.HitCount())
+
+	// All queries time out
+	r = NewFaultInjector("test-fault", upstream, FaultInjectorOptions{TimeoutRate: 1, Timeout: 1})
+	_, err = r.Resolve(q, ci)
+	require.Error(t, err)
+	require.Equal(t, 1, upstream.HitCount())
+}
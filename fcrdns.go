@@ -0,0 +1,165 @@
+package rdns
+
+import (
+	"errors"
+	"expvar"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// FCrDNS validates A/AAAA answers for a set of domains with forward-confirmed
+// reverse DNS. For every address in the response, the PTR records are looked
+// up, and at least one of the names in them has to resolve back to the same
+// address. Responses failing the check are logged, or blocked if enabled.
+type FCrDNS struct {
+	id       string
+	resolver Resolver
+	opt      FCrDNSOptions
+	domains  domainSet
+	metrics  *FCrDNSMetrics
+}
+
+type FCrDNSMetrics struct {
+	// Count of responses that passed the check.
+	match *expvar.Int
+	// Count of responses that failed the check.
+	mismatch *expvar.Int
+	// Count of blocked responses.
+	blocked *expvar.Int
+}
+
+var _ Resolver = &FCrDNS{}
+
+type FCrDNSOptions struct {
+	// Responses to queries for these domains, or names under them, are
+	// checked. All other responses are passed through.
+	Domains []string
+
+	// Reply with SERVFAIL instead of the response if the check fails.
+	// Mismatches are only logged if false.
+	Block bool
+
+	// Optional resolver used for the PTR and forward lookups. Uses the
+	// upstream resolver of the group if not set.
+	LookupResolver Resolver
+}
+
+// NewFCrDNS returns a new instance of a forward-confirmed reverse DNS validator.
+func NewFCrDNS(id string, resolver Resolver, opt FCrDNSOptions) *FCrDNS {
+	if opt.LookupResolver == nil {
+		opt.LookupResolver = resolver
+	}
+	return &FCrDNS{
+		id:       id,
+		resolver: resolver,
+		opt:      opt,
+		domains:  newDomainSet(opt.Domains),
+		metrics: &FCrDNSMetrics{
+			match:    getVarInt("fcrdns", id, "match"),
+			mismatch: getVarInt("fcrdns", id, "mismatch"),
+			blocked:  getVarInt("fcrdns", id, "blocked"),
+		},
+	}
+}
+
+// Resolve a DNS query and validate the addresses in the response.
+func (r *FCrDNS) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return nil, errors.New("no question in query")
+	}
+	a, err := r.resolver.Resolve(q, ci)
+	if err != nil || a == nil || a.Rcode != dns.RcodeSuccess {
+		return a, err
+	}
+	if !r.domains.match(q.Question[0].Name) {
+		return a, nil
+	}
+	log := logger(r.id, q, ci)
+
+	for _, rr := range a.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		names, ok := r.confirm(ip, ci)
+		if ok {
+			continue
+		}
+		r.metrics.mismatch.Add(1)
+		log.WithFields(logrus.Fields{"ip": ip, "ptr": strings.Join(names, ",")}).Warn("forward-confirmed reverse dns mismatch")
+		if r.opt.Block {
+			r.metrics.blocked.Add(1)
+			return servfail(q), nil
+		}
+		return a, nil
+	}
+	r.metrics.match.Add(1)
+	return a, nil
+}
+
+func (r *FCrDNS) String() string {
+	return r.id
+}
+
+// Looks up the PTR records for the address and returns true if one of the
+// names resolves back to it. Also returns the names from the PTR records.
+func (r *FCrDNS) confirm(ip net.IP, ci ClientInfo) ([]string, bool) {
+	reverse, err := dns.ReverseAddr(ip.String())
+	if err != nil {
+		return nil, false
+	}
+	resp, err := r.lookup(reverse, dns.TypePTR, ci)
+	if err != nil {
+		return nil, false
+	}
+	qtype := dns.TypeAAAA
+	if ip.To4() != nil {
+		qtype = dns.TypeA
+	}
+	var names []string
+	for _, rr := range resp.Answer {
+		ptr, ok := rr.(*dns.PTR)
+		if !ok {
+			continue
+		}
+		names = append(names, ptr.Ptr)
+		forward, err := r.lookup(ptr.Ptr, qtype, ci)
+		if err != nil {
+			continue
+		}
+		for _, rr := range forward.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				if rr.A.Equal(ip) {
+					return names, true
+				}
+			case *dns.AAAA:
+				if rr.AAAA.Equal(ip) {
+					return names, true
+				}
+			}
+		}
+	}
+	return names, false
+}
+
+func (r *FCrDNS) lookup(name string, qtype uint16, ci ClientInfo) (*dns.Msg, error) {
+	q := new(dns.Msg)
+	q.SetQuestion(name, qtype)
+	a, err := r.opt.LookupResolver.Resolve(q, ci)
+	if err != nil {
+		return nil, err
+	}
+	if a == nil || a.Rcode != dns.RcodeSuccess {
+		return nil, errors.New("lookup failed")
+	}
+	return a, nil
+}
@@ -0,0 +1,82 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFCrDNS(t *testing.T) {
+	var ci ClientInfo
+	records := map[string]dns.RR{
+		"good.example.com.":       &dns.A{A: net.IP{192, 0, 2, 1}},
+		"bad.example.com.":        &dns.A{A: net.IP{192, 0, 2, 2}},
+		"other.example.net.":      &dns.A{A: net.IP{192, 0, 2, 3}},
+		"1.2.0.192.in-addr.arpa.": &dns.PTR{Ptr: "good.example.com."},
+		"2.2.0.192.in-addr.arpa.": &dns.PTR{Ptr: "other.example.net."},
+		"unchecked.example.org.":  &dns.A{A: net.IP{192, 0, 2, 4}},
+		"no-ptr.example.com.":     &dns.A{A: net.IP{192, 0, 2, 5}},
+		"5.2.0.192.in-addr.arpa.": nil,
+		"good.sub.example.com.":   &dns.A{A: net.IP{192, 0, 2, 1}},
+	}
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			rr, ok := records[q.Question[0].Name]
+			if !ok || rr == nil {
+				a.Rcode = dns.RcodeNameError
+				return a, nil
+			}
+			rr = dns.Copy(rr)
+			*rr.Header() = dns.RR_Header{Name: q.Question[0].Name, Rrtype: q.Question[0].Qtype, Class: dns.ClassINET, Ttl: 60}
+			a.Answer = []dns.RR{rr}
+			return a, nil
+		},
+	}
+
+	r := NewFCrDNS("test-fcrdns", upstream, FCrDNSOptions{
+		Domains: []string{"Example.com"},
+		Block:   true,
+	})
+
+	// Matching reverse DNS
+	q := new(dns.Msg)
+	q.SetQuestion("good.sub.example.com.", dns.TypeA)
+	a, err := r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Len(t, a.Answer, 1)
+
+	// PTR points to a name with a different address
+	q.SetQuestion("bad.example.com.", dns.TypeA)
+	a, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeServerFailure, a.Rcode)
+
+	// No PTR record at all
+	q.SetQuestion("no-ptr.example.com.", dns.TypeA)
+	a, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeServerFailure, a.Rcode)
+
+	// Names outside the configured domains aren't checked
+	hits := upstream.HitCount()
+	q.SetQuestion("unchecked.example.org.", dns.TypeA)
+	a, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Equal(t, hits+1, upstream.HitCount())
+
+	// Without blocking, mismatches are passed through
+	r = NewFCrDNS("test-fcrdns-log", upstream, FCrDNSOptions{
+		Domains: []string{"example.com."},
+	})
+	q.SetQuestion("bad.example.com.", dns.TypeA)
+	a, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Len(t, a.Answer, 1)
+}
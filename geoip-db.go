@@ -5,39 +5,53 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/oschwald/maxminddb-golang"
 )
 
 // GeoIPDB holds blocklist rules based on location. When an IP is queried,
 // its location is looked up in a database and the result is compared to the
-// blocklist rules.
+// blocklist rules. Rules can be GeoName IDs, 2-letter ISO country codes, or
+// autonomous system numbers prefixed with "AS". The databases are MaxMind
+// GeoIP2/GeoLite2 files, City and Country databases provide the location
+// while ASN databases are needed to match AS numbers.
 type GeoIPDB struct {
-	name      string
-	loader    BlocklistLoader
-	geoDB     *maxminddb.Reader
-	geoDBFile string
-	db        map[uint64]struct{}
+	name       string
+	loader     BlocklistLoader
+	geoDBFiles []string
+	ids        map[uint64]struct{}
+	countries  map[string]struct{}
+	asns       map[uint64]struct{}
+
+	// The databases are memory-mapped and must not be used after they were
+	// closed, Match could still be running on an old instance after a reload.
+	mu     sync.RWMutex
+	geoDBs []*maxminddb.Reader
 }
 
 var _ IPBlocklistDB = &GeoIPDB{}
 
-// NewGeoIPDB returns a new instance of a matcher for a location rules.
-func NewGeoIPDB(name string, loader BlocklistLoader, geoDBFile string) (*GeoIPDB, error) {
-	if geoDBFile == "" {
-		geoDBFile = "/usr/share/GeoIP/GeoLite2-City.mmdb"
+// NewGeoIPDB returns a new instance of a matcher for a location rules. If no
+// database file is given, the GeoLite2 City database in the default location
+// is used.
+func NewGeoIPDB(name string, loader BlocklistLoader, geoDBFiles ...string) (*GeoIPDB, error) {
+	if len(geoDBFiles) == 0 {
+		geoDBFiles = []string{"/usr/share/GeoIP/GeoLite2-City.mmdb"}
 	}
-	geoDB, err := maxminddb.Open(geoDBFile)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open geo location database file: %w", err)
+	db := &GeoIPDB{
+		name:       name,
+		loader:     loader,
+		geoDBFiles: geoDBFiles,
+		ids:        make(map[uint64]struct{}),
+		countries:  make(map[string]struct{}),
+		asns:       make(map[uint64]struct{}),
 	}
 
 	rules, err := loader.Load()
 	if err != nil {
 		return nil, err
 	}
-
-	db := make(map[uint64]struct{})
 	for _, r := range rules {
 		r = strings.TrimSpace(r)
 		if strings.HasPrefix(r, "#") || r == "" {
@@ -45,23 +59,56 @@ func NewGeoIPDB(name string, loader BlocklistLoader, geoDBFile string) (*GeoIPDB
 		}
 		r = strings.Split(r, "#")[0] // possible comment at the end of the line
 		r = strings.TrimSpace(r)
+		if err := db.addRule(r); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, file := range geoDBFiles {
+		geoDB, err := maxminddb.Open(file)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to open geo location database file: %w", err)
+		}
+		db.geoDBs = append(db.geoDBs, geoDB)
+	}
+	return db, nil
+}
+
+// Parses a rule and adds it to the database.
+func (m *GeoIPDB) addRule(r string) error {
+	upper := strings.ToUpper(r)
+	switch {
+	case len(upper) > 2 && strings.HasPrefix(upper, "AS") && isDigits(upper[2:]): // AS number
+		value, err := strconv.ParseUint(upper[2:], 10, 32)
+		if err != nil {
+			return fmt.Errorf("unable to parse AS number in rule '%s': %w", r, err)
+		}
+		m.asns[value] = struct{}{}
+	case len(r) == 2: // ISO country code
+		m.countries[upper] = struct{}{}
+	default:
 		value, err := strconv.ParseUint(r, 10, 64) // GeoNames ID
 		if err != nil {
-			return nil, fmt.Errorf("unable to parse geoname id in rule '%s': %w", r, err)
+			return fmt.Errorf("unable to parse geoname id in rule '%s': %w", r, err)
 		}
-		db[value] = struct{}{}
+		m.ids[value] = struct{}{}
 	}
-	return &GeoIPDB{
-		name:      name,
-		geoDB:     geoDB,
-		geoDBFile: geoDBFile,
-		db:        db,
-		loader:    loader,
-	}, nil
+	return nil
+}
+
+// Returns true if the string is made up of decimal digits only.
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
 }
 
 func (m *GeoIPDB) Reload() (IPBlocklistDB, error) {
-	return NewGeoIPDB(m.name, m.loader, m.geoDBFile)
+	return NewGeoIPDB(m.name, m.loader, m.geoDBFiles...)
 }
 
 func (m *GeoIPDB) Match(ip net.IP) (*BlocklistMatch, bool) {
@@ -71,6 +118,7 @@ func (m *GeoIPDB) Match(ip net.IP) (*BlocklistMatch, bool) {
 		} `maxminddb:"continent"`
 		Country struct {
 			GeoNameID uint64 `maxminddb:"geoname_id"`
+			ISOCode   string `maxminddb:"iso_code"`
 		} `maxminddb:"country"`
 		City struct {
 			GeoNameID uint64 `maxminddb:"geoname_id"`
@@ -78,12 +126,24 @@ func (m *GeoIPDB) Match(ip net.IP) (*BlocklistMatch, bool) {
 		Subdivisions []struct {
 			GeoNameID uint64 `maxminddb:"geoname_id"`
 		} `maxminddb:"subdivisions"`
+		ASN uint64 `maxminddb:"autonomous_system_number"`
 	}
 
-	if err := m.geoDB.Lookup(ip, &record); err != nil {
-		Log.WithField("ip", ip).WithError(err).Error("failed to lookup ip in geo location database")
+	// Look the IP up in all databases. They hold different fields depending on
+	// the type so the results can be combined.
+	m.mu.RLock()
+	if m.geoDBs == nil { // closed after a reload
+		m.mu.RUnlock()
 		return nil, false
 	}
+	for _, geoDB := range m.geoDBs {
+		if err := geoDB.Lookup(ip, &record); err != nil {
+			m.mu.RUnlock()
+			Log.WithField("ip", ip).WithError(err).Error("failed to lookup ip in geo location database")
+			return nil, false
+		}
+	}
+	m.mu.RUnlock()
 
 	// Try to find the continent, country, or city GeoName ID in the blocklist
 	ids := []uint64{record.Continent.GeoNameID, record.Country.GeoNameID, record.City.GeoNameID}
@@ -91,20 +151,47 @@ func (m *GeoIPDB) Match(ip net.IP) (*BlocklistMatch, bool) {
 		ids = append(ids, sd.GeoNameID)
 	}
 	for _, id := range ids {
-		if _, ok := m.db[id]; ok {
+		if _, ok := m.ids[id]; ok {
 			return &BlocklistMatch{
 				List: m.name,
 				Rule: fmt.Sprintf("%d", id),
 			}, true
 		}
 	}
+	if _, ok := m.countries[record.Country.ISOCode]; ok {
+		return &BlocklistMatch{
+			List: m.name,
+			Rule: record.Country.ISOCode,
+		}, true
+	}
+	if _, ok := m.asns[record.ASN]; ok {
+		return &BlocklistMatch{
+			List: m.name,
+			Rule: fmt.Sprintf("AS%d", record.ASN),
+		}, true
+	}
 	return nil, false
 }
 
+// Close the databases. Waits for lookups that are in progress.
 func (m *GeoIPDB) Close() error {
-	return m.geoDB.Close()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var closeErr error
+	for _, geoDB := range m.geoDBs {
+		if err := geoDB.Close(); closeErr == nil {
+			closeErr = err
+		}
+	}
+	m.geoDBs = nil
+	return closeErr
 }
 
 func (m *GeoIPDB) String() string {
 	return "GeoIP-blocklist"
 }
+
+// Stale returns true if the rules were loaded from a stale copy of the list.
+func (m *GeoIPDB) Stale() bool {
+	return isStale(m.loader)
+}
@@ -0,0 +1,181 @@
+package rdns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGeoIPDB(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.mmdb")
+	writeTestMMDB(t, file, map[string]map[string]interface{}{
+		// American Samoa, its ISO code is the same as the AS prefix
+		"192.0.2.0/24": {
+			"country": map[string]interface{}{"geoname_id": uint32(5880801), "iso_code": "AS"},
+		},
+		"198.51.100.0/24": {
+			"country":                  map[string]interface{}{"geoname_id": uint32(2635167), "iso_code": "GB"},
+			"autonomous_system_number": uint32(64500),
+		},
+	})
+
+	loader := NewStaticLoader([]string{"as", "AS64500"})
+	db, err := NewGeoIPDB("test", loader, file)
+	require.NoError(t, err)
+
+	// Country code "AS"
+	match, ok := db.Match(net.ParseIP("192.0.2.1"))
+	require.True(t, ok)
+	require.Equal(t, "AS", match.Rule)
+
+	// AS number
+	match, ok = db.Match(net.ParseIP("198.51.100.1"))
+	require.True(t, ok)
+	require.Equal(t, "AS64500", match.Rule)
+
+	// Not in the database
+	_, ok = db.Match(net.ParseIP("203.0.113.1"))
+	require.False(t, ok)
+
+	// The old instance keeps matching after a reload until it's replaced
+	// and closed, lists that are re-used stay open
+	cidr, err := NewCidrDB("cidr", NewStaticLoader([]string{"203.0.113.0/24"}))
+	require.NoError(t, err)
+	multi, err := NewMultiIPDB(db, cidr)
+	require.NoError(t, err)
+	db2, err := db.Reload()
+	require.NoError(t, err)
+	_, ok = db.Match(net.ParseIP("192.0.2.1"))
+	require.True(t, ok)
+	multi2, err := NewMultiIPDB(db2, cidr)
+	require.NoError(t, err)
+	closeReplacedIPDB(multi, multi2)
+	_, ok = db.Match(net.ParseIP("192.0.2.1"))
+	require.False(t, ok)
+	_, ok = multi2.Match(net.ParseIP("192.0.2.1"))
+	require.True(t, ok)
+	_, ok = multi2.Match(net.ParseIP("203.0.113.1"))
+	require.True(t, ok)
+	require.NoError(t, multi2.Close())
+
+	// Invalid AS numbers are rejected
+	_, err = NewGeoIPDB("test", NewStaticLoader([]string{"AS12x"}), file)
+	require.Error(t, err)
+}
+
+// Writes a MaxMind DB file with IPv4 networks and their records. Only supports
+// the data types needed for the tests.
+func writeTestMMDB(t *testing.T, file string, networks map[string]map[string]interface{}) {
+	type node struct {
+		children [2]*node
+		data     []byte
+	}
+	var (
+		root = new(node)
+		data bytes.Buffer
+	)
+	cidrs := make([]string, 0, len(networks))
+	for cidr := range networks {
+		cidrs = append(cidrs, cidr)
+	}
+	sort.Strings(cidrs)
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		require.NoError(t, err)
+		ip := ipNet.IP.To4()
+		ones, _ := ipNet.Mask.Size()
+		n := root
+		for i := 0; i < ones; i++ {
+			bit := (ip[i/8] >> (7 - uint(i%8))) & 1
+			if n.children[bit] == nil {
+				n.children[bit] = new(node)
+			}
+			n = n.children[bit]
+		}
+		n.data = mmdbEncode(networks[cidr])
+	}
+
+	// Number the inner nodes and place the records in the data section
+	var (
+		nodes   []*node
+		offsets = make(map[*node]int)
+	)
+	var walk func(n *node)
+	walk = func(n *node) {
+		if n.data != nil {
+			offsets[n] = data.Len()
+			data.Write(n.data)
+			return
+		}
+		offsets[n] = len(nodes)
+		nodes = append(nodes, n)
+		for _, c := range n.children {
+			if c != nil {
+				walk(c)
+			}
+		}
+	}
+	walk(root)
+
+	var out bytes.Buffer
+	nodeCount := len(nodes)
+	for _, n := range nodes {
+		for _, c := range n.children {
+			record := nodeCount // no data
+			if c != nil && c.data != nil {
+				record = nodeCount + 16 + offsets[c]
+			} else if c != nil {
+				record = offsets[c]
+			}
+			out.Write([]byte{byte(record >> 16), byte(record >> 8), byte(record)})
+		}
+	}
+	out.Write(make([]byte, 16))
+	out.Write(data.Bytes())
+	out.WriteString("\xab\xcd\xefMaxMind.com")
+	out.Write(mmdbEncode(map[string]interface{}{
+		"binary_format_major_version": uint32(2),
+		"binary_format_minor_version": uint32(0),
+		"build_epoch":                 uint32(0),
+		"database_type":               "Test",
+		"ip_version":                  uint32(4),
+		"node_count":                  uint32(nodeCount),
+		"record_size":                 uint32(24),
+	}))
+	require.NoError(t, os.WriteFile(file, out.Bytes(), 0644))
+}
+
+// Encodes a value in the MaxMind DB data format.
+func mmdbEncode(v interface{}) []byte {
+	var b bytes.Buffer
+	switch v := v.(type) {
+	case string:
+		b.WriteByte(2<<5 | byte(len(v)))
+		b.WriteString(v)
+	case uint32:
+		value := make([]byte, 4)
+		binary.BigEndian.PutUint32(value, v)
+		b.WriteByte(6<<5 | 4)
+		b.Write(value)
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b.WriteByte(7<<5 | byte(len(v)))
+		for _, k := range keys {
+			b.Write(mmdbEncode(k))
+			b.Write(mmdbEncode(v[k]))
+		}
+	default:
+		panic("unsupported type")
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,463 @@
+package rdns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Handoff is used by a new process to take over the listening sockets and the
+// content of the caches from a running instance, for upgrades without
+// downtime. The running instance keeps answering queries until the new process
+// has started its listeners on the same sockets and reports that it's ready.
+type Handoff struct {
+	conn *net.UnixConn
+}
+
+type HandoffOptions struct {
+	// Listeners that are stopped once another process took over.
+	Listeners *ListenerSet
+
+	// Time to wait for queries that are already being processed to complete
+	// after the listeners were stopped. Default 5 seconds.
+	DrainTime time.Duration
+
+	// Time allowed for the new process to start and report that it's ready.
+	// Default 1 minute.
+	Timeout time.Duration
+}
+
+const (
+	// Time allowed for the transfer of sockets and caches
+	handoffTransferTimeout = time.Minute
+
+	// Time the new process waits for its listeners to pick up the sockets,
+	// sockets that aren't used by then are closed
+	handoffStartTimeout = 5 * time.Second
+
+	// Maximum number of sockets that can be handed over
+	handoffMaxSockets = 256
+
+	// Maximum size of the header
+	handoffMaxHeader = 1 << 20
+)
+
+// Sent by the running process, followed by the cache snapshot.
+type handoffHeader struct {
+	Sockets []handoffSocket `json:"sockets"`
+}
+
+// Sent by the new process once its listeners are started.
+type handoffReady struct {
+	Ready bool `json:"ready"`
+}
+
+// Socket opened by a listener, identified by network and the address from
+// the configuration.
+type handoffSocket struct {
+	Network string `json:"network"`
+	Address string `json:"address"`
+	conn    filer
+}
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+var (
+	handoffMu sync.Mutex
+	// Sockets and caches are only recorded if handoff is enabled
+	handoffEnabled bool
+	// Sockets opened by listeners in this process
+	handoffOpen []handoffSocket
+	// Sockets received from the previous process, by network and address
+	handoffInherited = make(map[string][]*os.File)
+	// Caches in this process, and snapshots received from the previous one, by ID
+	handoffCaches    = make(map[string]*Cache)
+	handoffSnapshots = make(map[string][]cacheSnapshotItem)
+)
+
+// EnableHandoff records the sockets opened by listeners and the caches created
+// from now on, so they can be taken over by another instance with ServeHandoff.
+// Needs to be called before any listeners or caches are created.
+func EnableHandoff() {
+	handoffMu.Lock()
+	handoffEnabled = true
+	handoffMu.Unlock()
+}
+
+// ReceiveHandoff connects to a running instance on the unix socket at path
+// and takes over its listening sockets and the content of its caches. They are
+// used by listeners and caches that are created afterwards with the same
+// address or ID. Returns nil if no instance is listening on path.
+func ReceiveHandoff(path string) (*Handoff, error) {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		if errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	log := Log.WithField("path", path)
+	// Only take sockets and caches from processes of the same user, or root,
+	// not from anyone that managed to create the socket
+	uid, err := peerUID(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read credentials of handoff sender: %w", err)
+	}
+	if uid != os.Geteuid() && uid != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("refusing handoff from process of user %d", uid)
+	}
+	log.Info("receiving sockets and caches from running instance")
+	_ = conn.SetDeadline(time.Now().Add(handoffTransferTimeout))
+
+	// The header is prefixed with its length and sent together with the sockets
+	buf := make([]byte, 64<<10)
+	n, files, err := readSockets(conn, buf)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	var r io.Reader = conn
+	if n < 4 {
+		m, err := io.ReadAtLeast(conn, buf[n:], 4-n)
+		if err != nil {
+			closeFiles(files)
+			conn.Close()
+			return nil, err
+		}
+		n += m
+	}
+	size := int(binary.BigEndian.Uint32(buf))
+	if size > handoffMaxHeader {
+		closeFiles(files)
+		conn.Close()
+		return nil, fmt.Errorf("handoff header of %d bytes exceeds limit", size)
+	}
+	header := make([]byte, size)
+	copied := copy(header, buf[4:n])
+	if copied < size {
+		if _, err := io.ReadFull(conn, header[copied:]); err != nil {
+			closeFiles(files)
+			conn.Close()
+			return nil, err
+		}
+	} else {
+		// Anything after the header is the start of the cache snapshot
+		r = io.MultiReader(bytes.NewReader(buf[4+size:n]), conn)
+	}
+	var h handoffHeader
+	if err := json.Unmarshal(header, &h); err != nil {
+		closeFiles(files)
+		conn.Close()
+		return nil, err
+	}
+	if len(h.Sockets) != len(files) {
+		closeFiles(files)
+		conn.Close()
+		return nil, fmt.Errorf("expected %d sockets in handoff, received %d", len(h.Sockets), len(files))
+	}
+	var snapshots map[string][]cacheSnapshotItem
+	if err := json.NewDecoder(r).Decode(&snapshots); err != nil {
+		closeFiles(files)
+		conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	handoffMu.Lock()
+	for i, s := range h.Sockets {
+		key := s.Network + " " + s.Address
+		handoffInherited[key] = append(handoffInherited[key], files[i])
+	}
+	for id, items := range snapshots {
+		handoffSnapshots[id] = items
+	}
+	handoffMu.Unlock()
+	log.WithFields(logrus.Fields{"sockets": len(files), "caches": len(snapshots)}).Info("received handoff")
+	return &Handoff{conn: conn}, nil
+}
+
+// Complete waits for the listeners to pick up the sockets that were handed
+// over, then tells the previous instance to stop. Returns once the previous
+// instance released the handoff socket, so this process can listen on it.
+func (h *Handoff) Complete() error {
+	defer h.conn.Close()
+	deadline := time.Now().Add(handoffStartTimeout)
+	for time.Now().Before(deadline) && handoffPending() > 0 {
+		time.Sleep(50 * time.Millisecond)
+	}
+	// Sockets that aren't used by any listener in this configuration
+	handoffMu.Lock()
+	for key, files := range handoffInherited {
+		Log.WithField("socket", key).Warn("closing socket that is not used by any listener")
+		closeFiles(files)
+	}
+	handoffInherited = make(map[string][]*os.File)
+	handoffSnapshots = make(map[string][]cacheSnapshotItem)
+	handoffMu.Unlock()
+
+	_ = h.conn.SetDeadline(time.Now().Add(handoffTransferTimeout))
+	if err := json.NewEncoder(h.conn).Encode(handoffReady{Ready: true}); err != nil {
+		return err
+	}
+	// The previous instance closes the connection after it stopped listening
+	// on the handoff socket
+	if _, err := io.Copy(ioutil.Discard, h.conn); err != nil {
+		return err
+	}
+	Log.Info("handoff completed")
+	return nil
+}
+
+// ServeHandoff listens on a unix socket at path for a new instance to take
+// over the sockets of the listeners and the content of the caches. Once the
+// new instance is ready, the listeners are stopped and ServeHandoff returns
+// after the drain time, at which point the process should exit. If the new
+// instance fails before it's ready, this one keeps running.
+func ServeHandoff(path string, opt HandoffOptions) error {
+	if opt.DrainTime == 0 {
+		opt.DrainTime = 5 * time.Second
+	}
+	if opt.Timeout == 0 {
+		opt.Timeout = time.Minute
+	}
+	// Remove the socket of an instance that didn't exit cleanly
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	ln, err := listenHandoff(path)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	log := Log.WithField("path", path)
+	log.Info("waiting for handoff")
+	for {
+		conn, err := ln.AcceptUnix()
+		if err != nil {
+			return err
+		}
+		// Anyone that can connect can take over the sockets, only hand them
+		// to processes of the same user, or root
+		uid, err := peerUID(conn)
+		if err != nil {
+			log.WithError(err).Warn("failed to read credentials of handoff client")
+			conn.Close()
+			continue
+		}
+		if uid != os.Geteuid() && uid != 0 {
+			log.WithField("uid", uid).Warn("refusing handoff to process of another user")
+			conn.Close()
+			continue
+		}
+		if err := handoffTo(conn, ln, path, opt.Timeout); err != nil {
+			log.WithError(err).Warn("handoff failed, continuing to serve")
+			conn.Close()
+			continue
+		}
+		log.Info("handed over to new instance, stopping listeners")
+		if opt.Listeners != nil {
+			opt.Listeners.Stop()
+		}
+		time.Sleep(opt.DrainTime)
+		return nil
+	}
+}
+
+// Listens on a unix socket at path that is only accessible to the current
+// user. The socket is created in a private directory and then moved into
+// place, so it's never accessible with the permissions of the umask.
+func listenHandoff(path string) (*net.UnixListener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".handoff")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "handoff.sock")
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// The socket is removed by handoffTo, under its final name
+	ln.SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, 0600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// Sends the sockets and cache snapshots to the new instance and waits for it
+// to be ready. On success, the handoff listener and the connection are closed
+// and the socket at path is removed.
+func handoffTo(conn *net.UnixConn, ln *net.UnixListener, path string, timeout time.Duration) error {
+	_ = conn.SetDeadline(time.Now().Add(handoffTransferTimeout))
+	sockets, files := handoffFiles()
+	defer closeFiles(files)
+	header, err := json.Marshal(handoffHeader{Sockets: sockets})
+	if err != nil {
+		return err
+	}
+	b := make([]byte, 4, 4+len(header))
+	binary.BigEndian.PutUint32(b, uint32(len(header)))
+	if err := writeSockets(conn, append(b, header...), files); err != nil {
+		return err
+	}
+	if err := json.NewEncoder(conn).Encode(handoffCacheSnapshots()); err != nil {
+		return err
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	var ready handoffReady
+	if err := json.NewDecoder(conn).Decode(&ready); err != nil {
+		return err
+	}
+	if !ready.Ready {
+		return errors.New("new instance is not ready")
+	}
+	ln.Close()
+	_ = os.Remove(path)
+	return conn.Close()
+}
+
+// Returns the sockets that are still open, with duplicates of their file
+// descriptors that can be sent to another process.
+func handoffFiles() ([]handoffSocket, []*os.File) {
+	handoffMu.Lock()
+	defer handoffMu.Unlock()
+	var (
+		open    []handoffSocket
+		sockets []handoffSocket
+		files   []*os.File
+	)
+	for _, s := range handoffOpen {
+		f, err := s.conn.File()
+		if err != nil { // Closed since
+			continue
+		}
+		open = append(open, s)
+		if len(files) == handoffMaxSockets {
+			Log.WithFields(logrus.Fields{"network": s.Network, "address": s.Address}).Warn("too many sockets to hand over")
+			f.Close()
+			continue
+		}
+		sockets = append(sockets, s)
+		files = append(files, f)
+	}
+	handoffOpen = open
+	return sockets, files
+}
+
+// Returns the content of all caches in this process.
+func handoffCacheSnapshots() map[string][]cacheSnapshotItem {
+	handoffMu.Lock()
+	caches := make(map[string]*Cache, len(handoffCaches))
+	for id, c := range handoffCaches {
+		caches[id] = c
+	}
+	handoffMu.Unlock()
+	snapshots := make(map[string][]cacheSnapshotItem, len(caches))
+	for id, c := range caches {
+		snapshots[id] = c.snapshot()
+	}
+	return snapshots
+}
+
+// Records a socket opened by a listener so it can be handed over, if handoff
+// is enabled. Sockets that were closed since, by listeners that stopped or
+// restarted, are dropped.
+func registerHandoffSocket(network, address string, conn filer) {
+	handoffMu.Lock()
+	defer handoffMu.Unlock()
+	if !handoffEnabled {
+		return
+	}
+	open := handoffOpen[:0]
+	for _, s := range handoffOpen {
+		if !socketClosed(s.conn) {
+			open = append(open, s)
+		}
+	}
+	handoffOpen = append(open, handoffSocket{Network: network, Address: address, conn: conn})
+}
+
+// Returns true if the socket of a listener was closed.
+func socketClosed(conn filer) bool {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return false
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return true
+	}
+	return rc.Control(func(uintptr) {}) != nil
+}
+
+// Returns a socket received from the previous instance, or nil.
+func takeHandoffSocket(network, address string) *os.File {
+	handoffMu.Lock()
+	defer handoffMu.Unlock()
+	key := network + " " + address
+	files := handoffInherited[key]
+	if len(files) == 0 {
+		return nil
+	}
+	f := files[0]
+	if len(files) == 1 {
+		delete(handoffInherited, key)
+	} else {
+		handoffInherited[key] = files[1:]
+	}
+	return f
+}
+
+// Returns the number of received sockets that haven't been used yet.
+func handoffPending() int {
+	handoffMu.Lock()
+	defer handoffMu.Unlock()
+	return len(handoffInherited)
+}
+
+// Records a cache so its content can be handed over, and loads what was
+// received for it from the previous instance, if handoff is enabled.
+func registerHandoffCache(c *Cache) {
+	handoffMu.Lock()
+	if !handoffEnabled {
+		handoffMu.Unlock()
+		return
+	}
+	handoffCaches[c.id] = c
+	items := handoffSnapshots[c.id]
+	delete(handoffSnapshots, c.id)
+	handoffMu.Unlock()
+	if len(items) > 0 {
+		n := c.restore(items)
+		Log.WithFields(logrus.Fields{"id": c.id, "entries": n}).Info("restored cache")
+	}
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
@@ -0,0 +1,31 @@
+//go:build linux
+// +build linux
+
+package rdns
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// Returns the user ID of the process on the other end of a unix socket.
+func peerUID(conn *net.UnixConn) (int, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var (
+		cred   *unix.Ucred
+		optErr error
+	)
+	if err := rc.Control(func(fd uintptr) {
+		cred, optErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil {
+		return 0, err
+	}
+	if optErr != nil {
+		return 0, optErr
+	}
+	return int(cred.Uid), nil
+}
@@ -0,0 +1,23 @@
+//go:build !linux && !freebsd
+// +build !linux,!freebsd
+
+package rdns
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// Passing sockets to another process is only supported on Linux and FreeBSD.
+func writeSockets(conn *net.UnixConn, b []byte, files []*os.File) error {
+	return errors.New("handoff is not supported on this platform")
+}
+
+func readSockets(conn *net.UnixConn, b []byte) (int, []*os.File, error) {
+	return 0, nil, errors.New("handoff is not supported on this platform")
+}
+
+func peerUID(conn *net.UnixConn) (int, error) {
+	return 0, errors.New("handoff is not supported on this platform")
+}
@@ -0,0 +1,155 @@
+package rdns
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// Enables handoff for the duration of a test.
+func enableHandoff(t *testing.T) {
+	EnableHandoff()
+	t.Cleanup(func() {
+		handoffMu.Lock()
+		handoffEnabled = false
+		handoffOpen = nil
+		handoffCaches = make(map[string]*Cache)
+		handoffMu.Unlock()
+	})
+}
+
+func TestHandoff(t *testing.T) {
+	enableHandoff(t)
+	path := filepath.Join(t.TempDir(), "handoff.sock")
+	tcpAddr, err := getLnAddress()
+	require.NoError(t, err)
+	udpAddr, err := getUDPLnAddress()
+	require.NoError(t, err)
+
+	// No instance is running yet
+	h, err := ReceiveHandoff(path)
+	require.NoError(t, err)
+	require.Nil(t, h)
+
+	// Running instance with a socket of each type and a cache with a response
+	ln, err := listenTCP(tcpAddr, ListenOptions{})
+	require.NoError(t, err)
+	defer ln.Close()
+	pc, err := listenUDP(udpAddr, ListenOptions{}, false)
+	require.NoError(t, err)
+	defer pc.Close()
+	upstream := new(TestResolver)
+	cache := NewCache("test-handoff-cache", upstream, CacheOptions{})
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err = cache.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 1, upstream.HitCount())
+
+	served := make(chan error)
+	go func() {
+		served <- ServeHandoff(path, HandoffOptions{Listeners: NewListenerSet(nil), DrainTime: time.Millisecond})
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Only the current user can connect
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	// New instance takes over the sockets and the cache content
+	h, err = ReceiveHandoff(path)
+	require.NoError(t, err)
+	require.NotNil(t, h)
+
+	newLn, err := listenTCP(tcpAddr, ListenOptions{})
+	require.NoError(t, err)
+	defer newLn.Close()
+	newPC, err := listenUDP(udpAddr, ListenOptions{}, false)
+	require.NoError(t, err)
+	defer newPC.Close()
+	require.Equal(t, 0, handoffPending())
+
+	// The inherited socket accepts connections even after the original is closed
+	ln.Close()
+	go func() {
+		if conn, err := net.Dial("tcp", tcpAddr); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := newLn.Accept()
+	require.NoError(t, err)
+	conn.Close()
+
+	newUpstream := new(TestResolver)
+	newCache := NewCache("test-handoff-cache", newUpstream, CacheOptions{})
+	_, err = newCache.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 0, newUpstream.HitCount())
+
+	// The running instance stops once the new one is ready
+	require.NoError(t, h.Complete())
+	select {
+	case err := <-served:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("handoff wasn't served")
+	}
+}
+
+func TestHandoffRegister(t *testing.T) {
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+
+	// Nothing is recorded unless handoff is enabled
+	ln, err := listenTCP(addr, ListenOptions{})
+	require.NoError(t, err)
+	NewCache("test-handoff-register", new(TestResolver), CacheOptions{})
+	handoffMu.Lock()
+	require.Empty(t, handoffOpen)
+	require.Empty(t, handoffCaches)
+	handoffMu.Unlock()
+	ln.Close()
+
+	// Sockets of stopped listeners are dropped
+	enableHandoff(t)
+	for i := 0; i < 3; i++ {
+		ln, err := listenTCP(addr, ListenOptions{})
+		require.NoError(t, err)
+		ln.Close()
+	}
+	ln, err = listenTCP(addr, ListenOptions{})
+	require.NoError(t, err)
+	defer ln.Close()
+	handoffMu.Lock()
+	require.Len(t, handoffOpen, 1)
+	handoffMu.Unlock()
+}
+
+func TestHandoffHeaderLimit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "handoff.sock")
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	require.NoError(t, err)
+	defer ln.Close()
+
+	// Sender announcing a header that's too large to allocate
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, 1<<31)
+		_, _ = conn.Write(b)
+	}()
+	_, err = ReceiveHandoff(path)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "exceeds limit")
+}
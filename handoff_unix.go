@@ -0,0 +1,61 @@
+//go:build linux || freebsd
+// +build linux freebsd
+
+package rdns
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+// Sends b together with the file descriptors of files.
+func writeSockets(conn *net.UnixConn, b []byte, files []*os.File) error {
+	fds := make([]int, 0, len(files))
+	for _, f := range files {
+		fds = append(fds, int(f.Fd()))
+	}
+	var oob []byte
+	if len(fds) > 0 {
+		oob = syscall.UnixRights(fds...)
+	}
+	n, oobn, err := conn.WriteMsgUnix(b, oob, nil)
+	if err != nil {
+		return err
+	}
+	if n != len(b) || oobn != len(oob) {
+		return errors.New("short write in handoff")
+	}
+	return nil
+}
+
+// Reads into b and returns the number of bytes read, along with any file
+// descriptors that were sent with them.
+func readSockets(conn *net.UnixConn, b []byte) (int, []*os.File, error) {
+	oob := make([]byte, syscall.CmsgSpace(4*handoffMaxSockets))
+	n, oobn, flags, _, err := conn.ReadMsgUnix(b, oob)
+	if err != nil {
+		return 0, nil, err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return 0, nil, err
+	}
+	var files []*os.File
+	for _, msg := range msgs {
+		fds, err := syscall.ParseUnixRights(&msg)
+		if err != nil {
+			closeFiles(files)
+			return 0, nil, err
+		}
+		for _, fd := range fds {
+			files = append(files, os.NewFile(uintptr(fd), "handoff"))
+		}
+	}
+	if flags&syscall.MSG_CTRUNC != 0 {
+		closeFiles(files)
+		return 0, nil, errors.New("too many sockets in handoff")
+	}
+	return n, files, nil
+}
@@ -0,0 +1,77 @@
+package rdns
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// HealthResponder answers health-check queries for a reserved name locally
+// with a TXT record describing the status of the instance. All other queries
+// are passed to the resolver, or refused if there is none. This allows DNS-level
+// monitoring of an instance without sending queries to upstream resolvers.
+type HealthResponder struct {
+	id       string
+	resolver Resolver
+	opt      HealthResponderOptions
+	started  time.Time
+}
+
+var _ Resolver = &HealthResponder{}
+
+type HealthResponderOptions struct {
+	// Query name that is answered locally. Default "health.routedns.".
+	Name string
+}
+
+// NewHealthResponder returns a resolver that answers health-check queries. The
+// resolver for all other queries can be nil.
+func NewHealthResponder(id string, resolver Resolver, opt HealthResponderOptions) *HealthResponder {
+	if opt.Name == "" {
+		opt.Name = "health.routedns."
+	}
+	opt.Name = dns.Fqdn(opt.Name)
+	return &HealthResponder{id: id, resolver: resolver, opt: opt, started: time.Now()}
+}
+
+// Resolve a DNS query. Queries for the health-check name are answered with a
+// TXT record, like "status=ok" "version=v0.1.6" "uptime=3600", followed by the
+// static labels of the instance.
+func (r *HealthResponder) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) > 0 && strings.EqualFold(q.Question[0].Name, r.opt.Name) {
+		question := q.Question[0]
+		log := logger(r.id, q, ci)
+		a := new(dns.Msg)
+		a.SetReply(q)
+		a.Authoritative = true
+		if question.Qtype == dns.TypeTXT && question.Qclass == dns.ClassINET {
+			log.Debug("responding to health-check")
+			txt := []string{
+				"status=ok",
+				"version=" + BuildVersion,
+				fmt.Sprintf("uptime=%d", int(time.Since(r.started).Seconds())),
+			}
+			a.Answer = []dns.RR{&dns.TXT{
+				Hdr: dns.RR_Header{
+					Name:   question.Name,
+					Rrtype: dns.TypeTXT,
+					Class:  dns.ClassINET,
+				},
+				Txt: append(txt, labelPairs...),
+			}}
+		}
+		return a, nil
+	}
+	if r.resolver == nil {
+		logger(r.id, q, ci).Debug("refusing query, only health-checks are answered")
+		a := new(dns.Msg)
+		return a.SetRcode(q, dns.RcodeRefused), nil
+	}
+	return r.resolver.Resolve(q, ci)
+}
+
+func (r *HealthResponder) String() string {
+	return r.id
+}
@@ -0,0 +1,48 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthResponder(t *testing.T) {
+	var ci ClientInfo
+	upstream := new(TestResolver)
+	r := NewHealthResponder("test-health", upstream, HealthResponderOptions{})
+
+	// Health-checks are answered locally
+	q := new(dns.Msg)
+	q.SetQuestion("Health.RouteDNS.", dns.TypeTXT)
+	a, err := r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 0, upstream.HitCount())
+	require.Len(t, a.Answer, 1)
+	txt := a.Answer[0].(*dns.TXT).Txt
+	require.Equal(t, "status=ok", txt[0])
+	require.Equal(t, uint32(0), a.Answer[0].Header().Ttl)
+
+	// Other types for the name get an empty response
+	q.SetQuestion("health.routedns.", dns.TypeA)
+	a, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Empty(t, a.Answer)
+
+	// Everything else goes upstream
+	q.SetQuestion("example.com.", dns.TypeTXT)
+	_, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, upstream.HitCount())
+
+	// Without resolver, other queries are refused
+	r = NewHealthResponder("test-health", nil, HealthResponderOptions{Name: "ping.example"})
+	a, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeRefused, a.Rcode)
+	q.SetQuestion("ping.example.", dns.TypeTXT)
+	a, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Len(t, a.Answer, 1)
+}
@@ -0,0 +1,100 @@
+package rdns
+
+import (
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// HealthCheckOptions define how the resolvers in a group are probed to detect
+// failures independently of client queries.
+type HealthCheckOptions struct {
+	// Interval between test queries. Health checks are disabled if 0.
+	Interval time.Duration
+
+	// Name and type of the test query. Default ". NS".
+	Name string
+	Type uint16
+}
+
+// Sends test queries to a list of resolvers in regular intervals and keeps
+// track of which of them respond successfully. A nil healthChecker considers
+// all resolvers healthy.
+type healthChecker struct {
+	id        string
+	resolvers []Resolver
+	opt       HealthCheckOptions
+	mu        sync.RWMutex
+	healthy   []bool
+}
+
+func newHealthChecker(id string, opt HealthCheckOptions, resolvers []Resolver) *healthChecker {
+	if opt.Interval <= 0 {
+		return nil
+	}
+	if opt.Name == "" {
+		opt.Name = "."
+	}
+	if opt.Type == 0 {
+		opt.Type = dns.TypeNS
+	}
+	h := &healthChecker{
+		id:        id,
+		resolvers: resolvers,
+		opt:       opt,
+		healthy:   make([]bool, len(resolvers)),
+	}
+	for i := range resolvers {
+		h.healthy[i] = true
+		go h.probeLoop(i)
+	}
+	return h
+}
+
+// Returns true if the resolver with the given index passed the last health
+// check. If none of the resolvers are healthy, all are considered healthy to
+// avoid failing queries because of a bad test query.
+func (h *healthChecker) isHealthy(i int) bool {
+	if h == nil {
+		return true
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.healthy[i] {
+		return true
+	}
+	for _, ok := range h.healthy {
+		if ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (h *healthChecker) probeLoop(i int) {
+	resolver := h.resolvers[i]
+	log := Log.WithFields(logrus.Fields{"id": h.id, "resolver": resolver.String()})
+	for {
+		time.Sleep(h.opt.Interval)
+		q := new(dns.Msg)
+		q.SetQuestion(dns.Fqdn(h.opt.Name), h.opt.Type)
+		a, err := resolver.Resolve(q, ClientInfo{})
+		healthy := err == nil && a != nil && (a.Rcode == dns.RcodeSuccess || a.Rcode == dns.RcodeNameError)
+
+		h.mu.Lock()
+		changed := h.healthy[i] != healthy
+		h.healthy[i] = healthy
+		h.mu.Unlock()
+
+		if !changed {
+			continue
+		}
+		if healthy {
+			log.Info("resolver passed health check")
+		} else {
+			log.WithError(err).Warn("resolver failed health check")
+		}
+	}
+}
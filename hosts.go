@@ -0,0 +1,240 @@
+package rdns
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// HostsResolver answers A, AAAA and PTR queries from hosts files like
+// /etc/hosts. The files are checked for changes periodically and reloaded
+// when modified. Queries for names that are not in any of the files are
+// forwarded to an optional resolver, or answered with NXDOMAIN.
+type HostsResolver struct {
+	id       string
+	resolver Resolver
+	opt      HostsResolverOptions
+
+	mu      sync.RWMutex
+	hosts   map[string]hostsEntry // IPs by lowercase FQDN
+	ptr     map[string][]string   // Names by reverse lookup name
+	modTime map[string]time.Time  // Modification time of the loaded files
+}
+
+var _ Resolver = &HostsResolver{}
+
+type HostsResolverOptions struct {
+	// Hosts files to load.
+	Files []string
+
+	// Interval in which the files are checked for changes. Default 10 seconds.
+	Refresh time.Duration
+
+	// TTL of records in responses. Default 300.
+	TTL uint32
+}
+
+type hostsEntry struct {
+	ip4 []net.IP
+	ip6 []net.IP
+}
+
+// NewHostsResolver returns a new instance of a hosts resolver. The resolver is
+// optional and used for all queries that can't be answered from the files.
+func NewHostsResolver(id string, resolver Resolver, opt HostsResolverOptions) (*HostsResolver, error) {
+	if opt.Refresh == 0 {
+		opt.Refresh = 10 * time.Second
+	}
+	if opt.TTL == 0 {
+		opt.TTL = 300
+	}
+	r := &HostsResolver{
+		id:       id,
+		resolver: resolver,
+		opt:      opt,
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	go r.refreshLoop()
+	return r, nil
+}
+
+// Resolve a DNS query using the hosts files.
+func (r *HostsResolver) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return nil, errors.New("no question in query")
+	}
+	question := q.Question[0]
+	log := logger(r.id, q, ci)
+
+	var answer []dns.RR
+	found := false
+	if question.Qclass == dns.ClassINET {
+		r.mu.RLock()
+		answer, found = r.lookup(question)
+		r.mu.RUnlock()
+	}
+	if !found {
+		if r.resolver == nil {
+			log.Debug("name not found in hosts files, responding with nxdomain")
+			return nxdomain(q), nil
+		}
+		log.WithField("resolver", r.resolver.String()).Debug("name not found in hosts files, forwarding query to resolver")
+		return r.resolver.Resolve(q, ci)
+	}
+
+	log.Debug("responding from hosts files")
+	a := new(dns.Msg)
+	a.SetReply(q)
+	a.Authoritative = true
+	a.Answer = answer
+	return a, nil
+}
+
+func (r *HostsResolver) String() string {
+	return r.id
+}
+
+// Returns the answer records for a question and true if the name is in the
+// hosts files. An empty answer means the name is known but there are no
+// records of the requested type.
+func (r *HostsResolver) lookup(question dns.Question) ([]dns.RR, bool) {
+	name := strings.ToLower(question.Name)
+	hdr := dns.RR_Header{
+		Name:   question.Name,
+		Rrtype: question.Qtype,
+		Class:  dns.ClassINET,
+		Ttl:    r.opt.TTL,
+	}
+
+	if question.Qtype == dns.TypePTR {
+		if names, ok := r.ptr[name]; ok {
+			var answer []dns.RR
+			for _, n := range names {
+				answer = append(answer, &dns.PTR{Hdr: hdr, Ptr: n})
+			}
+			return answer, true
+		}
+	}
+
+	entry, ok := r.hosts[name]
+	if !ok {
+		return nil, false
+	}
+	var answer []dns.RR
+	switch question.Qtype {
+	case dns.TypeA:
+		for _, ip := range entry.ip4 {
+			answer = append(answer, &dns.A{Hdr: hdr, A: ip})
+		}
+	case dns.TypeAAAA:
+		for _, ip := range entry.ip6 {
+			answer = append(answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return answer, true
+}
+
+// Loads all hosts files and replaces the current records.
+func (r *HostsResolver) load() error {
+	hosts := make(map[string]hostsEntry)
+	ptr := make(map[string][]string)
+	modTime := make(map[string]time.Time)
+	for _, file := range r.opt.Files {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modTime[file] = fi.ModTime()
+		if err := loadHostsFile(file, hosts, ptr); err != nil {
+			return err
+		}
+	}
+	r.mu.Lock()
+	r.hosts = hosts
+	r.ptr = ptr
+	r.modTime = modTime
+	r.mu.Unlock()
+	return nil
+}
+
+// Returns true if any of the files was modified since it was last loaded.
+func (r *HostsResolver) modified() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, file := range r.opt.Files {
+		fi, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		if !fi.ModTime().Equal(r.modTime[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *HostsResolver) refreshLoop() {
+	for {
+		time.Sleep(r.opt.Refresh)
+		if !r.modified() {
+			continue
+		}
+		log := Log.WithField("id", r.id)
+		log.Debug("reloading hosts files")
+		if err := r.load(); err != nil {
+			log.WithError(err).Error("failed to load hosts files")
+		}
+	}
+}
+
+// Reads a hosts file and adds its entries to the maps.
+func loadHostsFile(file string, hosts map[string]hostsEntry, ptr map[string][]string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+		names := fields[1:]
+		for _, name := range names {
+			name = strings.ToLower(dns.Fqdn(name))
+			entry := hosts[name]
+			if ip4 := ip.To4(); ip4 != nil {
+				entry.ip4 = append(entry.ip4, ip4)
+			} else {
+				entry.ip6 = append(entry.ip6, ip)
+			}
+			hosts[name] = entry
+		}
+		reverseAddr, err := dns.ReverseAddr(fields[0])
+		if err != nil {
+			continue
+		}
+		for _, name := range names {
+			ptr[reverseAddr] = append(ptr[reverseAddr], dns.Fqdn(name))
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,56 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostsResolver(t *testing.T) {
+	var ci ClientInfo
+	upstream := new(TestResolver)
+	r, err := NewHostsResolver("test-hosts", upstream, HostsResolverOptions{
+		Files: []string{"testdata/hosts"},
+	})
+	require.NoError(t, err)
+
+	resolve := func(name string, qtype uint16) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, qtype)
+		a, err := r.Resolve(q, ci)
+		require.NoError(t, err)
+		return a
+	}
+
+	// A and AAAA records
+	a := resolve("nas.lan.", dns.TypeA)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, "192.168.1.10", a.Answer[0].(*dns.A).A.String())
+	a = resolve("NAS.lan.", dns.TypeAAAA)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, "fd00::10", a.Answer[0].(*dns.AAAA).AAAA.String())
+
+	// Known name, but no record of the type
+	a = resolve("router.", dns.TypeAAAA)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Empty(t, a.Answer)
+
+	// Reverse lookup
+	a = resolve("1.1.168.192.in-addr.arpa.", dns.TypePTR)
+	require.Len(t, a.Answer, 2)
+	require.Equal(t, "router.lan.", a.Answer[0].(*dns.PTR).Ptr)
+	require.Equal(t, 0, upstream.HitCount())
+
+	// Unknown names go upstream
+	resolve("example.com.", dns.TypeA)
+	require.Equal(t, 1, upstream.HitCount())
+
+	// Without upstream, unknown names are NXDOMAIN
+	r, err = NewHostsResolver("test-hosts", nil, HostsResolverOptions{
+		Files: []string{"testdata/hosts"},
+	})
+	require.NoError(t, err)
+	a = resolve("example.com.", dns.TypeA)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+}
@@ -16,14 +16,35 @@ func NewMultiIPDB(dbs ...IPBlocklistDB) (MultiIPDB, error) {
 	return MultiIPDB{dbs}, nil
 }
 
+// Reload all lists. Lists that haven't changed since the last load, or that
+// failed to load, are re-used. Returns ErrNotModified if none of the lists
+// changed, or the first error if lists failed to load.
 func (m MultiIPDB) Reload() (IPBlocklistDB, error) {
-	var newDBs []IPBlocklistDB
+	var (
+		newDBs   []IPBlocklistDB
+		modified bool
+		loadErr  error
+	)
 	for _, db := range m.dbs {
 		n, err := db.Reload()
 		if err != nil {
-			return MultiIPDB{}, err
+			if err != ErrNotModified {
+				Log.WithField("list", db.String()).WithError(err).Error("failed to reload list, keeping current rules")
+				if loadErr == nil {
+					loadErr = err
+				}
+			}
+			newDBs = append(newDBs, db)
+			continue
 		}
 		newDBs = append(newDBs, n)
+		modified = true
+	}
+	if !modified {
+		if loadErr != nil {
+			return MultiIPDB{}, loadErr
+		}
+		return MultiIPDB{}, ErrNotModified
 	}
 	return NewMultiIPDB(newDBs...)
 }
@@ -50,3 +71,42 @@ func (m MultiIPDB) Close() error {
 func (m MultiIPDB) String() string {
 	return "Multi-IP-blocklist"
 }
+
+// Stale returns true if any of the lists were loaded from a stale copy.
+func (m MultiIPDB) Stale() bool {
+	for _, db := range m.dbs {
+		if isStale(db) {
+			return true
+		}
+	}
+	return false
+}
+
+// Closes the lists of a database that was replaced by the result of its
+// Reload, except for lists that are re-used by the new database. Needs to be
+// called after the new database is in use so there's no time when queries are
+// matched against closed lists.
+func closeReplacedIPDB(old, new IPBlocklistDB) {
+	switch o := old.(type) {
+	case MultiIPDB:
+		// Lists are reloaded in order, unchanged ones are at the same index
+		if n, ok := new.(MultiIPDB); ok && len(n.dbs) == len(o.dbs) {
+			for i := range o.dbs {
+				closeReplacedIPDB(o.dbs[i], n.dbs[i])
+			}
+			return
+		}
+	case *CategoryIPDB:
+		if n, ok := new.(*CategoryIPDB); ok {
+			if o != n {
+				closeReplacedIPDB(o.db, n.db)
+			}
+			return
+		}
+	default:
+		if old == new {
+			return
+		}
+	}
+	old.Close()
+}
@@ -0,0 +1,73 @@
+package rdns
+
+import (
+	"expvar"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Static labels, like site or environment, in "key=value" form. Appended to
+// query logs sent to syslog.
+var (
+	labelString string
+	labelPairs  []string
+)
+
+// SetLabels defines static labels that identify this instance, like site, host
+// or environment, to tell apart multiple instances in central logging and
+// monitoring systems. The labels are added to all log entries, query logs sent
+// to syslog, and are available in the metrics as "routedns.labels". It should
+// be called once, before any listeners or resolvers are started.
+func SetLabels(labels map[string]string) {
+	if len(labels) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fields := make(logrus.Fields, len(labels))
+	pairs := make([]string, 0, len(labels))
+	vars := getLabelsVar()
+	for _, k := range keys {
+		fields[k] = labels[k]
+		pairs = append(pairs, fmt.Sprintf("%s=%s", k, labels[k]))
+		v := new(expvar.String)
+		v.Set(labels[k])
+		vars.Set(k, v)
+	}
+	labelPairs = pairs
+	labelString = strings.Join(pairs, " ")
+	Log.AddHook(labelHook{fields})
+}
+
+func getLabelsVar() *expvar.Map {
+	if v := expvar.Get("routedns.labels"); v != nil {
+		return v.(*expvar.Map)
+	}
+	return expvar.NewMap("routedns.labels")
+}
+
+// Logrus hook that adds the static labels to every log entry. Fields that are
+// already set on an entry are not replaced.
+type labelHook struct {
+	fields logrus.Fields
+}
+
+func (h labelHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h labelHook) Fire(e *logrus.Entry) error {
+	for k, v := range h.fields {
+		if _, ok := e.Data[k]; !ok {
+			e.Data[k] = v
+		}
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package rdns
+
+import (
+	"bytes"
+	"expvar"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLabels(t *testing.T) {
+	buf := new(bytes.Buffer)
+	log := logrus.New()
+	log.SetOutput(buf)
+	log.SetFormatter(&logrus.JSONFormatter{})
+	defer func(l *logrus.Logger) { Log = l }(Log)
+	Log = log
+
+	SetLabels(map[string]string{"site": "fra1", "environment": "test"})
+	defer func() { labelString = "" }()
+
+	// Labels are added to log entries
+	Log.WithField("id", "test").Info("test message")
+	require.Contains(t, buf.String(), `"site":"fra1"`)
+	require.Contains(t, buf.String(), `"environment":"test"`)
+
+	// And available as metrics
+	require.Equal(t, `"fra1"`, expvar.Get("routedns.labels").(*expvar.Map).Get("site").String())
+	require.Equal(t, "environment=test site=fra1", labelString)
+}
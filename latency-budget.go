@@ -0,0 +1,184 @@
+package rdns
+
+import (
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// LatencyBudget limits the time clients wait for a response. If the upstream
+// resolver doesn't answer within the budget, the client gets a SERVFAIL, or
+// optionally the last response seen for the query, while the query continues
+// in the background. Once it completes, caches further up the pipeline hold
+// the response for the next query. Trades correctness for latency, useful on
+// interactive networks where a quick failure is better than a slow answer.
+type LatencyBudget struct {
+	id       string
+	resolver Resolver
+	opt      LatencyBudgetOptions
+	mu       sync.Mutex // protects stale
+	stale    *lruCache
+	metrics  *LatencyBudgetMetrics
+}
+
+type LatencyBudgetMetrics struct {
+	// Count of queries that exceeded the budget.
+	exceeded *expvar.Int
+	// Count of stale responses sent to clients.
+	stale *expvar.Int
+	// Count of SERVFAIL responses sent to clients.
+	servfail *expvar.Int
+}
+
+var _ Resolver = &LatencyBudget{}
+
+type LatencyBudgetOptions struct {
+	// Time to wait for a response from the upstream resolver.
+	Budget time.Duration
+
+	// Respond with the last successful response for the query, if there is
+	// one, instead of SERVFAIL when the budget is exceeded.
+	ServeStale bool
+
+	// TTL of the records in stale responses, default 30.
+	StaleTTL uint32
+
+	// Maximum age of responses that are used as stale responses, default 24h.
+	StaleMaxAge time.Duration
+
+	// Number of responses to keep for stale responses, default 10000.
+	StaleCapacity int
+}
+
+// NewLatencyBudget returns a new instance of a latency budget element.
+func NewLatencyBudget(id string, resolver Resolver, opt LatencyBudgetOptions) (*LatencyBudget, error) {
+	if opt.Budget <= 0 {
+		return nil, errors.New("latency budget must be greater than 0")
+	}
+	if opt.StaleTTL == 0 {
+		opt.StaleTTL = 30
+	}
+	if opt.StaleMaxAge == 0 {
+		opt.StaleMaxAge = 24 * time.Hour
+	}
+	if opt.StaleCapacity == 0 {
+		opt.StaleCapacity = 10000
+	}
+	return &LatencyBudget{
+		id:       id,
+		resolver: resolver,
+		opt:      opt,
+		stale:    newLRUCache(opt.StaleCapacity),
+		metrics: &LatencyBudgetMetrics{
+			exceeded: getVarInt("latency-budget", id, "exceeded"),
+			stale:    getVarInt("latency-budget", id, "stale"),
+			servfail: getVarInt("latency-budget", id, "servfail"),
+		},
+	}, nil
+}
+
+type latencyBudgetResult struct {
+	a   *dns.Msg
+	err error
+}
+
+// Resolve a DNS query, responding early if the upstream resolver is too slow.
+func (r *LatencyBudget) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) != 1 {
+		return r.resolver.Resolve(q, ci)
+	}
+
+	// Buffered so the background query can complete after the client
+	// was answered
+	result := make(chan latencyBudgetResult, 1)
+	bq := q.Copy() // The client's query may be modified after returning
+	go func() {
+		a, err := r.resolver.Resolve(bq, ci)
+		if err == nil && a != nil {
+			r.storeStale(bq, a)
+		}
+		result <- latencyBudgetResult{a: a, err: err}
+	}()
+
+	timer := time.NewTimer(r.opt.Budget)
+	defer timer.Stop()
+	select {
+	case res := <-result:
+		return res.a, res.err
+	case <-timer.C:
+	}
+
+	r.metrics.exceeded.Add(1)
+	log := logger(r.id, q, ci)
+	if a := r.loadStale(q); a != nil {
+		r.metrics.stale.Add(1)
+		log.Debug("latency budget exceeded, responding with stale answer")
+		return a, nil
+	}
+	r.metrics.servfail.Add(1)
+	log.Debug("latency budget exceeded, responding with servfail")
+	return servfail(q), nil
+}
+
+func (r *LatencyBudget) String() string {
+	return r.id
+}
+
+// Keeps a copy of successful responses for use as stale answers.
+func (r *LatencyBudget) storeStale(q, a *dns.Msg) {
+	if !r.opt.ServeStale {
+		return
+	}
+	switch a.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+	default:
+		return
+	}
+	if a.Truncated {
+		return
+	}
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stale.delete(q)
+	r.stale.add(q, &cacheAnswer{timestamp: now, expiry: now.Add(r.opt.StaleMaxAge), Msg: a.Copy()})
+}
+
+// Returns the last response for the query, with the TTLs set to StaleTTL,
+// or nil if there is none. Responses to EDNS0 queries are marked with the
+// "Stale Answer" extended error.
+func (r *LatencyBudget) loadStale(q *dns.Msg) *dns.Msg {
+	if !r.opt.ServeStale {
+		return nil
+	}
+	r.mu.Lock()
+	item := r.stale.get(q)
+	if item != nil && time.Now().After(item.expiry) {
+		r.stale.delete(q)
+		item = nil
+	}
+	r.mu.Unlock()
+	if item == nil {
+		return nil
+	}
+	a := item.Msg.Copy()
+	a.Id = q.Id
+	for _, rr := range a.Answer {
+		rr.Header().Ttl = r.opt.StaleTTL
+	}
+	for _, rr := range a.Ns {
+		rr.Header().Ttl = r.opt.StaleTTL
+	}
+	for _, rr := range a.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			rr.Header().Ttl = r.opt.StaleTTL
+		}
+	}
+	if edns0 := a.IsEdns0(); edns0 != nil {
+		edns0.Option = append(edns0.Option, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeStaleAnswer})
+	}
+	return a
+}
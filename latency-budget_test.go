@@ -0,0 +1,76 @@
+package rdns
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatencyBudget(t *testing.T) {
+	var (
+		ci      ClientInfo
+		mu      sync.Mutex
+		delay   time.Duration
+		release = make(chan struct{})
+		done    = make(chan struct{}, 10)
+	)
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			defer func() { done <- struct{}{} }()
+			mu.Lock()
+			d := delay
+			mu.Unlock()
+			if d > 0 {
+				<-release
+			}
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = []dns.RR{
+				&dns.A{Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600}, A: net.IP{1, 2, 3, 4}},
+			}
+			return a, nil
+		},
+	}
+	g, err := NewLatencyBudget("test-latency-budget", upstream, LatencyBudgetOptions{
+		Budget:     50 * time.Millisecond,
+		ServeStale: true,
+	})
+	require.NoError(t, err)
+
+	// Fast responses are passed through unchanged
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	a, err := g.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, uint32(3600), a.Answer[0].Header().Ttl)
+	<-done
+
+	// Slow upstream, the last response is returned as stale answer
+	mu.Lock()
+	delay = time.Second
+	mu.Unlock()
+	a, err = g.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Equal(t, uint32(30), a.Answer[0].Header().Ttl)
+
+	// Without a previous response, the client gets SERVFAIL
+	q2 := new(dns.Msg)
+	q2.SetQuestion("example.net.", dns.TypeA)
+	a, err = g.Resolve(q2, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeServerFailure, a.Rcode)
+
+	// The queries complete in the background
+	close(release)
+	<-done
+	<-done
+	require.Equal(t, 3, upstream.HitCount())
+
+	_, err = NewLatencyBudget("test-latency-budget-invalid", upstream, LatencyBudgetOptions{})
+	require.Error(t, err)
+}
@@ -0,0 +1,84 @@
+package rdns
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// Opens a TCP listener. If enabled in the options, connections are expected
+// to start with a PROXY protocol header and the client address in it is used
+// as remote address of the connection. Uses the socket handed over by a
+// previous instance for the address if there is one.
+func listenTCP(addr string, opt ListenOptions) (net.Listener, error) {
+	var (
+		ln  net.Listener
+		err error
+	)
+	if f := takeHandoffSocket("tcp", addr); f != nil {
+		ln, err = net.FileListener(f)
+		f.Close()
+	} else {
+		lc := net.ListenConfig{Control: listenControl(opt, false)}
+		ln, err = lc.Listen(context.Background(), "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := ln.(filer); ok {
+		registerHandoffSocket("tcp", addr, s)
+	}
+	if !opt.ProxyProtocol {
+		return ln, nil
+	}
+	return &proxyProtocolListener{Listener: ln, trusted: opt.ProxyProtocolTrusted}, nil
+}
+
+// Opens a UDP socket. With reusePort, SO_REUSEPORT is set so that multiple
+// sockets can be bound to the same address. Uses a socket handed over by a
+// previous instance for the address if there is one.
+func listenUDP(addr string, opt ListenOptions, reusePort bool) (net.PacketConn, error) {
+	var (
+		pc  net.PacketConn
+		err error
+	)
+	if f := takeHandoffSocket("udp", addr); f != nil {
+		pc, err = net.FilePacketConn(f)
+		f.Close()
+	} else {
+		lc := net.ListenConfig{Control: listenControl(opt, reusePort)}
+		pc, err = lc.ListenPacket(context.Background(), "udp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := pc.(filer); ok {
+		registerHandoffSocket("udp", addr, s)
+	}
+	return pc, nil
+}
+
+// Returns a function that sets socket options before the socket is bound, or
+// nil if no options are needed.
+func listenControl(opt ListenOptions, reusePort bool) func(network, address string, c syscall.RawConn) error {
+	if !opt.Freebind && !reusePort {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		cerr := c.Control(func(fd uintptr) {
+			if opt.Freebind {
+				if err = setFreebind(network, fd); err != nil {
+					return
+				}
+			}
+			if reusePort {
+				err = setReusePort(fd)
+			}
+		})
+		if cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
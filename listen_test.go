@@ -0,0 +1,26 @@
+package rdns
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenFreebind(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("freebind without privileges is only available on linux")
+	}
+	// Address from the documentation range that isn't assigned to the host
+	addr := "192.0.2.53:0"
+	_, err := listenUDP(addr, ListenOptions{}, false)
+	require.Error(t, err)
+
+	pc, err := listenUDP(addr, ListenOptions{Freebind: true}, false)
+	require.NoError(t, err)
+	pc.Close()
+
+	ln, err := listenTCP(addr, ListenOptions{Freebind: true})
+	require.NoError(t, err)
+	ln.Close()
+}
@@ -0,0 +1,390 @@
+package rdns
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrListenerExists is returned when adding a listener with an ID that's
+	// already in use.
+	ErrListenerExists = errors.New("listener already exists")
+
+	// ErrListenerNotFound is returned when removing a listener that doesn't exist.
+	ErrListenerNotFound = errors.New("listener not found")
+)
+
+// ListenerFactory creates a listener from its definition in the
+// configuration format of the application.
+type ListenerFactory func(id string, definition []byte) (Listener, error)
+
+// ListenerSet runs a set of listeners and restarts them if they fail. Listeners
+// can be added and removed while the others keep running, for example to bring
+// up a temporary listener with a new certificate during a migration.
+type ListenerSet struct {
+	mu        sync.Mutex
+	factory   ListenerFactory
+	listeners map[string]*managedListener
+	started   bool
+
+	// IDs of listeners that were removed and not added by definition, used
+	// to export the changes made at runtime.
+	removed map[string]struct{}
+}
+
+type managedListener struct {
+	Listener
+	stop chan struct{}
+	done chan struct{} // Closed once the listener stopped running, nil if it was never started
+
+	// Set for listeners added by definition at runtime
+	added      bool
+	definition []byte
+}
+
+// ListenerOverrides describes the changes made to a set of listeners at
+// runtime, so they can be applied again after a restart.
+type ListenerOverrides struct {
+	// Definitions of listeners added at runtime, by ID.
+	Added map[string]string `json:"added,omitempty"`
+
+	// IDs of listeners that were removed at runtime.
+	Removed []string `json:"removed,omitempty"`
+}
+
+// Listeners that can be removed from a running set need to support stopping.
+type stoppableListener interface {
+	Stop() error
+}
+
+// Listeners that hold resources, like an audit log, release them with Close
+// once they stopped or if they're never started.
+type closableListener interface {
+	Close() error
+}
+
+// Time to wait for a listener to stop.
+const listenerStopTimeout = 10 * time.Second
+
+// NewListenerSet returns a new, empty set of listeners. The factory is used to
+// create listeners added by definition and can be nil if that's not supported.
+func NewListenerSet(factory ListenerFactory) *ListenerSet {
+	return &ListenerSet{
+		factory:   factory,
+		listeners: make(map[string]*managedListener),
+		removed:   make(map[string]struct{}),
+	}
+}
+
+// Start all listeners in the set. Listeners added later are started right away.
+func (s *ListenerSet) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.started = true
+	for _, l := range s.listeners {
+		s.start(l)
+	}
+}
+
+// Add a listener to the set.
+func (s *ListenerSet) Add(l Listener) error {
+	return s.add(&managedListener{Listener: l, stop: make(chan struct{})})
+}
+
+func (s *ListenerSet) add(ml *managedListener) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := ml.String()
+	if _, ok := s.listeners[id]; ok {
+		return fmt.Errorf("%w: '%s'", ErrListenerExists, id)
+	}
+	s.listeners[id] = ml
+	if s.started {
+		s.start(ml)
+	}
+	return nil
+}
+
+// AddDefinition creates a listener from its definition and adds it to the set.
+func (s *ListenerSet) AddDefinition(id string, definition []byte) error {
+	if s.factory == nil {
+		return errors.New("adding listeners by definition is not supported")
+	}
+	if s.has(id) {
+		return fmt.Errorf("%w: '%s'", ErrListenerExists, id)
+	}
+	l, err := s.factory(id, definition)
+	if err != nil {
+		return err
+	}
+	if err := s.add(&managedListener{
+		Listener:   l,
+		stop:       make(chan struct{}),
+		added:      true,
+		definition: definition,
+	}); err != nil {
+		closeListener(l)
+		return err
+	}
+	return nil
+}
+
+// Remove stops a listener and removes it from the set. Returns once the
+// listener stopped. Queries that are already being processed may still be
+// answered.
+func (s *ListenerSet) Remove(id string) error {
+	s.mu.Lock()
+	l, ok := s.listeners[id]
+	if !ok {
+		s.mu.Unlock()
+		return fmt.Errorf("%w: '%s'", ErrListenerNotFound, id)
+	}
+	if _, ok := l.Listener.(stoppableListener); !ok {
+		s.mu.Unlock()
+		return fmt.Errorf("listener '%s' can not be stopped", id)
+	}
+	delete(s.listeners, id)
+	if !l.added {
+		s.removed[id] = struct{}{}
+	}
+	s.mu.Unlock()
+	return l.shutdown()
+}
+
+// Stop all listeners in the set and remove them. Listeners that don't support
+// stopping are removed but keep running.
+func (s *ListenerSet) Stop() {
+	s.mu.Lock()
+	listeners := s.listeners
+	s.listeners = make(map[string]*managedListener)
+	s.mu.Unlock()
+	var wg sync.WaitGroup
+	for id, l := range listeners {
+		if _, ok := l.Listener.(stoppableListener); !ok {
+			close(l.stop)
+			continue
+		}
+		wg.Add(1)
+		go func(id string, l *managedListener) {
+			defer wg.Done()
+			if err := l.shutdown(); err != nil {
+				Log.WithFields(logrus.Fields{"id": id}).WithError(err).Error("failed to stop listener")
+			}
+		}(id, l)
+	}
+	wg.Wait()
+}
+
+// IDs returns the sorted IDs of the listeners in the set.
+func (s *ListenerSet) IDs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]string, 0, len(s.listeners))
+	for id := range s.listeners {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Overrides returns the listeners that were added and removed at runtime.
+func (s *ListenerSet) Overrides() ListenerOverrides {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var o ListenerOverrides
+	for id, l := range s.listeners {
+		if !l.added {
+			continue
+		}
+		if o.Added == nil {
+			o.Added = make(map[string]string)
+		}
+		o.Added[id] = string(l.definition)
+	}
+	for id := range s.removed {
+		o.Removed = append(o.Removed, id)
+	}
+	sort.Strings(o.Removed)
+	return o
+}
+
+// ApplyOverrides removes and adds listeners as exported by Overrides. Listeners
+// that were already removed are ignored, as are added listeners that exist
+// with the same definition, so overrides can be applied more than once. All
+// changes are checked first, nothing is changed if any of them fails.
+func (s *ListenerSet) ApplyOverrides(o ListenerOverrides) error {
+	plan, err := s.prepareOverrides(o)
+	if err != nil {
+		return err
+	}
+	return s.applyOverrides(plan)
+}
+
+// Changes to a set of listeners that were checked and can be applied.
+type listenerOverridesPlan struct {
+	remove []string
+	add    []*managedListener
+}
+
+// Releases the listeners created for a plan that isn't going to be applied.
+func (p listenerOverridesPlan) discard() {
+	for _, l := range p.add {
+		closeListener(l.Listener)
+	}
+}
+
+// Checks the overrides and creates the listeners that need to be added,
+// without changing the set.
+func (s *ListenerSet) prepareOverrides(o ListenerOverrides) (listenerOverridesPlan, error) {
+	var plan listenerOverridesPlan
+	removing := make(map[string]struct{})
+	s.mu.Lock()
+	for _, id := range o.Removed {
+		l, ok := s.listeners[id]
+		if !ok {
+			continue
+		}
+		if _, ok := l.Listener.(stoppableListener); !ok {
+			s.mu.Unlock()
+			return plan, fmt.Errorf("listener '%s' can not be stopped", id)
+		}
+		plan.remove = append(plan.remove, id)
+		removing[id] = struct{}{}
+	}
+	s.mu.Unlock()
+
+	ids := make([]string, 0, len(o.Added))
+	for id := range o.Added {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		definition := o.Added[id]
+		s.mu.Lock()
+		l, ok := s.listeners[id]
+		s.mu.Unlock()
+		if ok && l.added && string(l.definition) == definition {
+			continue
+		}
+		if _, removed := removing[id]; ok && !removed {
+			plan.discard()
+			return plan, fmt.Errorf("%w: '%s'", ErrListenerExists, id)
+		}
+		if s.factory == nil {
+			plan.discard()
+			return plan, errors.New("adding listeners by definition is not supported")
+		}
+		nl, err := s.factory(id, []byte(definition))
+		if err != nil {
+			plan.discard()
+			return plan, fmt.Errorf("listener '%s': %w", id, err)
+		}
+		plan.add = append(plan.add, &managedListener{
+			Listener:   nl,
+			stop:       make(chan struct{}),
+			added:      true,
+			definition: []byte(definition),
+		})
+	}
+	return plan, nil
+}
+
+// Applies changes that were checked with prepareOverrides. Listeners that
+// fail to stop are logged, they're removed from the set regardless.
+func (s *ListenerSet) applyOverrides(plan listenerOverridesPlan) error {
+	for _, id := range plan.remove {
+		if err := s.Remove(id); err != nil {
+			if errors.Is(err, ErrListenerNotFound) {
+				continue
+			}
+			Log.WithFields(logrus.Fields{"id": id}).WithError(err).Error("failed to stop listener")
+		}
+	}
+	for i, l := range plan.add {
+		if err := s.add(l); err != nil {
+			for _, l := range plan.add[i:] {
+				closeListener(l.Listener)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ListenerSet) has(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.listeners[id]
+	return ok
+}
+
+// Runs a listener in the background. Needs to be called with the lock held.
+func (s *ListenerSet) start(l *managedListener) {
+	l.done = make(chan struct{})
+	go s.run(l)
+}
+
+// Runs a listener until it's removed from the set, restarting it on failure.
+func (s *ListenerSet) run(l *managedListener) {
+	defer close(l.done)
+	for {
+		err := l.Start()
+		select {
+		case <-l.stop:
+			return
+		default:
+		}
+		Log.WithFields(logrus.Fields{"id": l.String()}).WithError(err).Error("listener failed")
+		select {
+		case <-l.stop:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// Stops a listener that was removed from the set and waits until it stopped
+// running, then releases its resources. A listener can't always be stopped
+// before it's serving, Stop is repeated until it returns from Start.
+func (l *managedListener) shutdown() error {
+	close(l.stop)
+	if l.done != nil {
+		stopper := l.Listener.(stoppableListener)
+		err := stopper.Stop()
+		timeout := time.After(listenerStopTimeout)
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+	wait:
+		for {
+			select {
+			case <-l.done:
+				break wait
+			case <-ticker.C:
+				err = stopper.Stop()
+			case <-timeout:
+				if err == nil {
+					err = errors.New("timeout")
+				}
+				return fmt.Errorf("listener '%s' did not stop: %w", l, err)
+			}
+		}
+	}
+	closeListener(l.Listener)
+	return nil
+}
+
+// Releases the resources of a listener that isn't running.
+func closeListener(l Listener) {
+	c, ok := l.(closableListener)
+	if !ok {
+		return
+	}
+	if err := c.Close(); err != nil {
+		Log.WithFields(logrus.Fields{"id": l.String()}).WithError(err).Error("failed to close listener")
+	}
+}
@@ -0,0 +1,120 @@
+package rdns
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Listener that runs until it's stopped.
+type testListener struct {
+	id      string
+	started chan struct{}
+	stopped chan struct{}
+}
+
+func newTestListener(id string) *testListener {
+	return &testListener{id: id, started: make(chan struct{}, 1), stopped: make(chan struct{})}
+}
+
+func (l *testListener) Start() error {
+	l.started <- struct{}{}
+	<-l.stopped
+	return errors.New("stopped")
+}
+
+func (l *testListener) Stop() error {
+	close(l.stopped)
+	return nil
+}
+
+func (l *testListener) String() string {
+	return l.id
+}
+
+// Listener that can only be stopped once it's serving, like most servers.
+type slowListener struct {
+	mu      sync.Mutex
+	serving bool
+	closed  bool
+	stopped chan struct{}
+}
+
+func (l *slowListener) Start() error {
+	time.Sleep(200 * time.Millisecond)
+	l.mu.Lock()
+	l.serving = true
+	l.mu.Unlock()
+	<-l.stopped
+	return errors.New("stopped")
+}
+
+func (l *slowListener) Stop() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.serving {
+		return errors.New("not started")
+	}
+	l.serving = false
+	close(l.stopped)
+	return nil
+}
+
+func (l *slowListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	return nil
+}
+
+func (l *slowListener) String() string {
+	return "slow"
+}
+
+func TestListenerSet(t *testing.T) {
+	created := make(map[string]*testListener)
+	set := NewListenerSet(func(id string, definition []byte) (Listener, error) {
+		l := newTestListener(id)
+		created[id] = l
+		return l, nil
+	})
+
+	// Listeners added before the set is started don't run yet
+	l1 := newTestListener("l1")
+	require.NoError(t, set.Add(l1))
+	require.True(t, errors.Is(set.Add(newTestListener("l1")), ErrListenerExists))
+	set.Start()
+	<-l1.started
+
+	// Listeners added after are started right away
+	require.NoError(t, set.AddDefinition("l2", nil))
+	<-created["l2"].started
+	require.Equal(t, []string{"l1", "l2"}, set.IDs())
+
+	// Removing a listener stops it, the others keep running
+	require.NoError(t, set.Remove("l1"))
+	<-l1.stopped
+	require.Equal(t, []string{"l2"}, set.IDs())
+	require.True(t, errors.Is(set.Remove("l1"), ErrListenerNotFound))
+}
+
+func TestListenerSetRemoveStarting(t *testing.T) {
+	set := NewListenerSet(nil)
+	set.Start()
+
+	// Removing a listener before it's serving waits for it to stop
+	l := &slowListener{stopped: make(chan struct{})}
+	require.NoError(t, set.Add(l))
+	require.NoError(t, set.Remove("slow"))
+	select {
+	case <-l.stopped:
+	default:
+		t.Fatal("listener still running")
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	require.True(t, l.closed)
+}
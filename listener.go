@@ -1,6 +1,9 @@
 package rdns
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"expvar"
 	"fmt"
 	"net"
@@ -20,6 +23,50 @@ type ClientInfo struct {
 	// DoH query path used by the client. Only populated when
 	// the query was received over DoH.
 	DoHPath string
+
+	// ID of the listener that received the query.
+	Listener string
+
+	// Certificate presented by the client. Only populated when
+	// the query was received over TLS with mutual authentication.
+	TLSClientCert *x509.Certificate
+
+	// Whether the query would be answered from a cache, "hit" or "miss".
+	// Only populated after the query passed a cache-probe element.
+	CacheState string
+
+	// Blocklist rule that matched the query. Only populated in queries
+	// that a blocklist forwarded to its blocklist-resolver.
+	Blocked *BlocklistMatch
+
+	// Context of the query. Upstream resolvers give up on the query once
+	// the context is done. Not set by listeners, only by elements that may
+	// abandon a query before it's answered, like a blocklist in parallel
+	// mode that cancels the upstream query when the name is blocked. Never
+	// done if nil.
+	Context context.Context
+
+	// Collects details about how the query was resolved, like the upstream
+	// resolver that answered it. Only set for queries that are logged by a
+	// query log, or that are received with DoH GET requests.
+	trace *queryTrace
+}
+
+// Returns the context of the query, or an empty context if none is set.
+func (ci ClientInfo) ctx() context.Context {
+	if ci.Context == nil {
+		return context.Background()
+	}
+	return ci.Context
+}
+
+// Returns the certificate presented by the client in a TLS connection, or
+// nil if there is none.
+func peerCertificate(state *tls.ConnectionState) *x509.Certificate {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	return state.PeerCertificates[0]
 }
 
 // Metrics that are available from listeners and clients.
@@ -10,10 +10,19 @@ import (
 var Log = logrus.New()
 
 func logger(id string, q *dns.Msg, ci ClientInfo) *logrus.Entry {
-	return Log.WithFields(logrus.Fields{
+	fields := logrus.Fields{
 		"id":     id,
 		"client": ci.SourceIP,
 		"qtype":  dns.Type(q.Question[0].Qtype).String(),
 		"qname":  qName(q),
-	})
+	}
+	// Queries blocked further up in the pipeline
+	if m := ci.Blocked; m != nil {
+		fields["list"] = m.List
+		fields["rule"] = m.Rule
+		if m.Category != "" {
+			fields["category"] = m.Category
+		}
+	}
+	return Log.WithFields(fields)
 }
@@ -1,6 +1,7 @@
 package rdns
 
 import (
+	"strings"
 	"time"
 
 	"github.com/miekg/dns"
@@ -20,7 +21,8 @@ type cacheItem struct {
 
 type lruKey struct {
 	question dns.Question
-	net      string
+	net      string // ECS subnet, empty if the response is valid for all clients
+	do, cd   bool   // DNSSEC flags of the query, only set if they're part of the key
 }
 
 type cacheAnswer struct {
@@ -43,11 +45,16 @@ func newLRUCache(capacity int) *lruCache {
 	}
 }
 
-func (c *lruCache) add(query *dns.Msg, answer *cacheAnswer) {
-	key := lruKeyFromQuery(query)
+// Adds an answer to the cache and returns the items that were removed to
+// stay within the capacity.
+func (c *lruCache) add(query *dns.Msg, answer *cacheAnswer) []*cacheItem {
+	return c.addKey(lruKeyFromQuery(query), answer)
+}
+
+func (c *lruCache) addKey(key lruKey, answer *cacheAnswer) []*cacheItem {
 	item := c.touch(key)
 	if item != nil {
-		return
+		return nil
 	}
 	// Add new item to the top of the linked list
 	item = &cacheItem{
@@ -59,7 +66,7 @@ func (c *lruCache) add(query *dns.Msg, answer *cacheAnswer) {
 	c.head.next.prev = item
 	c.head.next = item
 	c.items[key] = item
-	c.resize()
+	return c.resize()
 }
 
 // Loads a cache item and puts it to the top of the queue (most recent).
@@ -79,7 +86,10 @@ func (c *lruCache) touch(key lruKey) *cacheItem {
 }
 
 func (c *lruCache) delete(q *dns.Msg) {
-	key := lruKeyFromQuery(q)
+	c.deleteKey(lruKeyFromQuery(q))
+}
+
+func (c *lruCache) deleteKey(key lruKey) {
 	item := c.items[key]
 	if item == nil {
 		return
@@ -90,7 +100,10 @@ func (c *lruCache) delete(q *dns.Msg) {
 }
 
 func (c *lruCache) get(query *dns.Msg) *cacheAnswer {
-	key := lruKeyFromQuery(query)
+	return c.getKey(lruKeyFromQuery(query))
+}
+
+func (c *lruCache) getKey(key lruKey) *cacheAnswer {
 	item := c.touch(key)
 	if item != nil {
 		return item.cacheAnswer
@@ -98,18 +111,22 @@ func (c *lruCache) get(query *dns.Msg) *cacheAnswer {
 	return nil
 }
 
-// Shrink the cache down to the maximum number of items.
-func (c *lruCache) resize() {
+// Shrink the cache down to the maximum number of items. Returns the
+// removed items.
+func (c *lruCache) resize() []*cacheItem {
 	if c.maxItems <= 0 { // no size limit
-		return
+		return nil
 	}
+	var dropped []*cacheItem
 	drop := len(c.items) - c.maxItems
 	for i := 0; i < drop; i++ {
 		item := c.tail.prev
 		item.prev.next = c.tail
 		c.tail.prev = item.prev
 		delete(c.items, item.key)
+		dropped = append(dropped, item)
 	}
+	return dropped
 }
 
 // Clear the cache.
@@ -145,6 +162,10 @@ func (c *lruCache) size() int {
 func lruKeyFromQuery(q *dns.Msg) lruKey {
 	key := lruKey{question: q.Question[0]}
 
+	// Names are case-insensitive, use the same cache entry for all variations.
+	// The listener restores the client's original case in the response.
+	key.question.Name = strings.ToLower(key.question.Name)
+
 	edns0 := q.IsEdns0()
 	if edns0 != nil {
 		// See if we have a subnet option
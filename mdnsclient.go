@@ -0,0 +1,173 @@
+package rdns
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// MDNSClient resolves names with multicast DNS (RFC 6762), typically names
+// in the .local domain or reverse lookups of link-local addresses. Queries
+// are sent as one-shot queries from a random port, which responders answer
+// directly with unicast responses.
+type MDNSClient struct {
+	id       string
+	endpoint *net.UDPAddr
+	ifi      *net.Interface
+	opt      MDNSClientOptions
+}
+
+var _ Resolver = &MDNSClient{}
+
+type MDNSClientOptions struct {
+	// Name of the network interface to send queries on. The system default
+	// is used if empty.
+	Interface string
+
+	// Local IP to send queries from. If nil, a local address is chosen.
+	LocalAddr net.IP
+
+	// Time to wait for a response. Names that aren't answered within that
+	// time return NXDOMAIN. Default 1 second.
+	QueryTimeout time.Duration
+}
+
+// Mask of the cache-flush bit in the class of mDNS records.
+const mdnsCacheFlush = 1 << 15
+
+// NewMDNSClient returns a resolver that sends queries to a multicast DNS
+// group, like 224.0.0.251:5353 or [ff02::fb]:5353.
+func NewMDNSClient(id, endpoint string, opt MDNSClientOptions) (*MDNSClient, error) {
+	addr, err := net.ResolveUDPAddr("udp", endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if opt.QueryTimeout == 0 {
+		opt.QueryTimeout = queryTimeout
+	}
+	c := &MDNSClient{id: id, endpoint: addr, opt: opt}
+	if opt.Interface != "" {
+		c.ifi, err = net.InterfaceByName(opt.Interface)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Resolve a DNS query with multicast DNS.
+func (d *MDNSClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return nil, errors.New("no question in query")
+	}
+	question := q.Question[0]
+	log := logger(d.id, q, ci).WithFields(logrus.Fields{
+		"resolver": d.endpoint.String(),
+		"protocol": "mdns",
+	})
+	log.Debug("querying upstream resolver")
+
+	network := "udp4"
+	if d.endpoint.IP.To4() == nil {
+		network = "udp6"
+	}
+	conn, err := net.ListenUDP(network, &net.UDPAddr{IP: d.opt.LocalAddr})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if d.ifi != nil {
+		if network == "udp4" {
+			err = ipv4.NewPacketConn(conn).SetMulticastInterface(d.ifi)
+		} else {
+			err = ipv6.NewPacketConn(conn).SetMulticastInterface(d.ifi)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Only send the question, responders don't use EDNS0 or other records
+	mq := new(dns.Msg)
+	mq.SetQuestion(question.Name, question.Qtype)
+	mq.RecursionDesired = false
+	b, err := mq.Pack()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteTo(b, d.endpoint); err != nil {
+		return nil, err
+	}
+
+	// Wait for a response that answers the question. Other devices on the
+	// network may send unrelated responses that need to be skipped.
+	if err := conn.SetReadDeadline(time.Now().Add(d.opt.QueryTimeout)); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				log.Debug("no mdns response, responding with nxdomain")
+				a := new(dns.Msg)
+				return a.SetRcode(q, dns.RcodeNameError), nil
+			}
+			return nil, err
+		}
+		resp := new(dns.Msg)
+		if err := resp.Unpack(buf[:n]); err != nil || !resp.Response {
+			continue
+		}
+		// Responses to one-shot queries repeat the ID, but not all responders do
+		if resp.Id != mq.Id && resp.Id != 0 {
+			continue
+		}
+		if !mdnsAnswers(resp, question) {
+			continue
+		}
+		a := new(dns.Msg)
+		a.SetReply(q)
+		a.RecursionAvailable = true
+		a.Answer = mdnsRecords(resp.Answer)
+		a.Extra = mdnsRecords(resp.Extra)
+		ci.recordUpstream(d.id)
+		return a, nil
+	}
+}
+
+func (d *MDNSClient) String() string {
+	return d.id
+}
+
+// Returns true if the response has records for the question.
+func mdnsAnswers(resp *dns.Msg, q dns.Question) bool {
+	for _, rr := range resp.Answer {
+		h := rr.Header()
+		if strings.EqualFold(h.Name, q.Name) && (h.Rrtype == q.Qtype || h.Rrtype == dns.TypeCNAME || q.Qtype == dns.TypeANY) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the records without the cache-flush bit, which isn't meaningful
+// to unicast DNS clients. OPT and NSEC records are removed.
+func mdnsRecords(records []dns.RR) []dns.RR {
+	var out []dns.RR
+	for _, rr := range records {
+		switch rr.Header().Rrtype {
+		case dns.TypeOPT, dns.TypeNSEC:
+			continue
+		}
+		rr.Header().Class &^= mdnsCacheFlush
+		out = append(out, rr)
+	}
+	return out
+}
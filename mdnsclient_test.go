@@ -0,0 +1,67 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMDNSClient(t *testing.T) {
+	var ci ClientInfo
+
+	// Responder on a local unicast address instead of the multicast group
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, dns.MaxMsgSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			q := new(dns.Msg)
+			if err := q.Unpack(buf[:n]); err != nil || q.Question[0].Name != "printer.local." {
+				continue
+			}
+			// Unrelated response from another device first
+			other := new(dns.Msg)
+			other.SetQuestion("tv.local.", dns.TypeA)
+			other.Response = true
+			rr, _ := dns.NewRR("tv.local. 120 IN A 192.168.1.20")
+			other.Answer = []dns.RR{rr}
+			b, _ := other.Pack()
+			_, _ = pc.WriteTo(b, addr)
+
+			a := new(dns.Msg)
+			a.SetReply(q)
+			rr, _ = dns.NewRR("printer.local. 120 IN A 192.168.1.10")
+			rr.Header().Class |= mdnsCacheFlush
+			a.Answer = []dns.RR{rr}
+			b, _ = a.Pack()
+			_, _ = pc.WriteTo(b, addr)
+		}
+	}()
+
+	r, err := NewMDNSClient("test-mdns", pc.LocalAddr().String(), MDNSClientOptions{QueryTimeout: 200 * time.Millisecond})
+	require.NoError(t, err)
+
+	// The matching response is returned with the cache-flush bit removed
+	q := new(dns.Msg)
+	q.SetQuestion("printer.local.", dns.TypeA)
+	a, err := r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, q.Id, a.Id)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, uint16(dns.ClassINET), a.Answer[0].Header().Class)
+	require.Equal(t, "192.168.1.10", a.Answer[0].(*dns.A).A.String())
+
+	// Names that aren't answered return NXDOMAIN
+	q.SetQuestion("unknown.local.", dns.TypeA)
+	a, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+}
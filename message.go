@@ -2,6 +2,7 @@ package rdns
 
 import (
 	"strconv"
+	"strings"
 
 	"github.com/miekg/dns"
 )
@@ -88,3 +89,104 @@ func setUDPSize(q *dns.Msg, size uint16) *dns.Msg {
 	}
 	return copy
 }
+
+// Restores the case of the query name in a response to what the client sent
+// originally. Clients using randomized case (0x20) expect the name in the
+// response to match exactly. Only names that differ in case from the original
+// are updated.
+func restoreQueryCase(name string, a *dns.Msg) {
+	if name == "" || a == nil {
+		return
+	}
+	for i := range a.Question {
+		if a.Question[i].Name != name && strings.EqualFold(a.Question[i].Name, name) {
+			a.Question[i].Name = name
+		}
+	}
+	for _, records := range [][]dns.RR{a.Answer, a.Ns, a.Extra} {
+		for _, rr := range records {
+			h := rr.Header()
+			if h.Name != name && strings.EqualFold(h.Name, name) {
+				h.Name = name
+			}
+		}
+	}
+}
+
+// Adds an extended DNS error (RFC 8914) with optional extra text to a response
+// generated for a blocked query. This is only done if the client supports EDNS0.
+func setBlockedEDE(q, a *dns.Msg, text string) {
+	edns0q := q.IsEdns0()
+	if edns0q == nil {
+		return
+	}
+	edns0a := a.IsEdns0()
+	if edns0a == nil {
+		a.SetEdns0(edns0q.UDPSize(), edns0q.Do())
+		edns0a = a.IsEdns0()
+	}
+	edns0a.Option = append(edns0a.Option, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeBlocked, ExtraText: text})
+}
+
+// Returns true if the response carries an extended DNS error indicating the
+// query was blocked or filtered, by a blocklist or by the upstream resolver.
+// Also returns the extra text of the error which can contain the reason.
+func isBlockedResponse(a *dns.Msg) (bool, string) {
+	if a == nil {
+		return false, ""
+	}
+	edns0 := a.IsEdns0()
+	if edns0 == nil {
+		return false, ""
+	}
+	for _, opt := range edns0.Option {
+		if ede, ok := opt.(*dns.EDNS0_EDE); ok {
+			switch ede.InfoCode {
+			case dns.ExtendedErrorCodeBlocked, dns.ExtendedErrorCodeCensored, dns.ExtendedErrorCodeFiltered:
+				return true, ede.ExtraText
+			}
+		}
+	}
+	return false, ""
+}
+
+// Sends a query to the resolver, making sure it supports EDNS0 so blocked
+// responses can be identified by their extended error. If the client didn't
+// send an OPT record, it's added to a copy of the query and removed from the
+// response again. The function is called with the response before that.
+func resolveWithEDE(resolver Resolver, q *dns.Msg, ci ClientInfo, inspect func(*dns.Msg)) (*dns.Msg, error) {
+	addedEdns0 := q.IsEdns0() == nil
+	if addedEdns0 {
+		q = q.Copy()
+		q.SetEdns0(dns.MinMsgSize, false)
+	}
+	a, err := resolver.Resolve(q, ci)
+	if err != nil {
+		return a, err
+	}
+	inspect(a)
+	if addedEdns0 && a != nil {
+		stripEdns0(a)
+	}
+	return a, nil
+}
+
+// Returns the text describing a blocklist match in extended DNS errors, if
+// enabled.
+func blockedEDEText(enabled bool, match *BlocklistMatch) string {
+	if !enabled || match == nil {
+		return ""
+	}
+	return match.String()
+}
+
+// Removes the OPT record from a message.
+func stripEdns0(m *dns.Msg) {
+	extra := m.Extra[:0]
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	m.Extra = extra
+}
@@ -0,0 +1,31 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestoreQueryCase(t *testing.T) {
+	a := new(dns.Msg)
+	a.SetQuestion("www.example.com.", dns.TypeA)
+	a.Answer = []dns.RR{
+		&dns.CNAME{
+			Hdr:    dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 3600},
+			Target: "example.com.",
+		},
+		&dns.A{
+			Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600},
+			A:   net.IP{127, 0, 0, 1},
+		},
+	}
+
+	restoreQueryCase("wWw.ExAmple.COM.", a)
+	require.Equal(t, "wWw.ExAmple.COM.", a.Question[0].Name)
+	require.Equal(t, "wWw.ExAmple.COM.", a.Answer[0].Header().Name)
+
+	// Records for other names should not be touched
+	require.Equal(t, "example.com.", a.Answer[1].Header().Name)
+}
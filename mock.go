@@ -0,0 +1,183 @@
+package rdns
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// MockResolver is a resolver that answers queries from records held in memory
+// instead of forwarding them to an upstream server. Delays and failures can be
+// scripted with rules. Useful for testing configurations and pipelines without
+// depending on real upstream resolvers.
+type MockResolver struct {
+	id      string
+	opt     MockResolverOptions
+	records map[string][]dns.RR // Records by lowercase owner name
+
+	mu      sync.Mutex
+	queries []dns.Question
+	types   []uint16 // Query type per rule, 0 for any
+	hits    []int    // Number of matches per rule
+}
+
+var _ Resolver = &MockResolver{}
+
+type MockResolverOptions struct {
+	// Records in zone-file format.
+	Records []string
+
+	// Delay applied to all queries.
+	Delay time.Duration
+
+	// Rules to inject delays or failures for specific queries. The first
+	// matching rule is applied.
+	Rules []MockRule
+
+	// Number of most recent queries kept for Queries(). Default 1000.
+	MaxQueries int
+}
+
+// MockRule defines the behavior of a mock resolver for matching queries.
+type MockRule struct {
+	// Query name and type, like "A", the rule applies to. Empty values match
+	// any query.
+	Name string
+	Type string
+
+	// Apply the rule only to the first N matching queries. 0 to always apply.
+	Count int
+
+	// Delay the response. Replaces the default delay of the resolver if not 0.
+	Delay time.Duration
+
+	// Return an error instead of a response, like a failed upstream.
+	Error bool
+
+	// Respond with this response code and no records if not 0.
+	RCode int
+}
+
+// NewMockResolver returns a new instance of a mock resolver.
+func NewMockResolver(id string, opt MockResolverOptions) (*MockResolver, error) {
+	if opt.MaxQueries == 0 {
+		opt.MaxQueries = 1000
+	}
+	r := &MockResolver{
+		id:      id,
+		opt:     opt,
+		records: make(map[string][]dns.RR),
+		hits:    make([]int, len(opt.Rules)),
+	}
+	for _, rule := range opt.Rules {
+		var qtype uint16
+		if rule.Type != "" {
+			types, err := stringToType([]string{rule.Type})
+			if err != nil {
+				return nil, err
+			}
+			qtype = types[0]
+		}
+		r.types = append(r.types, qtype)
+	}
+	for _, record := range opt.Records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			return nil, err
+		}
+		if rr == nil {
+			continue
+		}
+		name := strings.ToLower(rr.Header().Name)
+		r.records[name] = append(r.records[name], rr)
+	}
+	return r, nil
+}
+
+// Resolve a DNS query from the records in memory, applying delays and failures
+// as defined in the rules.
+func (r *MockResolver) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return nil, errors.New("no question in query")
+	}
+	question := q.Question[0]
+	log := logger(r.id, q, ci)
+
+	r.mu.Lock()
+	if len(r.queries) >= r.opt.MaxQueries {
+		n := copy(r.queries, r.queries[len(r.queries)-r.opt.MaxQueries+1:])
+		r.queries = r.queries[:n]
+	}
+	r.queries = append(r.queries, question)
+	rule := r.matchRule(question)
+	r.mu.Unlock()
+
+	delay := r.opt.Delay
+	if rule != nil && rule.Delay > 0 {
+		delay = rule.Delay
+	}
+	time.Sleep(delay)
+
+	if rule != nil {
+		if rule.Error {
+			log.Debug("responding with mock error")
+			return nil, errors.New("mock error")
+		}
+		if rule.RCode != 0 {
+			log.WithField("rcode", rule.RCode).Debug("responding with mock rcode")
+			return responseWithCode(q, rule.RCode), nil
+		}
+	}
+
+	rrs, ok := r.records[strings.ToLower(question.Name)]
+	if !ok {
+		log.Debug("no mock records, responding with nxdomain")
+		return nxdomain(q), nil
+	}
+	a := new(dns.Msg)
+	a.SetReply(q)
+	for _, rr := range rrs {
+		if question.Qtype == dns.TypeANY || rr.Header().Rrtype == question.Qtype {
+			rr = dns.Copy(rr)
+			rr.Header().Name = question.Name
+			a.Answer = append(a.Answer, rr)
+		}
+	}
+	log.Debug("responding with mock records")
+	return a, nil
+}
+
+// Returns the first rule matching the question and counts the match. Needs to
+// be called with the lock held.
+func (r *MockResolver) matchRule(question dns.Question) *MockRule {
+	for i := range r.opt.Rules {
+		rule := &r.opt.Rules[i]
+		if rule.Name != "" && !strings.EqualFold(dns.Fqdn(rule.Name), question.Name) {
+			continue
+		}
+		if r.types[i] != 0 && r.types[i] != question.Qtype {
+			continue
+		}
+		if rule.Count > 0 && r.hits[i] >= rule.Count {
+			continue
+		}
+		r.hits[i]++
+		return rule
+	}
+	return nil
+}
+
+// Queries returns the questions of the most recent queries received by the
+// resolver, oldest first.
+func (r *MockResolver) Queries() []dns.Question {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]dns.Question(nil), r.queries...)
+}
+
+func (r *MockResolver) String() string {
+	return r.id
+}
@@ -0,0 +1,87 @@
+package rdns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMockResolver(t *testing.T) {
+	var ci ClientInfo
+	r, err := NewMockResolver("test-mock", MockResolverOptions{
+		Records: []string{
+			"example.com. 300 IN A 192.0.2.1",
+			"example.com. 300 IN AAAA 2001:db8::1",
+		},
+		Rules: []MockRule{
+			{Name: "example.com", Type: "A", Count: 1, Error: true},
+			{Type: "MX", RCode: dns.RcodeServerFailure},
+		},
+	})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// First query fails, the second succeeds
+	_, err = r.Resolve(q, ci)
+	require.Error(t, err)
+	a, err := r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Len(t, a.Answer, 1)
+
+	// Scripted response code
+	q.SetQuestion("example.com.", dns.TypeMX)
+	a, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeServerFailure, a.Rcode)
+
+	// Unknown name
+	q.SetQuestion("example.net.", dns.TypeA)
+	a, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+
+	require.Len(t, r.Queries(), 4)
+}
+
+func TestMockResolverDelay(t *testing.T) {
+	var ci ClientInfo
+	r, err := NewMockResolver("test-mock-delay", MockResolverOptions{
+		Delay: 100 * time.Millisecond,
+		Rules: []MockRule{
+			{Type: "MX", RCode: dns.RcodeServerFailure},
+		},
+	})
+	require.NoError(t, err)
+
+	// Rules without a delay use the default delay of the resolver
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeMX)
+	start := time.Now()
+	a, err := r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeServerFailure, a.Rcode)
+	require.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+}
+
+func TestMockResolverMaxQueries(t *testing.T) {
+	var ci ClientInfo
+	r, err := NewMockResolver("test-mock-max", MockResolverOptions{MaxQueries: 3})
+	require.NoError(t, err)
+
+	// Only the most recent queries are kept
+	q := new(dns.Msg)
+	for _, name := range []string{"a.", "b.", "c.", "d.", "e."} {
+		q.SetQuestion(name, dns.TypeA)
+		_, err = r.Resolve(q, ci)
+		require.NoError(t, err)
+	}
+	var names []string
+	for _, question := range r.Queries() {
+		names = append(names, question.Name)
+	}
+	require.Equal(t, []string{"c.", "d.", "e."}, names)
+}
@@ -0,0 +1,140 @@
+package rdns
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// NATReflection rewrites addresses in responses that point to the public IP
+// of the network to the internal address of the service behind it, for
+// clients inside the network. Routers often don't support connecting to
+// their own public address from the inside (hairpin NAT), so clients in the
+// network need the internal address while external clients use the public
+// one.
+type NATReflection struct {
+	id       string
+	resolver Resolver
+	opt      NATReflectionOptions
+	rules    []natReflectionRule
+	metrics  *NATReflectionMetrics
+}
+
+type NATReflectionMetrics struct {
+	// Count of rewritten records.
+	rewritten *expvar.Int
+}
+
+var _ Resolver = &NATReflection{}
+
+type NATReflectionOptions struct {
+	// Rules are evaluated in order, the first rule matching an address is
+	// applied.
+	Rules []NATReflectionRule
+
+	// Networks of the clients inside the network. Responses to other clients
+	// aren't modified. Applies to all clients if empty.
+	ClientNets []*net.IPNet
+}
+
+// NATReflectionRule maps a public address to an internal one.
+type NATReflectionRule struct {
+	// Public address in A or AAAA records.
+	Public net.IP
+
+	// Internal address to respond with instead, of the same family.
+	Internal net.IP
+
+	// Only apply the rule to queries for these domains or their sub-domains.
+	// Needed when the public address is shared by several internal hosts.
+	// Optional.
+	Domains []string
+}
+
+type natReflectionRule struct {
+	NATReflectionRule
+	domains domainSet
+}
+
+// NewNATReflection returns a new instance of a NAT reflection element.
+func NewNATReflection(id string, resolver Resolver, opt NATReflectionOptions) (*NATReflection, error) {
+	r := &NATReflection{
+		id:       id,
+		resolver: resolver,
+		opt:      opt,
+		metrics: &NATReflectionMetrics{
+			rewritten: getVarInt("nat-reflection", id, "rewritten"),
+		},
+	}
+	for i, rule := range opt.Rules {
+		if rule.Public == nil || rule.Internal == nil {
+			return nil, fmt.Errorf("rule %d: public and internal address are required", i+1)
+		}
+		if (rule.Public.To4() == nil) != (rule.Internal.To4() == nil) {
+			return nil, fmt.Errorf("rule %d: public and internal address need to be of the same family", i+1)
+		}
+		r.rules = append(r.rules, natReflectionRule{
+			NATReflectionRule: rule,
+			domains:           newDomainSet(rule.Domains),
+		})
+	}
+	return r, nil
+}
+
+// Resolve a DNS query and rewrite public addresses in the response for
+// clients inside the network.
+func (r *NATReflection) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return nil, errors.New("no question in query")
+	}
+	a, err := r.resolver.Resolve(q, ci)
+	if err != nil || a == nil {
+		return a, err
+	}
+	if !isAllowed(r.opt.ClientNets, ci.SourceIP) {
+		return a, nil
+	}
+	name := q.Question[0].Name
+	for _, rr := range a.Answer {
+		var ip *net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = &rr.A
+		case *dns.AAAA:
+			ip = &rr.AAAA
+		default:
+			continue
+		}
+		internal := r.internalAddress(name, *ip)
+		if internal == nil {
+			continue
+		}
+		logger(r.id, q, ci).WithFields(logrus.Fields{"public": ip.String(), "internal": internal.String()}).Debug("rewriting public address")
+		*ip = internal
+		r.metrics.rewritten.Add(1)
+	}
+	return a, nil
+}
+
+func (r *NATReflection) String() string {
+	return r.id
+}
+
+// Returns the internal address for a public one in a response to a query
+// for name, or nil if no rule matches.
+func (r *NATReflection) internalAddress(name string, ip net.IP) net.IP {
+	for _, rule := range r.rules {
+		if !rule.Public.Equal(ip) {
+			continue
+		}
+		if len(rule.domains) > 0 && !rule.domains.match(name) {
+			continue
+		}
+		return rule.Internal
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNATReflection(t *testing.T) {
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = []dns.RR{
+				&dns.A{Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET}, A: net.ParseIP("203.0.113.10")},
+				&dns.A{Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET}, A: net.ParseIP("198.51.100.1")},
+			}
+			return a, nil
+		},
+	}
+	_, lan, _ := net.ParseCIDR("192.168.1.0/24")
+	g, err := NewNATReflection("test-nat-reflection", upstream, NATReflectionOptions{
+		ClientNets: []*net.IPNet{lan},
+		Rules: []NATReflectionRule{
+			{Public: net.ParseIP("203.0.113.10"), Internal: net.ParseIP("192.168.1.20"), Domains: []string{"nas.example.com"}},
+			{Public: net.ParseIP("203.0.113.10"), Internal: net.ParseIP("192.168.1.30")},
+		},
+	})
+	require.NoError(t, err)
+
+	inside := ClientInfo{SourceIP: net.ParseIP("192.168.1.100")}
+	q := new(dns.Msg)
+
+	// Rule limited to a domain
+	q.SetQuestion("nas.example.com.", dns.TypeA)
+	a, err := g.Resolve(q, inside)
+	require.NoError(t, err)
+	require.Equal(t, "192.168.1.20", a.Answer[0].(*dns.A).A.String())
+	require.Equal(t, "198.51.100.1", a.Answer[1].(*dns.A).A.String())
+
+	// Catch-all rule
+	q.SetQuestion("www.example.com.", dns.TypeA)
+	a, err = g.Resolve(q, inside)
+	require.NoError(t, err)
+	require.Equal(t, "192.168.1.30", a.Answer[0].(*dns.A).A.String())
+
+	// Clients outside the network get the public address
+	a, err = g.Resolve(q, ClientInfo{SourceIP: net.ParseIP("10.0.0.1")})
+	require.NoError(t, err)
+	require.Equal(t, "203.0.113.10", a.Answer[0].(*dns.A).A.String())
+
+	// Addresses of different families can't be mapped
+	_, err = NewNATReflection("test-nat-reflection-invalid", upstream, NATReflectionOptions{
+		Rules: []NATReflectionRule{{Public: net.ParseIP("203.0.113.10"), Internal: net.ParseIP("fd00::1")}},
+	})
+	require.Error(t, err)
+}
@@ -0,0 +1,173 @@
+package rdns
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Changes to interfaces, addresses or routes are usually reported in bursts,
+// wait this long for things to settle before notifying.
+const netChangeSettleTime = 500 * time.Millisecond
+
+// Notifies about changes to the network configuration of the host, like an
+// interface going down or a new default route after a WAN failover. Used to
+// re-open upstream connections that no longer use the right interface instead
+// of waiting for them to time out.
+type netChangeNotifier struct {
+	once sync.Once
+	mu   sync.Mutex
+	ch   chan struct{}
+}
+
+var netChanges netChangeNotifier
+
+// Returns a channel that is closed on the next change to the network
+// configuration. The channel is never closed if changes can't be detected
+// on this platform.
+func (n *netChangeNotifier) wait() <-chan struct{} {
+	n.once.Do(func() {
+		go func() {
+			if err := watchNetwork(n.notify); err != nil {
+				Log.WithError(err).Debug("unable to monitor network changes")
+			}
+		}()
+	})
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ch == nil {
+		n.ch = make(chan struct{})
+	}
+	return n.ch
+}
+
+func (n *netChangeNotifier) notify() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ch != nil {
+		close(n.ch)
+		n.ch = nil
+	}
+}
+
+// Addresses of the most recent connection to an upstream server, for clients
+// that don't manage their connections in a pipeline, like DoH and DoQ.
+type upstreamConn struct {
+	mu     sync.Mutex
+	once   sync.Once
+	local  net.Addr
+	remote net.Addr
+	src    net.IP // Preferred source address for the remote when the connection was opened
+}
+
+// Records a newly opened connection. The first call starts monitoring the
+// network, closeFn is then called whenever a change leaves the most recent
+// connection stale.
+func (c *upstreamConn) dialed(local, remote net.Addr, closeFn func()) {
+	src := preferredSource(remote)
+	c.mu.Lock()
+	c.local, c.remote, c.src = local, remote, src
+	c.mu.Unlock()
+	c.once.Do(func() {
+		go func() {
+			for {
+				<-netChanges.wait()
+				if c.stale() {
+					Log.WithField("addr", remote.String()).Debug("network changed, closing connection")
+					closeFn()
+				}
+			}
+		}()
+	})
+}
+
+func (c *upstreamConn) stale() bool {
+	c.mu.Lock()
+	local, remote, src := c.local, c.remote, c.src
+	c.mu.Unlock()
+	ip := addrIP(local)
+	if ip == nil || ip.IsUnspecified() {
+		// Unbound sockets, as used for QUIC, don't have a fixed source address.
+		// Check if packets to the server would now be sent from a different one.
+		now := preferredSource(remote)
+		return src != nil && now != nil && !now.Equal(src)
+	}
+	return connStale(local, remote, src != nil && src.Equal(ip))
+}
+
+// Returns the local address the host would currently use to send packets to
+// the given remote address. No packets are sent.
+func preferredSource(remote net.Addr) net.IP {
+	// Connections through a proxy are routed to the proxy, and the name of the
+	// upstream server must not be resolved locally
+	if _, ok := remote.(socks5Addr); ok {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(remote.String())
+	if err != nil {
+		return nil
+	}
+	probe, err := net.Dial("udp", net.JoinHostPort(host, port))
+	if err != nil {
+		return nil
+	}
+	defer probe.Close()
+	return addrIP(probe.LocalAddr())
+}
+
+// Returns true if a connection with the given local address no longer works
+// after a network change. That's the case if the address was removed, the
+// interface is down, or the route to the remote address now uses a different
+// source address. The route is not checked if the connection didn't use the
+// preferred address in the first place, because it was bound to an address.
+func connStale(local, remote net.Addr, checkRoute bool) bool {
+	ip := addrIP(local)
+	if ip == nil || ip.IsUnspecified() {
+		return false
+	}
+	if !localAddrUp(ip) {
+		return true
+	}
+	if !checkRoute {
+		return false
+	}
+	src := preferredSource(remote)
+	return src != nil && !src.Equal(ip)
+}
+
+// Returns true if the address is assigned to an interface that is up.
+func localAddrUp(ip net.IP) bool {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return true
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if n, ok := addr.(*net.IPNet); ok && n.IP.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,52 @@
+//go:build linux
+// +build linux
+
+package rdns
+
+import (
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Subscribes to link, address and route changes via netlink and calls the
+// function once a burst of changes has settled. Blocks until the netlink
+// socket fails.
+func watchNetwork(changed func()) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	addr := &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: unix.RTMGRP_LINK |
+			unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV4_ROUTE |
+			unix.RTMGRP_IPV6_IFADDR | unix.RTMGRP_IPV6_ROUTE,
+	}
+	if err := syscall.Bind(fd, addr); err != nil {
+		return err
+	}
+
+	var timer *time.Timer
+	buf := make([]byte, 1<<16)
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err == syscall.EINTR || err == syscall.ENOBUFS {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if n < syscall.NLMSG_HDRLEN {
+			continue
+		}
+		Log.Trace("network change detected")
+		if timer == nil {
+			timer = time.AfterFunc(netChangeSettleTime, changed)
+		} else {
+			timer.Reset(netChangeSettleTime)
+		}
+	}
+}
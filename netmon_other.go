@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package rdns
+
+import "errors"
+
+// Network changes are only detected on Linux.
+func watchNetwork(changed func()) error {
+	return errors.New("not supported on this platform")
+}
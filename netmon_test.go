@@ -0,0 +1,49 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnStale(t *testing.T) {
+	remote := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+
+	// Loopback is always up and the preferred source for itself
+	local := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12345}
+	require.False(t, connStale(local, remote, true))
+
+	// Addresses that aren't assigned to any interface
+	local = &net.UDPAddr{IP: net.ParseIP("192.0.2.123"), Port: 12345}
+	require.True(t, connStale(local, remote, false))
+}
+
+func TestUpstreamConnStale(t *testing.T) {
+	remote := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 853}
+
+	// Unbound QUIC socket, stale once the source address for the remote changes
+	c := &upstreamConn{local: &net.UDPAddr{IP: net.IPv4zero}, remote: remote, src: net.IPv4(127, 0, 0, 1)}
+	require.False(t, c.stale())
+	c.src = net.ParseIP("192.0.2.123")
+	require.True(t, c.stale())
+
+	// Bound socket with an address that's no longer assigned
+	c = &upstreamConn{local: &net.TCPAddr{IP: net.ParseIP("192.0.2.123")}, remote: remote}
+	require.True(t, c.stale())
+}
+
+func TestNetChangeNotifier(t *testing.T) {
+	var n netChangeNotifier
+	ch := n.wait()
+	require.Equal(t, ch, n.wait())
+
+	// Waiters are woken up and get a new channel for the next change
+	n.notify()
+	select {
+	case <-ch:
+	default:
+		t.Fatal("channel not closed")
+	}
+	require.NotEqual(t, ch, n.wait())
+}
@@ -1,16 +1,19 @@
 package rdns
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
-// Defines how long to wait for a response from the resolver.
+// Defines how long to wait for a response from the resolver by default.
 const queryTimeout = time.Second
 
 // Tear down an upstream connection if nothing has been received for this long.
@@ -24,7 +27,11 @@ type Pipeline struct {
 	addr     string
 	client   DNSDialer
 	requests chan *request
+	timeout  time.Duration
 	metrics  *ListenerMetrics
+
+	// Only accept responses that repeat the case of the query name exactly
+	strictCase bool
 }
 
 // DNSDialer is an abstraction for a dns.Client that returns a *dns.Conn.
@@ -34,21 +41,47 @@ type DNSDialer interface {
 
 // NewPipeline returns an initialized (and running) DNS connection manager.
 func NewPipeline(id string, addr string, client DNSDialer) *Pipeline {
+	return NewPipelineWithTimeout(id, addr, client, queryTimeout)
+}
+
+// NewPipelineWithTimeout returns a DNS connection manager like NewPipeline. Queries
+// fail if there is no response within the timeout, a default is used if 0.
+func NewPipelineWithTimeout(id string, addr string, client DNSDialer, timeout time.Duration) *Pipeline {
+	if timeout == 0 {
+		timeout = queryTimeout
+	}
 	c := &Pipeline{
 		addr:     addr,
 		client:   client,
 		requests: make(chan *request),
+		timeout:  timeout,
 		metrics:  NewListenerMetrics("client", id),
 	}
 	go c.start()
 	return c
 }
 
+// SetStrictCase enables or disables strict case checking of responses. When
+// enabled, responses are only accepted if the question name has exactly the same
+// case as the query, which makes spoofing harder for queries with randomized case
+// (DNS 0x20). Not all servers preserve the case, so it's off by default. Must be
+// called before the pipeline is used.
+func (c *Pipeline) SetStrictCase(strict bool) {
+	c.strictCase = strict
+}
+
 // Resolve a single query using this connection.
 func (c *Pipeline) Resolve(q *dns.Msg) (*dns.Msg, error) {
-	r := newRequest(q)
+	return c.ResolveContext(context.Background(), q)
+}
 
-	timeout := time.NewTimer(queryTimeout)
+// ResolveContext resolves a single query using this connection, like Resolve,
+// but gives up once the context is done. The query is not sent if that happens
+// before it was written to the connection.
+func (c *Pipeline) ResolveContext(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	r := newRequest(ctx, q)
+
+	timeout := time.NewTimer(c.timeout)
 	defer timeout.Stop()
 
 	// Queue up the request or time out
@@ -57,6 +90,9 @@ func (c *Pipeline) Resolve(q *dns.Msg) (*dns.Msg, error) {
 	case <-timeout.C:
 		c.metrics.err.Add("querytimeout", 1)
 		return nil, QueryTimeoutError{q}
+	case <-ctx.Done():
+		c.metrics.err.Add("cancel", 1)
+		return nil, ctx.Err()
 	}
 
 	// Wait for the request to complete or time out
@@ -65,11 +101,58 @@ func (c *Pipeline) Resolve(q *dns.Msg) (*dns.Msg, error) {
 	case <-timeout.C:
 		c.metrics.err.Add("querytimeout", 1)
 		return nil, QueryTimeoutError{q}
+	case <-ctx.Done():
+		c.metrics.err.Add("cancel", 1)
+		return nil, ctx.Err()
 	}
 
 	return r.waitFor()
 }
 
+// PipelinePool manages multiple pipelines to the same upstream resolver and
+// spreads queries across them. Each pipeline uses its own connection which is
+// kept open and reused for many queries.
+type PipelinePool struct {
+	pipelines []*Pipeline
+	next      uint32
+}
+
+// NewPipelinePool returns a pool of pipelines to the same address. At least one
+// pipeline is created if size is 0.
+func NewPipelinePool(id string, addr string, client DNSDialer, timeout time.Duration, size int) *PipelinePool {
+	if size < 1 {
+		size = 1
+	}
+	p := &PipelinePool{pipelines: make([]*Pipeline, size)}
+	for i := range p.pipelines {
+		p.pipelines[i] = NewPipelineWithTimeout(id, addr, client, timeout)
+	}
+	return p
+}
+
+// SetStrictCase enables or disables strict case checking of responses on all
+// pipelines in the pool. Must be called before the pool is used.
+func (p *PipelinePool) SetStrictCase(strict bool) {
+	for _, c := range p.pipelines {
+		c.SetStrictCase(strict)
+	}
+}
+
+// Resolve a single query using the next pipeline in the pool.
+func (p *PipelinePool) Resolve(q *dns.Msg) (*dns.Msg, error) {
+	return p.ResolveContext(context.Background(), q)
+}
+
+// ResolveContext resolves a single query using the next pipeline in the pool
+// and gives up once the context is done.
+func (p *PipelinePool) ResolveContext(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	if len(p.pipelines) == 1 {
+		return p.pipelines[0].ResolveContext(ctx, q)
+	}
+	i := atomic.AddUint32(&p.next, 1) % uint32(len(p.pipelines))
+	return p.pipelines[i].ResolveContext(ctx, q)
+}
+
 // Starts a loop that will wait for queries and open an upstream connection on-demand, writing queries
 // and reading answers concurrently using the same connection. It also handles errors like idle
 // close from upstream.
@@ -80,6 +163,10 @@ func (c *Pipeline) start() {
 	)
 	log := Log.WithField("addr", c.addr)
 	for req := range c.requests { // Lazy connection. Only open a real connection if there's a request
+		if err := req.ctx.Err(); err != nil { // No need to connect if the query was abandoned
+			req.markDone(nil, err)
+			continue
+		}
 		done := make(chan struct{})
 		log.Trace("opening connection")
 		conn, err := c.client.Dial(c.addr)
@@ -93,10 +180,35 @@ func (c *Pipeline) start() {
 
 		go func() { c.requests <- req }() // re-queue the request that triggered the upstream connection
 
+		go func() { // network monitor
+			// Only check if the route to the server changed if the connection uses
+			// the preferred source address. It could be bound to a specific one.
+			local, remote := conn.LocalAddr(), conn.RemoteAddr()
+			src := preferredSource(remote)
+			checkRoute := src != nil && src.Equal(addrIP(local))
+			for {
+				select {
+				case <-netChanges.wait():
+					if connStale(local, remote, checkRoute) {
+						c.metrics.err.Add("netchange", 1)
+						log.Debug("network changed, closing connection")
+						conn.Close() // wakes up the reader which then stops the writer
+						return
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+
 		go func() { // writer
 			for {
 				select {
 				case req := <-c.requests:
+					if err := req.ctx.Err(); err != nil { // don't send queries that were abandoned
+						req.markDone(nil, err)
+						continue
+					}
 					query := inFlight.add(req)
 					log.WithField("qname", qName(query)).Trace("sending query")
 					c.metrics.query.Add(1)
@@ -156,12 +268,18 @@ func (c *Pipeline) start() {
 						log.WithField("qname", qName(a)).Warn(err)
 					}
 				}
-				req := inFlight.get(a) // match the answer to an in-flight query
+				req, ok := inFlight.match(a, c.strictCase) // match the answer to an in-flight query
 				if req == nil {
 					c.metrics.err.Add("unexpected_a", 1)
 					log.WithField("qname", qName(a)).Warn("unexpected answer received, ignoring")
 					continue
 				}
+				if !ok {
+					// Keep waiting for the real response, this one could be spoofed
+					c.metrics.err.Add("spoof", 1)
+					log.WithField("qname", qName(a)).Warn("answer doesn't match the query, ignoring")
+					continue
+				}
 				c.metrics.response.Add(rCode(a), 1)
 				req.markDone(a, nil)
 				ql := inFlight.maxQueueLen()
@@ -179,13 +297,15 @@ func (c *Pipeline) start() {
 // Request received from a client. It also contains the response and a channel that is
 // closed when the request is done.
 type request struct {
+	ctx  context.Context
 	q, a *dns.Msg
 	err  error
 	done chan struct{}
 }
 
-func newRequest(q *dns.Msg) *request {
+func newRequest(ctx context.Context, q *dns.Msg) *request {
 	return &request{
+		ctx:  ctx,
 		q:    q,
 		done: make(chan struct{}),
 	}
@@ -201,7 +321,7 @@ func (r *request) waitFor() (*dns.Msg, error) {
 		if len(r.a.Question) > 0 && len(r.q.Question) > 0 {
 			q := r.q.Question[0]
 			a := r.a.Question[0]
-			if a.Name != q.Name || a.Qclass != q.Qclass || a.Qtype != q.Qtype {
+			if !strings.EqualFold(a.Name, q.Name) || a.Qclass != q.Qclass || a.Qtype != q.Qtype {
 				return nil, fmt.Errorf("expected answer for %s, got %s", q.String(), a.String())
 			}
 		}
@@ -223,26 +343,29 @@ func (r *request) markDone(a *dns.Msg, err error) {
 // Queue to manage requests that are in flight. Used to asynchronously match received
 // responses with their requests.
 type inFlightQueue struct {
-	requests  map[uint16]*request
-	mu        sync.Mutex
-	idCounter uint16
-	maxLen    int
+	requests map[uint16]*request
+	mu       sync.Mutex
+	maxLen   int
 }
 
 // Add a request to the queue and return an updated DNS query with a new ID. The ID needs
 // to be unique per connection, and we could be receiving multiple queries with the same
 // ID. So make up a new ID, used that in the query upstream, then map it back to the
-// request and replace the ID with the original one.
+// request and replace the ID with the original one. IDs are random to make it hard to
+// spoof responses.
 func (q *inFlightQueue) add(r *request) *dns.Msg {
 	q.mu.Lock()
 	defer q.mu.Unlock()
 	if q.requests == nil {
 		q.requests = make(map[uint16]*request)
 	}
-	q.idCounter++
-	q.requests[q.idCounter] = r
+	id := dns.Id()
+	for q.requests[id] != nil {
+		id = dns.Id()
+	}
+	q.requests[id] = r
 	query := r.q.Copy()
-	query.Id = q.idCounter
+	query.Id = id
 	if len(q.requests) > q.maxLen {
 		q.maxLen = len(q.requests)
 	}
@@ -263,6 +386,50 @@ func (q *inFlightQueue) get(a *dns.Msg) *request {
 	return r
 }
 
+// Returns the request for the ID of a response, or nil if the request isn't in the
+// queue. The request is only removed from the queue, and true returned, if the
+// response matches its question.
+func (q *inFlightQueue) match(a *dns.Msg, strictCase bool) (*request, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	r, ok := q.requests[a.Id]
+	if !ok {
+		return nil, false
+	}
+	if !responseMatches(r.q, a, strictCase) {
+		return r, false
+	}
+	delete(q.requests, a.Id)
+	return r, true
+}
+
+// Returns true if the question of a response is identical to that of the query.
+// Names are compared case-insensitively (RFC 4343) unless strictCase is set, then
+// the case, which may have been randomized, has to match as well. Error responses
+// without question and records are accepted, some servers don't echo the question
+// in them.
+func responseMatches(q, a *dns.Msg, strictCase bool) bool {
+	if len(a.Question) == 0 {
+		if len(q.Question) == 0 {
+			return true
+		}
+		return a.Rcode != dns.RcodeSuccess && a.Rcode != dns.RcodeNameError &&
+			len(a.Answer) == 0 && len(a.Ns) == 0
+	}
+	if len(q.Question) == 0 {
+		return false
+	}
+	qq, aq := q.Question[0], a.Question[0]
+	if strictCase {
+		if aq.Name != qq.Name {
+			return false
+		}
+	} else if !strings.EqualFold(aq.Name, qq.Name) {
+		return false
+	}
+	return aq.Qtype == qq.Qtype && aq.Qclass == qq.Qclass
+}
+
 func (q *inFlightQueue) maxQueueLen() int64 {
 	q.mu.Lock()
 	defer q.mu.Unlock()
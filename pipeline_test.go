@@ -1,7 +1,11 @@
 package rdns
 
 import (
+	"context"
 	"errors"
+	"expvar"
+	"net"
+	"sync"
 	"testing"
 	"time"
 
@@ -37,3 +41,182 @@ func TestPipelineQueryTimeout(t *testing.T) {
 	require.ErrorAs(t, err, &QueryTimeoutError{})
 	require.WithinDuration(t, start.Add(queryTimeout), time.Now(), 10*time.Millisecond)
 }
+
+func TestPipelineContext(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		dials int
+	)
+	df := func(address string) (*dns.Conn, error) {
+		mu.Lock()
+		dials++
+		mu.Unlock()
+		time.Sleep(100 * time.Millisecond)
+		return nil, errors.New("failed")
+	}
+	p := NewPipelineWithTimeout("test", "localhost:53", testDialer(df), 0)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// Queries that were abandoned before they're sent don't open a connection
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := p.ResolveContext(ctx, q)
+	require.ErrorIs(t, err, context.Canceled)
+
+	// The deadline of the context is used if it's before the query timeout
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = p.ResolveContext(ctx, q)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Less(t, time.Since(start), 50*time.Millisecond)
+
+	time.Sleep(200 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, 1, dials)
+}
+
+func TestPipelinePool(t *testing.T) {
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+
+	// Server that records which connection each query arrived on. It closes
+	// the connection after answering queries for close.example.
+	var (
+		mu      sync.Mutex
+		queries = make(map[string]int)
+		dials   int
+	)
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		mu.Lock()
+		queries[w.RemoteAddr().String()]++
+		mu.Unlock()
+		a := new(dns.Msg)
+		a.SetReply(q)
+		_ = w.WriteMsg(a)
+		if q.Question[0].Name == "close.example." {
+			w.Close()
+		}
+	})
+	s := &dns.Server{Addr: addr, Net: "tcp", Handler: handler}
+	go func() { _ = s.ListenAndServe() }()
+	defer s.Shutdown()
+	time.Sleep(100 * time.Millisecond)
+
+	client := &dns.Client{Net: "tcp"}
+	df := func(address string) (*dns.Conn, error) {
+		mu.Lock()
+		dials++
+		mu.Unlock()
+		return client.Dial(address)
+	}
+	p := NewPipelinePool("test-pool", addr, testDialer(df), 0, 3)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// Queries are spread evenly across all pipelines, each one using its own
+	// connection for several queries
+	for i := 0; i < 9; i++ {
+		_, err := p.Resolve(q)
+		require.NoError(t, err)
+	}
+	mu.Lock()
+	require.Equal(t, 3, dials)
+	require.Len(t, queries, 3)
+	for conn, n := range queries {
+		require.Equal(t, 3, n, conn)
+	}
+	mu.Unlock()
+
+	// The server closes one of the connections, only that pipeline reconnects
+	// for its next query
+	q.SetQuestion("close.example.", dns.TypeA)
+	_, err = p.Resolve(q)
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+	q.SetQuestion("example.com.", dns.TypeA)
+	for i := 0; i < 3; i++ {
+		_, err := p.Resolve(q)
+		require.NoError(t, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, 4, dials)
+	require.Len(t, queries, 4)
+}
+
+func TestPipelineSpoofedResponse(t *testing.T) {
+	addr, err := getUDPLnAddress()
+	require.NoError(t, err)
+
+	// Server that sends a response with the wrong case in the name before the
+	// real response, which is only detected with strict case checking
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		spoofed := new(dns.Msg)
+		spoofed.SetReply(q)
+		spoofed.Question[0].Name = "EXAMPLE.com."
+		spoofed.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: "EXAMPLE.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600},
+			A:   net.IP{6, 6, 6, 6},
+		}}
+		_ = w.WriteMsg(spoofed)
+
+		a := new(dns.Msg)
+		a.SetReply(q)
+		a.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600},
+			A:   net.IP{1, 2, 3, 4},
+		}}
+		_ = w.WriteMsg(a)
+	})
+	s := &dns.Server{Addr: addr, Net: "udp", Handler: handler}
+	go func() { _ = s.ListenAndServe() }()
+	defer s.Shutdown()
+	time.Sleep(100 * time.Millisecond)
+
+	p := NewPipeline("test-spoof", addr, &dns.Client{Net: "udp"})
+	p.SetStrictCase(true)
+	q := new(dns.Msg)
+	q.SetQuestion("ExAmPlE.com.", dns.TypeA)
+	a, err := p.Resolve(q)
+	require.NoError(t, err)
+	require.Equal(t, q.Id, a.Id)
+	require.Equal(t, "1.2.3.4", a.Answer[0].(*dns.A).A.String())
+	require.Equal(t, int64(1), p.metrics.err.Get("spoof").(*expvar.Int).Value())
+}
+
+func TestResponseMatches(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("ExAmPlE.com.", dns.TypeA)
+
+	a := new(dns.Msg)
+	a.SetReply(q)
+	require.True(t, responseMatches(q, a, false))
+	require.True(t, responseMatches(q, a, true))
+
+	// Different case is only rejected with strict case checking
+	a.Question[0].Name = "example.com."
+	require.True(t, responseMatches(q, a, false))
+	require.False(t, responseMatches(q, a, true))
+
+	// Different name, type or class
+	a.Question[0].Name = "example.net."
+	require.False(t, responseMatches(q, a, false))
+	a.SetReply(q)
+	a.Question[0].Qtype = dns.TypeAAAA
+	require.False(t, responseMatches(q, a, false))
+	a.SetReply(q)
+	a.Question[0].Qclass = dns.ClassCHAOS
+	require.False(t, responseMatches(q, a, false))
+
+	// Errors without question are accepted, but not if they contain records
+	a = new(dns.Msg)
+	a.Rcode = dns.RcodeFormatError
+	require.True(t, responseMatches(q, a, false))
+	a.Rcode = dns.RcodeSuccess
+	require.False(t, responseMatches(q, a, false))
+}
@@ -0,0 +1,175 @@
+package rdns
+
+import (
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// PrefixRewriter translates IPv6 prefixes in AAAA records, for networks that
+// use Network Prefix Translation (NPTv6, RFC 6296). For example, clients in
+// the network can be given the internal ULA address of a service that's
+// published with its global address, or the other way around. The interface
+// identifier of the address is kept.
+type PrefixRewriter struct {
+	id       string
+	resolver Resolver
+	opt      PrefixRewriteOptions
+	metrics  *PrefixRewriteMetrics
+}
+
+type PrefixRewriteMetrics struct {
+	// Count of rewritten records.
+	rewritten *expvar.Int
+}
+
+var _ Resolver = &PrefixRewriter{}
+
+type PrefixRewriteOptions struct {
+	// Rules are evaluated in order, the first rule with a prefix matching an
+	// address is applied.
+	Rules []PrefixRewriteRule
+
+	// Networks of the clients that get translated addresses. Applies to all
+	// clients if empty.
+	ClientNets []*net.IPNet
+
+	// Translate addresses like NPTv6 does, adjusting the address so the
+	// checksum stays the same. Needed for the addresses to match those
+	// produced by NPTv6 routers. Only supports prefixes up to /64.
+	ChecksumNeutral bool
+}
+
+// PrefixRewriteRule maps one IPv6 prefix to another of the same length.
+type PrefixRewriteRule struct {
+	From *net.IPNet
+	To   *net.IPNet
+}
+
+// NewPrefixRewriter returns a new instance of an IPv6 prefix rewriter.
+func NewPrefixRewriter(id string, resolver Resolver, opt PrefixRewriteOptions) (*PrefixRewriter, error) {
+	for i, rule := range opt.Rules {
+		if rule.From == nil || rule.To == nil {
+			return nil, fmt.Errorf("rule %d: from and to prefixes are required", i+1)
+		}
+		fromOnes, fromBits := rule.From.Mask.Size()
+		toOnes, toBits := rule.To.Mask.Size()
+		if fromBits != net.IPv6len*8 || toBits != net.IPv6len*8 {
+			return nil, fmt.Errorf("rule %d: prefixes need to be IPv6", i+1)
+		}
+		if fromOnes != toOnes {
+			return nil, fmt.Errorf("rule %d: prefixes need to be of the same length", i+1)
+		}
+		if opt.ChecksumNeutral && fromOnes > 64 {
+			return nil, fmt.Errorf("rule %d: prefixes longer than /64 are not supported with checksum-neutral translation", i+1)
+		}
+	}
+	return &PrefixRewriter{
+		id:       id,
+		resolver: resolver,
+		opt:      opt,
+		metrics: &PrefixRewriteMetrics{
+			rewritten: getVarInt("prefix-rewrite", id, "rewritten"),
+		},
+	}, nil
+}
+
+// Resolve a DNS query and translate the prefixes of IPv6 addresses in the
+// response.
+func (r *PrefixRewriter) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return nil, errors.New("no question in query")
+	}
+	a, err := r.resolver.Resolve(q, ci)
+	if err != nil || a == nil {
+		return a, err
+	}
+	if !isAllowed(r.opt.ClientNets, ci.SourceIP) {
+		return a, nil
+	}
+	for _, rr := range a.Answer {
+		aaaa, ok := rr.(*dns.AAAA)
+		if !ok {
+			continue
+		}
+		if ip := r.translate(aaaa.AAAA); ip != nil {
+			aaaa.AAAA = ip
+			r.metrics.rewritten.Add(1)
+		}
+	}
+	return a, nil
+}
+
+func (r *PrefixRewriter) String() string {
+	return r.id
+}
+
+// Returns the translated address, or nil if no rule applies.
+func (r *PrefixRewriter) translate(ip net.IP) net.IP {
+	ip = ip.To16()
+	if ip == nil || ip.To4() != nil {
+		return nil
+	}
+	for _, rule := range r.opt.Rules {
+		if !rule.From.Contains(ip) {
+			continue
+		}
+		out := make(net.IP, net.IPv6len)
+		for i := range out {
+			out[i] = rule.To.IP[i]&rule.To.Mask[i] | ip[i]&^rule.To.Mask[i]
+		}
+		if r.opt.ChecksumNeutral && !checksumAdjust(out, rule.From, rule.To) {
+			return nil
+		}
+		return out
+	}
+	return nil
+}
+
+// Adjusts an address translated from one prefix to another so its one's
+// complement checksum is the same as before, as described in RFC 6296
+// section 3. For prefixes up to /48 the subnet ID word is adjusted, for longer
+// prefixes the first word of the interface identifier that isn't 0xFFFF.
+// Returns false if the address can't be translated.
+func checksumAdjust(ip net.IP, from, to *net.IPNet) bool {
+	adjustment := onesComplementAdd(prefixChecksum(from), ^prefixChecksum(to))
+	ones, _ := from.Mask.Size()
+	word := 3
+	if ones > 48 {
+		for word = 4; word < 8; word++ {
+			if binary.BigEndian.Uint16(ip[2*word:]) != 0xffff {
+				break
+			}
+		}
+		if word == 8 {
+			return false
+		}
+	} else if binary.BigEndian.Uint16(ip[6:]) == 0xffff {
+		return false
+	}
+	v := onesComplementAdd(binary.BigEndian.Uint16(ip[2*word:]), adjustment)
+	if v == 0xffff {
+		v = 0
+	}
+	binary.BigEndian.PutUint16(ip[2*word:], v)
+	return true
+}
+
+// One's complement sum of the 16-bit words of a prefix.
+func prefixChecksum(n *net.IPNet) uint16 {
+	var sum uint16
+	ip := n.IP.To16()
+	for i := 0; i < net.IPv6len; i += 2 {
+		sum = onesComplementAdd(sum, binary.BigEndian.Uint16(ip[i:])&binary.BigEndian.Uint16(n.Mask[i:]))
+	}
+	return sum
+}
+
+func onesComplementAdd(a, b uint16) uint16 {
+	s := uint32(a) + uint32(b)
+	return uint16(s&0xffff + s>>16)
+}
@@ -0,0 +1,65 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefixRewrite(t *testing.T) {
+	var answer string
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = []dns.RR{
+				&dns.AAAA{Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET}, AAAA: net.ParseIP(answer)},
+			}
+			return a, nil
+		},
+	}
+	_, internal, _ := net.ParseCIDR("fd01:203:405::/48")
+	_, external, _ := net.ParseCIDR("2001:db8:1::/48")
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeAAAA)
+
+	// Plain prefix replacement
+	g, err := NewPrefixRewriter("test-prefix-rewrite", upstream, PrefixRewriteOptions{
+		Rules: []PrefixRewriteRule{{From: internal, To: external}},
+	})
+	require.NoError(t, err)
+	answer = "fd01:203:405:1::1234"
+	a, err := g.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, "2001:db8:1:1::1234", a.Answer[0].(*dns.AAAA).AAAA.String())
+
+	// Addresses outside the prefix are unchanged
+	answer = "2001:db8:2::1"
+	a, err = g.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, "2001:db8:2::1", a.Answer[0].(*dns.AAAA).AAAA.String())
+
+	// Checksum-neutral translation, example from RFC 6296 section 3.5
+	g, err = NewPrefixRewriter("test-prefix-rewrite-nptv6", upstream, PrefixRewriteOptions{
+		Rules:           []PrefixRewriteRule{{From: internal, To: external}, {From: external, To: internal}},
+		ChecksumNeutral: true,
+	})
+	require.NoError(t, err)
+	answer = "fd01:203:405:1::1234"
+	a, err = g.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, "2001:db8:1:d550::1234", a.Answer[0].(*dns.AAAA).AAAA.String())
+	answer = "2001:db8:1:d550::1234"
+	a, err = g.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, "fd01:203:405:1::1234", a.Answer[0].(*dns.AAAA).AAAA.String())
+
+	// Prefixes need to have the same length
+	_, other, _ := net.ParseCIDR("2001:db8::/32")
+	_, err = NewPrefixRewriter("test-prefix-rewrite-invalid", upstream, PrefixRewriteOptions{
+		Rules: []PrefixRewriteRule{{From: internal, To: other}},
+	})
+	require.Error(t, err)
+}
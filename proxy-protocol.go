@@ -0,0 +1,181 @@
+package rdns
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Time allowed for a client to send the PROXY protocol header.
+const proxyProtocolTimeout = 5 * time.Second
+
+// Signature that starts a PROXY protocol v2 header.
+var proxyProtocolV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolListener accepts connections that start with a PROXY protocol
+// (v1 or v2) header, as sent by load balancers like HAProxy.
+type proxyProtocolListener struct {
+	net.Listener
+	trusted []*net.IPNet // Sources that are expected to send a header, all if empty
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	// Connections from other sources than the load balancers are used as they are
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && len(l.trusted) > 0 && !isAllowed(l.trusted, addr.IP) {
+		return conn, nil
+	}
+	return &proxyProtocolConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// proxyProtocolConn reads the PROXY protocol header on first use, which is
+// done lazily to not block the listener's accept loop.
+type proxyProtocolConn struct {
+	net.Conn
+	r          *bufio.Reader
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+
+	mu       sync.Mutex
+	deadline time.Time // Read deadline set by the user of the connection
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxyProtocolConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	_ = c.Conn.SetReadDeadline(time.Now().Add(proxyProtocolTimeout))
+	defer func() {
+		c.mu.Lock()
+		_ = c.Conn.SetReadDeadline(c.deadline)
+		c.mu.Unlock()
+	}()
+
+	c.remoteAddr, c.err = readProxyProtocolHeader(c.r)
+	if c.err != nil {
+		Log.WithField("client", c.Conn.RemoteAddr()).WithError(c.err).Debug("failed to read proxy protocol header")
+		c.Conn.Close()
+	}
+}
+
+// Reads a v1 or v2 PROXY protocol header and returns the source address of the
+// client. The returned address is nil if the header doesn't contain one, like
+// for health checks by the load balancer.
+func readProxyProtocolHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyProtocolV2Sig))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(sig, proxyProtocolV2Sig) {
+		return readProxyProtocolV2(r)
+	}
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return readProxyProtocolV1(r)
+	}
+	return nil, errors.New("no proxy protocol header")
+}
+
+// Reads a human-readable v1 header, for example
+// "PROXY TCP4 192.0.2.1 192.0.2.2 56324 53\r\n".
+func readProxyProtocolV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 { // Maximum length of a v1 header
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("invalid proxy protocol v1 header")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid proxy protocol v1 header: %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("invalid proxy protocol v1 header: %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// Reads a binary v2 header.
+func readProxyProtocolV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported proxy protocol version %d", hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	// The LOCAL command is used for connections by the load balancer itself
+	if hdr[12]&0x0f == 0 {
+		return nil, nil
+	}
+	switch hdr[13] {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, errors.New("invalid proxy protocol v2 header")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, errors.New("invalid proxy protocol v2 header")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	default: // Other protocols or address families, use the connection address
+		return nil, nil
+	}
+}
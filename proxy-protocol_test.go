@@ -0,0 +1,76 @@
+package rdns
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyProtocolV1(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("PROXY TCP4 192.0.2.1 192.0.2.2 56324 53\r\nquery"))
+	addr, err := readProxyProtocolHeader(r)
+	require.NoError(t, err)
+	require.Equal(t, "192.0.2.1:56324", addr.String())
+
+	// The data following the header is still available
+	rest, _ := r.ReadString(0)
+	require.Equal(t, "query", rest)
+
+	// Connections without client information use the connection address
+	r = bufio.NewReader(strings.NewReader("PROXY UNKNOWN\r\n"))
+	addr, err = readProxyProtocolHeader(r)
+	require.NoError(t, err)
+	require.Nil(t, addr)
+
+	// Missing header
+	r = bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\n"))
+	_, err = readProxyProtocolHeader(r)
+	require.Error(t, err)
+}
+
+func TestProxyProtocolV2(t *testing.T) {
+	var b bytes.Buffer
+	b.Write(proxyProtocolV2Sig)
+	b.Write([]byte{0x21, 0x21, 0, 36}) // v2 PROXY, TCP over IPv6, 36 bytes of addresses
+	b.Write(net.ParseIP("2001:db8::1"))
+	b.Write(net.ParseIP("2001:db8::2"))
+	b.Write([]byte{0xdc, 0x04, 0, 53})
+	b.WriteString("query")
+
+	r := bufio.NewReader(&b)
+	addr, err := readProxyProtocolHeader(r)
+	require.NoError(t, err)
+	require.Equal(t, "[2001:db8::1]:56324", addr.String())
+
+	rest, _ := r.ReadString(0)
+	require.Equal(t, "query", rest)
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	ln, err := listenTCP("127.0.0.1:0", ListenOptions{ProxyProtocol: true})
+	require.NoError(t, err)
+	defer ln.Close()
+
+	go func() {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.Write([]byte("PROXY TCP4 192.0.2.1 127.0.0.1 56324 53\r\nhello"))
+	}()
+
+	conn, err := ln.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, "192.0.2.1:56324", conn.RemoteAddr().String())
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+}
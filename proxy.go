@@ -0,0 +1,387 @@
+package rdns
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/proxy"
+)
+
+// Timeout for establishing a connection through a proxy, including the TLS
+// handshake with the upstream resolver.
+const proxyDialTimeout = 5 * time.Second
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// Returns a function that opens TCP connections through a proxy. Supported
+// are SOCKS5 proxies (socks5:// or socks5h://) and HTTP proxies using the
+// CONNECT method (http://). The dialer is used to connect to the proxy.
+func proxyDialer(proxyURL string, dialer *net.Dialer) (dialFunc, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		d, err := proxy.FromURL(u, dialer)
+		if err != nil {
+			return nil, err
+		}
+		return d.(proxy.ContextDialer).DialContext, nil
+	case "http":
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return httpConnect(ctx, dialer, u, addr)
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme '%s'", u.Scheme)
+	}
+}
+
+// Connects to an HTTP proxy and asks it to open a tunnel to addr.
+func httpConnect(ctx context.Context, dialer *net.Dialer, proxyURL *url.URL, addr string) (net.Conn, error) {
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "80")
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The proxy doesn't send anything after the response until the TLS
+	// handshake starts, so the buffered reader can be discarded.
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy connect to %s failed: %s", addr, resp.Status)
+	}
+	return conn, nil
+}
+
+// proxyTLSDialer implements DNSDialer for DNS-over-TLS connections that are
+// tunneled through a proxy.
+type proxyTLSDialer struct {
+	dial      dialFunc
+	tlsConfig *tls.Config
+}
+
+var _ DNSDialer = proxyTLSDialer{}
+
+func (d proxyTLSDialer) Dial(address string) (*dns.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), proxyDialTimeout)
+	defer cancel()
+	conn, err := d.dial(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := d.tlsConfig.Clone()
+	if tlsConfig == nil {
+		tlsConfig = new(tls.Config)
+	}
+	if tlsConfig.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConfig.ServerName = host
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &dns.Conn{Conn: tlsConn}, nil
+}
+
+// Returns an error if the proxy can't be used for QUIC-based protocols. Only
+// SOCKS5 proxies can relay UDP, HTTP proxies can only tunnel TCP.
+func validPacketProxy(proxyURL string) error {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		return nil
+	case "http":
+		return errors.New("http proxies don't support quic, use a socks5 proxy")
+	default:
+		return fmt.Errorf("unsupported proxy scheme '%s'", u.Scheme)
+	}
+}
+
+// socks5Addr is the address of a host behind a SOCKS5 proxy, in host:port
+// form. Names are resolved by the proxy.
+type socks5Addr string
+
+func (a socks5Addr) Network() string { return "udp" }
+func (a socks5Addr) String() string  { return string(a) }
+
+// socks5PacketConn sends and receives datagrams through a SOCKS5 proxy
+// using the UDP ASSOCIATE command (RFC 1928). The association lasts as long
+// as the TCP control connection to the proxy is open.
+type socks5PacketConn struct {
+	conn  *net.UDPConn
+	ctrl  net.Conn
+	relay *net.UDPAddr // Address of the proxy that relays the datagrams
+}
+
+var _ net.PacketConn = &socks5PacketConn{}
+
+// Opens a UDP association with a SOCKS5 proxy. The local address is used
+// for the connections to the proxy.
+func proxyPacketConn(proxyURL string, lAddr net.IP) (*socks5PacketConn, error) {
+	if err := validPacketProxy(proxyURL); err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	proxyAddr := u.Host
+	if u.Port() == "" {
+		proxyAddr = net.JoinHostPort(u.Hostname(), "1080")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), proxyDialTimeout)
+	defer cancel()
+	dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: lAddr}}
+	ctrl, err := dialer.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	deadline, _ := ctx.Deadline()
+	ctrl.SetDeadline(deadline)
+	relay, err := socks5UDPAssociate(ctrl, u.User)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	ctrl.SetDeadline(time.Time{})
+
+	// Proxies commonly respond with an unspecified address if the relay is
+	// on the same address as the control connection
+	if relay.IP.IsUnspecified() {
+		relay.IP = ctrl.RemoteAddr().(*net.TCPAddr).IP
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: lAddr})
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	c := &socks5PacketConn{conn: conn, ctrl: ctrl, relay: relay}
+
+	// The proxy ends the association by closing the control connection, stop
+	// using the relay then as well
+	go func() {
+		io.Copy(io.Discard, ctrl)
+		c.Close()
+	}()
+	return c, nil
+}
+
+// Performs the SOCKS5 handshake on the control connection and asks for a UDP
+// association. Returns the address of the relay.
+func socks5UDPAssociate(ctrl net.Conn, user *url.Userinfo) (*net.UDPAddr, error) {
+	methods := []byte{0x00} // No authentication
+	if user != nil {
+		methods = append(methods, 0x02) // Username/password
+	}
+	if _, err := ctrl.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return nil, err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(ctrl, reply); err != nil {
+		return nil, err
+	}
+	if reply[0] != 0x05 {
+		return nil, fmt.Errorf("unexpected socks version %d", reply[0])
+	}
+	switch reply[1] {
+	case 0x00:
+	case 0x02:
+		if user == nil {
+			return nil, errors.New("socks proxy requires authentication")
+		}
+		// RFC 1929
+		password, _ := user.Password()
+		req := []byte{0x01, byte(len(user.Username()))}
+		req = append(req, user.Username()...)
+		req = append(req, byte(len(password)))
+		req = append(req, password...)
+		if _, err := ctrl.Write(req); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(ctrl, reply); err != nil {
+			return nil, err
+		}
+		if reply[1] != 0x00 {
+			return nil, errors.New("socks proxy authentication failed")
+		}
+	default:
+		return nil, errors.New("no supported socks authentication method")
+	}
+
+	// The address the datagrams are sent from isn't known before they're sent,
+	// leave it unspecified
+	if _, err := ctrl.Write([]byte{0x05, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0}); err != nil {
+		return nil, err
+	}
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(ctrl, header); err != nil {
+		return nil, err
+	}
+	if header[1] != 0x00 {
+		return nil, fmt.Errorf("socks proxy refused udp associate with code %d", header[1])
+	}
+	addr, err := readSocks5Addr(ctrl)
+	if err != nil {
+		return nil, err
+	}
+	return net.ResolveUDPAddr("udp", addr)
+}
+
+func (c *socks5PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	dst, err := socks5EncodeAddr(addr.String())
+	if err != nil {
+		return 0, err
+	}
+	pkt := make([]byte, 0, 3+len(dst)+len(b))
+	pkt = append(pkt, 0, 0, 0) // Reserved and fragment number
+	pkt = append(pkt, dst...)
+	pkt = append(pkt, b...)
+	if _, err := c.conn.WriteToUDP(pkt, c.relay); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *socks5PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, len(b)+262) // Room for the largest header
+	for {
+		n, from, err := c.conn.ReadFromUDP(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		// Drop datagrams that don't come from the relay, as well as fragments
+		// which are not supported
+		if !from.IP.Equal(c.relay.IP) || from.Port != c.relay.Port || n < 3 || buf[2] != 0 {
+			continue
+		}
+		r := bytes.NewReader(buf[3:n])
+		addr, err := readSocks5Addr(r)
+		if err != nil {
+			continue
+		}
+		payload := buf[n-r.Len() : n]
+		return copy(b, payload), socks5Addr(addr), nil
+	}
+}
+
+func (c *socks5PacketConn) Close() error {
+	c.ctrl.Close()
+	return c.conn.Close()
+}
+
+func (c *socks5PacketConn) LocalAddr() net.Addr                { return c.conn.LocalAddr() }
+func (c *socks5PacketConn) SetDeadline(t time.Time) error      { return c.conn.SetDeadline(t) }
+func (c *socks5PacketConn) SetReadDeadline(t time.Time) error  { return c.conn.SetReadDeadline(t) }
+func (c *socks5PacketConn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
+
+// Encodes a host:port address in SOCKS5 form, with the address type first.
+func socks5EncodeAddr(addr string) ([]byte, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	var b []byte
+	ip := net.ParseIP(host)
+	switch {
+	case ip.To4() != nil:
+		b = append([]byte{0x01}, ip.To4()...)
+	case ip != nil:
+		b = append([]byte{0x04}, ip.To16()...)
+	case len(host) <= 255:
+		b = append([]byte{0x03, byte(len(host))}, host...)
+	default:
+		return nil, fmt.Errorf("name too long in '%s'", addr)
+	}
+	return append(b, byte(portNum>>8), byte(portNum)), nil
+}
+
+// Reads an address in SOCKS5 form and returns it as host:port.
+func readSocks5Addr(r io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp[0] {
+	case 0x01, 0x04:
+		ip := make(net.IP, net.IPv4len)
+		if atyp[0] == 0x04 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case 0x03:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(r, n); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("unsupported socks address type %d", atyp[0])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))), nil
+}
@@ -0,0 +1,207 @@
+package rdns
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// Minimal HTTP proxy that supports the CONNECT method and counts tunnels.
+type testConnectProxy struct {
+	tunnels int32
+}
+
+func (p *testConnectProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		http.Error(w, "only CONNECT supported", http.StatusMethodNotAllowed)
+		return
+	}
+	upstream, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+	atomic.AddInt32(&p.tunnels, 1)
+	conn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+	go func() {
+		io.Copy(upstream, conn)
+		upstream.Close()
+	}()
+	io.Copy(conn, upstream)
+	conn.Close()
+}
+
+func TestDoTClientHTTPProxy(t *testing.T) {
+	upstream := new(TestResolver)
+	proxy := new(testConnectProxy)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	tlsServerConfig, err := TLSServerConfig("", "testdata/server.crt", "testdata/server.key", false)
+	require.NoError(t, err)
+	s := NewDoTListener("test-ln", addr, DoTListenerOptions{TLSConfig: tlsServerConfig}, upstream)
+	go func() {
+		err := s.Start()
+		require.NoError(t, err)
+	}()
+	defer s.Stop()
+	time.Sleep(time.Second)
+
+	// Send a query through the proxy
+	tlsConfig, err := TLSClientConfig("testdata/ca.crt", "", "")
+	require.NoError(t, err)
+	c, err := NewDoTClient("test-dot", addr, DoTClientOptions{TLSConfig: tlsConfig, Proxy: proxyServer.URL})
+	require.NoError(t, err)
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+
+	require.Equal(t, 1, upstream.HitCount())
+	require.Equal(t, int32(1), atomic.LoadInt32(&proxy.tunnels))
+}
+
+func TestProxyInvalid(t *testing.T) {
+	_, err := NewDoTClient("test-dot", "127.0.0.1:853", DoTClientOptions{Proxy: "ftp://127.0.0.1"})
+	require.Error(t, err)
+
+	_, err = NewDoTClient("test-dot", "dns.google:853", DoTClientOptions{Proxy: "socks5://127.0.0.1:1080", BootstrapAddr: "8.8.8.8"})
+	require.Error(t, err)
+
+	// HTTP proxies can't relay QUIC
+	_, err = NewDoQClient("test-doq", "127.0.0.1:853", DoQClientOptions{Proxy: "http://127.0.0.1:8080"})
+	require.Error(t, err)
+	_, err = NewDoQClient("test-doq", "127.0.0.1:853", DoQClientOptions{Proxy: "socks5://127.0.0.1:1080"})
+	require.NoError(t, err)
+}
+
+// Minimal SOCKS5 proxy that supports the UDP ASSOCIATE command with
+// username/password authentication, for a single association.
+func testSocks5UDPProxy(t *testing.T, user, password string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		ctrl, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer ctrl.Close()
+		buf := make([]byte, 512)
+
+		// Require username/password authentication
+		if _, err := io.ReadFull(ctrl, buf[:2]); err != nil {
+			return
+		}
+		io.ReadFull(ctrl, buf[:buf[1]])
+		ctrl.Write([]byte{0x05, 0x02})
+		io.ReadFull(ctrl, buf[:2])
+		u := make([]byte, buf[1])
+		io.ReadFull(ctrl, u)
+		io.ReadFull(ctrl, buf[:1])
+		p := make([]byte, buf[0])
+		io.ReadFull(ctrl, p)
+		if string(u) != user || string(p) != password {
+			ctrl.Write([]byte{0x01, 0x01})
+			return
+		}
+		ctrl.Write([]byte{0x01, 0x00})
+
+		// UDP associate request, respond with an unspecified relay address
+		io.ReadFull(ctrl, buf[:10])
+		relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			return
+		}
+		defer relay.Close()
+		port := relay.LocalAddr().(*net.UDPAddr).Port
+		ctrl.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, byte(port >> 8), byte(port)})
+
+		// Relay datagrams between the client and the targets
+		go func() {
+			var client *net.UDPAddr
+			for {
+				n, from, err := relay.ReadFromUDP(buf)
+				if err != nil {
+					return
+				}
+				if from.Port == relay.LocalAddr().(*net.UDPAddr).Port {
+					continue
+				}
+				if client == nil || (from.IP.Equal(client.IP) && from.Port == client.Port) {
+					// From the client, strip the header and forward
+					client = from
+					r := bytes.NewReader(buf[3:n])
+					addr, err := readSocks5Addr(r)
+					if err != nil {
+						continue
+					}
+					dst, err := net.ResolveUDPAddr("udp", addr)
+					if err != nil {
+						continue
+					}
+					relay.WriteToUDP(buf[n-r.Len():n], dst)
+					continue
+				}
+				// From a target, add the header and send to the client
+				hdr, _ := socks5EncodeAddr(from.String())
+				pkt := append(append([]byte{0, 0, 0}, hdr...), buf[:n]...)
+				relay.WriteToUDP(pkt, client)
+			}
+		}()
+		io.Copy(io.Discard, ctrl)
+	}()
+	return "socks5://" + user + ":" + password + "@" + ln.Addr().String()
+}
+
+func TestSocks5PacketConn(t *testing.T) {
+	// UDP echo server
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], from)
+		}
+	}()
+
+	proxyURL := testSocks5UDPProxy(t, "user", "secret")
+	conn, err := proxyPacketConn(proxyURL, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.WriteTo([]byte("hello"), socks5Addr(echo.LocalAddr().String()))
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1500)
+	n, from, err := conn.ReadFrom(buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf[:n]))
+	require.Equal(t, echo.LocalAddr().String(), from.String())
+
+	// Wrong credentials fail the handshake
+	proxyURL = strings.Replace(testSocks5UDPProxy(t, "user", "secret"), ":secret@", ":wrong@", 1)
+	_, err = proxyPacketConn(proxyURL, nil)
+	require.Error(t, err)
+}
@@ -0,0 +1,99 @@
+package rdns
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// QueryFlags sets or clears header flags in queries before they are passed to
+// the resolver. Some upstream servers behave differently depending on the
+// flags they receive, like not validating DNSSEC with CD set or not recursing
+// without RD. The RD and CD flags in the response are restored to the values
+// the client sent.
+type QueryFlags struct {
+	id       string
+	resolver Resolver
+	set      queryFlags
+	clear    queryFlags
+}
+
+var _ Resolver = &QueryFlags{}
+
+type QueryFlagsOptions struct {
+	// Flags to set in queries, "rd", "cd" or "ad".
+	Set []string
+
+	// Flags to clear in queries, "rd", "cd" or "ad".
+	Clear []string
+}
+
+type queryFlags struct {
+	rd, cd, ad bool
+}
+
+// NewQueryFlags returns a resolver that sets or clears flags in queries.
+func NewQueryFlags(id string, resolver Resolver, opt QueryFlagsOptions) (*QueryFlags, error) {
+	set, err := parseQueryFlags(opt.Set)
+	if err != nil {
+		return nil, err
+	}
+	unset, err := parseQueryFlags(opt.Clear)
+	if err != nil {
+		return nil, err
+	}
+	if (set.rd && unset.rd) || (set.cd && unset.cd) || (set.ad && unset.ad) {
+		return nil, fmt.Errorf("flags can not be set and cleared at the same time")
+	}
+	return &QueryFlags{id: id, resolver: resolver, set: set, clear: unset}, nil
+}
+
+// Resolve a DNS query with modified flags.
+func (r *QueryFlags) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	// Work on a copy, the same query may be sent to other resolvers as well
+	fq := q.Copy()
+	fq.RecursionDesired = r.apply(q.RecursionDesired, r.set.rd, r.clear.rd)
+	fq.CheckingDisabled = r.apply(q.CheckingDisabled, r.set.cd, r.clear.cd)
+	fq.AuthenticatedData = r.apply(q.AuthenticatedData, r.set.ad, r.clear.ad)
+
+	a, err := r.resolver.Resolve(fq, ci)
+	if err != nil || a == nil {
+		return a, err
+	}
+	a.RecursionDesired = q.RecursionDesired
+	a.CheckingDisabled = q.CheckingDisabled
+	return a, nil
+}
+
+func (r *QueryFlags) String() string {
+	return r.id
+}
+
+func (r *QueryFlags) apply(value, set, clear bool) bool {
+	switch {
+	case set:
+		return true
+	case clear:
+		return false
+	default:
+		return value
+	}
+}
+
+func parseQueryFlags(names []string) (queryFlags, error) {
+	var flags queryFlags
+	for _, name := range names {
+		switch strings.ToLower(name) {
+		case "rd":
+			flags.rd = true
+		case "cd":
+			flags.cd = true
+		case "ad":
+			flags.ad = true
+		default:
+			return flags, fmt.Errorf("unsupported flag '%s'", name)
+		}
+	}
+	return flags, nil
+}
@@ -0,0 +1,53 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryFlags(t *testing.T) {
+	var (
+		ci       ClientInfo
+		received *dns.Msg
+	)
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			received = q
+			a := new(dns.Msg)
+			a.SetReply(q)
+			return a, nil
+		},
+	}
+	r, err := NewQueryFlags("test-flags", upstream, QueryFlagsOptions{
+		Set:   []string{"rd"},
+		Clear: []string{"CD", "ad"},
+	})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.RecursionDesired = false
+	q.CheckingDisabled = true
+	q.AuthenticatedData = true
+	a, err := r.Resolve(q, ci)
+	require.NoError(t, err)
+
+	// The upstream receives the modified flags
+	require.True(t, received.RecursionDesired)
+	require.False(t, received.CheckingDisabled)
+	require.False(t, received.AuthenticatedData)
+
+	// The original query is unchanged and the response matches its flags
+	require.False(t, q.RecursionDesired)
+	require.True(t, q.CheckingDisabled)
+	require.False(t, a.RecursionDesired)
+	require.True(t, a.CheckingDisabled)
+
+	// Unknown or conflicting flags are rejected
+	_, err = NewQueryFlags("test-flags", upstream, QueryFlagsOptions{Set: []string{"qr"}})
+	require.Error(t, err)
+	_, err = NewQueryFlags("test-flags", upstream, QueryFlagsOptions{Set: []string{"cd"}, Clear: []string{"cd"}})
+	require.Error(t, err)
+}
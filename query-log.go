@@ -0,0 +1,355 @@
+package rdns
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// QueryLog writes one structured record for every query and its response to
+// a file, then returns the response unmodified. Files are rotated by size and
+// the number of records can be limited by sampling. The metrics count all
+// queries, including those that aren't logged.
+type QueryLog struct {
+	id       string
+	resolver Resolver
+	opt      QueryLogOptions
+	out      *rotatingFile
+	metrics  *QueryLogMetrics
+}
+
+var _ Resolver = &QueryLog{}
+
+type QueryLogOptions struct {
+	// File the records are written to. Required.
+	File string
+
+	// Format of the records, "json" or "tsv". Defaults to "json".
+	Format string
+
+	// Size in bytes at which the file is rotated. Default 100MB.
+	MaxSize int64
+
+	// Number of rotated files to keep. Default 5.
+	MaxFiles int
+
+	// Fraction of queries that are logged, between 0 and 1. All queries are
+	// logged by default.
+	SampleRate float64
+}
+
+type QueryLogMetrics struct {
+	// Number of queries, logged or not.
+	query *expvar.Int
+	// Response codes of all queries, logged or not.
+	response *expvar.Map
+	// Number of records written.
+	logged *expvar.Int
+	// Number of records that could not be written.
+	failed *expvar.Int
+}
+
+// A record in the query log.
+type queryLogRecord struct {
+	Time     time.Time `json:"time"`
+	ID       string    `json:"id"`
+	Listener string    `json:"listener,omitempty"`
+	Client   string    `json:"client"`
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
+	Rcode    string    `json:"rcode"`
+	Answers  int       `json:"answers"`
+	Duration float64   `json:"duration-ms"`
+	Upstream string    `json:"upstream,omitempty"` // ID of the upstream resolver that answered
+	Blocked  bool      `json:"blocked,omitempty"`
+	Reason   string    `json:"reason,omitempty"` // Extra text of the extended error, or the matching rule, for blocked queries
+	Error    string    `json:"error,omitempty"`
+}
+
+// Details collected while a query is resolved.
+type queryTrace struct {
+	mu             sync.Mutex
+	upstream       string
+	clientSpecific bool
+}
+
+// Records the upstream resolver that answered the query. Only the first one
+// is kept, for groups that send the query to several resolvers in parallel
+// and use the first response.
+func (ci ClientInfo) recordUpstream(id string) {
+	t := ci.trace
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	if t.upstream == "" {
+		t.upstream = id
+	}
+	t.mu.Unlock()
+}
+
+func (t *queryTrace) upstreamID() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.upstream
+}
+
+// Records that the response depends on the client that sent the query, for
+// example because it was routed by the client address.
+func (ci ClientInfo) recordClientSpecific() {
+	t := ci.trace
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.clientSpecific = true
+	t.mu.Unlock()
+}
+
+func (t *queryTrace) isClientSpecific() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.clientSpecific
+}
+
+// NewQueryLog returns a new instance of a query logger.
+func NewQueryLog(id string, resolver Resolver, opt QueryLogOptions) (*QueryLog, error) {
+	if opt.File == "" {
+		return nil, errors.New("no query log file specified")
+	}
+	switch opt.Format {
+	case "":
+		opt.Format = "json"
+	case "json", "tsv":
+	default:
+		return nil, fmt.Errorf("unsupported query log format '%s'", opt.Format)
+	}
+	if opt.MaxSize == 0 {
+		opt.MaxSize = 100 << 20
+	}
+	if opt.MaxFiles == 0 {
+		opt.MaxFiles = 5
+	}
+	if opt.SampleRate == 0 {
+		opt.SampleRate = 1
+	}
+	if opt.SampleRate < 0 || opt.SampleRate > 1 {
+		return nil, fmt.Errorf("invalid query log sample rate %v", opt.SampleRate)
+	}
+	out, err := newRotatingFile(opt.File, opt.MaxSize, opt.MaxFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &QueryLog{
+		id:       id,
+		resolver: resolver,
+		opt:      opt,
+		out:      out,
+		metrics: &QueryLogMetrics{
+			query:    getVarInt("query-log", id, "query"),
+			response: getVarMap("query-log", id, "response"),
+			logged:   getVarInt("query-log", id, "logged"),
+			failed:   getVarInt("query-log", id, "failed"),
+		},
+	}, nil
+}
+
+// Resolve a DNS query and log it together with the response.
+func (r *QueryLog) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	r.metrics.query.Add(1)
+	if len(q.Question) == 0 || !sampled(r.opt.SampleRate) {
+		a, err := r.resolver.Resolve(q, ci)
+		r.metrics.response.Add(responseCode(a, err), 1)
+		return a, err
+	}
+	// Nested query logs share the trace
+	if ci.trace == nil {
+		ci.trace = new(queryTrace)
+	}
+	question := q.Question[0]
+	record := queryLogRecord{
+		Time:     time.Now(),
+		ID:       r.id,
+		Listener: ci.Listener,
+		Client:   ci.SourceIP.String(),
+		Name:     question.Name,
+		Type:     dns.Type(question.Qtype).String(),
+	}
+	a, err := resolveWithEDE(r.resolver, q, ci, func(a *dns.Msg) {
+		if a == nil {
+			record.Rcode = "DROP"
+			return
+		}
+		record.Rcode = rCode(a)
+		record.Answers = len(a.Answer)
+		record.Blocked, record.Reason = isBlockedResponse(a)
+		// Queries forwarded by a blocklist carry the rule that matched
+		if ci.Blocked != nil {
+			record.Blocked, record.Reason = true, ci.Blocked.String()
+		}
+	})
+	record.Duration = float64(time.Since(record.Time)) / float64(time.Millisecond)
+	if !record.Blocked {
+		record.Upstream = ci.trace.upstreamID()
+	}
+	if err != nil {
+		record.Rcode = "ERROR"
+		record.Error = err.Error()
+	}
+	r.metrics.response.Add(record.Rcode, 1)
+	if werr := r.write(record); werr != nil {
+		r.metrics.failed.Add(1)
+		logger(r.id, q, ci).WithError(werr).Error("failed to write query log")
+	} else {
+		r.metrics.logged.Add(1)
+	}
+	return a, err
+}
+
+func (r *QueryLog) String() string {
+	return r.id
+}
+
+func (r *QueryLog) write(record queryLogRecord) error {
+	var b []byte
+	switch r.opt.Format {
+	case "tsv":
+		fields := []string{
+			record.Time.Format(time.RFC3339Nano),
+			record.ID,
+			record.Listener,
+			record.Client,
+			record.Name,
+			record.Type,
+			record.Rcode,
+			strconv.Itoa(record.Answers),
+			strconv.FormatFloat(record.Duration, 'f', 3, 64),
+			record.Upstream,
+			strconv.FormatBool(record.Blocked),
+			record.Reason,
+			record.Error,
+		}
+		for i, f := range fields {
+			fields[i] = tsvEscaper.Replace(f)
+		}
+		b = []byte(strings.Join(fields, "\t") + "\n")
+	default:
+		var err error
+		if b, err = json.Marshal(record); err != nil {
+			return err
+		}
+		b = append(b, '\n')
+	}
+	_, err := r.out.Write(b)
+	return err
+}
+
+// Returns true if a query should be logged, for a fraction of queries between
+// 0 and 1.
+func sampled(rate float64) bool {
+	return rate >= 1 || randFloat64() < rate
+}
+
+// Returns the response code of a response, or "DROP" and "ERROR" if there
+// is no response.
+func responseCode(a *dns.Msg, err error) string {
+	switch {
+	case err != nil:
+		return "ERROR"
+	case a == nil:
+		return "DROP"
+	default:
+		return rCode(a)
+	}
+}
+
+// Replaces characters that can't be used in TSV fields.
+var tsvEscaper = strings.NewReplacer("\t", " ", "\n", " ")
+
+// rotatingFile is a writer that appends to a file and rotates it once it
+// reaches the maximum size. Rotated files get a numeric suffix, with ".1"
+// being the most recent.
+type rotatingFile struct {
+	name     string
+	maxSize  int64
+	maxFiles int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func newRotatingFile(name string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	w := &rotatingFile{name: name, maxSize: maxSize, maxFiles: maxFiles}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *rotatingFile) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return 0, os.ErrClosed
+	}
+	if w.size > 0 && w.size+int64(len(b)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.f.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+// Close the file, writes fail afterwards.
+func (w *rotatingFile) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return nil
+	}
+	err := w.f.Close()
+	w.f = nil
+	return err
+}
+
+func (w *rotatingFile) open() error {
+	f, err := os.OpenFile(w.name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f = f
+	w.size = info.Size()
+	return nil
+}
+
+// Closes the current file, shifts the existing rotated files by one and
+// opens a new file. Needs to be called with the lock held.
+func (w *rotatingFile) rotate() error {
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+	for i := w.maxFiles - 1; i > 0; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", w.name, i), fmt.Sprintf("%s.%d", w.name, i+1))
+	}
+	err := os.Rename(w.name, w.name+".1")
+	if oerr := w.open(); oerr != nil {
+		return oerr
+	}
+	return err
+}
@@ -0,0 +1,154 @@
+package rdns
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryLogJSON(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "queries.json")
+	db, err := NewDomainDB("ads", NewStaticLoader([]string{".ads.test"}))
+	require.NoError(t, err)
+	b, err := NewBlocklist("test-ql-bl", new(TestResolver), BlocklistOptions{BlocklistDB: db, EDEText: true})
+	require.NoError(t, err)
+
+	r, err := NewQueryLog("test-ql", b, QueryLogOptions{File: file})
+	require.NoError(t, err)
+
+	ci := ClientInfo{SourceIP: net.ParseIP("192.168.1.1"), Listener: "local-udp"}
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	q.SetQuestion("www.ads.test.", dns.TypeAAAA)
+	a, err := r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Nil(t, a.IsEdns0())
+
+	content, err := os.ReadFile(file)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	require.Len(t, lines, 2)
+
+	var record queryLogRecord
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &record))
+	require.Equal(t, "example.com.", record.Name)
+	require.Equal(t, "A", record.Type)
+	require.Equal(t, "NOERROR", record.Rcode)
+	require.Equal(t, "192.168.1.1", record.Client)
+	require.Equal(t, "local-udp", record.Listener)
+	require.False(t, record.Blocked)
+
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &record))
+	require.Equal(t, "AAAA", record.Type)
+	require.Equal(t, "NXDOMAIN", record.Rcode)
+	require.True(t, record.Blocked)
+	require.Equal(t, "ads: .ads.test", record.Reason)
+}
+
+func TestQueryLogRotate(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "queries.tsv")
+	r, err := NewQueryLog("test-ql-rotate", new(TestResolver), QueryLogOptions{
+		File:     file,
+		Format:   "tsv",
+		MaxSize:  100,
+		MaxFiles: 2,
+	})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	for i := 0; i < 10; i++ {
+		_, err = r.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+	}
+
+	// Every record is larger than half the max size, so each one is in its own
+	// file and only the most recent ones are kept
+	for _, name := range []string{file, file + ".1", file + ".2"} {
+		content, err := os.ReadFile(name)
+		require.NoError(t, err)
+		require.Equal(t, 1, strings.Count(string(content), "\n"))
+		require.Len(t, strings.Split(string(content), "\t"), 13)
+	}
+	_, err = os.Stat(file + ".3")
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestQueryLogSampling(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "queries.json")
+	r, err := NewQueryLog("test-ql-sample", new(TestResolver), QueryLogOptions{
+		File:       file,
+		SampleRate: 0.5,
+	})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	for i := 0; i < 100; i++ {
+		_, err = r.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+	}
+
+	// Only some queries are logged, but all are counted
+	content, err := os.ReadFile(file)
+	require.NoError(t, err)
+	logged := strings.Count(string(content), "\n")
+	require.Greater(t, logged, 0)
+	require.Less(t, logged, 100)
+	require.Equal(t, int64(logged), r.metrics.logged.Value())
+	require.Equal(t, int64(100), r.metrics.query.Value())
+	require.Equal(t, "100", r.metrics.response.Get("NOERROR").String())
+}
+
+func TestQueryLogUpstream(t *testing.T) {
+	addr, err := getUDPLnAddress()
+	require.NoError(t, err)
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		a := new(dns.Msg)
+		a.SetReply(q)
+		a.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600},
+			A:   net.IP{1, 2, 3, 4},
+		}}
+		_ = w.WriteMsg(a)
+	})
+	s := &dns.Server{Addr: addr, Net: "udp", Handler: handler}
+	go func() { _ = s.ListenAndServe() }()
+	defer s.Shutdown()
+	time.Sleep(100 * time.Millisecond)
+
+	upstream, err := NewDNSClient("test-ql-upstream", addr, "udp", DNSClientOptions{})
+	require.NoError(t, err)
+	cache := NewCache("test-ql-cache", upstream, CacheOptions{})
+	file := filepath.Join(t.TempDir(), "queries.json")
+	r, err := NewQueryLog("test-ql", cache, QueryLogOptions{File: file})
+	require.NoError(t, err)
+
+	// The second query is answered from the cache
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	for i := 0; i < 2; i++ {
+		_, err = r.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+	}
+
+	content, err := os.ReadFile(file)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	require.Len(t, lines, 2)
+	var record queryLogRecord
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &record))
+	require.Equal(t, "test-ql-upstream", record.Upstream)
+	record = queryLogRecord{}
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &record))
+	require.Empty(t, record.Upstream)
+}
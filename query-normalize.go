@@ -0,0 +1,231 @@
+package rdns
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// QueryNormalize is a resolver that cleans up malformed query names, as sent
+// by some buggy clients, before they are passed on. It removes whitespace and
+// control characters, as well as dots that are part of a label, like in
+// "example.com\.". Names that can't be cleaned up, or any malformed names in
+// strict mode, are rejected. Responses are returned with the original name.
+type QueryNormalize struct {
+	id       string
+	resolver Resolver
+	opt      QueryNormalizeOptions
+	metrics  *QueryNormalizeMetrics
+}
+
+type QueryNormalizeMetrics struct {
+	// Count of queries with names that were cleaned up.
+	fixed *expvar.Int
+	// Count of rejected queries.
+	rejected *expvar.Int
+}
+
+var _ Resolver = &QueryNormalize{}
+
+type QueryNormalizeOptions struct {
+	// Reject queries with malformed names instead of cleaning them up.
+	Strict bool
+
+	// Handling of underscores in names. "allow" (default), "leading" to only
+	// allow them as first character of a label, like in "_sip._tcp", or
+	// "reject" to reject all names with underscores.
+	Underscores string
+
+	// Response to rejected queries. Defaults to FORMERR, PolicyPass is not
+	// supported.
+	Action QueryPolicyAction
+}
+
+// NewQueryNormalize returns a new instance of a query name normalizer.
+func NewQueryNormalize(id string, resolver Resolver, opt QueryNormalizeOptions) (*QueryNormalize, error) {
+	switch opt.Underscores {
+	case "":
+		opt.Underscores = "allow"
+	case "allow", "leading", "reject":
+	default:
+		return nil, fmt.Errorf("unsupported underscore policy '%s'", opt.Underscores)
+	}
+	switch opt.Action {
+	case PolicyDefault:
+		opt.Action = PolicyFormErr
+	case PolicyPass:
+		return nil, errors.New("rejected queries can not be passed on")
+	}
+	return &QueryNormalize{
+		id:       id,
+		resolver: resolver,
+		opt:      opt,
+		metrics: &QueryNormalizeMetrics{
+			fixed:    getVarInt("query-normalize", id, "fixed"),
+			rejected: getVarInt("query-normalize", id, "rejected"),
+		},
+	}, nil
+}
+
+// Resolve a DNS query after cleaning up the query name.
+func (r *QueryNormalize) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return nil, errors.New("no question in query")
+	}
+	log := logger(r.id, q, ci)
+	origName := q.Question[0].Name
+	name, err := r.normalize(origName)
+	if err != nil {
+		r.metrics.rejected.Add(1)
+		log.WithError(err).Debug("rejecting malformed query name")
+		switch r.opt.Action {
+		case PolicyRefused:
+			return refused(q), nil
+		case PolicyDrop:
+			return nil, nil
+		default:
+			return responseWithCode(q, dns.RcodeFormatError), nil
+		}
+	}
+	if name == origName {
+		return r.resolver.Resolve(q, ci)
+	}
+	r.metrics.fixed.Add(1)
+	log.WithField("new-name", name).Debug("normalized query name")
+
+	newQ := q.Copy()
+	newQ.Question[0].Name = name
+	a, err := r.resolver.Resolve(newQ, ci)
+	if err != nil || a == nil {
+		return a, err
+	}
+	// Return the response with the name the client asked for
+	a.Question = q.Question
+	for _, rr := range a.Answer {
+		if h := rr.Header(); strings.EqualFold(h.Name, name) {
+			h.Name = origName
+		}
+	}
+	return a, nil
+}
+
+func (r *QueryNormalize) String() string {
+	return r.id
+}
+
+// Returns the cleaned up name, or an error if the name is malformed and
+// can't be used.
+func (r *QueryNormalize) normalize(name string) (string, error) {
+	var labels []string
+	for _, label := range dns.SplitDomainName(name) {
+		raw, err := unescapeLabel(label)
+		if err != nil {
+			return "", err
+		}
+		clean := cleanLabel(raw)
+		if clean != raw && r.opt.Strict {
+			return "", fmt.Errorf("invalid characters in label '%s'", label)
+		}
+		if err := r.checkUnderscores(clean); err != nil {
+			return "", err
+		}
+		if clean == "" {
+			continue
+		}
+		if clean == raw {
+			labels = append(labels, label) // keep the original form if there's nothing to fix
+		} else {
+			labels = append(labels, escapeLabel(clean))
+		}
+	}
+	if len(labels) == 0 {
+		if dns.CountLabel(name) > 0 {
+			return "", errors.New("no valid labels in name")
+		}
+		return name, nil
+	}
+	return strings.Join(labels, ".") + ".", nil
+}
+
+func (r *QueryNormalize) checkUnderscores(label string) error {
+	switch r.opt.Underscores {
+	case "reject":
+		if strings.Contains(label, "_") {
+			return fmt.Errorf("underscore in label '%s'", label)
+		}
+	case "leading":
+		if strings.Contains(strings.TrimPrefix(label, "_"), "_") {
+			return fmt.Errorf("underscore in label '%s'", label)
+		}
+	}
+	return nil
+}
+
+// Removes whitespace and control characters from a label, as well as dots.
+func cleanLabel(label string) string {
+	var b strings.Builder
+	for i := 0; i < len(label); i++ {
+		c := label[i]
+		if c <= ' ' || c == 0x7f || c == '.' {
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// Decodes the escape sequences, like "\." or "\032", in a label in
+// presentation format.
+func unescapeLabel(label string) (string, error) {
+	if !strings.Contains(label, `\`) {
+		return label, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(label); i++ {
+		c := label[i]
+		if c != '\\' {
+			b.WriteByte(c)
+			continue
+		}
+		if i+3 < len(label) && isDigit(label[i+1]) && isDigit(label[i+2]) && isDigit(label[i+3]) {
+			v, err := strconv.Atoi(label[i+1 : i+4])
+			if err != nil || v > 255 {
+				return "", fmt.Errorf("invalid escape sequence in label '%s'", label)
+			}
+			b.WriteByte(byte(v))
+			i += 3
+			continue
+		}
+		if i+1 < len(label) {
+			b.WriteByte(label[i+1])
+			i++
+			continue
+		}
+		return "", fmt.Errorf("invalid escape sequence in label '%s'", label)
+	}
+	return b.String(), nil
+}
+
+// Encodes a label in presentation format, escaping all characters other
+// than letters, digits, hyphens, underscores and asterisks.
+func escapeLabel(label string) string {
+	var b strings.Builder
+	for i := 0; i < len(label); i++ {
+		c := label[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', isDigit(c), c == '-', c == '_', c == '*':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "\\%03d", c)
+		}
+	}
+	return b.String()
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
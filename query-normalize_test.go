@@ -0,0 +1,88 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryNormalize(t *testing.T) {
+	var ci ClientInfo
+	var received string
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			received = q.Question[0].Name
+			a := new(dns.Msg)
+			a.SetReply(q)
+			rr, err := dns.NewRR(q.Question[0].Name + " 60 IN A 192.0.2.1")
+			require.NoError(t, err)
+			a.Answer = append(a.Answer, rr)
+			return a, nil
+		},
+	}
+	g, err := NewQueryNormalize("test-normalize", r, QueryNormalizeOptions{})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"example.com.", "example.com."},
+		{"exa\\032mple.com.", "example.com."},
+		{"example.com\\..", "example.com."},
+		{"example\\009.com.", "example.com."},
+		{"_sip._tcp.example.com.", "_sip._tcp.example.com."},
+	}
+	for _, test := range tests {
+		q := new(dns.Msg)
+		q.SetQuestion(test.name, dns.TypeA)
+		a, err := g.Resolve(q, ci)
+		require.NoError(t, err)
+		require.Equal(t, test.expected, received, test.name)
+
+		// The response has the name the client asked for
+		require.Equal(t, test.name, a.Question[0].Name)
+		require.Len(t, a.Answer, 1)
+		require.Equal(t, test.name, a.Answer[0].Header().Name)
+	}
+}
+
+func TestQueryNormalizeReject(t *testing.T) {
+	var ci ClientInfo
+	r := new(TestResolver)
+
+	tests := []struct {
+		opt   QueryNormalizeOptions
+		name  string
+		rcode int
+	}{
+		{QueryNormalizeOptions{Strict: true}, "exa\\032mple.com.", dns.RcodeFormatError},
+		{QueryNormalizeOptions{Strict: true, Action: PolicyRefused}, "example.com\\..", dns.RcodeRefused},
+		{QueryNormalizeOptions{}, "\\032.", dns.RcodeFormatError},
+		{QueryNormalizeOptions{Underscores: "reject"}, "_sip._tcp.example.com.", dns.RcodeFormatError},
+		{QueryNormalizeOptions{Underscores: "leading"}, "my_host.example.com.", dns.RcodeFormatError},
+	}
+	for _, test := range tests {
+		g, err := NewQueryNormalize("test-normalize", r, test.opt)
+		require.NoError(t, err)
+		q := new(dns.Msg)
+		q.SetQuestion(test.name, dns.TypeA)
+		a, err := g.Resolve(q, ci)
+		require.NoError(t, err)
+		require.Equal(t, test.rcode, a.Rcode, test.name)
+	}
+	require.Equal(t, 0, r.HitCount())
+
+	// Leading underscores are fine with the "leading" policy
+	g, err := NewQueryNormalize("test-normalize", r, QueryNormalizeOptions{Underscores: "leading"})
+	require.NoError(t, err)
+	q := new(dns.Msg)
+	q.SetQuestion("_sip._tcp.example.com.", dns.TypeSRV)
+	_, err = g.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r.HitCount())
+
+	_, err = NewQueryNormalize("test-normalize", r, QueryNormalizeOptions{Underscores: "invalid"})
+	require.Error(t, err)
+}
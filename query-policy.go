@@ -0,0 +1,95 @@
+package rdns
+
+import (
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// QueryPolicyAction defines what a listener does with a query that matches
+// one of the conditions in a QueryPolicy.
+type QueryPolicyAction int
+
+const (
+	PolicyDefault QueryPolicyAction = iota // Use the default action for the condition
+	PolicyPass                             // Pass the query on to the resolver
+	PolicyFormErr                          // Respond with FORMERR
+	PolicyRefused                          // Respond with REFUSED
+	PolicyDrop                             // Don't respond at all
+)
+
+// ParseQueryPolicyAction returns the action for a given name, one of "pass",
+// "formerr", "refused", or "drop". An empty string returns PolicyDefault.
+func ParseQueryPolicyAction(s string) (QueryPolicyAction, error) {
+	switch s {
+	case "":
+		return PolicyDefault, nil
+	case "pass":
+		return PolicyPass, nil
+	case "formerr":
+		return PolicyFormErr, nil
+	case "refused":
+		return PolicyRefused, nil
+	case "drop":
+		return PolicyDrop, nil
+	default:
+		return PolicyDefault, fmt.Errorf("unsupported query policy action '%s'", s)
+	}
+}
+
+// QueryPolicy defines how listeners handle unusual queries before they are
+// passed to the resolver.
+type QueryPolicy struct {
+	// Queries without question. Defaults to FORMERR. Passing queries without
+	// question on to resolvers is not supported, PolicyPass is treated as
+	// FORMERR.
+	NoQuestion QueryPolicyAction
+
+	// Queries with more than one question. Defaults to FORMERR. If passed on,
+	// resolvers generally only look at the first question.
+	MultiQuestion QueryPolicyAction
+
+	// Queries with a class other than IN, like CH or HS. Defaults to passing
+	// the query on to the resolver.
+	UnusualClass QueryPolicyAction
+}
+
+// Checks a query against the policy. If the query should not be passed on to
+// the resolver, the response and true is returned. A nil response means the
+// query should be dropped.
+func (p QueryPolicy) apply(q *dns.Msg) (*dns.Msg, bool) {
+	var action QueryPolicyAction
+	switch {
+	case len(q.Question) == 0:
+		action = p.NoQuestion
+		if action == PolicyDefault || action == PolicyPass {
+			action = PolicyFormErr
+		}
+	case len(q.Question) > 1:
+		action = p.MultiQuestion
+		if action == PolicyDefault {
+			action = PolicyFormErr
+		}
+	case q.Question[0].Qclass != dns.ClassINET:
+		action = p.UnusualClass
+	}
+
+	switch action {
+	case PolicyFormErr:
+		return responseWithCode(q, dns.RcodeFormatError), true
+	case PolicyRefused:
+		return refused(q), true
+	case PolicyDrop:
+		return nil, true
+	default:
+		return nil, false
+	}
+}
+
+// Message accept function for listeners using dns.Server. The question count
+// is checked by the listener based on the QueryPolicy, all other checks are
+// done by the default function.
+func policyMsgAcceptFunc(dh dns.Header) dns.MsgAcceptAction {
+	dh.Qdcount = 1
+	return dns.DefaultMsgAcceptFunc(dh)
+}
@@ -0,0 +1,54 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryPolicy(t *testing.T) {
+	var p QueryPolicy
+
+	// Regular query, passed on
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, reject := p.apply(q)
+	require.False(t, reject)
+
+	// No question, FORMERR by default
+	q = new(dns.Msg)
+	a, reject := p.apply(q)
+	require.True(t, reject)
+	require.Equal(t, dns.RcodeFormatError, a.Rcode)
+
+	// Multiple questions, FORMERR by default
+	q = new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.Question = append(q.Question, dns.Question{Name: "example.net.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	a, reject = p.apply(q)
+	require.True(t, reject)
+	require.Equal(t, dns.RcodeFormatError, a.Rcode)
+
+	// CHAOS class query, passed on by default
+	q = new(dns.Msg)
+	q.SetQuestion("version.bind.", dns.TypeTXT)
+	q.Question[0].Qclass = dns.ClassCHAOS
+	_, reject = p.apply(q)
+	require.False(t, reject)
+
+	// Refuse CHAOS queries, drop multiple questions
+	p = QueryPolicy{
+		MultiQuestion: PolicyDrop,
+		UnusualClass:  PolicyRefused,
+	}
+	a, reject = p.apply(q)
+	require.True(t, reject)
+	require.Equal(t, dns.RcodeRefused, a.Rcode)
+
+	q = new(dns.Msg)
+	q.Question = make([]dns.Question, 2)
+	a, reject = p.apply(q)
+	require.True(t, reject)
+	require.Nil(t, a)
+}
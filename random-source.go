@@ -0,0 +1,43 @@
+package rdns
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Source of random numbers for all elements that make random decisions, like
+// the random group, the adaptive group, answer shuffling, sampling and fault
+// injection. Seeded with the time by default.
+var randomSource = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// SetRandomSeed replaces the source of random numbers with one that uses a
+// fixed seed, making random decisions reproducible. Intended for tests of
+// configurations. Decisions only repeat exactly if queries are processed in
+// the same order. It should be called once, before any listeners are started.
+func SetRandomSeed(seed int64) {
+	randomSource.Lock()
+	randomSource.Rand = rand.New(rand.NewSource(seed))
+	randomSource.Unlock()
+}
+
+func randFloat64() float64 {
+	randomSource.Lock()
+	defer randomSource.Unlock()
+	return randomSource.Float64()
+}
+
+func randIntn(n int) int {
+	randomSource.Lock()
+	defer randomSource.Unlock()
+	return randomSource.Intn(n)
+}
+
+func randShuffle(n int, swap func(i, j int)) {
+	randomSource.Lock()
+	defer randomSource.Unlock()
+	randomSource.Shuffle(n, swap)
+}
@@ -0,0 +1,43 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRandomSeed(t *testing.T) {
+	var ci ClientInfo
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// Returns the resolvers picked by a random group for a number of queries
+	picks := func() []int {
+		resolvers := make([]*TestResolver, 3)
+		var list []Resolver
+		for i := range resolvers {
+			resolvers[i] = new(TestResolver)
+			list = append(list, resolvers[i])
+		}
+		g := NewRandom("test-random", RandomOptions{}, list...)
+		var picked []int
+		for i := 0; i < 20; i++ {
+			_, err := g.Resolve(q, ci)
+			require.NoError(t, err)
+			for j, r := range resolvers {
+				if r.HitCount() > 0 {
+					picked = append(picked, j)
+					r.hitCount = 0
+				}
+			}
+		}
+		return picked
+	}
+
+	// The same seed results in the same decisions
+	SetRandomSeed(42)
+	first := picks()
+	SetRandomSeed(42)
+	require.Equal(t, first, picks())
+}
@@ -2,7 +2,6 @@ package rdns
 
 import (
 	"errors"
-	"math/rand"
 	"sync"
 	"time"
 
@@ -35,7 +34,6 @@ type RandomOptions struct {
 
 // NewRandom returns a new instance of a random resolver group.
 func NewRandom(id string, opt RandomOptions, resolvers ...Resolver) *Random {
-	rand.Seed(time.Now().UnixNano())
 	if opt.ResetAfter == 0 {
 		opt.ResetAfter = time.Minute
 	}
@@ -83,7 +81,7 @@ func (r *Random) pick() Resolver {
 	if available == 0 {
 		return nil
 	}
-	return r.resolvers[rand.Intn(available)]
+	return r.resolvers[randIntn(available)]
 }
 
 // Remove the resolver from the list of active ones and schedule it to
@@ -1,24 +1,33 @@
 package rdns
 
 import (
+	"encoding/json"
+	"errors"
 	"expvar"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
 )
 
 // RateLimiter is a resolver that limits the number of queries by a client (network)
-// that are passed to the upstream resolver per timeframe.
+// that are passed to the upstream resolver per timeframe. Multiple limits for
+// networks of different sizes can be applied at the same time.
 type RateLimiter struct {
+	limited uint64 // Number of rate-limited queries, used for slip. First for 64-bit alignment.
+
 	id       string
 	resolver Resolver
 	RateLimiterOptions
 
+	tiers     []RateLimiterTier
 	mu        sync.RWMutex
 	currWinID int64
-	counters  map[string]*uint
+	counters  []map[string]*uint // One set of counters per tier
 	metrics   *RateLimiterMetrics
 }
 
@@ -30,6 +39,46 @@ type RateLimiterOptions struct {
 	Prefix4       uint8    // Netmask to identify IP4 clients
 	Prefix6       uint8    // Netmask to identify IP6 clients
 	LimitResolver Resolver // Alternate resolver for rate-limited requests
+
+	// Response to rate-limited queries if there's no LimitResolver. "drop"
+	// (default), "refused", or "truncate" which sets the TC bit so clients
+	// retry over TCP.
+	LimitAction string
+
+	// Respond to every n-th rate-limited query with a truncated response,
+	// instead of applying the limit action. Like "slip" in classic response
+	// rate limiting, this lets legitimate clients retry over TCP while most
+	// responses to spoofed sources are dropped. Disabled if 0.
+	Slip uint
+
+	// Additional limits that are evaluated together with the one above. A query
+	// is rate-limited if any of them is exceeded.
+	Tiers []RateLimiterTier
+
+	// File the counters of the current window are saved to and loaded from on
+	// startup, so a restart doesn't reset the limits. Mostly useful with long
+	// windows like an hour or a day. Counters are not persisted if empty.
+	StateFile string
+
+	// Interval in which the counters are written to the file. Default 1 minute.
+	SaveInterval time.Duration
+}
+
+// RateLimiterTier is a limit of requests for clients grouped by network. Unlike
+// the top-level options, prefixes of 0 are not replaced with defaults, they put
+// all clients in the same group which allows defining a global limit.
+type RateLimiterTier struct {
+	Requests uint  // Number of requests allowed per time period
+	Prefix4  uint8 // Netmask to identify IP4 clients
+	Prefix6  uint8 // Netmask to identify IP6 clients
+}
+
+// Content of the file used to persist the counters of a rate-limiter.
+type rateLimiterState struct {
+	Window   uint              `json:"window"`
+	WindowID int64             `json:"window-id"`
+	Tiers    []RateLimiterTier `json:"tiers"`
+	Counters []map[string]uint `json:"counters"`
 }
 
 type RateLimiterMetrics struct {
@@ -39,6 +88,8 @@ type RateLimiterMetrics struct {
 	exceed *expvar.Int
 	// Count of dropped queries.
 	drop *expvar.Int
+	// Count of rate-limited queries answered with a truncated response.
+	truncate *expvar.Int
 }
 
 // NewRateLimiterIP returns a new instance of a query rate limiter.
@@ -52,16 +103,35 @@ func NewRateLimiter(id string, resolver Resolver, opt RateLimiterOptions) *RateL
 	if opt.Prefix6 == 0 {
 		opt.Prefix6 = 56
 	}
-	return &RateLimiter{
+	// The top-level limit is always applied, unless only tiers are configured
+	var tiers []RateLimiterTier
+	if opt.Requests > 0 || len(opt.Tiers) == 0 {
+		tiers = append(tiers, RateLimiterTier{Requests: opt.Requests, Prefix4: opt.Prefix4, Prefix6: opt.Prefix6})
+	}
+	tiers = append(tiers, opt.Tiers...)
+	if opt.SaveInterval == 0 {
+		opt.SaveInterval = time.Minute
+	}
+	r := &RateLimiter{
 		id:                 id,
 		resolver:           resolver,
 		RateLimiterOptions: opt,
+		tiers:              tiers,
 		metrics: &RateLimiterMetrics{
-			query:  getVarInt("router", id, "query"),
-			exceed: getVarInt("router", id, "exceed"),
-			drop:   getVarInt("router", id, "drop"),
+			query:    getVarInt("router", id, "query"),
+			exceed:   getVarInt("router", id, "exceed"),
+			drop:     getVarInt("router", id, "drop"),
+			truncate: getVarInt("router", id, "truncate"),
 		},
 	}
+	if opt.StateFile != "" {
+		// Don't fail on a broken file, the limits just start from zero
+		if err := r.load(); err != nil {
+			Log.WithField("id", id).WithError(err).Warn("failed to load rate-limiter state")
+		}
+		go r.saveLoop()
+	}
+	return r
 }
 
 // Resolve a DNS query while limiting the query rate per time period.
@@ -69,15 +139,6 @@ func (r *RateLimiter) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	log := logger(r.id, q, ci)
 	r.metrics.query.Add(1)
 
-	// Apply the desired mask to the client IP to build a key it identify the client (network)
-	source := ci.SourceIP
-	if ip4 := source.To4(); len(ip4) == net.IPv4len {
-		source = source.Mask(net.CIDRMask(int(r.Prefix4), 32))
-	} else {
-		source = source.Mask(net.CIDRMask(int(r.Prefix6), 128))
-	}
-	key := source.String()
-
 	// Calculate the current (fixed) window
 	windowID := time.Now().Unix() / int64(r.Window)
 
@@ -86,33 +147,44 @@ func (r *RateLimiter) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 
 	// If we have moved on to the next window, re-initialize the counters
 	if windowID != r.currWinID {
-		r.currWinID = windowID
-		r.counters = make(map[string]*uint)
+		r.resetCounters(windowID)
 	}
 
-	// Load the current counter for this client or make a new one
-	v, ok := r.counters[key]
-	if !ok {
-		v = new(uint)
-		r.counters[key] = v
+	// Check the number of requests made in this window in every tier, any one
+	// of them can cause the query to be rejected
+	counters := make([]*uint, len(r.tiers))
+	for i, tier := range r.tiers {
+		key := tier.clientKey(ci.SourceIP)
+
+		// Load the current counter for this client or make a new one
+		v, ok := r.counters[i][key]
+		if !ok {
+			v = new(uint)
+			r.counters[i][key] = v
+		}
+		counters[i] = v
+		if *v >= tier.Requests {
+			reject = true
+		}
 	}
 
-	// Check the number of requests made in this window
-	if *v >= r.Requests {
-		reject = true
+	// Only count queries that are passed on, otherwise a single client that
+	// is already limited would use up the limits of the larger networks
+	if !reject {
+		for _, v := range counters {
+			*v++
+		}
 	}
-	*v++
 	r.mu.Unlock()
 
 	if reject {
 		r.metrics.exceed.Add(1)
+		auditRefused(ci, AuditReasonRateLimit, q)
 		if r.LimitResolver != nil {
 			log.WithField("resolver", r.LimitResolver).Debug("rate-limit exceeded, forwarding to limit-resolver")
 			return r.LimitResolver.Resolve(q, ci)
 		}
-		r.metrics.drop.Add(1)
-		log.Debug("rate-limit reached, dropping")
-		return nil, nil
+		return r.limit(q, log), nil
 	}
 	log.WithField("resolver", r.resolver).Debug("forwarding query to resolver")
 	return r.resolver.Resolve(q, ci)
@@ -121,3 +193,126 @@ func (r *RateLimiter) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 func (r *RateLimiter) String() string {
 	return r.id
 }
+
+// Starts a new window with empty counters. Needs to be called with the lock held.
+func (r *RateLimiter) resetCounters(windowID int64) {
+	r.currWinID = windowID
+	r.counters = make([]map[string]*uint, len(r.tiers))
+	for i := range r.counters {
+		r.counters[i] = make(map[string]*uint)
+	}
+}
+
+// Loads the counters from file. They're only used if they're for the current
+// window and the limits haven't changed. A missing file is not an error,
+// it'll be created on the first save.
+func (r *RateLimiter) load() error {
+	b, err := os.ReadFile(r.StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state rateLimiterState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return err
+	}
+	windowID := time.Now().Unix() / int64(r.Window)
+	if state.Window != r.Window || state.WindowID != windowID || !sameRateLimiterTiers(state.Tiers, r.tiers) || len(state.Counters) != len(r.tiers) {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.resetCounters(windowID)
+	for i, counters := range state.Counters {
+		for key, n := range counters {
+			v := n
+			r.counters[i][key] = &v
+		}
+	}
+	return nil
+}
+
+// Writes the counters of the current window to file. A temporary file is used
+// and renamed to avoid leaving a partial file behind if the process is stopped.
+func (r *RateLimiter) save() error {
+	r.mu.Lock()
+	state := rateLimiterState{
+		Window:   r.Window,
+		WindowID: r.currWinID,
+		Tiers:    r.tiers,
+	}
+	for _, counters := range r.counters {
+		m := make(map[string]uint, len(counters))
+		for key, v := range counters {
+			m[key] = *v
+		}
+		state.Counters = append(state.Counters, m)
+	}
+	r.mu.Unlock()
+
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := r.StateFile + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.StateFile)
+}
+
+func (r *RateLimiter) saveLoop() {
+	for {
+		time.Sleep(r.SaveInterval)
+		if err := r.save(); err != nil {
+			Log.WithField("id", r.id).WithError(err).Error("failed to save rate-limiter state")
+		}
+	}
+}
+
+func sameRateLimiterTiers(a, b []RateLimiterTier) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the response to a rate-limited query, or nil to drop it.
+func (r *RateLimiter) limit(q *dns.Msg, log *logrus.Entry) *dns.Msg {
+	action := r.LimitAction
+	if r.Slip > 0 && atomic.AddUint64(&r.limited, 1)%uint64(r.Slip) == 0 {
+		action = "truncate"
+	}
+	switch action {
+	case "refused":
+		log.Debug("rate-limit reached, refusing")
+		a := new(dns.Msg)
+		return a.SetRcode(q, dns.RcodeRefused)
+	case "truncate":
+		r.metrics.truncate.Add(1)
+		log.Debug("rate-limit reached, truncating")
+		a := new(dns.Msg)
+		a.SetReply(q)
+		a.Truncated = true
+		return a
+	default:
+		r.metrics.drop.Add(1)
+		log.Debug("rate-limit reached, dropping")
+		return nil
+	}
+}
+
+// Apply the desired mask to the client IP to build a key to identify the client (network)
+func (t RateLimiterTier) clientKey(ip net.IP) string {
+	if ip4 := ip.To4(); len(ip4) == net.IPv4len {
+		return ip4.Mask(net.CIDRMask(int(t.Prefix4), 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(int(t.Prefix6), 128)).String()
+}
@@ -0,0 +1,119 @@
+package rdns
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiterTiers(t *testing.T) {
+	upstream := new(TestResolver)
+	limitResolver := new(TestResolver)
+	r := NewRateLimiter("test-rrl", upstream, RateLimiterOptions{
+		Window:        3600,
+		LimitResolver: limitResolver,
+		Tiers: []RateLimiterTier{
+			{Requests: 2, Prefix4: 32, Prefix6: 128}, // Per host
+			{Requests: 3, Prefix4: 24, Prefix6: 56},  // Per network
+			{Requests: 5},                            // Global
+		},
+	})
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	resolve := func(ip string) {
+		_, err := r.Resolve(q, ClientInfo{SourceIP: net.ParseIP(ip)})
+		require.NoError(t, err)
+	}
+
+	// The per-host limit applies to a single client
+	resolve("192.168.1.1")
+	resolve("192.168.1.1")
+	resolve("192.168.1.1")
+	require.Equal(t, 2, upstream.HitCount())
+	require.Equal(t, 1, limitResolver.HitCount())
+
+	// Another host in the same network is limited by the network tier
+	resolve("192.168.1.2")
+	resolve("192.168.1.2")
+	require.Equal(t, 3, upstream.HitCount())
+	require.Equal(t, 2, limitResolver.HitCount())
+
+	// Clients in other networks are only limited by the global tier
+	resolve("10.0.0.1")
+	resolve("10.0.1.1")
+	resolve("10.0.2.1")
+	require.Equal(t, 5, upstream.HitCount())
+	require.Equal(t, 3, limitResolver.HitCount())
+}
+
+func TestRateLimiterActions(t *testing.T) {
+	var ci ClientInfo
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// Respond with REFUSED once the limit is reached
+	upstream := new(TestResolver)
+	r := NewRateLimiter("test-rrl", upstream, RateLimiterOptions{Requests: 1, LimitAction: "refused"})
+	_, err := r.Resolve(q, ci)
+	require.NoError(t, err)
+	a, err := r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeRefused, a.Rcode)
+	require.Equal(t, 1, upstream.HitCount())
+
+	// Respond with a truncated response
+	r = NewRateLimiter("test-rrl", upstream, RateLimiterOptions{Requests: 1, LimitAction: "truncate"})
+	_, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	a, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.True(t, a.Truncated)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+
+	// Drop limited queries, but truncate every second one
+	r = NewRateLimiter("test-rrl", upstream, RateLimiterOptions{Requests: 1, Slip: 2})
+	_, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	a, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Nil(t, a)
+	a, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.True(t, a.Truncated)
+	a, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Nil(t, a)
+}
+
+func TestRateLimiterPersist(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "state.json")
+	upstream := new(TestResolver)
+	opt := RateLimiterOptions{Requests: 2, Window: 3600, StateFile: file}
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	ci := ClientInfo{SourceIP: net.ParseIP("192.168.1.1")}
+
+	r := NewRateLimiter("test-rrl-persist-1", upstream, opt)
+	_, err := r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.NoError(t, r.save())
+
+	// A new instance continues with the saved counters, so the client only
+	// has one query left in this window
+	r = NewRateLimiter("test-rrl-persist-2", upstream, opt)
+	_, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	_, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 2, upstream.HitCount())
+
+	// Counters are discarded if the limits changed
+	opt.Prefix4 = 32
+	r = NewRateLimiter("test-rrl-persist-3", upstream, opt)
+	_, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 3, upstream.HitCount())
+}
@@ -2,6 +2,8 @@ package rdns
 
 import (
 	"encoding/binary"
+	"expvar"
+	"strings"
 	"sync"
 
 	"github.com/miekg/dns"
@@ -10,6 +12,8 @@ import (
 type dedupKey struct {
 	name        string
 	qtype       uint16
+	qclass      uint16
+	do, cd      bool // DNSSEC flags change the response
 	ecs_ipv4    uint32
 	ecs_ipv6_hi uint64
 	ecs_ipv6_lo uint64
@@ -23,7 +27,7 @@ type inflightRequest struct {
 }
 
 // requestDedup passes individual requests normally. Subsequent
-// queries for the same name are being held until the first query
+// queries for the same name, type and class are being held until the first query
 // returns. In that case, all waiting requests are answered with
 // the same response. This element is used to smooth out spikes
 // of queries for the same name.
@@ -32,6 +36,7 @@ type requestDedup struct {
 	resolver Resolver
 	mu       sync.Mutex
 	inflight map[dedupKey]*inflightRequest
+	metrics  *expvar.Int // Number of queries answered from another in-flight query
 }
 
 var _ Resolver = &requestDedup{}
@@ -41,6 +46,7 @@ func NewRequestDedup(id string, resolver Resolver) *requestDedup {
 		id:       id,
 		resolver: resolver,
 		inflight: make(map[dedupKey]*inflightRequest),
+		metrics:  getVarInt("router", id, "deduplicated"),
 	}
 }
 
@@ -51,8 +57,10 @@ func (r *requestDedup) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 		ecsMask              uint8
 	)
 
+	var do bool
 	edns0 := q.IsEdns0()
 	if edns0 != nil {
+		do = edns0.Do()
 		// Find the ECS option
 		for _, opt := range edns0.Option {
 			ecs, ok := opt.(*dns.EDNS0_SUBNET)
@@ -71,8 +79,11 @@ func (r *requestDedup) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 		}
 	}
 	k := dedupKey{
-		name:        q.Question[0].Name,
+		name:        strings.ToLower(q.Question[0].Name),
 		qtype:       q.Question[0].Qtype,
+		qclass:      q.Question[0].Qclass,
+		do:          do,
+		cd:          q.CheckingDisabled,
 		ecs_ipv4:    ecsIPv4,
 		ecs_ipv6_hi: ecsIPv6Hi,
 		ecs_ipv6_lo: ecsIPv6Lo,
@@ -93,12 +104,17 @@ func (r *requestDedup) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	// If the request is already in flight, wait for that to complete and
 	// return the same answer.
 	if ok {
+		r.metrics.Add(1)
 		log.Debug("duplicated request, waiting for first answer")
 		<-req.done
 		a, err := req.answer, req.err
-		// Return a copy of the answer as other elements might be modifying it
+		// Return a copy of the answer as other waiters might be modifying it.
+		// The answer is for the first query, so the ID and question (which may
+		// differ in case) need to be updated to match this query.
 		if a != nil {
 			a = a.Copy()
+			a.Id = q.Id
+			a.Question = append([]dns.Question(nil), q.Question...)
 		}
 		return a, err
 	}
@@ -106,7 +122,12 @@ func (r *requestDedup) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 
 	// Not already in flight, make the request
 	a, err := r.resolver.Resolve(q, ci)
-	req.answer = a
+	// Keep a private copy for the waiters. The original is returned to the
+	// caller and may be modified by elements or the listener while the
+	// waiters are still copying it.
+	if a != nil {
+		req.answer = a.Copy()
+	}
 	req.err = err
 	close(req.done) // release other goroutines waiting for the response
 
@@ -1,6 +1,7 @@
 package rdns
 
 import (
+	"net"
 	"sync"
 	"testing"
 	"time"
@@ -37,3 +38,93 @@ func TestRequestDedup(t *testing.T) {
 	// Only one request should have hit the resolver
 	require.Equal(t, 1, r.HitCount())
 }
+
+func TestRequestDedupAnswerID(t *testing.T) {
+	var ci ClientInfo
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			time.Sleep(100 * time.Millisecond)
+			a := new(dns.Msg)
+			a.SetReply(q)
+			return a, nil
+		},
+	}
+	g := NewRequestDedup("test-dedup-id", r)
+
+	// Send queries with different IDs and name case, each must get an answer
+	// matching its own query
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		if i%2 == 0 {
+			q.Question[0].Name = "EXAMPLE.com."
+		}
+		q.Id = uint16(i + 1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a, err := g.Resolve(q, ci)
+			require.NoError(t, err)
+			require.Equal(t, q.Id, a.Id)
+			require.Equal(t, q.Question[0].Name, a.Question[0].Name)
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, 1, r.HitCount())
+
+	// Queries with the DO bit set are not answered with the same response
+	q1 := new(dns.Msg)
+	q1.SetQuestion("example.com.", dns.TypeA)
+	q2 := q1.Copy()
+	q2.SetEdns0(4096, true)
+	wg.Add(2)
+	for _, q := range []*dns.Msg{q1, q2} {
+		q := q
+		go func() {
+			defer wg.Done()
+			_, err := g.Resolve(q, ci)
+			require.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, 3, r.HitCount())
+}
+
+func TestRequestDedupLeaderModifies(t *testing.T) {
+	var ci ClientInfo
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			time.Sleep(100 * time.Millisecond)
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600},
+				A:   net.IP{192, 0, 2, 1},
+			}}
+			return a, nil
+		},
+	}
+	g := NewRequestDedup("test-dedup-modify", r)
+
+	// Every caller modifies its answer right away, like a listener setting the
+	// ID or truncating it. The race detector flags it if the waiters copy the
+	// same message the leader is modifying.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			a, err := g.Resolve(q, ci)
+			require.NoError(t, err)
+			require.Len(t, a.Answer, 1)
+			require.Equal(t, uint32(3600), a.Answer[0].Header().Ttl)
+			a.Answer[0].Header().Ttl = 0
+			a.Answer = nil
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, 1, r.HitCount())
+}
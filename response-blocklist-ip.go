@@ -12,6 +12,9 @@ import (
 
 // IPBlocklistDB is a database containing IPs used in blocklists.
 type IPBlocklistDB interface {
+	// Reload initializes a new instance of the same database with a new
+	// ruleset loaded. The old instance remains usable until it's closed with
+	// closeReplacedIPDB once the new one is in use.
 	Reload() (IPBlocklistDB, error)
 	Match(ip net.IP) (*BlocklistMatch, bool)
 	Close() error
@@ -38,19 +41,34 @@ type ResponseBlocklistIPOptions struct {
 	// Refresh period for the blocklist. Disabled if 0.
 	BlocklistRefresh time.Duration
 
+	// Optional, IPs matching the allowlist are never blocked, even if they
+	// are also covered by the blocklist.
+	AllowlistDB IPBlocklistDB
+
+	// Refresh period for the allowlist. Disabled if 0.
+	AllowlistRefresh time.Duration
+
 	// If true, removes matching records from the response rather than replying with NXDOMAIN. Can
 	// not be combined with alternative blockist-resolver
 	Filter bool
+
+	// Include the list and rule that matched as extra text in the extended
+	// DNS error of blocked responses.
+	EDEText bool
 }
 
 // NewResponseBlocklistIP returns a new instance of a response blocklist resolver.
 func NewResponseBlocklistIP(id string, resolver Resolver, opt ResponseBlocklistIPOptions) (*ResponseBlocklistIP, error) {
 	blocklist := &ResponseBlocklistIP{id: id, resolver: resolver, ResponseBlocklistIPOptions: opt}
 
-	// Start the refresh goroutines if we have a list and a refresh period was given
-	if blocklist.BlocklistDB != nil && blocklist.BlocklistRefresh > 0 {
+	// Start the refresh goroutines if we have a list. Lists are reloaded if a
+	// refresh period was given, or if they were loaded from a stale copy.
+	if blocklist.BlocklistDB != nil {
 		go blocklist.refreshLoopBlocklist(blocklist.BlocklistRefresh)
 	}
+	if blocklist.AllowlistDB != nil {
+		go blocklist.refreshLoopAllowlist(blocklist.AllowlistRefresh)
+	}
 	return blocklist, nil
 }
 
@@ -76,19 +94,85 @@ func (r *ResponseBlocklistIP) String() string {
 
 func (r *ResponseBlocklistIP) refreshLoopBlocklist(refresh time.Duration) {
 	for {
-		time.Sleep(refresh)
+		wait, ok := nextRefresh(r.BlocklistDB, refresh)
+		if !ok {
+			return
+		}
+		time.Sleep(wait)
 		log := Log.WithField("id", r.id)
 		log.Debug("reloading blocklist")
 		db, err := r.BlocklistDB.Reload()
+		if err == ErrNotModified {
+			log.Debug("list not modified, keeping current rules")
+			continue
+		}
 		if err != nil {
 			Log.WithError(err).Error("failed to load rules")
 			continue
 		}
 		r.mu.Lock()
-		r.BlocklistDB.Close()
+		old := r.BlocklistDB
 		r.BlocklistDB = db
 		r.mu.Unlock()
+		closeReplacedIPDB(old, db)
+	}
+}
+
+func (r *ResponseBlocklistIP) refreshLoopAllowlist(refresh time.Duration) {
+	for {
+		wait, ok := nextRefresh(r.AllowlistDB, refresh)
+		if !ok {
+			return
+		}
+		time.Sleep(wait)
+		log := Log.WithField("id", r.id)
+		log.Debug("reloading allowlist")
+		db, err := r.AllowlistDB.Reload()
+		if err == ErrNotModified {
+			log.Debug("list not modified, keeping current rules")
+			continue
+		}
+		if err != nil {
+			Log.WithError(err).Error("failed to load rules")
+			continue
+		}
+		r.mu.Lock()
+		old := r.AllowlistDB
+		r.AllowlistDB = db
+		r.mu.Unlock()
+		closeReplacedIPDB(old, db)
+	}
+}
+
+// Returns the blocklist match for an IP. IPs on the allowlist never match,
+// regardless of how specific the blocklist rule is.
+func (r *ResponseBlocklistIP) match(ip net.IP) (*BlocklistMatch, bool) {
+	r.mu.RLock()
+	blocklistDB, allowlistDB := r.BlocklistDB, r.AllowlistDB
+	r.mu.RUnlock()
+	if allowlistDB != nil {
+		if _, ok := allowlistDB.Match(ip); ok {
+			return nil, false
+		}
+	}
+	return blocklistDB.Match(ip)
+}
+
+// TestIP returns which rule, if any, matches an IP in a response without
+// resolving anything. Used to find out why a response is blocked.
+func (r *ResponseBlocklistIP) TestIP(ip net.IP) BlocklistTestResult {
+	r.mu.RLock()
+	blocklistDB, allowlistDB := r.BlocklistDB, r.AllowlistDB
+	r.mu.RUnlock()
+	if allowlistDB != nil {
+		if match, ok := allowlistDB.Match(ip); ok {
+			return BlocklistTestResult{Allowed: true, List: match.List, Rule: match.Rule}
+		}
+	}
+	if match, ok := blocklistDB.Match(ip); ok {
+		return BlocklistTestResult{Blocked: true, List: match.List, Rule: match.Rule}
 	}
+	return BlocklistTestResult{}
 }
 
 func (r *ResponseBlocklistIP) blockIfMatch(query, answer *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
@@ -103,14 +187,17 @@ func (r *ResponseBlocklistIP) blockIfMatch(query, answer *dns.Msg, ci ClientInfo
 			default:
 				continue
 			}
-			if match, ok := r.BlocklistDB.Match(ip); ok {
-				log := logger(r.id, query, ci).WithFields(logrus.Fields{"list": match.List, "rule": match.Rule, "ip": ip})
+			if match, ok := r.match(ip); ok {
+				ci.Blocked = match
+				log := logger(r.id, query, ci).WithField("ip", ip)
 				if r.BlocklistResolver != nil {
 					log.WithField("resolver", r.BlocklistResolver).Debug("blocklist match, forwarding to blocklist-resolver")
 					return r.BlocklistResolver.Resolve(query, ci)
 				}
 				log.Debug("blocking response")
-				return nxdomain(query), nil
+				a := nxdomain(query)
+				setBlockedEDE(query, a, blockedEDEText(r.EDEText, match))
+				return a, nil
 			}
 		}
 	}
@@ -127,7 +214,9 @@ func (r *ResponseBlocklistIP) filterMatch(query, answer *dns.Msg, ci ClientInfo)
 			return r.BlocklistResolver.Resolve(query, ci)
 		}
 		log.Debug("no answers after filtering, blocking response")
-		return nxdomain(query), nil
+		a := nxdomain(query)
+		setBlockedEDE(query, a, "")
+		return a, nil
 	}
 	answer.Ns = r.filterRR(query, ci, answer.Ns)
 	answer.Extra = r.filterRR(query, ci, answer.Extra)
@@ -147,7 +236,7 @@ func (r *ResponseBlocklistIP) filterRR(query *dns.Msg, ci ClientInfo, rrs []dns.
 			newRRs = append(newRRs, rr)
 			continue
 		}
-		if match, ok := r.BlocklistDB.Match(ip); ok {
+		if match, ok := r.match(ip); ok {
 			logger(r.id, query, ci).WithFields(logrus.Fields{"list": match.List, "rule": match.Rule, "ip": ip}).Debug("filtering response")
 			continue
 		}
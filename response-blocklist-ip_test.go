@@ -0,0 +1,56 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseBlocklistIPAllowlist(t *testing.T) {
+	var ci ClientInfo
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			for _, ip := range []string{"1.2.3.4", "1.2.100.1"} {
+				a.Answer = append(a.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   net.ParseIP(ip),
+				})
+			}
+			return a, nil
+		},
+	}
+	blocklistDB, err := NewCidrDB("blocklist", NewStaticLoader([]string{"1.2.0.0/16"}))
+	require.NoError(t, err)
+	allowlistDB, err := NewCidrDB("allowlist", NewStaticLoader([]string{"1.2.3.4/32"}))
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// Without an allowlist, the whole response is blocked
+	b, err := NewResponseBlocklistIP("test-rbl", r, ResponseBlocklistIPOptions{BlocklistDB: blocklistDB})
+	require.NoError(t, err)
+	a, err := b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+
+	// The allowed IP alone doesn't prevent blocking if the other one matches
+	b, err = NewResponseBlocklistIP("test-rbl", r, ResponseBlocklistIPOptions{BlocklistDB: blocklistDB, AllowlistDB: allowlistDB})
+	require.NoError(t, err)
+	a, err = b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+
+	// When filtering, only the allowed IP remains
+	b, err = NewResponseBlocklistIP("test-rbl", r, ResponseBlocklistIPOptions{BlocklistDB: blocklistDB, AllowlistDB: allowlistDB, Filter: true})
+	require.NoError(t, err)
+	a, err = b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, "1.2.3.4", a.Answer[0].(*dns.A).A.String())
+}
@@ -26,16 +26,31 @@ type ResponseBlocklistNameOptions struct {
 
 	// Refresh period for the blocklist. Disabled if 0.
 	BlocklistRefresh time.Duration
+
+	// Optional, names matching the allowlist are never blocked, even if they
+	// are also matched by the blocklist.
+	AllowlistDB BlocklistDB
+
+	// Refresh period for the allowlist. Disabled if 0.
+	AllowlistRefresh time.Duration
+
+	// Include the list and rule that matched as extra text in the extended
+	// DNS error of blocked responses.
+	EDEText bool
 }
 
 // NewResponseBlocklistName returns a new instance of a response blocklist resolver.
 func NewResponseBlocklistName(id string, resolver Resolver, opt ResponseBlocklistNameOptions) (*ResponseBlocklistName, error) {
 	blocklist := &ResponseBlocklistName{id: id, resolver: resolver, ResponseBlocklistNameOptions: opt}
 
-	// Start the refresh goroutines if we have a list and a refresh period was given
-	if blocklist.BlocklistDB != nil && blocklist.BlocklistRefresh > 0 {
+	// Start the refresh goroutines if we have a list. Lists are reloaded if a
+	// refresh period was given, or if they were loaded from a stale copy.
+	if blocklist.BlocklistDB != nil {
 		go blocklist.refreshLoopBlocklist(blocklist.BlocklistRefresh)
 	}
+	if blocklist.AllowlistDB != nil {
+		go blocklist.refreshLoopAllowlist(blocklist.AllowlistRefresh)
+	}
 	return blocklist, nil
 }
 
@@ -55,10 +70,18 @@ func (r *ResponseBlocklistName) String() string {
 
 func (r *ResponseBlocklistName) refreshLoopBlocklist(refresh time.Duration) {
 	for {
-		time.Sleep(refresh)
+		wait, ok := nextRefresh(r.BlocklistDB, refresh)
+		if !ok {
+			return
+		}
+		time.Sleep(wait)
 		log := Log.WithField("id", r.id)
 		log.Debug("reloading blocklist")
 		db, err := r.BlocklistDB.Reload()
+		if err == ErrNotModified {
+			log.Debug("list not modified, keeping current rules")
+			continue
+		}
 		if err != nil {
 			Log.WithError(err).Error("failed to load rules")
 			continue
@@ -69,6 +92,47 @@ func (r *ResponseBlocklistName) refreshLoopBlocklist(refresh time.Duration) {
 	}
 }
 
+func (r *ResponseBlocklistName) refreshLoopAllowlist(refresh time.Duration) {
+	for {
+		wait, ok := nextRefresh(r.AllowlistDB, refresh)
+		if !ok {
+			return
+		}
+		time.Sleep(wait)
+		log := Log.WithField("id", r.id)
+		log.Debug("reloading allowlist")
+		db, err := r.AllowlistDB.Reload()
+		if err == ErrNotModified {
+			log.Debug("list not modified, keeping current rules")
+			continue
+		}
+		if err != nil {
+			Log.WithError(err).Error("failed to load rules")
+			continue
+		}
+		r.mu.Lock()
+		r.AllowlistDB = db
+		r.mu.Unlock()
+	}
+}
+
+// Returns the blocklist match for a name. Names on the allowlist never
+// match, so it's possible to make exceptions for names that are covered by
+// a broader blocklist rule.
+func (r *ResponseBlocklistName) match(name string) (*BlocklistMatch, bool) {
+	r.mu.RLock()
+	blocklistDB, allowlistDB := r.BlocklistDB, r.AllowlistDB
+	r.mu.RUnlock()
+	question := dns.Question{Name: name}
+	if allowlistDB != nil {
+		if _, _, _, ok := allowlistDB.Match(question); ok {
+			return nil, false
+		}
+	}
+	_, _, match, ok := blocklistDB.Match(question)
+	return match, ok
+}
+
 func (r *ResponseBlocklistName) blockIfMatch(query, answer *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	for _, records := range [][]dns.RR{answer.Answer, answer.Ns, answer.Extra} {
 		for _, rr := range records {
@@ -87,14 +151,17 @@ func (r *ResponseBlocklistName) blockIfMatch(query, answer *dns.Msg, ci ClientIn
 			default:
 				continue
 			}
-			if _, _, rule, ok := r.BlocklistDB.Match(dns.Question{Name: name}); ok {
-				log := logger(r.id, query, ci).WithField("rule", rule)
+			if match, ok := r.match(name); ok {
+				ci.Blocked = match
+				log := logger(r.id, query, ci).WithField("name", name)
 				if r.BlocklistResolver != nil {
 					log.WithField("resolver", r.BlocklistResolver).Debug("blocklist match, forwarding to blocklist-resolver")
 					return r.BlocklistResolver.Resolve(query, ci)
 				}
 				log.Debug("blocking response")
-				return nxdomain(query), nil
+				a := nxdomain(query)
+				setBlockedEDE(query, a, blockedEDEText(r.EDEText, match))
+				return a, nil
 			}
 		}
 	}
@@ -0,0 +1,47 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseBlocklistNameAllowlist(t *testing.T) {
+	var ci ClientInfo
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = []dns.RR{&dns.CNAME{
+				Hdr:    dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+				Target: "edge-" + q.Question[0].Name[:len(q.Question[0].Name)-1] + ".cdn.net.",
+			}}
+			return a, nil
+		},
+	}
+	blocklistDB, err := NewDomainDB("blocklist", NewStaticLoader([]string{"*.cdn.net"}))
+	require.NoError(t, err)
+	allowlistDB, err := NewDomainDB("allowlist", NewStaticLoader([]string{"edge-good.com.cdn.net"}))
+	require.NoError(t, err)
+
+	b, err := NewResponseBlocklistName("test-rbl", r, ResponseBlocklistNameOptions{
+		BlocklistDB: blocklistDB,
+		AllowlistDB: allowlistDB,
+	})
+	require.NoError(t, err)
+
+	// CNAME to a blocked name
+	q := new(dns.Msg)
+	q.SetQuestion("bad.com.", dns.TypeA)
+	a, err := b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+
+	// CNAME to a name that's covered by the blocklist, but allowed
+	q.SetQuestion("good.com.", dns.TypeA)
+	a, err = b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Len(t, a.Answer, 1)
+}
@@ -0,0 +1,161 @@
+package rdns
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ResponseNormalize is a resolver that cleans up responses from upstream
+// resolvers. It removes duplicate records, sets the TTL of all records in an
+// RRset to the lowest TTL in the set, and sorts the records of each RRset
+// in canonical order (RFC 4034, section 6.3).
+type ResponseNormalize struct {
+	id       string
+	resolver Resolver
+}
+
+var _ Resolver = &ResponseNormalize{}
+
+// NewResponseNormalize returns a new instance of a response normalizer.
+func NewResponseNormalize(id string, resolver Resolver) *ResponseNormalize {
+	return &ResponseNormalize{id: id, resolver: resolver}
+}
+
+// Resolve a DNS query with the upstream resolver and normalize the records
+// in the response.
+func (r *ResponseNormalize) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	answer, err := r.resolver.Resolve(q, ci)
+	if err != nil || answer == nil {
+		return answer, err
+	}
+	var modified bool
+	answer.Answer, modified = normalizeRRs(answer.Answer)
+	if ns, ok := normalizeRRs(answer.Ns); ok {
+		answer.Ns = ns
+		modified = true
+	}
+	if extra, ok := normalizeRRs(answer.Extra); ok {
+		answer.Extra = extra
+		modified = true
+	}
+	if modified {
+		logger(r.id, q, ci).Debug("normalized response")
+	}
+	return answer, nil
+}
+
+func (r *ResponseNormalize) String() string {
+	return r.id
+}
+
+type rrsetKey struct {
+	name    string
+	class   uint16
+	typ     uint16
+	covered uint16 // Type covered by RRSIGs, their TTL follows that of the covered set
+}
+
+// Groups the records into RRsets, keeping the order in which the sets first
+// appear in the list. Duplicates are removed, TTLs are set to the lowest value
+// in the set and records are sorted by their RDATA. OPT records are left where
+// they are. Returns true if anything changed.
+func normalizeRRs(rrs []dns.RR) ([]dns.RR, bool) {
+	if len(rrs) < 2 {
+		return rrs, false
+	}
+	var (
+		keys     []rrsetKey
+		sets     = make(map[rrsetKey][]dns.RR)
+		opt      []dns.RR
+		modified bool
+	)
+	for _, rr := range rrs {
+		if _, ok := rr.(*dns.OPT); ok {
+			opt = append(opt, rr)
+			continue
+		}
+		h := rr.Header()
+		key := rrsetKey{name: strings.ToLower(h.Name), class: h.Class, typ: h.Rrtype}
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			key.covered = sig.TypeCovered
+		}
+		set, ok := sets[key]
+		if !ok {
+			keys = append(keys, key)
+		}
+		var duplicate bool
+		for _, existing := range set {
+			if dns.IsDuplicate(existing, rr) {
+				duplicate = true
+				break
+			}
+		}
+		if duplicate {
+			// Keep the lower TTL of the two
+			if first := set[0].Header(); h.Ttl < first.Ttl {
+				first.Ttl = h.Ttl
+			}
+			modified = true
+			continue
+		}
+		sets[key] = append(set, rr)
+	}
+
+	out := make([]dns.RR, 0, len(rrs))
+	for _, key := range keys {
+		set := sets[key]
+
+		// Use the lowest TTL for all records in the set
+		min := set[0].Header().Ttl
+		for _, rr := range set {
+			if rr.Header().Ttl < min {
+				min = rr.Header().Ttl
+			}
+		}
+		for _, rr := range set {
+			if rr.Header().Ttl != min {
+				rr.Header().Ttl = min
+				modified = true
+			}
+		}
+
+		// Sort the records by their RDATA in wire format
+		sorted := sort.SliceIsSorted(set, func(i, j int) bool {
+			return bytes.Compare(rdataWire(set[i]), rdataWire(set[j])) < 0
+		})
+		if !sorted {
+			sort.SliceStable(set, func(i, j int) bool {
+				return bytes.Compare(rdataWire(set[i]), rdataWire(set[j])) < 0
+			})
+			modified = true
+		}
+		out = append(out, set...)
+	}
+	out = append(out, opt...)
+	if !modified {
+		return rrs, false
+	}
+	return out, true
+}
+
+// Returns the RDATA of a record in uncompressed wire format.
+func rdataWire(rr dns.RR) []byte {
+	buf := make([]byte, dns.Len(rr)+1)
+	off, err := dns.PackRR(rr, buf, 0, nil, false)
+	if err != nil {
+		return nil
+	}
+	nameLen, err := dns.PackDomainName(rr.Header().Name, make([]byte, 256), 0, nil, false)
+	if err != nil {
+		return nil
+	}
+	// The RDATA follows the name and 10 bytes of type, class, TTL and length
+	start := nameLen + 10
+	if start > off {
+		return nil
+	}
+	return buf[start:off]
+}
@@ -0,0 +1,61 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseNormalize(t *testing.T) {
+	var ci ClientInfo
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			for _, s := range []string{
+				"www.example.com. 300 IN CNAME example.com.",
+				"example.com. 60 IN A 192.0.2.2",
+				"example.com. 120 IN A 192.0.2.1",
+				"EXAMPLE.com. 30 IN A 192.0.2.2",
+			} {
+				rr, err := dns.NewRR(s)
+				require.NoError(t, err)
+				a.Answer = append(a.Answer, rr)
+			}
+			return a, nil
+		},
+	}
+	g := NewResponseNormalize("test-normalize", r)
+
+	q := new(dns.Msg)
+	q.SetQuestion("www.example.com.", dns.TypeA)
+	a, err := g.Resolve(q, ci)
+	require.NoError(t, err)
+
+	// Duplicate removed, CNAME still first, A records sorted with lowest TTL
+	require.Len(t, a.Answer, 3)
+	require.Equal(t, dns.TypeCNAME, a.Answer[0].Header().Rrtype)
+	require.Equal(t, "192.0.2.1", a.Answer[1].(*dns.A).A.String())
+	require.Equal(t, "192.0.2.2", a.Answer[2].(*dns.A).A.String())
+	require.Equal(t, uint32(30), a.Answer[1].Header().Ttl)
+	require.Equal(t, uint32(30), a.Answer[2].Header().Ttl)
+}
+
+func TestResponseNormalizeRRSIG(t *testing.T) {
+	var rrs []dns.RR
+	for _, s := range []string{
+		"example.com. 300 IN RRSIG A 13 2 300 20300101000000 20200101000000 12345 example.com. c2ln",
+		"example.com. 60 IN RRSIG AAAA 13 2 60 20300101000000 20200101000000 12345 example.com. c2ln",
+	} {
+		rr, err := dns.NewRR(s)
+		require.NoError(t, err)
+		rrs = append(rrs, rr)
+	}
+
+	// Signatures of different types are separate sets, with their own TTL
+	out, modified := normalizeRRs(rrs)
+	require.False(t, modified)
+	require.Equal(t, uint32(300), out[0].Header().Ttl)
+	require.Equal(t, uint32(60), out[1].Header().Ttl)
+}
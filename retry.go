@@ -0,0 +1,103 @@
+package rdns
+
+import (
+	"expvar"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Retry is a resolver that repeats failed queries on the same resolver,
+// waiting in between attempts. Only errors, like timeouts, are retried.
+// Responses are returned as they are, including SERVFAIL.
+type Retry struct {
+	id       string
+	resolver Resolver
+	opt      RetryOptions
+	retries  *expvar.Int
+}
+
+var _ Resolver = &Retry{}
+
+// RetryOptions contain settings for retrying failed queries.
+type RetryOptions struct {
+	// Number of times a failed query is repeated.
+	Retries int
+
+	// Time to wait before the first retry. Default 100ms.
+	Backoff time.Duration
+
+	// How the wait time changes between retries.
+	BackoffStrategy BackoffStrategy
+
+	// Upper limit for the wait time with exponential backoff. Not limited if 0.
+	BackoffMax time.Duration
+}
+
+// BackoffStrategy defines how the wait time changes between retries.
+type BackoffStrategy int
+
+const (
+	BackoffConstant    BackoffStrategy = iota // Wait the same time between all retries
+	BackoffExponential                        // Double the wait time after every retry
+)
+
+// ParseBackoffStrategy returns the backoff strategy for its string form,
+// "constant" or "exponential". An empty string returns the default.
+func ParseBackoffStrategy(s string) (BackoffStrategy, error) {
+	switch strings.ToLower(s) {
+	case "", "constant":
+		return BackoffConstant, nil
+	case "exponential":
+		return BackoffExponential, nil
+	default:
+		return 0, fmt.Errorf("unsupported backoff strategy '%s'", s)
+	}
+}
+
+// NewRetry returns a resolver that retries failed queries.
+func NewRetry(id string, resolver Resolver, opt RetryOptions) *Retry {
+	if opt.Backoff == 0 {
+		opt.Backoff = 100 * time.Millisecond
+	}
+	return &Retry{
+		id:       id,
+		resolver: resolver,
+		opt:      opt,
+		retries:  getVarInt("client", id, "retry"),
+	}
+}
+
+// Resolve a DNS query, retrying it if the resolver fails. Stops retrying once
+// the context of the query is done.
+func (r *Retry) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	wait := r.opt.Backoff
+	done := ci.ctx().Done()
+	for i := 0; ; i++ {
+		a, err := r.resolver.Resolve(q, ci)
+		if err == nil || i >= r.opt.Retries {
+			return a, err
+		}
+		logger(r.id, q, ci).WithError(err).WithField("wait", wait).Debug("query failed, retrying")
+		r.retries.Add(1)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-done:
+			timer.Stop()
+			return nil, ci.ctx().Err()
+		}
+		if r.opt.BackoffStrategy == BackoffExponential {
+			wait *= 2
+			if r.opt.BackoffMax > 0 && wait > r.opt.BackoffMax {
+				wait = r.opt.BackoffMax
+			}
+		}
+	}
+}
+
+func (r *Retry) String() string {
+	return r.id
+}
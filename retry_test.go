@@ -0,0 +1,62 @@
+package rdns
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetry(t *testing.T) {
+	var ci ClientInfo
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// Upstream that fails the first two queries
+	var calls int
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			calls++
+			if calls <= 2 {
+				return nil, errors.New("timeout")
+			}
+			return q, nil
+		},
+	}
+	r := NewRetry("test-retry", upstream, RetryOptions{
+		Retries:         3,
+		Backoff:         10 * time.Millisecond,
+		BackoffStrategy: BackoffExponential,
+	})
+	a, err := r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.NotNil(t, a)
+	require.Equal(t, 3, upstream.HitCount())
+
+	// Give up once the retries are exhausted
+	upstream = new(TestResolver)
+	upstream.SetFail(true)
+	r = NewRetry("test-retry-fail", upstream, RetryOptions{
+		Retries: 2,
+		Backoff: time.Millisecond,
+	})
+	_, err = r.Resolve(q, ci)
+	require.Error(t, err)
+	require.Equal(t, 3, upstream.HitCount())
+
+	// No more retries once the context of the query is done
+	upstream = new(TestResolver)
+	upstream.SetFail(true)
+	r = NewRetry("test-retry-ctx", upstream, RetryOptions{
+		Retries: 2,
+		Backoff: time.Hour,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = r.Resolve(q, ClientInfo{Context: ctx})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Equal(t, 1, upstream.HitCount())
+}
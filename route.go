@@ -1,10 +1,13 @@
 package rdns
 
 import (
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"net"
 	"regexp"
+	"regexp/syntax"
 	"strconv"
 	"strings"
 	"time"
@@ -22,6 +25,13 @@ type route struct {
 	after    *TimeOfDay
 	inverted bool // invert the matching behavior
 	dohPath  *regexp.Regexp
+	listener *regexp.Regexp
+	tlsName  *regexp.Regexp
+	domains  domainSet // matching the domains and their sub-domains
+	cache    string    // "hit" or "miss", as determined by a cache-probe
+	auth     string    // "authenticated" or "anonymous" client
+	percent  *float64  // share of clients, by hash of their address, all if nil
+	salt     string    // mixed into the client hash to select different clients
 	resolver Resolver
 }
 
@@ -89,12 +99,30 @@ func (r *route) match(q *dns.Msg, ci ClientInfo) bool {
 	if !r.name.MatchString(question.Name) {
 		return r.inverted
 	}
+	if len(r.domains) > 0 && !r.domains.match(question.Name) {
+		return r.inverted
+	}
 	if r.source != nil && !r.source.Contains(ci.SourceIP) {
 		return r.inverted
 	}
 	if !r.dohPath.MatchString(ci.DoHPath) {
 		return r.inverted
 	}
+	if r.listener != nil && !r.listener.MatchString(ci.Listener) {
+		return r.inverted
+	}
+	if r.tlsName != nil && !r.matchTLSName(ci.TLSClientCert) {
+		return r.inverted
+	}
+	if r.cache != "" && r.cache != ci.CacheState {
+		return r.inverted
+	}
+	if r.auth != "" && r.auth != clientAuth(ci) {
+		return r.inverted
+	}
+	if r.percent != nil && !r.matchClientPercent(ci.SourceIP) {
+		return r.inverted
+	}
 	if len(r.weekdays) > 0 || r.before != nil || r.after != nil {
 		now := time.Now().Local()
 		hour := now.Hour()
@@ -122,10 +150,94 @@ func (r *route) match(q *dns.Msg, ci ClientInfo) bool {
 	return !r.inverted
 }
 
+// Returns true if the route matches by properties of the client, so different
+// clients can get different responses for the same query.
+func (r *route) clientSpecific() bool {
+	return r.source != nil || r.tlsName != nil || r.auth != "" || r.percent != nil
+}
+
 func (r *route) Invert(value bool) {
 	r.inverted = value
 }
 
+// SetDomains limits the route to queries for names in the given domains or
+// any of their sub-domains. Unlike the name expression, domains are indexed
+// by the router, so routes with large numbers of domains, or large numbers
+// of routes, don't slow down queries.
+func (r *route) SetDomains(domains []string) {
+	r.domains = newDomainSet(domains)
+}
+
+// SetListener limits the route to queries received by listeners with an ID
+// matching the expression.
+func (r *route) SetListener(expr string) error {
+	if expr == "" {
+		r.listener = nil
+		return nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return err
+	}
+	r.listener = re
+	return nil
+}
+
+// SetTLSClientName limits the route to clients that presented a TLS
+// certificate with a common name or subject alternative name matching the
+// expression.
+func (r *route) SetTLSClientName(expr string) error {
+	if expr == "" {
+		r.tlsName = nil
+		return nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return err
+	}
+	r.tlsName = re
+	return nil
+}
+
+// SetCacheState limits the route to queries that would be a cache "hit" or
+// "miss". The state needs to be set by a cache-probe element before the router.
+func (r *route) SetCacheState(state string) error {
+	switch state {
+	case "hit", "miss", "":
+	default:
+		return fmt.Errorf("invalid cache state '%s', must be 'hit' or 'miss'", state)
+	}
+	r.cache = state
+	return nil
+}
+
+// SetClientAuth limits the route to queries from "authenticated" clients that
+// presented a verified certificate to a mutual TLS listener, or "anonymous"
+// clients that didn't.
+func (r *route) SetClientAuth(auth string) error {
+	switch auth {
+	case "authenticated", "anonymous", "":
+	default:
+		return fmt.Errorf("invalid client auth '%s', must be 'authenticated' or 'anonymous'", auth)
+	}
+	r.auth = auth
+	return nil
+}
+
+// SetClientPercent limits the route to a percentage of the clients, selected
+// by a hash of their address. A client always gets the same result, so a
+// change in the pipeline can be rolled out to a growing share of clients. The
+// salt changes which clients are selected for the same percentage. With 0, no
+// clients match.
+func (r *route) SetClientPercent(percent float64, salt string) error {
+	if percent < 0 || percent > 100 {
+		return fmt.Errorf("invalid client percent %v, must be between 0 and 100", percent)
+	}
+	r.percent = &percent
+	r.salt = salt
+	return nil
+}
+
 func (r *route) String() string {
 	if r.isDefault() {
 		return "(default)"
@@ -151,6 +263,24 @@ func (r *route) String() string {
 	if r.dohPath.String() != "" {
 		fragments = append(fragments, "doh-path="+r.dohPath.String())
 	}
+	if len(r.domains) > 0 {
+		fragments = append(fragments, fmt.Sprintf("domains=%d", len(r.domains)))
+	}
+	if r.listener != nil {
+		fragments = append(fragments, "listener="+r.listener.String())
+	}
+	if r.tlsName != nil {
+		fragments = append(fragments, "tls-client-name="+r.tlsName.String())
+	}
+	if r.cache != "" {
+		fragments = append(fragments, "cache-state="+r.cache)
+	}
+	if r.auth != "" {
+		fragments = append(fragments, "client-auth="+r.auth)
+	}
+	if r.percent != nil {
+		fragments = append(fragments, fmt.Sprintf("client-percent=%v", *r.percent))
+	}
 	if len(r.weekdays) > 0 {
 		fragments = append(fragments, fmt.Sprintf("weekdays=%v", r.weekdays))
 	}
@@ -166,8 +296,123 @@ func (r *route) String() string {
 	return "(" + strings.Join(fragments, ",") + ")"
 }
 
+// Returns true if the route has no conditions and matches all queries.
 func (r *route) isDefault() bool {
-	return r.class == 0 && len(r.types) == 0 && r.name.String() == ""
+	return r.class == 0 && len(r.types) == 0 && r.name.String() == "" && len(r.domains) == 0 &&
+		r.source == nil && len(r.weekdays) == 0 && r.before == nil && r.after == nil &&
+		r.dohPath.String() == "" && r.listener == nil && r.tlsName == nil &&
+		r.cache == "" && r.auth == "" && r.percent == nil && !r.inverted
+}
+
+// Returns the domain that all names matching the name expression belong to,
+// for expressions ending in a literal domain like `\.example\.com\.$` or
+// `(^|\.)example\.com\.$`, or an empty string if there's no such domain.
+func (r *route) nameDomain() string {
+	re, err := syntax.Parse(r.name.String(), syntax.Perl)
+	if err != nil {
+		return ""
+	}
+	re = re.Simplify()
+	if re.Op != syntax.OpConcat || len(re.Sub) < 2 || re.Sub[len(re.Sub)-1].Op != syntax.OpEndText {
+		return ""
+	}
+	// Collect the literal ahead of the end of the name
+	var suffix string
+	i := len(re.Sub) - 2
+	for ; i >= 0 && re.Sub[i].Op == syntax.OpLiteral; i-- {
+		suffix = string(re.Sub[i].Rune) + suffix
+	}
+	suffix = strings.ToLower(suffix)
+	if !strings.HasSuffix(suffix, ".") {
+		return ""
+	}
+	labels := strings.Split(strings.TrimSuffix(suffix, "."), ".")
+
+	// The first label is only complete if it's preceded by the start of the
+	// name or a dot, otherwise it could be the end of a longer label.
+	if i < 0 || !labelBoundary(re.Sub[i]) {
+		labels = labels[1:]
+	}
+	if len(labels) > 0 && labels[0] == "" {
+		labels = labels[1:]
+	}
+	if len(labels) == 0 {
+		return ""
+	}
+	return strings.Join(labels, ".") + "."
+}
+
+// Returns true if the expression always ends at the start of a name, or
+// with a dot.
+func labelBoundary(re *syntax.Regexp) bool {
+	switch re.Op {
+	case syntax.OpBeginText:
+		return true
+	case syntax.OpLiteral:
+		return len(re.Rune) > 0 && re.Rune[len(re.Rune)-1] == '.'
+	case syntax.OpCapture:
+		return labelBoundary(re.Sub[0])
+	case syntax.OpAlternate:
+		for _, sub := range re.Sub {
+			if !labelBoundary(sub) {
+				return false
+			}
+		}
+		return true
+	case syntax.OpConcat:
+		return len(re.Sub) > 0 && labelBoundary(re.Sub[len(re.Sub)-1])
+	}
+	return false
+}
+
+// Returns "authenticated" if the client presented a certificate, "anonymous"
+// otherwise. Listeners only accept verified certificates.
+func clientAuth(ci ClientInfo) string {
+	if ci.TLSClientCert != nil {
+		return "authenticated"
+	}
+	return "anonymous"
+}
+
+// Returns true if the client falls into the percentage of the route. The hash
+// of the address is scaled to 0-100, which allows fractions of a percent.
+// Clients without address never match.
+func (r *route) matchClientPercent(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	h := fnv.New32a()
+	h.Write([]byte(r.salt))
+	h.Write(ip.To16())
+	return float64(h.Sum32())/(1<<32)*100 < *r.percent
+}
+
+// Returns true if the common name or any of the DNS, email or URI subject
+// alternative names in the certificate match. Never matches without a
+// certificate.
+func (r *route) matchTLSName(cert *x509.Certificate) bool {
+	if cert == nil {
+		return false
+	}
+	if r.tlsName.MatchString(cert.Subject.CommonName) {
+		return true
+	}
+	for _, name := range cert.DNSNames {
+		if r.tlsName.MatchString(name) {
+			return true
+		}
+	}
+	for _, email := range cert.EmailAddresses {
+		if r.tlsName.MatchString(email) {
+			return true
+		}
+	}
+	for _, uri := range cert.URIs {
+		if r.tlsName.MatchString(uri.String()) {
+			return true
+		}
+	}
+	return false
 }
 
 func (r *route) matchType(typ uint16) bool {
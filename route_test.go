@@ -1,6 +1,9 @@
 package rdns
 
 import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
 	"testing"
 
 	"github.com/miekg/dns"
@@ -91,3 +94,123 @@ func TestRoute(t *testing.T) {
 		require.Equal(t, test.match, match)
 	}
 }
+
+func TestRouteClient(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	cert := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "client"},
+		DNSNames: []string{"kids-tablet.home.example.com"},
+	}
+
+	tests := []struct {
+		listener, tlsName string
+		ci                ClientInfo
+		match             bool
+	}{
+		{listener: "^local-udp$", ci: ClientInfo{Listener: "local-udp"}, match: true},
+		{listener: "^local-udp$", ci: ClientInfo{Listener: "local-tcp"}, match: false},
+		{tlsName: "^client$", ci: ClientInfo{TLSClientCert: cert}, match: true},
+		{tlsName: `^kids-.*\.example\.com$`, ci: ClientInfo{TLSClientCert: cert}, match: true},
+		{tlsName: "^other$", ci: ClientInfo{TLSClientCert: cert}, match: false},
+		{tlsName: ".*", ci: ClientInfo{}, match: false},
+	}
+	for _, test := range tests {
+		r, err := NewRoute("", "", nil, nil, "", "", "", "", &TestResolver{})
+		require.NoError(t, err)
+		require.NoError(t, r.SetListener(test.listener))
+		require.NoError(t, r.SetTLSClientName(test.tlsName))
+		require.Equal(t, test.match, r.match(q, test.ci))
+	}
+}
+
+func TestRouteNameDomain(t *testing.T) {
+	tests := []struct {
+		name   string
+		domain string
+	}{
+		{`\.acme\.test\.$`, "acme.test."},
+		{`(^|\.)acme\.test\.$`, "acme.test."},
+		{`^www\.acme\.test\.$`, "www.acme.test."},
+		{`(?i)\.ACME\.test\.$`, "acme.test."},
+		{`.*\.acme\.test\.$`, "acme.test."},
+		{`acme\.test\.$`, "test."},
+		{`^(www|mail)\.acme\.test\.$`, "acme.test."},
+		{`^www[0-9]\.acme\.test\.$`, "acme.test."},
+		{`test\.$`, ""},
+		{`\.acme\.test$`, ""},
+		{`\.acme\.test\..*`, ""},
+		{`(?m)\.acme\.test\.$`, ""},
+		{`\.acme\.test\.$|\.other\.$`, ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		r, err := NewRoute(test.name, "", nil, nil, "", "", "", "", &TestResolver{})
+		require.NoError(t, err)
+		require.Equal(t, test.domain, r.nameDomain(), test.name)
+	}
+}
+
+func TestRouteClientAuth(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	authenticated := ClientInfo{TLSClientCert: &x509.Certificate{Subject: pkix.Name{CommonName: "client"}}}
+	anonymous := ClientInfo{Listener: "local-udp"}
+
+	r, err := NewRoute("", "", nil, nil, "", "", "", "", &TestResolver{})
+	require.NoError(t, err)
+	require.NoError(t, r.SetClientAuth("authenticated"))
+	require.True(t, r.match(q, authenticated))
+	require.False(t, r.match(q, anonymous))
+
+	require.NoError(t, r.SetClientAuth("anonymous"))
+	require.False(t, r.match(q, authenticated))
+	require.True(t, r.match(q, anonymous))
+
+	require.Error(t, r.SetClientAuth("other"))
+}
+
+func TestRouteClientPercent(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	r, err := NewRoute("", "", nil, nil, "", "", "", "", &TestResolver{})
+	require.NoError(t, err)
+
+	// Returns the clients out of 1000 that match the route
+	matching := func() map[int]bool {
+		m := make(map[int]bool)
+		for i := 0; i < 1000; i++ {
+			ci := ClientInfo{SourceIP: net.IPv4(10, 0, byte(i>>8), byte(i))}
+			if r.match(q, ci) {
+				m[i] = true
+			}
+		}
+		return m
+	}
+
+	require.NoError(t, r.SetClientPercent(20, ""))
+	twenty := matching()
+	require.InDelta(t, 200, len(twenty), 50)
+	require.Equal(t, twenty, matching())
+
+	// Raising the percentage keeps the clients that matched before
+	require.NoError(t, r.SetClientPercent(50, ""))
+	fifty := matching()
+	require.InDelta(t, 500, len(fifty), 50)
+	for i := range twenty {
+		require.True(t, fifty[i])
+	}
+
+	// A different salt selects different clients
+	require.NoError(t, r.SetClientPercent(50, "other"))
+	require.NotEqual(t, fifty, matching())
+
+	// Clients without address don't match
+	require.False(t, r.match(q, ClientInfo{}))
+
+	// 0% matches no clients
+	require.NoError(t, r.SetClientPercent(0, ""))
+	require.Empty(t, matching())
+
+	require.Error(t, r.SetClientPercent(101, ""))
+}
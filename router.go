@@ -4,6 +4,8 @@ import (
 	"errors"
 	"expvar"
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
@@ -13,11 +15,50 @@ import (
 type Router struct {
 	id      string
 	routes  []*route
+	linear  []int      // Indexes of routes that need to be evaluated for every query
+	domains *routeTrie // Indexes of routes that only apply to some domains
+	opt     RouterOptions
 	metrics *RouterMetrics
 }
 
 var _ Resolver = &Router{}
 
+// RouterOptions contain settings for a router.
+type RouterOptions struct {
+	// Response to queries that don't match any of the routes. By default
+	// an error is returned which causes listeners to respond with SERVFAIL.
+	NoMatch RouterNoMatch
+}
+
+// RouterNoMatch defines how a router responds to queries that don't match
+// any of its routes.
+type RouterNoMatch int
+
+const (
+	NoMatchError RouterNoMatch = iota
+	NoMatchRefused
+	NoMatchNXDOMAIN
+	NoMatchDrop
+)
+
+// ParseRouterNoMatch returns the no-match behavior for its string form,
+// "error", "refused", "nxdomain" or "drop". An empty string returns the
+// default.
+func ParseRouterNoMatch(s string) (RouterNoMatch, error) {
+	switch strings.ToLower(s) {
+	case "", "error":
+		return NoMatchError, nil
+	case "refused":
+		return NoMatchRefused, nil
+	case "nxdomain":
+		return NoMatchNXDOMAIN, nil
+	case "drop":
+		return NoMatchDrop, nil
+	default:
+		return 0, fmt.Errorf("unsupported no-match behavior '%s'", s)
+	}
+}
+
 type RouterMetrics struct {
 	// Next route counts.
 	route *expvar.Map
@@ -25,6 +66,8 @@ type RouterMetrics struct {
 	failure *expvar.Map
 	// Count of available routes.
 	available *expvar.Int
+	// Count of queries that didn't match any route.
+	noMatch *expvar.Int
 }
 
 func NewRouterMetrics(id string, available int) *RouterMetrics {
@@ -34,14 +77,23 @@ func NewRouterMetrics(id string, available int) *RouterMetrics {
 		route:     getVarMap("router", id, "route"),
 		failure:   getVarMap("router", id, "failure"),
 		available: avail,
+		noMatch:   getVarInt("router", id, "nomatch"),
 	}
 }
 
 // NewRouter returns a new router instance. The router won't have any routes and can only be used
 // once Add() is called to setup a route.
 func NewRouter(id string) *Router {
+	return NewRouterWithOptions(id, RouterOptions{})
+}
+
+// NewRouterWithOptions returns a new router instance like NewRouter, with
+// options such as the response to queries that don't match any route.
+func NewRouterWithOptions(id string, opt RouterOptions) *Router {
 	return &Router{
 		id:      id,
+		domains: new(routeTrie),
+		opt:     opt,
 		metrics: NewRouterMetrics(id, 0),
 	}
 }
@@ -53,7 +105,11 @@ func (r *Router) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	}
 	question := q.Question[0]
 	log := logger(r.id, q, ci)
-	for _, route := range r.routes {
+	for _, i := range r.candidates(question.Name) {
+		route := r.routes[i]
+		if route.clientSpecific() {
+			ci.recordClientSpecific()
+		}
 		if !route.match(q, ci) {
 			continue
 		}
@@ -68,6 +124,18 @@ func (r *Router) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 		}
 		return a, err
 	}
+	r.metrics.noMatch.Add(1)
+	switch r.opt.NoMatch {
+	case NoMatchRefused:
+		log.Debug("no matching route, refusing query")
+		return refused(q), nil
+	case NoMatchNXDOMAIN:
+		log.Debug("no matching route, responding with nxdomain")
+		return nxdomain(q), nil
+	case NoMatchDrop:
+		log.Debug("no matching route, dropping query")
+		return nil, nil
+	}
 	return nil, fmt.Errorf("no route for %s", question.String())
 }
 
@@ -76,12 +144,116 @@ func (r *Router) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 // route (no name, no type) should be added last since subsequently added
 // routes won't have any impact. Name is a regular expression that is
 // applied to the name in the first question section of the DNS message.
-// Source is an IP or network in CIDR format.
+// Source is an IP or network in CIDR format. Routes with domains, or with a
+// name expression that ends in a literal domain, are indexed and only
+// evaluated for queries in those domains.
 func (r *Router) Add(routes ...*route) {
-	r.routes = append(r.routes, routes...)
+	for _, route := range routes {
+		i := len(r.routes)
+		r.routes = append(r.routes, route)
+		switch {
+		case route.inverted:
+			r.linear = append(r.linear, i)
+		case len(route.domains) > 0:
+			for domain := range route.domains {
+				r.domains.add(domain, i)
+			}
+		case route.nameDomain() != "":
+			r.domains.add(route.nameDomain(), i)
+		default:
+			r.linear = append(r.linear, i)
+		}
+	}
 	r.metrics.available.Add(1)
 }
 
+// Returns the indexes of the routes that could match a query name, in the
+// order they were added. Routes limited to domains are looked up in the
+// index, all others are always included.
+func (r *Router) candidates(name string) []int {
+	indexed := r.domains.lookup(name)
+	if len(indexed) == 0 {
+		return r.linear
+	}
+	candidates := make([]int, 0, len(r.linear)+len(indexed))
+	candidates = append(candidates, r.linear...)
+	candidates = append(candidates, indexed...)
+	sort.Ints(candidates)
+
+	// A route can be indexed under a domain as well as its sub-domain
+	unique := candidates[:1]
+	for _, i := range candidates[1:] {
+		if i != unique[len(unique)-1] {
+			unique = append(unique, i)
+		}
+	}
+	return unique
+}
+
+// HasDefaultRoute returns true if the router has a route without any
+// conditions that matches all queries.
+func (r *Router) HasDefaultRoute() bool {
+	for _, route := range r.routes {
+		if route.isDefault() {
+			return true
+		}
+	}
+	return false
+}
+
 func (r *Router) String() string {
 	return r.id
 }
+
+// Tree of domain labels, starting at the TLD, with the indexes of the routes
+// that apply to each domain and its sub-domains.
+type routeTrie struct {
+	routes   []int
+	children map[string]*routeTrie
+}
+
+// Adds a route index for a domain. The domain needs to be a lowercase FQDN.
+func (t *routeTrie) add(domain string, i int) {
+	n := t
+	for _, label := range reverseLabels(domain) {
+		child, ok := n.children[label]
+		if !ok {
+			if n.children == nil {
+				n.children = make(map[string]*routeTrie)
+			}
+			child = new(routeTrie)
+			n.children[label] = child
+		}
+		n = child
+	}
+	n.routes = append(n.routes, i)
+}
+
+// Returns the indexes of all routes for domains that contain the name.
+func (t *routeTrie) lookup(name string) []int {
+	var routes []int
+	n := t
+	routes = append(routes, n.routes...)
+	for _, label := range reverseLabels(strings.ToLower(name)) {
+		child, ok := n.children[label]
+		if !ok {
+			break
+		}
+		n = child
+		routes = append(routes, n.routes...)
+	}
+	return routes
+}
+
+// Returns the labels of a domain name, starting with the TLD.
+func reverseLabels(name string) []string {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return nil
+	}
+	labels := strings.Split(name, ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return labels
+}
@@ -1,6 +1,7 @@
 package rdns
 
 import (
+	"fmt"
 	"net"
 	"testing"
 
@@ -114,3 +115,132 @@ func TestRouterSource(t *testing.T) {
 	require.Equal(t, 1, r1.HitCount())
 	require.Equal(t, 1, r2.HitCount())
 }
+
+func TestRouterNoMatch(t *testing.T) {
+	r1 := new(TestResolver)
+	q := new(dns.Msg)
+	var ci ClientInfo
+
+	route1, _ := NewRoute(`\.acme\.test\.$`, "", nil, nil, "", "", "", "", r1)
+
+	// By default, queries without matching route fail
+	router := NewRouter("my-router")
+	router.Add(route1)
+	require.False(t, router.HasDefaultRoute())
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err := router.Resolve(q, ci)
+	require.Error(t, err)
+
+	// Respond with REFUSED
+	router = NewRouterWithOptions("my-router", RouterOptions{NoMatch: NoMatchRefused})
+	router.Add(route1)
+	a, err := router.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeRefused, a.Rcode)
+
+	// Drop the query
+	router = NewRouterWithOptions("my-router", RouterOptions{NoMatch: NoMatchDrop})
+	router.Add(route1)
+	a, err = router.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Nil(t, a)
+	require.Equal(t, 0, r1.HitCount())
+
+	// A route with a source condition is not a default route
+	route2, _ := NewRoute("", "", nil, nil, "", "", "192.168.1.0/24", "", r1)
+	router.Add(route2)
+	require.False(t, router.HasDefaultRoute())
+	route3, _ := NewRoute("", "", nil, nil, "", "", "", "", r1)
+	router.Add(route3)
+	require.True(t, router.HasDefaultRoute())
+}
+
+func TestRouterDomains(t *testing.T) {
+	r1 := new(TestResolver)
+	r2 := new(TestResolver)
+	r3 := new(TestResolver)
+	r4 := new(TestResolver)
+	q := new(dns.Msg)
+	var ci ClientInfo
+
+	// Lots of indexed routes, mixed with regular ones
+	router := NewRouter("my-router")
+	for i := 0; i < 1000; i++ {
+		route, _ := NewRoute("", "", nil, nil, "", "", "", "", r4)
+		route.SetDomains([]string{fmt.Sprintf("domain%d.test", i)})
+		router.Add(route)
+	}
+	route1, _ := NewRoute("", "", []string{"MX"}, nil, "", "", "", "", r1)
+	route1.SetDomains([]string{"acme.test", "sub.acme.test"})
+	route2, _ := NewRoute(`^www\.`, "", nil, nil, "", "", "", "", r2)
+	route3, _ := NewRoute("", "", nil, nil, "", "", "", "", r3)
+	route3.SetDomains([]string{"ACME.test."})
+	route4, _ := NewRoute("", "", nil, nil, "", "", "", "", r4)
+	router.Add(route1, route2, route3, route4)
+
+	tests := []struct {
+		name     string
+		qtype    uint16
+		expected *TestResolver
+	}{
+		{"domain500.test.", dns.TypeA, r4},
+		{"x.domain500.test.", dns.TypeA, r4},
+		{"acme.test.", dns.TypeMX, r1},
+		{"a.sub.ACME.test.", dns.TypeMX, r1},
+		{"www.acme.test.", dns.TypeA, r2},
+		{"mail.acme.test.", dns.TypeA, r3},
+		{"acme.test.", dns.TypeA, r3},
+		{"xacme.test.", dns.TypeA, r4},
+	}
+	for _, test := range tests {
+		before := test.expected.HitCount()
+		q.SetQuestion(test.name, test.qtype)
+		_, err := router.Resolve(q, ci)
+		require.NoError(t, err)
+		require.Equal(t, before+1, test.expected.HitCount(), test.name)
+	}
+}
+
+func TestRouterNameIndex(t *testing.T) {
+	r1 := new(TestResolver)
+	r2 := new(TestResolver)
+	r3 := new(TestResolver)
+	q := new(dns.Msg)
+	var ci ClientInfo
+
+	// Routes with a name ending in a literal domain are indexed
+	router := NewRouter("my-router")
+	for i := 0; i < 1000; i++ {
+		route, _ := NewRoute(fmt.Sprintf(`(^|\.)domain%d\.test\.$`, i), "", nil, nil, "", "", "", "", r3)
+		router.Add(route)
+	}
+	route1, _ := NewRoute(`^www\.acme\.test\.$`, "", nil, nil, "", "", "", "", r1)
+	route2, _ := NewRoute(`\.test\.$`, "", []string{"MX"}, nil, "", "", "", "", r2)
+	route3, _ := NewRoute(`acme\.test\.$`, "", nil, nil, "", "", "", "", r2)
+	route4, _ := NewRoute("", "", nil, nil, "", "", "", "", r3)
+	router.Add(route1, route2, route3, route4)
+	require.Equal(t, []int{1003}, router.linear)
+
+	tests := []struct {
+		name     string
+		qtype    uint16
+		expected *TestResolver
+	}{
+		{"domain500.test.", dns.TypeA, r3},
+		{"x.domain500.test.", dns.TypeMX, r3},
+		{"xdomain500.test.", dns.TypeMX, r2},
+		{"www.acme.test.", dns.TypeA, r1},
+		{"www.acme.test.", dns.TypeMX, r1},
+		{"mail.acme.test.", dns.TypeA, r2},
+		{"xacme.test.", dns.TypeA, r2},
+		{"WWW.acme.test.", dns.TypeA, r2},
+		{"acme.other.", dns.TypeA, r3},
+	}
+	for _, test := range tests {
+		before := test.expected.HitCount()
+		q.SetQuestion(test.name, test.qtype)
+		_, err := router.Resolve(q, ci)
+		require.NoError(t, err)
+		require.Equal(t, before+1, test.expected.HitCount(), test.name)
+	}
+}
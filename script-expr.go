@@ -0,0 +1,433 @@
+package rdns
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// A small expression language used by the script group to match queries and
+// responses. Expressions compare variables like qname or client with literals,
+// for example:
+//
+//	qtype == "AAAA" && client in "192.168.1.0/24"
+//	qname =~ `\.example\.com\.$` || qname in ["a.test.", "b.test."]
+//
+// Supported are string, integer and boolean literals, lists of literals, the
+// comparison operators ==, !=, <, <=, >, >=, regexp matching with =~ and !~,
+// "in" for list membership or IP addresses in a CIDR, as well as !, && and ||.
+// Strings are enclosed in double quotes, or in backticks for raw strings which
+// are easier to use for regular expressions.
+type scriptExpr interface {
+	eval(env scriptEnv) interface{}
+}
+
+// Values of the variables available to expressions. Values can be string,
+// int64, bool or []interface{}.
+type scriptEnv map[string]interface{}
+
+// Parses an expression. Only variables listed in vars can be used.
+func parseScriptExpr(s string, vars map[string]bool) (scriptExpr, error) {
+	tokens, err := scriptTokenize(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &scriptParser{tokens: tokens, vars: vars}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected '%s'", p.tokens[p.pos].text)
+	}
+	return expr, nil
+}
+
+type scriptTokenKind int
+
+const (
+	tokenIdent scriptTokenKind = iota
+	tokenString
+	tokenNumber
+	tokenOp
+)
+
+type scriptToken struct {
+	kind scriptTokenKind
+	text string
+}
+
+var scriptOperators = []string{"&&", "||", "==", "!=", "<=", ">=", "=~", "!~", "<", ">", "!", "(", ")", "[", "]", ","}
+
+func scriptTokenize(s string) ([]scriptToken, error) {
+	var tokens []scriptToken
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"':
+			// Find the closing quote, skipping escaped characters
+			j := i + 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("unterminated string in '%s'", s)
+			}
+			str, err := strconv.Unquote(s[i : j+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string %s: %w", s[i:j+1], err)
+			}
+			tokens = append(tokens, scriptToken{tokenString, str})
+			i = j + 1
+		case c == '`': // Raw string, useful for regular expressions
+			j := strings.IndexByte(s[i+1:], '`')
+			if j < 0 {
+				return nil, fmt.Errorf("unterminated string in '%s'", s)
+			}
+			tokens = append(tokens, scriptToken{tokenString, s[i+1 : i+1+j]})
+			i += j + 2
+		case unicode.IsDigit(c):
+			j := i
+			for j < len(s) && unicode.IsDigit(rune(s[j])) {
+				j++
+			}
+			tokens = append(tokens, scriptToken{tokenNumber, s[i:j]})
+			i = j
+		case unicode.IsLetter(c) || c == '_':
+			j := i
+			for j < len(s) && (unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j])) || s[j] == '_') {
+				j++
+			}
+			tokens = append(tokens, scriptToken{tokenIdent, s[i:j]})
+			i = j
+		default:
+			var found bool
+			for _, op := range scriptOperators {
+				if strings.HasPrefix(s[i:], op) {
+					tokens = append(tokens, scriptToken{tokenOp, op})
+					i += len(op)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("unexpected character '%c' in '%s'", c, s)
+			}
+		}
+	}
+	return tokens, nil
+}
+
+type scriptParser struct {
+	tokens []scriptToken
+	pos    int
+	vars   map[string]bool
+}
+
+func (p *scriptParser) peek() (scriptToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return scriptToken{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+// Consumes the next token if it's the given operator or keyword.
+func (p *scriptParser) accept(text string) bool {
+	t, ok := p.peek()
+	if ok && (t.kind == tokenOp || t.kind == tokenIdent) && t.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *scriptParser) parseOr() (scriptExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = scriptOr{left, right}
+	}
+	return left, nil
+}
+
+func (p *scriptParser) parseAnd() (scriptExpr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = scriptAnd{left, right}
+	}
+	return left, nil
+}
+
+func (p *scriptParser) parseUnary() (scriptExpr, error) {
+	if p.accept("!") {
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return scriptNot{expr}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *scriptParser) parseComparison() (scriptExpr, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	t, ok := p.peek()
+	if !ok {
+		return left, nil
+	}
+	switch {
+	case t.kind == tokenOp && (t.text == "=~" || t.text == "!~"):
+		p.pos++
+		lit, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		pattern, ok := scriptLiteralString(lit)
+		if !ok {
+			return nil, fmt.Errorf("'%s' requires a string literal", t.text)
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		return scriptMatch{left, re, t.text == "!~"}, nil
+	case t.kind == tokenIdent && t.text == "in":
+		p.pos++
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		if s, ok := scriptLiteralString(right); ok {
+			_, ipNet, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, err
+			}
+			return scriptInNet{left, ipNet}, nil
+		}
+		return scriptIn{left, right}, nil
+	case t.kind == tokenOp && (t.text == "==" || t.text == "!=" || t.text == "<" || t.text == "<=" || t.text == ">" || t.text == ">="):
+		p.pos++
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		return scriptCompare{t.text, left, right}, nil
+	}
+	return left, nil
+}
+
+func (p *scriptParser) parsePrimary() (scriptExpr, error) {
+	t, ok := p.peek()
+	if !ok {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	p.pos++
+	switch t.kind {
+	case tokenString:
+		return scriptLiteral{t.text}, nil
+	case tokenNumber:
+		n, err := strconv.ParseInt(t.text, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return scriptLiteral{n}, nil
+	case tokenIdent:
+		switch t.text {
+		case "true":
+			return scriptLiteral{true}, nil
+		case "false":
+			return scriptLiteral{false}, nil
+		}
+		if !p.vars[t.text] {
+			return nil, fmt.Errorf("unknown variable '%s'", t.text)
+		}
+		return scriptVar(t.text), nil
+	}
+	switch t.text {
+	case "(":
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, fmt.Errorf("missing ')'")
+		}
+		return expr, nil
+	case "[":
+		var list []interface{}
+		for !p.accept("]") {
+			if len(list) > 0 && !p.accept(",") {
+				return nil, fmt.Errorf("expected ',' in list")
+			}
+			item, err := p.parsePrimary()
+			if err != nil {
+				return nil, err
+			}
+			lit, ok := item.(scriptLiteral)
+			if _, isList := lit.value.([]interface{}); !ok || isList {
+				return nil, fmt.Errorf("lists can only contain string, number or boolean literals")
+			}
+			list = append(list, lit.value)
+		}
+		return scriptLiteral{list}, nil
+	}
+	return nil, fmt.Errorf("unexpected '%s'", t.text)
+}
+
+type scriptLiteral struct{ value interface{} }
+
+// Returns the value of a string literal.
+func scriptLiteralString(e scriptExpr) (string, bool) {
+	lit, ok := e.(scriptLiteral)
+	if !ok {
+		return "", false
+	}
+	s, ok := lit.value.(string)
+	return s, ok
+}
+
+func (e scriptLiteral) eval(env scriptEnv) interface{} { return e.value }
+
+type scriptVar string
+
+func (e scriptVar) eval(env scriptEnv) interface{} { return env[string(e)] }
+
+type scriptOr struct{ left, right scriptExpr }
+
+func (e scriptOr) eval(env scriptEnv) interface{} {
+	return scriptTrue(e.left.eval(env)) || scriptTrue(e.right.eval(env))
+}
+
+type scriptAnd struct{ left, right scriptExpr }
+
+func (e scriptAnd) eval(env scriptEnv) interface{} {
+	return scriptTrue(e.left.eval(env)) && scriptTrue(e.right.eval(env))
+}
+
+type scriptNot struct{ expr scriptExpr }
+
+func (e scriptNot) eval(env scriptEnv) interface{} {
+	return !scriptTrue(e.expr.eval(env))
+}
+
+type scriptMatch struct {
+	expr   scriptExpr
+	re     *regexp.Regexp
+	negate bool
+}
+
+func (e scriptMatch) eval(env scriptEnv) interface{} {
+	s, ok := e.expr.eval(env).(string)
+	return ok && e.re.MatchString(s) != e.negate
+}
+
+// Checks if an IP address, or any in a list, is in a network.
+type scriptInNet struct {
+	expr  scriptExpr
+	ipNet *net.IPNet
+}
+
+func (e scriptInNet) eval(env scriptEnv) interface{} {
+	v := e.expr.eval(env)
+	values, ok := v.([]interface{})
+	if !ok {
+		values = []interface{}{v}
+	}
+	for _, v := range values {
+		if s, ok := v.(string); ok {
+			if ip := net.ParseIP(s); ip != nil && e.ipNet.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Checks if a value, or any value in a list, is in a list.
+type scriptIn struct{ left, right scriptExpr }
+
+func (e scriptIn) eval(env scriptEnv) interface{} {
+	list, ok := e.right.eval(env).([]interface{})
+	if !ok {
+		return false
+	}
+	v := e.left.eval(env)
+	values, ok := v.([]interface{})
+	if !ok {
+		values = []interface{}{v}
+	}
+	for _, v := range values {
+		for _, item := range list {
+			if v == item {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type scriptCompare struct {
+	op          string
+	left, right scriptExpr
+}
+
+func (e scriptCompare) eval(env scriptEnv) interface{} {
+	left, right := e.left.eval(env), e.right.eval(env)
+	// Lists can't be compared, only scalar values
+	_, leftList := left.([]interface{})
+	_, rightList := right.([]interface{})
+	switch e.op {
+	case "==":
+		return !leftList && !rightList && left == right
+	case "!=":
+		return leftList || rightList || left != right
+	}
+	l, ok := left.(int64)
+	if !ok {
+		return false
+	}
+	r, ok := right.(int64)
+	if !ok {
+		return false
+	}
+	switch e.op {
+	case "<":
+		return l < r
+	case "<=":
+		return l <= r
+	case ">":
+		return l > r
+	case ">=":
+		return l >= r
+	}
+	return false
+}
+
+// Values other than booleans are considered false.
+func scriptTrue(v interface{}) bool {
+	b, ok := v.(bool)
+	return ok && b
+}
@@ -0,0 +1,278 @@
+package rdns
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Script is a group that evaluates a list of rules against queries and
+// responses. Each rule has a condition written in a small expression language
+// and an action, like dropping the query, sending it to a different resolver,
+// or modifying the response. It's meant for one-off behaviors that don't
+// warrant a dedicated group type.
+type Script struct {
+	id       string
+	resolver Resolver
+	query    []scriptRule
+	response []scriptRule
+}
+
+var _ Resolver = &Script{}
+
+// ScriptOptions contains the rules of a script group.
+type ScriptOptions struct {
+	// Rules are evaluated in order, the first rule whose condition matches
+	// is applied. Rules for queries and responses are evaluated separately.
+	Rules []ScriptRule
+}
+
+// ScriptRule defines a condition and the action to take if it matches.
+type ScriptRule struct {
+	// Condition, like `qtype == "AAAA" && client in "192.168.0.0/16"`. The
+	// rule always applies if empty.
+	If string
+
+	// Evaluate the rule for the "query" or the "response". Defaults to "query".
+	On string
+
+	// Action to take if the condition matches:
+	//  - "pass" stops evaluating rules and leaves the query or response as it is
+	//  - "drop" drops the query or response
+	//  - "route" sends the query to Resolver instead of the default resolver
+	//  - "rcode" responds with RCode and no records
+	//  - "answer" responds with Records, replacing any answer records
+	//  - "ttl" sets the TTL of all records in the response to TTL
+	Action string
+
+	Resolver Resolver
+	RCode    int
+
+	// Records in zone-file format. Records with "@" as name are returned
+	// with the name of the query.
+	Records []string
+	TTL     uint32
+}
+
+type scriptRule struct {
+	ScriptRule
+	cond    scriptExpr
+	records []dns.RR
+}
+
+// Variables that can be used in conditions for queries.
+var scriptQueryVars = map[string]bool{
+	"qname":    true, // Query name in lowercase, like "www.example.com."
+	"qtype":    true, // Query type, like "AAAA"
+	"client":   true, // IP address of the client
+	"listener": true, // ID of the listener that received the query
+	"doh_path": true, // Path of the DoH query
+}
+
+// Variables that can be used in conditions for responses, in addition to the
+// ones available for queries.
+var scriptResponseVars = map[string]bool{
+	"rcode":   true, // Response code, like "NXDOMAIN"
+	"answers": true, // Number of answer records
+	"ips":     true, // List of IP addresses in A and AAAA answer records
+	"ttl":     true, // Lowest TTL of the answer records
+}
+
+// Placeholder for "@" in records, replaced with the query name.
+const scriptQueryName = "query.script.invalid."
+
+// Returns all variables that can be used in conditions for responses.
+func scriptAllResponseVars() map[string]bool {
+	vars := make(map[string]bool)
+	for k := range scriptQueryVars {
+		vars[k] = true
+	}
+	for k := range scriptResponseVars {
+		vars[k] = true
+	}
+	return vars
+}
+
+// NewScript returns a new instance of a script group.
+func NewScript(id string, resolver Resolver, opt ScriptOptions) (*Script, error) {
+	responseVars := scriptAllResponseVars()
+
+	r := &Script{id: id, resolver: resolver}
+	for i, rule := range opt.Rules {
+		compiled := scriptRule{ScriptRule: rule}
+		vars := scriptQueryVars
+		if rule.On == "response" {
+			vars = responseVars
+		} else if rule.On != "query" && rule.On != "" {
+			return nil, fmt.Errorf("rule %d: invalid value '%s' for on, must be 'query' or 'response'", i+1, rule.On)
+		}
+		if rule.If != "" {
+			cond, err := parseScriptExpr(rule.If, vars)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: %w", i+1, err)
+			}
+			compiled.cond = cond
+		}
+		switch rule.Action {
+		case "pass", "drop":
+		case "route":
+			if rule.On == "response" {
+				return nil, fmt.Errorf("rule %d: action 'route' is only supported for queries", i+1)
+			}
+			if rule.Resolver == nil {
+				return nil, fmt.Errorf("rule %d: action 'route' requires a resolver", i+1)
+			}
+		case "rcode":
+		case "answer":
+			for _, record := range rule.Records {
+				if fields := strings.Fields(record); len(fields) > 0 && fields[0] == "@" {
+					record = scriptQueryName + strings.TrimPrefix(strings.TrimSpace(record), "@")
+				}
+				rr, err := dns.NewRR(record)
+				if err != nil {
+					return nil, fmt.Errorf("rule %d: %w", i+1, err)
+				}
+				if rr != nil {
+					compiled.records = append(compiled.records, rr)
+				}
+			}
+		case "ttl":
+			if rule.On != "response" {
+				return nil, fmt.Errorf("rule %d: action 'ttl' is only supported for responses", i+1)
+			}
+		default:
+			return nil, fmt.Errorf("rule %d: unsupported action '%s'", i+1, rule.Action)
+		}
+		if rule.On == "response" {
+			r.response = append(r.response, compiled)
+		} else {
+			r.query = append(r.query, compiled)
+		}
+	}
+	return r, nil
+}
+
+// Resolve a DNS query after applying the rules to it, then apply the rules to
+// the response.
+func (r *Script) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return nil, errors.New("no question in query")
+	}
+	log := logger(r.id, q, ci)
+	env := newScriptEnv(q, ci)
+
+	resolver := r.resolver
+	if rule := matchScriptRule(r.query, env); rule != nil {
+		log = log.WithField("action", rule.Action)
+		switch rule.Action {
+		case "drop":
+			log.Debug("dropping query")
+			return nil, nil
+		case "route":
+			log.WithField("resolver", rule.Resolver.String()).Debug("routing query")
+			resolver = rule.Resolver
+		case "rcode", "answer":
+			log.Debug("responding to query")
+			return scriptResponse(q, rule), nil
+		}
+	}
+
+	a, err := resolver.Resolve(q, ci)
+	if err != nil || a == nil || len(r.response) == 0 {
+		return a, err
+	}
+
+	env.addResponse(a)
+	rule := matchScriptRule(r.response, env)
+	if rule == nil {
+		return a, nil
+	}
+	log = log.WithField("action", rule.Action)
+	switch rule.Action {
+	case "drop":
+		log.Debug("dropping response")
+		return nil, nil
+	case "rcode", "answer":
+		log.Debug("replacing response")
+		return scriptResponse(q, rule), nil
+	case "ttl":
+		log.Debug("updating ttl in response")
+		// The response may be shared, like when it comes from a cache, so
+		// the records can't be modified in place
+		a = a.Copy()
+		for _, records := range [][]dns.RR{a.Answer, a.Ns, a.Extra} {
+			for _, rr := range records {
+				if rr.Header().Rrtype != dns.TypeOPT {
+					rr.Header().Ttl = rule.TTL
+				}
+			}
+		}
+	}
+	return a, nil
+}
+
+func (r *Script) String() string {
+	return r.id
+}
+
+// Returns the values of the variables for a query. The query needs to have a
+// question.
+func newScriptEnv(q *dns.Msg, ci ClientInfo) scriptEnv {
+	return scriptEnv{
+		"qname":    strings.ToLower(q.Question[0].Name),
+		"qtype":    dns.Type(q.Question[0].Qtype).String(),
+		"client":   ci.SourceIP.String(),
+		"listener": ci.Listener,
+		"doh_path": ci.DoHPath,
+	}
+}
+
+// Adds the values of the variables for a response.
+func (env scriptEnv) addResponse(a *dns.Msg) {
+	env["rcode"] = rCode(a)
+	env["answers"] = int64(len(a.Answer))
+	var (
+		ips []interface{}
+		ttl int64 = -1
+	)
+	for _, rr := range a.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			ips = append(ips, rr.A.String())
+		case *dns.AAAA:
+			ips = append(ips, rr.AAAA.String())
+		}
+		if t := int64(rr.Header().Ttl); ttl < 0 || t < ttl {
+			ttl = t
+		}
+	}
+	env["ips"] = ips
+	env["ttl"] = ttl
+}
+
+// Returns the first rule whose condition matches, or nil.
+func matchScriptRule(rules []scriptRule, env scriptEnv) *scriptRule {
+	for i := range rules {
+		if rules[i].cond == nil || scriptTrue(rules[i].cond.eval(env)) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// Builds a response for the "rcode" and "answer" actions.
+func scriptResponse(q *dns.Msg, rule *scriptRule) *dns.Msg {
+	a := new(dns.Msg)
+	a.SetReply(q)
+	a.Rcode = rule.RCode
+	for _, rr := range rule.records {
+		rr = dns.Copy(rr)
+		if rr.Header().Name == scriptQueryName {
+			rr.Header().Name = q.Question[0].Name
+		}
+		a.Answer = append(a.Answer, rr)
+	}
+	return a
+}
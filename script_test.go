@@ -0,0 +1,154 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScriptExpr(t *testing.T) {
+	vars := map[string]bool{"qname": true, "qtype": true, "client": true, "ips": true, "ttl": true}
+	env := scriptEnv{
+		"qname":  "www.example.com.",
+		"qtype":  "AAAA",
+		"client": "192.168.1.10",
+		"ips":    []interface{}{"10.0.0.1", "192.0.2.1"},
+		"ttl":    int64(30),
+	}
+	tests := map[string]bool{
+		`qtype == "AAAA"`:                         true,
+		`qtype != "AAAA"`:                         false,
+		`qname =~ "\\.example\\.com\\.$"`:         true,
+		"qname =~ `^example`":                     false,
+		"qname !~ `^example`":                     true,
+		`client in "192.168.1.0/24"`:              true,
+		`client in "192.168.2.0/24"`:              false,
+		`ips in "192.0.2.0/24"`:                   true,
+		`qtype in ["A", "AAAA"]`:                  true,
+		`ttl < 60 && ttl >= 30`:                   true,
+		`ttl > 60 || qtype == "A"`:                false,
+		`!(qtype == "A") && (ttl == 30 || false)`: true,
+		`ips == "10.0.0.1"`:                       false,
+	}
+	for expr, expected := range tests {
+		e, err := parseScriptExpr(expr, vars)
+		require.NoError(t, err, expr)
+		require.Equal(t, expected, scriptTrue(e.eval(env)), expr)
+	}
+
+	// Invalid expressions
+	for _, expr := range []string{
+		`rcode == "NXDOMAIN"`,
+		`qtype == `,
+		`(qtype == "A"`,
+		`qname =~ qtype`,
+		`client in "not-a-network"`,
+		`qtype == "A" qname`,
+		`qtype in [["A"]]`,
+	} {
+		_, err := parseScriptExpr(expr, vars)
+		require.Error(t, err, expr)
+	}
+}
+
+func TestScript(t *testing.T) {
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 10},
+				A:   net.IP{192, 0, 2, 1},
+			}}
+			return a, nil
+		},
+	}
+	alt := new(TestResolver)
+	g, err := NewScript("test-script", r, ScriptOptions{
+		Rules: []ScriptRule{
+			{If: `qtype == "AAAA"`, Action: "drop"},
+			{If: `qname == "alt.test."`, Action: "route", Resolver: alt},
+			{If: `qname == "static.test."`, Action: "answer", Records: []string{"static.test. 300 IN A 192.0.2.2"}},
+			{If: "qname =~ `\\.any\\.test\\.$`", Action: "answer", Records: []string{"@ 300 IN A 192.0.2.3"}},
+			{If: `client in "10.0.0.0/8"`, Action: "rcode", RCode: dns.RcodeRefused},
+			{On: "response", If: `ips in "192.0.2.0/24" && ttl < 60`, Action: "ttl", TTL: 60},
+		},
+	})
+	require.NoError(t, err)
+
+	ci := ClientInfo{SourceIP: net.ParseIP("192.168.1.1")}
+	q := new(dns.Msg)
+
+	q.SetQuestion("example.com.", dns.TypeAAAA)
+	a, err := g.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Nil(t, a)
+
+	q.SetQuestion("alt.test.", dns.TypeA)
+	_, err = g.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, alt.HitCount())
+	require.Equal(t, 0, r.HitCount())
+
+	q.SetQuestion("static.test.", dns.TypeA)
+	a, err = g.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, net.IP{192, 0, 2, 2}, a.Answer[0].(*dns.A).A.To4())
+
+	// Records with "@" get the query name
+	q.SetQuestion("host1.any.test.", dns.TypeA)
+	a, err = g.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, "host1.any.test.", a.Answer[0].Header().Name)
+	require.Equal(t, net.IP{192, 0, 2, 3}, a.Answer[0].(*dns.A).A.To4())
+
+	q.SetQuestion("example.com.", dns.TypeA)
+	a, err = g.Resolve(q, ClientInfo{SourceIP: net.ParseIP("10.1.1.1")})
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeRefused, a.Rcode)
+
+	// The response rule raises the TTL
+	a, err = g.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, uint32(60), a.Answer[0].Header().Ttl)
+	require.Equal(t, 1, r.HitCount())
+
+	// Invalid rules
+	_, err = NewScript("test-script", r, ScriptOptions{Rules: []ScriptRule{{On: "response", Action: "route", Resolver: alt}}})
+	require.Error(t, err)
+	_, err = NewScript("test-script", r, ScriptOptions{Rules: []ScriptRule{{Action: "ttl"}}})
+	require.Error(t, err)
+	_, err = NewScript("test-script", r, ScriptOptions{Rules: []ScriptRule{{If: `rcode == "NOERROR"`, Action: "drop"}}})
+	require.Error(t, err)
+}
+
+func TestScriptTTLCopy(t *testing.T) {
+	// The upstream always returns the same message, like a cache would
+	upstream := new(dns.Msg)
+	upstream.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 10},
+		A:   net.IP{192, 0, 2, 1},
+	}}
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			return upstream, nil
+		},
+	}
+	g, err := NewScript("test-script", r, ScriptOptions{
+		Rules: []ScriptRule{{On: "response", Action: "ttl", TTL: 60}},
+	})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	a, err := g.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, uint32(60), a.Answer[0].Header().Ttl)
+
+	// The upstream message is unmodified
+	require.Equal(t, uint32(10), upstream.Answer[0].Header().Ttl)
+}
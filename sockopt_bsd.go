@@ -0,0 +1,20 @@
+//go:build darwin || dragonfly || netbsd || openbsd
+// +build darwin dragonfly netbsd openbsd
+
+package rdns
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// Binding to addresses that aren't assigned to the host is only supported on
+// Linux and FreeBSD.
+func setFreebind(network string, fd uintptr) error {
+	return errors.New("freebind is not supported on this platform")
+}
+
+func setReusePort(fd uintptr) error {
+	return unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+}
@@ -0,0 +1,23 @@
+//go:build freebsd
+// +build freebsd
+
+package rdns
+
+import (
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Allows binding to addresses that aren't (yet) assigned to the host. This
+// requires elevated privileges on FreeBSD.
+func setFreebind(network string, fd uintptr) error {
+	if strings.HasSuffix(network, "6") {
+		return unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_BINDANY, 1)
+	}
+	return unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_BINDANY, 1)
+}
+
+func setReusePort(fd uintptr) error {
+	return unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+}
@@ -0,0 +1,16 @@
+//go:build linux
+// +build linux
+
+package rdns
+
+import "golang.org/x/sys/unix"
+
+// Allows binding to addresses that aren't (yet) assigned to the host. Applies
+// to IPv4 and IPv6 sockets.
+func setFreebind(network string, fd uintptr) error {
+	return unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_FREEBIND, 1)
+}
+
+func setReusePort(fd uintptr) error {
+	return unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+}
@@ -0,0 +1,16 @@
+//go:build !linux && !freebsd && !darwin && !dragonfly && !netbsd && !openbsd
+// +build !linux,!freebsd,!darwin,!dragonfly,!netbsd,!openbsd
+
+package rdns
+
+import "errors"
+
+// Binding to addresses that aren't assigned to the host is only supported on
+// Linux and FreeBSD.
+func setFreebind(network string, fd uintptr) error {
+	return errors.New("freebind is not supported on this platform")
+}
+
+func setReusePort(fd uintptr) error {
+	return errors.New("reuseport is not supported on this platform")
+}
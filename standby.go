@@ -0,0 +1,38 @@
+package rdns
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// Interval between queries that keep standby connections open. Needs to be
+// shorter than the idle timeout of upstream connections.
+const warmStandbyInterval = idleTimeout / 2
+
+// Keeps the upstream connections of the standby resolvers in a group open
+// by sending a query to them right away, and then in regular intervals. When
+// the group fails over, the connection to the next resolver, including any TLS
+// handshake, is already established. The active resolver is skipped since it
+// keeps its connection open with client queries.
+func startWarmStandby(id string, resolvers []Resolver, active func() int) {
+	for i := range resolvers {
+		go warmStandbyLoop(id, resolvers, i, active)
+	}
+}
+
+func warmStandbyLoop(id string, resolvers []Resolver, i int, active func() int) {
+	resolver := resolvers[i]
+	log := Log.WithFields(logrus.Fields{"id": id, "resolver": resolver.String()})
+	for {
+		if active() != i {
+			q := new(dns.Msg)
+			q.SetQuestion(".", dns.TypeNS)
+			if _, err := resolver.Resolve(q, ClientInfo{}); err != nil {
+				log.WithError(err).Debug("failed to keep standby connection open")
+			}
+		}
+		time.Sleep(warmStandbyInterval)
+	}
+}
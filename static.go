@@ -8,23 +8,33 @@ import (
 // Typically used in combination with a blocklist to define fixed block responses or
 // with a router when building a walled garden.
 type StaticResolver struct {
-	id     string
-	answer []dns.RR
-	ns     []dns.RR
-	extra  []dns.RR
-	rcode  int
-	truncate	bool
+	id       string
+	answer   []dns.RR
+	ns       []dns.RR
+	extra    []dns.RR
+	rcode    int
+	truncate bool
+	byType   bool
+	edeText  bool
 }
 
 var _ Resolver = &StaticResolver{}
 
 type StaticResolverOptions struct {
 	// Records in zone-file format
-	Answer []string
-	NS     []string
-	Extra  []string
-	RCode  int
-	Truncate	bool
+	Answer   []string
+	NS       []string
+	Extra    []string
+	RCode    int
+	Truncate bool
+
+	// Only return answer records of the type in the query, and CNAME records.
+	// Queries for types without records get an empty (NODATA) response.
+	AnswerByType bool
+
+	// Include the list and rule that matched in the extended DNS error of
+	// responses to queries forwarded by a blocklist.
+	EDEText bool
 }
 
 // NewStaticResolver returns a new instance of a StaticResolver resolver.
@@ -53,9 +63,11 @@ func NewStaticResolver(id string, opt StaticResolverOptions) (*StaticResolver, e
 		r.extra = append(r.extra, rr)
 	}
 	r.rcode = opt.RCode
-	
+
 	r.truncate = opt.Truncate
-	
+	r.byType = opt.AnswerByType
+	r.edeText = opt.EDEText
+
 	return r, nil
 }
 
@@ -67,6 +79,9 @@ func (r *StaticResolver) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	// Update the name of every answer record to match that of the query
 	answer.Answer = make([]dns.RR, 0, len(r.answer))
 	for _, rr := range r.answer {
+		if r.byType && len(q.Question) > 0 && !answerMatchesType(rr, q.Question[0].Qtype) {
+			continue
+		}
 		r := dns.Copy(rr)
 		r.Header().Name = qName(q)
 		answer.Answer = append(answer.Answer, r)
@@ -76,6 +91,16 @@ func (r *StaticResolver) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	answer.Rcode = r.rcode
 	answer.Truncated = r.truncate
 
+	// Mark responses to queries from a blocklist as blocked, like the
+	// blocklist does for the responses it generates itself
+	if ci.Blocked != nil {
+		answer.Extra = make([]dns.RR, 0, len(r.extra)+1)
+		for _, rr := range r.extra {
+			answer.Extra = append(answer.Extra, dns.Copy(rr))
+		}
+		setBlockedEDE(q, answer, blockedEDEText(r.edeText, ci.Blocked))
+	}
+
 	logger(r.id, q, ci).WithField("truncated", r.truncate).Debug("responding")
 
 	return answer, nil
@@ -84,3 +109,10 @@ func (r *StaticResolver) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 func (r *StaticResolver) String() string {
 	return r.id
 }
+
+// Returns true if a record should be in the answer to a query. Records match
+// their own type, ANY queries, and CNAMEs match all types.
+func answerMatchesType(rr dns.RR, qtype uint16) bool {
+	rrtype := rr.Header().Rrtype
+	return rrtype == qtype || rrtype == dns.TypeCNAME || qtype == dns.TypeANY
+}
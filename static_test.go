@@ -35,3 +35,68 @@ func TestStaticResolver(t *testing.T) {
 	require.Equal(t, "example.com.", a.Ns[0].Header().Name)
 	require.Equal(t, "ns1.example.com.", a.Extra[0].Header().Name)
 }
+
+func TestStaticResolverAnswerByType(t *testing.T) {
+	opt := StaticResolverOptions{
+		Answer: []string{
+			"IN A 1.2.3.4",
+			"IN AAAA ::1",
+			`IN TXT "hello"`,
+			"IN MX 10 mail.example.com.",
+		},
+		NS: []string{
+			"example.com. IN SOA ns1.example.com. hostmaster.example.com. 1 3600 600 86400 300",
+		},
+		AnswerByType: true,
+	}
+	r, err := NewStaticResolver("test-static", opt)
+	require.NoError(t, err)
+
+	// Only the records of the query type are returned
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeTXT, dns.TypeMX} {
+		q := new(dns.Msg)
+		q.SetQuestion("test.com.", qtype)
+		a, err := r.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+		require.Len(t, a.Answer, 1)
+		require.Equal(t, qtype, a.Answer[0].Header().Rrtype)
+	}
+
+	// NODATA for types without records
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeSRV)
+	a, err := r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Empty(t, a.Answer)
+	require.Len(t, a.Ns, 1)
+}
+
+func TestStaticResolverBlockedEDE(t *testing.T) {
+	r, err := NewStaticResolver("test-static-ede", StaticResolverOptions{
+		Answer:  []string{"IN A 0.0.0.0"},
+		EDEText: true,
+	})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("x.ads.test.", dns.TypeA)
+	q.SetEdns0(4096, false)
+
+	// No extended error unless the query was forwarded by a blocklist
+	a, err := r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Nil(t, a.IsEdns0())
+
+	ci := ClientInfo{Blocked: &BlocklistMatch{List: "ads", Rule: ".ads.test", Category: "advertising"}}
+	a, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Len(t, a.Answer, 1)
+	edns0 := a.IsEdns0()
+	require.NotNil(t, edns0)
+	require.Len(t, edns0.Option, 1)
+	ede, ok := edns0.Option[0].(*dns.EDNS0_EDE)
+	require.True(t, ok)
+	require.Equal(t, dns.ExtendedErrorCodeBlocked, ede.InfoCode)
+	require.Equal(t, "ads (advertising): .ads.test", ede.ExtraText)
+}
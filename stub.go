@@ -0,0 +1,453 @@
+package rdns
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// StubResolver sends queries for a set of zones directly to their
+// authoritative name servers. Instead of using static server addresses, the
+// name servers of each zone are learned from hint servers and refreshed when
+// the TTL of the NS records expires, or when none of the known servers
+// respond. Changes to NS records or glue are followed without changes to the
+// configuration, as long as one of the known servers or hints is reachable.
+type StubResolver struct {
+	id      string
+	opt     StubResolverOptions
+	zones   []*stubZone // Sorted by length, longest first
+	client  *dns.Client
+	tcp     *dns.Client
+	metrics *StubResolverMetrics
+}
+
+var _ Resolver = &StubResolver{}
+
+type StubResolverOptions struct {
+	// Zones that are resolved by this resolver. Required.
+	Zones []string
+
+	// Addresses of servers, like "10.0.0.53:53", that are asked for the NS
+	// records of the zones and their addresses. Can be authoritative servers
+	// of the zones or recursive resolvers that know them. Required.
+	Hints []string
+
+	// Port the learned name servers are queried on. Default 53.
+	Port string
+
+	// Local IP to send queries from. If nil, a local address is chosen.
+	LocalAddr net.IP
+
+	// Time to wait for a response from a name server. Default 1 second.
+	QueryTimeout time.Duration
+
+	// Maximum time learned name servers are used before they're refreshed,
+	// regardless of the TTL of the NS records. Default 1 hour.
+	MaxRefresh time.Duration
+
+	// Only accept responses with exactly the same case in the question name as
+	// the query. Not all servers preserve the case.
+	StrictCase bool
+}
+
+type StubResolverMetrics struct {
+	// Count of queries sent to name servers.
+	query *expvar.Int
+	// Count of failed queries.
+	err *expvar.Int
+	// Count of responses that didn't match the query.
+	spoof *expvar.Int
+	// Count of name server refreshes.
+	refresh *expvar.Int
+	// Count of refreshes that changed the name servers of a zone.
+	changed *expvar.Int
+}
+
+// Minimum time learned name servers are used, for NS records with very
+// low TTLs. Also the minimum time between refreshes after the servers fail.
+const stubMinRefresh = 5 * time.Second
+
+// Time to wait before learning the name servers of a zone again after a
+// failed attempt.
+const stubRetryRefresh = 30 * time.Second
+
+type stubZone struct {
+	name string
+
+	mu         sync.Mutex
+	servers    []string      // Learned name server addresses
+	expiry     time.Time     // Time at which the servers need to be refreshed
+	refreshed  time.Time     // Time of the last attempt to learn the servers
+	refreshing chan struct{} // Closed once the ongoing refresh completes
+}
+
+// NewStubResolver returns a new instance of a stub resolver.
+func NewStubResolver(id string, opt StubResolverOptions) (*StubResolver, error) {
+	if len(opt.Zones) == 0 {
+		return nil, errors.New("no stub zones defined")
+	}
+	if len(opt.Hints) == 0 {
+		return nil, errors.New("no stub hints defined")
+	}
+	if opt.Port == "" {
+		opt.Port = PlainDNSPort
+	}
+	if opt.QueryTimeout == 0 {
+		opt.QueryTimeout = queryTimeout
+	}
+	if opt.MaxRefresh == 0 {
+		opt.MaxRefresh = time.Hour
+	}
+	hints := make([]string, 0, len(opt.Hints))
+	for _, hint := range opt.Hints {
+		hint = AddressWithDefault(hint, PlainDNSPort)
+		if err := validEndpoint(hint); err != nil {
+			return nil, err
+		}
+		hints = append(hints, hint)
+	}
+	opt.Hints = hints
+	r := &StubResolver{
+		id:  id,
+		opt: opt,
+		metrics: &StubResolverMetrics{
+			query:   getVarInt("stub", id, "query"),
+			err:     getVarInt("stub", id, "error"),
+			spoof:   getVarInt("stub", id, "spoof"),
+			refresh: getVarInt("stub", id, "refresh"),
+			changed: getVarInt("stub", id, "changed"),
+		},
+	}
+	for _, zone := range opt.Zones {
+		r.zones = append(r.zones, &stubZone{name: dns.CanonicalName(zone)})
+	}
+	sort.SliceStable(r.zones, func(i, j int) bool { return len(r.zones[i].name) > len(r.zones[j].name) })
+
+	var udpDialer, tcpDialer *net.Dialer
+	if opt.LocalAddr != nil {
+		udpDialer = &net.Dialer{LocalAddr: &net.UDPAddr{IP: opt.LocalAddr}}
+		tcpDialer = &net.Dialer{LocalAddr: &net.TCPAddr{IP: opt.LocalAddr}}
+	}
+	r.client = &dns.Client{Net: "udp", Dialer: udpDialer, Timeout: opt.QueryTimeout, UDPSize: 4096}
+	r.tcp = &dns.Client{Net: "tcp", Dialer: tcpDialer, Timeout: opt.QueryTimeout}
+	return r, nil
+}
+
+// Resolve a DNS query by sending it to the authoritative name servers of the
+// zone it belongs to. Queries for names outside the zones are refused.
+func (r *StubResolver) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return nil, errors.New("no question in query")
+	}
+	log := logger(r.id, q, ci)
+	zone := r.zoneFor(q.Question[0].Name)
+	if zone == nil {
+		log.Debug("name not in stub zones, refusing")
+		return refused(q), nil
+	}
+	log = log.WithField("zone", zone.name)
+
+	servers := r.servers(zone, log, false)
+	a, err := r.exchange(q, servers, log)
+	if err == nil {
+		ci.recordUpstream(r.id)
+		return a, nil
+	}
+
+	// None of the name servers responded, they may have changed
+	log.WithError(err).Debug("name servers failed, refreshing")
+	if refreshed := r.servers(zone, log, true); !sameServers(servers, refreshed) {
+		a, err = r.exchange(q, refreshed, log)
+	}
+	if err != nil {
+		r.metrics.err.Add(1)
+		return nil, err
+	}
+	ci.recordUpstream(r.id)
+	return a, nil
+}
+
+func (r *StubResolver) String() string {
+	return r.id
+}
+
+// Returns the zone a name belongs to, or nil if there is none.
+func (r *StubResolver) zoneFor(name string) *stubZone {
+	name = dns.CanonicalName(name)
+	for _, z := range r.zones {
+		if dns.IsSubDomain(z.name, name) {
+			return z
+		}
+	}
+	return nil
+}
+
+// Returns the name servers of a zone, learning them first if they're not
+// known yet or have expired. With force, they're learned again unless that
+// was attempted recently. Falls back to the hints if nothing was learned.
+// Only one query learns the servers at a time, others wait for the result.
+func (r *StubResolver) servers(z *stubZone, log *logrus.Entry, force bool) []string {
+	z.mu.Lock()
+	now := time.Now()
+	if force && now.Sub(z.refreshed) >= stubMinRefresh {
+		z.expiry = now
+	}
+	if len(z.servers) > 0 && now.Before(z.expiry) {
+		defer z.mu.Unlock()
+		return z.servers
+	}
+	if done := z.refreshing; done != nil {
+		z.mu.Unlock()
+		<-done
+		z.mu.Lock()
+		defer z.mu.Unlock()
+		if len(z.servers) > 0 {
+			return z.servers
+		}
+		return r.opt.Hints
+	}
+	done := make(chan struct{})
+	z.refreshing = done
+	z.refreshed = now
+	known := z.servers
+	z.mu.Unlock()
+
+	// Learn the servers without holding the lock, this takes network
+	// round-trips
+	r.metrics.refresh.Add(1)
+	servers, ttl, err := r.learn(z, known)
+
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.refreshing = nil
+	close(done)
+	if err != nil {
+		log.WithError(err).Warn("failed to learn name servers")
+		z.expiry = now.Add(stubRetryRefresh)
+		if len(z.servers) > 0 {
+			return z.servers
+		}
+		return r.opt.Hints
+	}
+	if !sameServers(z.servers, servers) {
+		r.metrics.changed.Add(1)
+		log.WithField("servers", servers).Info("learned name servers")
+	}
+	z.servers = servers
+	z.expiry = now.Add(ttl)
+	return z.servers
+}
+
+// Queries the known name servers of the zone, then the hints, for the NS
+// records of a zone and the addresses of the name servers. Returns the
+// addresses and the time they can be used for.
+func (r *StubResolver) learn(z *stubZone, known []string) ([]string, time.Duration, error) {
+	sources := append(append([]string{}, known...), r.opt.Hints...)
+	var lastErr error
+	for _, source := range uniqueStrings(sources) {
+		servers, ttl, err := r.learnFrom(z, source)
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %w", source, err)
+			continue
+		}
+		return servers, ttl, nil
+	}
+	return nil, 0, lastErr
+}
+
+func (r *StubResolver) learnFrom(z *stubZone, source string) ([]string, time.Duration, error) {
+	q := new(dns.Msg)
+	q.SetQuestion(z.name, dns.TypeNS)
+	a, err := r.query(q, source)
+	if err != nil {
+		return nil, 0, err
+	}
+	if a.Rcode != dns.RcodeSuccess {
+		return nil, 0, fmt.Errorf("unexpected response code %s", dns.RcodeToString[a.Rcode])
+	}
+
+	// NS records can be in the answer, or the authority section of a referral
+	ttl := r.opt.MaxRefresh
+	var names []string
+	for _, rr := range append(append([]dns.RR{}, a.Answer...), a.Ns...) {
+		ns, ok := rr.(*dns.NS)
+		if !ok || !strings.EqualFold(ns.Hdr.Name, z.name) {
+			continue
+		}
+		names = append(names, dns.CanonicalName(ns.Ns))
+		if d := time.Duration(ns.Hdr.Ttl) * time.Second; d < ttl {
+			ttl = d
+		}
+	}
+	if len(names) == 0 {
+		return nil, 0, errors.New("no NS records in response")
+	}
+	if ttl < stubMinRefresh {
+		ttl = stubMinRefresh
+	}
+
+	// Use the glue records, and look up the addresses of name servers without
+	var servers []string
+	for _, name := range names {
+		ips := glueAddresses(a, name)
+		if len(ips) == 0 {
+			ips = r.lookupAddresses(name, source)
+		}
+		for _, ip := range ips {
+			servers = append(servers, net.JoinHostPort(ip.String(), r.opt.Port))
+		}
+	}
+	if len(servers) == 0 {
+		return nil, 0, errors.New("no addresses for name servers")
+	}
+	return uniqueStrings(servers), ttl, nil
+}
+
+// Returns the addresses of a name server from the additional section.
+func glueAddresses(a *dns.Msg, name string) []net.IP {
+	var ips []net.IP
+	for _, rr := range a.Extra {
+		if !strings.EqualFold(rr.Header().Name, name) {
+			continue
+		}
+		switch rr := rr.(type) {
+		case *dns.A:
+			ips = append(ips, rr.A)
+		case *dns.AAAA:
+			ips = append(ips, rr.AAAA)
+		}
+	}
+	return ips
+}
+
+// Looks up the A and AAAA records of a name server.
+func (r *StubResolver) lookupAddresses(name, source string) []net.IP {
+	var ips []net.IP
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		q := new(dns.Msg)
+		q.SetQuestion(name, qtype)
+		a, err := r.query(q, source)
+		if err != nil {
+			continue
+		}
+		for _, rr := range a.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				ips = append(ips, rr.A)
+			case *dns.AAAA:
+				ips = append(ips, rr.AAAA)
+			}
+		}
+	}
+	return ips
+}
+
+// Sends a query to the servers in order until one of them responds.
+func (r *StubResolver) exchange(q *dns.Msg, servers []string, log *logrus.Entry) (*dns.Msg, error) {
+	var lastErr error
+	for _, server := range servers {
+		log.WithField("resolver", server).Debug("querying name server")
+		a, err := r.query(q, server)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		switch a.Rcode {
+		case dns.RcodeServerFailure, dns.RcodeRefused:
+			lastErr = fmt.Errorf("%s responded with %s", server, dns.RcodeToString[a.Rcode])
+			continue
+		}
+		return a, nil
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no name servers")
+	}
+	return nil, lastErr
+}
+
+// Sends a query to a server over UDP, and repeats it over TCP if the
+// response is truncated. The query is sent with a random ID, responses
+// that don't match the question are ignored.
+func (r *StubResolver) query(q *dns.Msg, server string) (*dns.Msg, error) {
+	r.metrics.query.Add(1)
+	query := q.Copy()
+	query.Id = dns.Id()
+	a, err := r.exchangeUDP(query, server)
+	if err == nil && a.Truncated {
+		a, _, err = r.tcp.Exchange(query, server)
+		if err == nil && !responseMatches(query, a, r.opt.StrictCase) {
+			r.metrics.spoof.Add(1)
+			err = fmt.Errorf("response from %s doesn't match the query", server)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	a.Id = q.Id
+	return a, nil
+}
+
+// Sends a query over UDP and reads responses until one matches the query, or
+// the query timeout expires. Like in the pipeline, spoofed or malformed
+// responses don't fail the query.
+func (r *StubResolver) exchangeUDP(query *dns.Msg, server string) (*dns.Msg, error) {
+	co, err := r.client.Dial(server)
+	if err != nil {
+		return nil, err
+	}
+	defer co.Close()
+	_ = co.SetDeadline(time.Now().Add(r.opt.QueryTimeout))
+	if err := co.WriteMsg(query); err != nil {
+		return nil, err
+	}
+	for {
+		a, err := co.ReadMsg()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) {
+				return nil, err
+			}
+			r.metrics.spoof.Add(1)
+			continue
+		}
+		if a.Id != query.Id || !responseMatches(query, a, r.opt.StrictCase) {
+			r.metrics.spoof.Add(1)
+			continue
+		}
+		return a, nil
+	}
+}
+
+func sameServers(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the strings without duplicates, keeping the order.
+func uniqueStrings(s []string) []string {
+	seen := make(map[string]struct{}, len(s))
+	var out []string
+	for _, v := range s {
+		if _, ok := seen[v]; ok {
+			continue
+		}
+		seen[v] = struct{}{}
+		out = append(out, v)
+	}
+	return out
+}
@@ -0,0 +1,175 @@
+package rdns
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// Authoritative server for the test zone. The glue in NS responses points to
+// the current name server, A queries are answered with an address that
+// identifies the server that responded.
+type stubTestZone struct {
+	mu   sync.Mutex
+	glue net.IP
+}
+
+func (z *stubTestZone) setGlue(ip string) {
+	z.mu.Lock()
+	z.glue = net.ParseIP(ip)
+	z.mu.Unlock()
+}
+
+func (z *stubTestZone) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
+	a := new(dns.Msg)
+	a.SetReply(q)
+	a.Authoritative = true
+	name := q.Question[0].Name
+	switch q.Question[0].Qtype {
+	case dns.TypeNS:
+		z.mu.Lock()
+		glue := z.glue
+		z.mu.Unlock()
+		a.Answer = []dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 3600}, Ns: "ns1.corp.test."}}
+		a.Extra = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "ns1.corp.test.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600}, A: glue}}
+	case dns.TypeA:
+		local := w.LocalAddr().(*net.UDPAddr).IP.To4()
+		a.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.IPv4(10, 0, 0, local[3])}}
+	}
+	_ = w.WriteMsg(a)
+}
+
+func TestStubResolver(t *testing.T) {
+	addr, err := getUDPLnAddress()
+	require.NoError(t, err)
+	_, port, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+
+	// Run the zone on three addresses, the hint and two name servers
+	zone := &stubTestZone{}
+	zone.setGlue("127.0.0.1")
+	servers := make(map[string]*dns.Server)
+	for _, ip := range []string{"127.0.0.1", "127.0.0.2", "127.0.0.3"} {
+		s := &dns.Server{Addr: net.JoinHostPort(ip, port), Net: "udp", Handler: zone}
+		go func() { _ = s.ListenAndServe() }()
+		defer s.Shutdown()
+		servers[ip] = s
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	r, err := NewStubResolver("test-stub", StubResolverOptions{
+		Zones:        []string{"corp.test"},
+		Hints:        []string{net.JoinHostPort("127.0.0.3", port)},
+		Port:         port,
+		QueryTimeout: 200 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	// Queries go to the name server learned from the hint
+	q := new(dns.Msg)
+	q.SetQuestion("host.corp.test.", dns.TypeA)
+	a, err := r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.1", a.Answer[0].(*dns.A).A.String())
+
+	// Names outside the zones are refused
+	q.SetQuestion("example.com.", dns.TypeA)
+	a, err = r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeRefused, a.Rcode)
+
+	// Move the zone to a new name server and stop the old one. The next query
+	// fails on the old server and the new one is learned.
+	zone.setGlue("127.0.0.2")
+	_ = servers["127.0.0.1"].Shutdown()
+	time.Sleep(stubMinRefresh)
+	q.SetQuestion("host.corp.test.", dns.TypeA)
+	a, err = r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.2", a.Answer[0].(*dns.A).A.String())
+}
+
+func TestStubResolverSingleRefresh(t *testing.T) {
+	addr, err := getUDPLnAddress()
+	require.NoError(t, err)
+	_, port, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+
+	// Slow hint, concurrent queries need to wait for the same refresh
+	zone := &stubTestZone{}
+	zone.setGlue("127.0.0.1")
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		if q.Question[0].Qtype == dns.TypeNS {
+			time.Sleep(100 * time.Millisecond)
+		}
+		zone.ServeDNS(w, q)
+	})
+	s := &dns.Server{Addr: net.JoinHostPort("127.0.0.1", port), Net: "udp", Handler: handler}
+	go func() { _ = s.ListenAndServe() }()
+	defer s.Shutdown()
+	time.Sleep(100 * time.Millisecond)
+
+	r, err := NewStubResolver("test-stub-single", StubResolverOptions{
+		Zones: []string{"corp.test"},
+		Hints: []string{net.JoinHostPort("127.0.0.1", port)},
+		Port:  port,
+	})
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q := new(dns.Msg)
+			q.SetQuestion("host.corp.test.", dns.TypeA)
+			a, err := r.Resolve(q, ClientInfo{})
+			require.NoError(t, err)
+			require.Equal(t, "10.0.0.1", a.Answer[0].(*dns.A).A.String())
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int64(1), r.metrics.refresh.Value())
+}
+
+func TestStubResolverSpoofedResponse(t *testing.T) {
+	addr, err := getUDPLnAddress()
+	require.NoError(t, err)
+	_, port, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+
+	// Name server that sends a response for another name before the real one
+	zone := &stubTestZone{}
+	zone.setGlue("127.0.0.1")
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		spoofed := new(dns.Msg)
+		spoofed.SetReply(q)
+		spoofed.Question[0].Name = "other.corp.test."
+		_ = w.WriteMsg(spoofed)
+		zone.ServeDNS(w, q)
+	})
+	s := &dns.Server{Addr: addr, Net: "udp", Handler: handler}
+	go func() { _ = s.ListenAndServe() }()
+	defer s.Shutdown()
+	time.Sleep(100 * time.Millisecond)
+
+	r, err := NewStubResolver("test-stub-spoof", StubResolverOptions{
+		Zones: []string{"corp.test"},
+		Hints: []string{addr},
+		Port:  port,
+	})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("host.corp.test.", dns.TypeA)
+	a, err := r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, q.Id, a.Id)
+	require.Equal(t, "10.0.0.1", a.Answer[0].(*dns.A).A.String())
+	// One for learning the name servers, one for the query
+	require.Equal(t, int64(2), r.metrics.spoof.Value())
+}
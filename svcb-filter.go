@@ -0,0 +1,152 @@
+package rdns
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// SVCBFilter is a response modifier for SVCB and HTTPS records. It can remove
+// parameters, like ECH or IP hints, from the records or drop the records
+// entirely. Useful in networks that inspect TLS or don't support IPv6.
+type SVCBFilter struct {
+	id       string
+	resolver Resolver
+	opt      SVCBFilterOptions
+	remove   map[dns.SVCBKey]struct{}
+}
+
+var _ Resolver = &SVCBFilter{}
+
+type SVCBFilterOptions struct {
+	// Remove all SVCB and HTTPS records from responses.
+	Drop bool
+
+	// Names of the parameters to remove from records, like "ech", "ipv4hint"
+	// or "ipv6hint". Unregistered keys can be given as "key<number>".
+	RemoveKeys []string
+}
+
+// NewSVCBFilter returns a new instance of an SVCB/HTTPS record filter.
+func NewSVCBFilter(id string, resolver Resolver, opt SVCBFilterOptions) (*SVCBFilter, error) {
+	remove := make(map[dns.SVCBKey]struct{})
+	for _, name := range opt.RemoveKeys {
+		key, err := parseSVCBKey(name)
+		if err != nil {
+			return nil, err
+		}
+		if key == dns.SVCB_MANDATORY {
+			return nil, fmt.Errorf("svcb key '%s' can not be removed", name)
+		}
+		remove[key] = struct{}{}
+	}
+	return &SVCBFilter{id: id, resolver: resolver, opt: opt, remove: remove}, nil
+}
+
+// Resolve a DNS query, then remove or modify SVCB and HTTPS records in the
+// response.
+func (r *SVCBFilter) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	answer, err := r.resolver.Resolve(q, ci)
+	if err != nil || answer == nil || answer.Rcode != dns.RcodeSuccess {
+		return answer, err
+	}
+	if r.opt.Drop {
+		answer.Answer = r.dropRecords(answer.Answer)
+		answer.Extra = r.dropRecords(answer.Extra)
+		return answer, nil
+	}
+	if len(r.remove) == 0 {
+		return answer, nil
+	}
+	for _, records := range [][]dns.RR{answer.Answer, answer.Extra} {
+		for _, rr := range records {
+			var svcb *dns.SVCB
+			switch rr := rr.(type) {
+			case *dns.SVCB:
+				svcb = rr
+			case *dns.HTTPS:
+				svcb = &rr.SVCB
+			default:
+				continue
+			}
+			if r.removeKeys(svcb) {
+				logger(r.id, q, ci).WithField("rr", svcb.Hdr.Name).Debug("removed parameters from record")
+			}
+		}
+	}
+	return answer, nil
+}
+
+func (r *SVCBFilter) String() string {
+	return r.id
+}
+
+// Returns the records without any SVCB or HTTPS records, or their signatures.
+func (r *SVCBFilter) dropRecords(records []dns.RR) []dns.RR {
+	var out []dns.RR
+	for _, rr := range records {
+		rrtype := rr.Header().Rrtype
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			rrtype = sig.TypeCovered
+		}
+		if rrtype == dns.TypeSVCB || rrtype == dns.TypeHTTPS {
+			continue
+		}
+		out = append(out, rr)
+	}
+	return out
+}
+
+// Removes the configured parameters from a record. They are also removed from
+// the list of mandatory keys, otherwise clients would have to ignore the record.
+// Returns true if the record was modified.
+func (r *SVCBFilter) removeKeys(rr *dns.SVCB) bool {
+	var (
+		values   []dns.SVCBKeyValue
+		modified bool
+	)
+	for _, kv := range rr.Value {
+		if _, ok := r.remove[kv.Key()]; ok {
+			modified = true
+			continue
+		}
+		if mandatory, ok := kv.(*dns.SVCBMandatory); ok {
+			var keys []dns.SVCBKey
+			for _, key := range mandatory.Code {
+				if _, ok := r.remove[key]; !ok {
+					keys = append(keys, key)
+				}
+			}
+			if len(keys) == 0 {
+				modified = true
+				continue
+			}
+			if len(keys) != len(mandatory.Code) {
+				kv = &dns.SVCBMandatory{Code: keys}
+				modified = true
+			}
+		}
+		values = append(values, kv)
+	}
+	rr.Value = values
+	return modified
+}
+
+// Parses the name of an SVCB key, like "ech" or "key65333".
+func parseSVCBKey(name string) (dns.SVCBKey, error) {
+	name = strings.ToLower(name)
+	for key := dns.SVCB_MANDATORY; key <= dns.SVCB_IPV6HINT; key++ {
+		if key.String() == name {
+			return key, nil
+		}
+	}
+	if strings.HasPrefix(name, "key") {
+		n, err := strconv.ParseUint(name[3:], 10, 16)
+		if err == nil && n != 65535 {
+			return dns.SVCBKey(n), nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported svcb key '%s'", name)
+}
@@ -0,0 +1,51 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSVCBFilter(t *testing.T) {
+	var ci ClientInfo
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			rr, err := dns.NewRR("example.com. 300 IN HTTPS 1 . mandatory=alpn,ipv6hint alpn=h2 ipv4hint=192.0.2.1 ech=AAAA ipv6hint=2001:db8::1")
+			require.NoError(t, err)
+			a.Answer = []dns.RR{rr}
+			return a, nil
+		},
+	}
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeHTTPS)
+
+	// Remove ECH and IPv6 hints, ipv6hint also has to be removed from the mandatory keys
+	r, err := NewSVCBFilter("test-svcb", upstream, SVCBFilterOptions{RemoveKeys: []string{"ech", "ipv6hint"}})
+	require.NoError(t, err)
+	a, err := r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Len(t, a.Answer, 1)
+	var keys []dns.SVCBKey
+	for _, kv := range a.Answer[0].(*dns.HTTPS).Value {
+		keys = append(keys, kv.Key())
+		if mandatory, ok := kv.(*dns.SVCBMandatory); ok {
+			require.Equal(t, []dns.SVCBKey{dns.SVCB_ALPN}, mandatory.Code)
+		}
+	}
+	require.Equal(t, []dns.SVCBKey{dns.SVCB_MANDATORY, dns.SVCB_ALPN, dns.SVCB_IPV4HINT}, keys)
+
+	// Drop the records entirely
+	r, err = NewSVCBFilter("test-svcb", upstream, SVCBFilterOptions{Drop: true})
+	require.NoError(t, err)
+	a, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Empty(t, a.Answer)
+
+	// Unknown keys are rejected
+	_, err = NewSVCBFilter("test-svcb", upstream, SVCBFilterOptions{RemoveKeys: []string{"bla"}})
+	require.Error(t, err)
+}
@@ -1,6 +1,7 @@
 package rdns
 
 import (
+	"expvar"
 	"fmt"
 	"strings"
 
@@ -15,6 +16,7 @@ type Syslog struct {
 	writer   *syslog.Writer
 	resolver Resolver
 	opt      SyslogOptions
+	metrics  *SyslogMetrics
 }
 
 var _ Resolver = &Syslog{}
@@ -38,6 +40,19 @@ type SyslogOptions struct {
 
 	// Log all response records, including those that do not match the query type
 	Verbose bool
+
+	// Fraction of queries that are logged, between 0 and 1. All queries are
+	// logged by default.
+	SampleRate float64
+}
+
+type SyslogMetrics struct {
+	// Number of queries, logged or not.
+	query *expvar.Int
+	// Response codes of all queries, logged or not.
+	response *expvar.Map
+	// Number of queries that were logged.
+	logged *expvar.Int
 }
 
 // NewSyslog returns a new instance of a Syslog generator.
@@ -47,25 +62,42 @@ func NewSyslog(id string, resolver Resolver, opt SyslogOptions) *Syslog {
 		// Log any error but don't block if this fails
 		logrus.New().WithError(err).Error("failed to initialize syslog")
 	}
+	if opt.SampleRate == 0 {
+		opt.SampleRate = 1
+	}
 	return &Syslog{
 		id:       id,
 		writer:   writer,
 		resolver: resolver,
 		opt:      opt,
+		metrics: &SyslogMetrics{
+			query:    getVarInt("syslog", id, "query"),
+			response: getVarMap("syslog", id, "response"),
+			logged:   getVarInt("syslog", id, "logged"),
+		},
 	}
 }
 
 // Resolve passes a DNS query through unmodified. Query details are sent via syslog.
 func (r *Syslog) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	r.metrics.query.Add(1)
+	if !sampled(r.opt.SampleRate) {
+		a, err := r.resolver.Resolve(q, ci)
+		r.metrics.response.Add(responseCode(a, err), 1)
+		return a, err
+	}
+	r.metrics.logged.Add(1)
+
 	var msg string
 	if r.opt.LogRequest {
 		msg = fmt.Sprintf("id=%s qid=%d type=query client=%s qtype=%s qname=%s", r.id, q.Id, ci.SourceIP.String(), qType(q), qName(q))
-		if _, err := r.writer.Write([]byte(msg)); err != nil {
+		if err := r.write(msg); err != nil {
 			logger(r.id, q, ci).WithError(err).Error("failed to send syslog")
 		}
 	}
 
 	a, err := r.resolver.Resolve(q, ci)
+	r.metrics.response.Add(responseCode(a, err), 1)
 	if err == nil && a != nil && r.opt.LogResponse {
 		if a.Rcode == dns.RcodeSuccess {
 			var answerRRs = a.Answer
@@ -83,20 +115,20 @@ func (r *Syslog) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 			for i, rr := range answerRRs {
 				s := strings.ReplaceAll(rr.String(), "\t", " ")
 				msg = fmt.Sprintf("id=%s qid=%d type=answer answer-num=%d/%d qtype=%s qname=%s answer=%q", r.id, q.Id, i+1, len(answerRRs), qType(q), qName(q), s)
-				if _, err := r.writer.Write([]byte(msg)); err != nil {
+				if err := r.write(msg); err != nil {
 					logger(r.id, q, ci).WithError(err).Error("failed to send syslog")
 				}
 			}
 			// Synthesize a NODATA rcode when the response is NOERROR without any response records
 			if len(answerRRs) == 0 {
 				msg = fmt.Sprintf("id=%s qid=%d type=answer qtype=%s qname=%s rcode=NODATA", r.id, q.Id, qType(q), qName(q))
-				if _, err := r.writer.Write([]byte(msg)); err != nil {
+				if err := r.write(msg); err != nil {
 					logger(r.id, q, ci).WithError(err).Error("failed to send syslog")
 				}
 			}
 		} else {
 			msg = fmt.Sprintf("id=%s qid=%d type=answer qtype=%s qname=%s rcode=%s", r.id, q.Id, qType(q), qName(q), dns.RcodeToString[a.Rcode])
-			if _, err := r.writer.Write([]byte(msg)); err != nil {
+			if err := r.write(msg); err != nil {
 				logger(r.id, q, ci).WithError(err).Error("failed to send syslog")
 			}
 		}
@@ -104,6 +136,15 @@ func (r *Syslog) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	return a, err
 }
 
+// Sends a message to syslog, including the static labels if any are defined.
+func (r *Syslog) write(msg string) error {
+	if labelString != "" {
+		msg += " " + labelString
+	}
+	_, err := r.writer.Write([]byte(msg))
+	return err
+}
+
 func (r *Syslog) String() string {
 	return r.id
 }
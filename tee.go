@@ -0,0 +1,131 @@
+package rdns
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// Tee passes queries to its upstream resolver and sends a copy of them to a
+// secondary resolver in the background. Responses from the secondary are
+// discarded. Used to test a new upstream or pipeline with real traffic
+// without affecting clients.
+type Tee struct {
+	id       string
+	resolver Resolver
+	opt      TeeOptions
+	domains  domainSet
+	inFlight chan struct{}
+	metrics  *TeeMetrics
+}
+
+type TeeMetrics struct {
+	// Count of queries sent to the secondary resolver.
+	mirrored *expvar.Int
+	// Count of queries not mirrored because too many were in flight.
+	dropped *expvar.Int
+	// Count of failed queries to the secondary resolver.
+	failed *expvar.Int
+	// Response codes from the secondary resolver.
+	response *expvar.Map
+}
+
+var _ Resolver = &Tee{}
+
+type TeeOptions struct {
+	// Resolver that receives copies of the queries.
+	Resolver Resolver
+
+	// Only mirror queries for these domains or their sub-domains. All
+	// queries are mirrored if empty.
+	Domains []string
+
+	// Fraction of the queries to mirror, between 0 and 1. Defaults to 1.
+	SampleRate float64
+
+	// Maximum number of mirrored queries in flight. Further queries aren't
+	// mirrored until some complete, so a slow secondary can't pile up
+	// goroutines. Defaults to 100.
+	MaxInFlight int
+}
+
+// NewTee returns a new instance of a tee.
+func NewTee(id string, resolver Resolver, opt TeeOptions) (*Tee, error) {
+	if opt.Resolver == nil {
+		return nil, errors.New("no secondary resolver for tee")
+	}
+	if opt.SampleRate == 0 {
+		opt.SampleRate = 1
+	}
+	if opt.SampleRate < 0 || opt.SampleRate > 1 {
+		return nil, fmt.Errorf("invalid tee sample rate %v", opt.SampleRate)
+	}
+	if opt.MaxInFlight == 0 {
+		opt.MaxInFlight = 100
+	}
+	return &Tee{
+		id:       id,
+		resolver: resolver,
+		opt:      opt,
+		domains:  newDomainSet(opt.Domains),
+		inFlight: make(chan struct{}, opt.MaxInFlight),
+		metrics: &TeeMetrics{
+			mirrored: getVarInt("tee", id, "mirrored"),
+			dropped:  getVarInt("tee", id, "dropped"),
+			failed:   getVarInt("tee", id, "failed"),
+			response: getVarMap("tee", id, "response"),
+		},
+	}, nil
+}
+
+// Resolve a DNS query with the upstream resolver and mirror it to the secondary.
+func (r *Tee) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if r.shouldMirror(q) {
+		r.mirror(q, ci)
+	}
+	return r.resolver.Resolve(q, ci)
+}
+
+func (r *Tee) String() string {
+	return r.id
+}
+
+func (r *Tee) shouldMirror(q *dns.Msg) bool {
+	if len(q.Question) < 1 {
+		return false
+	}
+	if len(r.domains) > 0 && !r.domains.match(q.Question[0].Name) {
+		return false
+	}
+	return sampled(r.opt.SampleRate)
+}
+
+// Sends a copy of the query to the secondary resolver in the background.
+func (r *Tee) mirror(q *dns.Msg, ci ClientInfo) {
+	select {
+	case r.inFlight <- struct{}{}:
+	default:
+		r.metrics.dropped.Add(1)
+		return
+	}
+	r.metrics.mirrored.Add(1)
+	q = q.Copy() // The upstream pipeline may modify the original
+
+	// Query logs in front of the tee only show the upstream that answered
+	ci.trace = nil
+	go func() {
+		defer func() { <-r.inFlight }()
+		log := logger(r.id, q, ci).WithField("resolver", r.opt.Resolver.String())
+		a, err := r.opt.Resolver.Resolve(q, ci)
+		if err != nil {
+			r.metrics.failed.Add(1)
+			log.WithError(err).Debug("mirrored query failed")
+			return
+		}
+		if a != nil {
+			r.metrics.response.Add(rCode(a), 1)
+		}
+	}()
+}
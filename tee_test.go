@@ -0,0 +1,71 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTee(t *testing.T) {
+	var ci ClientInfo
+	primary := new(TestResolver)
+	mirrored := make(chan string, 10)
+	secondary := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			mirrored <- q.Question[0].Name
+			return nil, nil
+		},
+	}
+	g, err := NewTee("test-tee", primary, TeeOptions{
+		Resolver: secondary,
+		Domains:  []string{"example.com"},
+	})
+	require.NoError(t, err)
+
+	// Queries for the domain go to both resolvers
+	q := new(dns.Msg)
+	q.SetQuestion("www.example.com.", dns.TypeA)
+	_, err = g.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, "www.example.com.", <-mirrored)
+	require.Equal(t, 1, primary.HitCount())
+
+	// Other queries are only sent upstream
+	q.SetQuestion("example.net.", dns.TypeA)
+	_, err = g.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 2, primary.HitCount())
+	require.Equal(t, 1, secondary.HitCount())
+
+	// A secondary resolver is required
+	_, err = NewTee("test-tee", primary, TeeOptions{})
+	require.Error(t, err)
+}
+
+func TestTeeMaxInFlight(t *testing.T) {
+	var ci ClientInfo
+	primary := new(TestResolver)
+	block := make(chan struct{})
+	secondary := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			<-block
+			return q, nil
+		},
+	}
+	g, err := NewTee("test-tee-inflight", primary, TeeOptions{Resolver: secondary, MaxInFlight: 1})
+	require.NoError(t, err)
+
+	// The second query isn't mirrored while the first is still in flight, but
+	// both are answered
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	for i := 0; i < 2; i++ {
+		_, err = g.Resolve(q, ci)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 2, primary.HitCount())
+	require.Equal(t, int64(1), g.metrics.mirrored.Value())
+	require.Equal(t, int64(1), g.metrics.dropped.Value())
+	close(block)
+}
@@ -1,17 +1,29 @@
 package rdns
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 )
 
+// TLSKeyLogWriter, if set, receives the TLS session secrets of all client and
+// server connections in NSS key log format. This allows decrypting traffic
+// with tools like Wireshark. It compromises the security of the connections
+// and should only be used for debugging.
+var TLSKeyLogWriter io.Writer
+
 // TLSServerConfig is a convenience function that builds a tls.Config instance for TLS servers
 // based on common options and certificate+key files.
 func TLSServerConfig(caFile, crtFile, keyFile string, mutualTLS bool) (*tls.Config, error) {
 	tlsConfig := &tls.Config{
-		MinVersion: tls.VersionTLS12,
+		MinVersion:   tls.VersionTLS12,
+		KeyLogWriter: TLSKeyLogWriter,
 	}
 	if mutualTLS {
 		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
@@ -43,7 +55,8 @@ func TLSServerConfig(caFile, crtFile, keyFile string, mutualTLS bool) (*tls.Conf
 // based on common options and certificate+key files.
 func TLSClientConfig(caFile, crtFile, keyFile string) (*tls.Config, error) {
 	tlsConfig := &tls.Config{
-		MinVersion: tls.VersionTLS12,
+		MinVersion:   tls.VersionTLS12,
+		KeyLogWriter: TLSKeyLogWriter,
 	}
 
 	// Add client key/cert if provided
@@ -69,3 +82,90 @@ func TLSClientConfig(caFile, crtFile, keyFile string) (*tls.Config, error) {
 	}
 	return tlsConfig, nil
 }
+
+// TLSPinning returns a function for tls.Config.VerifyPeerCertificate that
+// fails the connection unless the certificate chain of the server contains a
+// public key matching one of the pins. Pins are base64-encoded SHA256 hashes
+// of the DER-encoded SubjectPublicKeyInfo, as defined in RFC 7469. The pins
+// are checked in addition to the regular certificate validation.
+func TLSPinning(pins []string) (func([][]byte, [][]*x509.Certificate) error, error) {
+	var hashes [][]byte
+	for _, pin := range pins {
+		hash, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("invalid spki pin '%s'", pin)
+		}
+		hashes = append(hashes, hash)
+	}
+	match := func(cert *x509.Certificate) bool {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, hash := range hashes {
+			if bytes.Equal(sum[:], hash) {
+				return true
+			}
+		}
+		return false
+	}
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		// Only use the certificates presented by the server if they were not
+		// validated, otherwise the pins need to match the validated chain.
+		if len(verifiedChains) == 0 {
+			for _, raw := range rawCerts {
+				cert, err := x509.ParseCertificate(raw)
+				if err != nil {
+					return err
+				}
+				if match(cert) {
+					return nil
+				}
+			}
+		}
+		for _, chain := range verifiedChains {
+			for _, cert := range chain {
+				if match(cert) {
+					return nil
+				}
+			}
+		}
+		return errors.New("no pinned public key in the server certificate chain")
+	}, nil
+}
+
+// ParseTLSVersion returns the TLS version for "1.2" or "1.3". Older versions
+// are not supported.
+func ParseTLSVersion(s string) (uint16, error) {
+	switch s {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unsupported tls version '%s'", s)
+	}
+}
+
+// ParseTLSCipherSuites returns the IDs of cipher suites by name, like
+// "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384". Only secure TLS 1.2 cipher suites
+// are supported since the TLS 1.3 ones can't be configured.
+func ParseTLSCipherSuites(names []string) ([]uint16, error) {
+	var ids []uint16
+	for _, name := range names {
+		var found bool
+		for _, suite := range tls.CipherSuites() {
+			if suite.Name != name {
+				continue
+			}
+			for _, v := range suite.SupportedVersions {
+				if v == tls.VersionTLS12 {
+					found = true
+				}
+			}
+			ids = append(ids, suite.ID)
+			break
+		}
+		if !found {
+			return nil, fmt.Errorf("unsupported tls cipher suite '%s'", name)
+		}
+	}
+	return ids, nil
+}
@@ -0,0 +1,76 @@
+package rdns
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSPinning(t *testing.T) {
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	tlsServerConfig, err := TLSServerConfig("", "testdata/server.crt", "testdata/server.key", false)
+	require.NoError(t, err)
+	s := NewDoTListener("test-ln", addr, DoTListenerOptions{TLSConfig: tlsServerConfig}, new(TestResolver))
+	go func() {
+		err := s.Start()
+		require.NoError(t, err)
+	}()
+	defer s.Stop()
+	time.Sleep(time.Second)
+
+	resolve := func(pins ...string) error {
+		tlsConfig, err := TLSClientConfig("testdata/ca.crt", "", "")
+		require.NoError(t, err)
+		tlsConfig.VerifyPeerCertificate, err = TLSPinning(pins)
+		require.NoError(t, err)
+		c, err := NewDoTClient("test-dot", addr, DoTClientOptions{TLSConfig: tlsConfig})
+		require.NoError(t, err)
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		_, err = c.Resolve(q, ClientInfo{})
+		return err
+	}
+
+	// Pin of the server key
+	require.NoError(t, resolve(testPin(t, "testdata/server.crt")))
+
+	// Pin of the CA key, plus one that doesn't match
+	require.NoError(t, resolve("AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=", testPin(t, "testdata/ca.crt")))
+
+	// No matching pin fails the connection
+	require.Error(t, resolve("AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="))
+
+	// Invalid pins are rejected
+	_, err = TLSPinning([]string{"not-a-pin"})
+	require.Error(t, err)
+}
+
+// Returns the pin of the public key in a PEM-encoded certificate.
+func testPin(t *testing.T, filename string) string {
+	b, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	block, _ := pem.Decode(b)
+	require.NotNil(t, block)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestParseTLSCipherSuites(t *testing.T) {
+	ids, err := ParseTLSCipherSuites([]string{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"})
+	require.NoError(t, err)
+	require.Len(t, ids, 1)
+
+	// TLS 1.3 suites can't be configured
+	_, err = ParseTLSCipherSuites([]string{"TLS_AES_128_GCM_SHA256"})
+	require.Error(t, err)
+}
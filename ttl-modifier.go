@@ -1,6 +1,8 @@
 package rdns
 
 import (
+	"fmt"
+
 	"github.com/miekg/dns"
 )
 
@@ -10,6 +12,8 @@ type TTLModifier struct {
 	id string
 	TTLModifierOptions
 	resolver Resolver
+	domains  domainSet
+	rules    []ttlRule
 }
 
 var _ Resolver = &TTLModifier{}
@@ -21,6 +25,31 @@ type TTLModifierOptions struct {
 	// Maximum TTL, any RR with a TTL higher than this will have their value
 	// set to the max. A value of 0 disables the limit. Default 0.
 	MaxTTL uint32
+
+	// Only modify responses to queries for these domains or their sub-domains.
+	// Applies to all queries if empty.
+	Domains []string
+}
+
+// TTLRule sets the TTL of the records in responses that match a condition.
+type TTLRule struct {
+	// Condition in the same language as script groups, like
+	// `ips in "10.0.0.0/8"` or `qname == "ns1.example.com."`. The query and
+	// response variables of script groups are available. The rule always
+	// applies if empty.
+	If string
+
+	// TTL to set on all records. If 0, MinTTL and MaxTTL are applied instead.
+	TTL uint32
+
+	// Limits to apply to the TTL of records, a MaxTTL of 0 disables the limit.
+	MinTTL uint32
+	MaxTTL uint32
+}
+
+type ttlRule struct {
+	TTLRule
+	cond scriptExpr
 }
 
 // NewTTLModifier returns a new instance of a TTL modifier.
@@ -29,9 +58,35 @@ func NewTTLModifier(id string, resolver Resolver, opt TTLModifierOptions) *TTLMo
 		id:                 id,
 		TTLModifierOptions: opt,
 		resolver:           resolver,
+		domains:            newDomainSet(opt.Domains),
 	}
 }
 
+// SetRules sets rules that set the TTL based on the query and response, like
+// a short TTL for answers with private addresses. The first rule whose
+// condition matches is applied instead of MinTTL and MaxTTL. Must be called
+// before the modifier is used.
+func (r *TTLModifier) SetRules(rules []TTLRule) error {
+	var compiledRules []ttlRule
+	vars := scriptAllResponseVars()
+	for i, rule := range rules {
+		compiled := ttlRule{TTLRule: rule}
+		if rule.If != "" {
+			cond, err := parseScriptExpr(rule.If, vars)
+			if err != nil {
+				return fmt.Errorf("ttl rule %d: %w", i+1, err)
+			}
+			compiled.cond = cond
+		}
+		if rule.TTL == 0 && rule.MaxTTL > 0 && rule.MinTTL > rule.MaxTTL {
+			return fmt.Errorf("ttl rule %d: minimum ttl is greater than the maximum", i+1)
+		}
+		compiledRules = append(compiledRules, compiled)
+	}
+	r.rules = compiledRules
+	return nil
+}
+
 // Resolve a DNS query by first resoling it upstream, then applying TTL limits
 // on the response.
 func (r *TTLModifier) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
@@ -39,6 +94,17 @@ func (r *TTLModifier) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	if err != nil || a == nil {
 		return a, err
 	}
+	if len(r.domains) > 0 && (len(q.Question) < 1 || !r.domains.match(q.Question[0].Name)) {
+		return a, nil
+	}
+
+	minTTL, maxTTL := r.MinTTL, r.MaxTTL
+	if rule := r.matchRule(q, ci, a); rule != nil {
+		minTTL, maxTTL = rule.MinTTL, rule.MaxTTL
+		if rule.TTL > 0 {
+			minTTL, maxTTL = rule.TTL, rule.TTL
+		}
+	}
 
 	var modified bool
 	for _, rrs := range [][]dns.RR{a.Answer, a.Ns, a.Extra} {
@@ -47,12 +113,12 @@ func (r *TTLModifier) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 				continue
 			}
 			h := rr.Header()
-			if h.Ttl < r.MinTTL {
-				h.Ttl = r.MinTTL
+			if h.Ttl < minTTL {
+				h.Ttl = minTTL
 				modified = true
 			}
-			if r.MaxTTL > 0 && h.Ttl > r.MaxTTL {
-				h.Ttl = r.MaxTTL
+			if maxTTL > 0 && h.Ttl > maxTTL {
+				h.Ttl = maxTTL
 				modified = true
 			}
 		}
@@ -63,6 +129,21 @@ func (r *TTLModifier) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	return a, nil
 }
 
+// Returns the first rule that matches the query and response, or nil.
+func (r *TTLModifier) matchRule(q *dns.Msg, ci ClientInfo, a *dns.Msg) *ttlRule {
+	if len(r.rules) == 0 || len(q.Question) < 1 {
+		return nil
+	}
+	env := newScriptEnv(q, ci)
+	env.addResponse(a)
+	for i := range r.rules {
+		if r.rules[i].cond == nil || scriptTrue(r.rules[i].cond.eval(env)) {
+			return &r.rules[i]
+		}
+	}
+	return nil
+}
+
 func (r *TTLModifier) String() string {
 	return r.id
 }
@@ -0,0 +1,88 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTTLModifierDomains(t *testing.T) {
+	var ci ClientInfo
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = []dns.RR{
+				&dns.A{
+					Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600},
+					A:   net.IP{192, 0, 2, 1},
+				},
+			}
+			return a, nil
+		},
+	}
+	r := NewTTLModifier("test-ttl", upstream, TTLModifierOptions{MaxTTL: 60, Domains: []string{"Corp.example.com"}})
+
+	// Names in the domain, or under it, are modified
+	q := new(dns.Msg)
+	q.SetQuestion("host.corp.example.com.", dns.TypeA)
+	a, err := r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, uint32(60), a.Answer[0].Header().Ttl)
+
+	// Other names are not
+	q.SetQuestion("www.example.com.", dns.TypeA)
+	a, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, uint32(3600), a.Answer[0].Header().Ttl)
+}
+
+func TestTTLModifierRules(t *testing.T) {
+	var ci ClientInfo
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			ip := net.IP{192, 0, 2, 1}
+			if q.Question[0].Name == "host.internal.test." {
+				ip = net.IP{10, 0, 0, 1}
+			}
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = []dns.RR{
+				&dns.A{
+					Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 600},
+					A:   ip,
+				},
+			}
+			return a, nil
+		},
+	}
+	r := NewTTLModifier("test-ttl-rules", upstream, TTLModifierOptions{MaxTTL: 300})
+	err := r.SetRules([]TTLRule{
+		{If: `ips in "10.0.0.0/8"`, TTL: 30},
+		{If: `qname == "ns1.example.com."`, MinTTL: 86400},
+	})
+	require.NoError(t, err)
+
+	resolve := func(name string) uint32 {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		a, err := r.Resolve(q, ci)
+		require.NoError(t, err)
+		return a.Answer[0].Header().Ttl
+	}
+
+	// Private address, first rule sets the TTL
+	require.Equal(t, uint32(30), resolve("host.internal.test."))
+
+	// Second rule raises the TTL and replaces the max of the modifier
+	require.Equal(t, uint32(86400), resolve("ns1.example.com."))
+
+	// No rule matches, the limits of the modifier apply
+	require.Equal(t, uint32(300), resolve("www.example.com."))
+
+	// Invalid conditions are rejected
+	err = NewTTLModifier("test-ttl-rules-invalid", upstream, TTLModifierOptions{}).SetRules([]TTLRule{{If: `unknown == "x"`}})
+	require.Error(t, err)
+}
@@ -0,0 +1,164 @@
+package rdns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// TypeFilter is a group that answers queries for some record types itself,
+// with an empty response, a response code, or by dropping them. All other
+// queries are forwarded to the resolver. It can be used to refuse ANY queries,
+// drop reverse lookups for private networks, or to hide AAAA records in
+// networks with broken IPv6.
+type TypeFilter struct {
+	id       string
+	resolver Resolver
+	rules    []typeFilterRule
+}
+
+var _ Resolver = &TypeFilter{}
+
+type TypeFilterOptions struct {
+	// Rules are evaluated in order, the first matching rule is applied.
+	Rules []TypeFilterRule
+}
+
+// TypeFilterRule defines which queries are filtered and how.
+type TypeFilterRule struct {
+	// Query types the rule applies to, like "ANY" or "AAAA". All types if empty.
+	Types []string
+
+	// Limit the rule to reverse lookups (in-addr.arpa and ip6.arpa names) of
+	// addresses in these networks. Optional.
+	ReverseNets []*net.IPNet
+
+	// "nodata" responds with no records, "rcode" with the response code in
+	// RCode, and "drop" drops the query. Defaults to "nodata".
+	Action string
+	RCode  int
+}
+
+type typeFilterRule struct {
+	TypeFilterRule
+	types map[uint16]struct{}
+}
+
+// NewTypeFilter returns a new instance of a query type filter.
+func NewTypeFilter(id string, resolver Resolver, opt TypeFilterOptions) (*TypeFilter, error) {
+	r := &TypeFilter{id: id, resolver: resolver}
+	for i, rule := range opt.Rules {
+		compiled := typeFilterRule{TypeFilterRule: rule, types: make(map[uint16]struct{})}
+		for _, t := range rule.Types {
+			qtype, ok := dns.StringToType[strings.ToUpper(t)]
+			if !ok {
+				return nil, fmt.Errorf("rule %d: unknown query type '%s'", i+1, t)
+			}
+			compiled.types[qtype] = struct{}{}
+		}
+		switch rule.Action {
+		case "":
+			compiled.Action = "nodata"
+		case "nodata", "rcode", "drop":
+		default:
+			return nil, fmt.Errorf("rule %d: unsupported action '%s'", i+1, rule.Action)
+		}
+		r.rules = append(r.rules, compiled)
+	}
+	return r, nil
+}
+
+// Resolve a DNS query, or answer it directly if it matches a rule.
+func (r *TypeFilter) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return nil, errors.New("no question in query")
+	}
+	question := q.Question[0]
+	for _, rule := range r.rules {
+		if !rule.match(question) {
+			continue
+		}
+		log := logger(r.id, q, ci).WithField("action", rule.Action)
+		switch rule.Action {
+		case "drop":
+			log.Debug("dropping query")
+			return nil, nil
+		case "rcode":
+			log.WithField("rcode", rule.RCode).Debug("responding with rcode")
+			a := new(dns.Msg)
+			a.SetRcode(q, rule.RCode)
+			return a, nil
+		default:
+			log.Debug("responding with nodata")
+			a := new(dns.Msg)
+			a.SetReply(q)
+			return a, nil
+		}
+	}
+	return r.resolver.Resolve(q, ci)
+}
+
+func (r *TypeFilter) String() string {
+	return r.id
+}
+
+func (r typeFilterRule) match(q dns.Question) bool {
+	if len(r.types) > 0 {
+		if _, ok := r.types[q.Qtype]; !ok {
+			return false
+		}
+	}
+	if len(r.ReverseNets) == 0 {
+		return true
+	}
+	ptrNet := reverseNameToNet(q.Name)
+	if ptrNet == nil {
+		return false
+	}
+	ptrOnes, _ := ptrNet.Mask.Size()
+	for _, n := range r.ReverseNets {
+		ones, _ := n.Mask.Size()
+		if n.Contains(ptrNet.IP) && ptrOnes >= ones && len(n.IP) == len(ptrNet.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the network a reverse lookup name refers to, like 192.168.0.0/16 for
+// "168.192.in-addr.arpa.", or nil if it's not a valid reverse name. Full names
+// return a single address, /32 or /128.
+func reverseNameToNet(name string) *net.IPNet {
+	labels := reverseLabels(strings.ToLower(name))
+	switch {
+	case len(labels) > 2 && labels[0] == "arpa" && labels[1] == "in-addr" && len(labels) <= 6:
+		ip := make(net.IP, net.IPv4len)
+		for i, label := range labels[2:] {
+			b, err := strconv.ParseUint(label, 10, 8)
+			if err != nil {
+				return nil
+			}
+			ip[i] = byte(b)
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(8*(len(labels)-2), 32)}
+	case len(labels) > 2 && labels[0] == "arpa" && labels[1] == "ip6" && len(labels) <= 34:
+		ip := make(net.IP, net.IPv6len)
+		for i, label := range labels[2:] {
+			nibble, err := strconv.ParseUint(label, 16, 4)
+			if err != nil || len(label) != 1 {
+				return nil
+			}
+			if i%2 == 0 {
+				ip[i/2] |= byte(nibble) << 4
+			} else {
+				ip[i/2] |= byte(nibble)
+			}
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(4*(len(labels)-2), 128)}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTypeFilter(t *testing.T) {
+	var ci ClientInfo
+	upstream := new(TestResolver)
+	_, private, err := net.ParseCIDR("192.168.0.0/16")
+	require.NoError(t, err)
+
+	r, err := NewTypeFilter("test-tf", upstream, TypeFilterOptions{
+		Rules: []TypeFilterRule{
+			{Types: []string{"ANY"}, Action: "rcode", RCode: dns.RcodeRefused},
+			{Types: []string{"PTR"}, ReverseNets: []*net.IPNet{private}, Action: "drop"},
+			{Types: []string{"AAAA"}},
+		},
+	})
+	require.NoError(t, err)
+	q := new(dns.Msg)
+
+	// ANY is refused
+	q.SetQuestion("example.com.", dns.TypeANY)
+	a, err := r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeRefused, a.Rcode)
+
+	// Reverse lookups for the private network are dropped, others are forwarded
+	q.SetQuestion("4.3.168.192.in-addr.arpa.", dns.TypePTR)
+	a, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Nil(t, a)
+	require.Equal(t, 0, upstream.HitCount())
+	q.SetQuestion("1.2.0.192.in-addr.arpa.", dns.TypePTR)
+	_, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, upstream.HitCount())
+
+	// AAAA gets an empty response
+	q.SetQuestion("example.com.", dns.TypeAAAA)
+	a, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Empty(t, a.Answer)
+	require.Equal(t, 1, upstream.HitCount())
+
+	// Other types are forwarded
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 2, upstream.HitCount())
+}
@@ -0,0 +1,192 @@
+package rdns
+
+import (
+	"expvar"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Watchdog monitors the heap size, number of goroutines and open file
+// descriptors of the process and exposes them as metrics. When one of the
+// configured limits is exceeded, it can make listeners refuse queries until
+// usage is back below a low-water mark, and flush caches when the heap is
+// over its limit. Intended to keep instances on small devices stable under
+// load.
+type Watchdog struct {
+	opt     WatchdogOptions
+	metrics *WatchdogMetrics
+	over    bool // A limit was exceeded and usage isn't below the low-water mark yet
+}
+
+type WatchdogOptions struct {
+	// Time between checks. Default 10 seconds.
+	Interval time.Duration
+
+	// Limits, not checked if 0. Heap size in bytes.
+	MaxHeap       uint64
+	MaxGoroutines int
+	MaxFDs        int
+
+	// Fraction of the limits, between 0 and 1, usage has to drop below after
+	// a limit was exceeded before the safeguards are lifted. Default 0.9.
+	LowWater float64
+
+	// Refuse queries in all listeners while a limit is exceeded.
+	ShedLoad bool
+
+	// Caches that are flushed when the heap limit is exceeded.
+	Caches []*Cache
+}
+
+type WatchdogMetrics struct {
+	// Heap size in bytes.
+	heap *expvar.Int
+	// Number of goroutines.
+	goroutines *expvar.Int
+	// Number of open file descriptors, -1 if not supported on the platform.
+	fds *expvar.Int
+	// Count of checks that exceeded a limit, by limit.
+	exceeded *expvar.Map
+	// 1 while queries are refused, 0 otherwise.
+	shedding *expvar.Int
+	// Count of cache flushes.
+	flushed *expvar.Int
+}
+
+// Set while listeners should refuse queries. Accessed atomically.
+var shedding int32
+
+// Returns true if listeners should refuse queries because the process is
+// over one of the watchdog limits.
+func sheddingLoad() bool {
+	return atomic.LoadInt32(&shedding) == 1
+}
+
+// NewWatchdog returns a new watchdog. It needs to be started to run checks.
+func NewWatchdog(opt WatchdogOptions) *Watchdog {
+	if opt.Interval == 0 {
+		opt.Interval = 10 * time.Second
+	}
+	if opt.LowWater <= 0 || opt.LowWater > 1 {
+		opt.LowWater = 0.9
+	}
+	return &Watchdog{
+		opt: opt,
+		metrics: &WatchdogMetrics{
+			heap:       getVarInt("watchdog", "process", "heap"),
+			goroutines: getVarInt("watchdog", "process", "goroutines"),
+			fds:        getVarInt("watchdog", "process", "fds"),
+			exceeded:   getVarMap("watchdog", "process", "exceeded"),
+			shedding:   getVarInt("watchdog", "process", "shedding"),
+			flushed:    getVarInt("watchdog", "process", "flushed"),
+		},
+	}
+}
+
+// Start running checks in the background.
+func (w *Watchdog) Start() {
+	go func() {
+		for {
+			w.check()
+			time.Sleep(w.opt.Interval)
+		}
+	}()
+}
+
+// Reads the current usage, updates the metrics and applies the safeguards if
+// a limit is exceeded. Once over a limit, usage has to drop below the
+// low-water mark of all limits before the safeguards are lifted, to avoid
+// switching them on and off with every check. Returns true while the
+// safeguards apply.
+func (w *Watchdog) check() bool {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	goroutines := runtime.NumGoroutine()
+	fds := openFDs()
+	w.metrics.heap.Set(int64(mem.HeapAlloc))
+	w.metrics.goroutines.Set(int64(goroutines))
+	w.metrics.fds.Set(int64(fds))
+
+	var (
+		exceeded      []string
+		aboveLowWater bool
+	)
+	for _, l := range []struct {
+		name         string
+		usage, limit float64
+	}{
+		{"heap", float64(mem.HeapAlloc), float64(w.opt.MaxHeap)},
+		{"goroutines", float64(goroutines), float64(w.opt.MaxGoroutines)},
+		{"fds", float64(fds), float64(w.opt.MaxFDs)},
+	} {
+		if l.limit <= 0 {
+			continue
+		}
+		if l.usage > l.limit {
+			w.metrics.exceeded.Add(l.name, 1)
+			exceeded = append(exceeded, l.name)
+		}
+		if l.usage > l.limit*w.opt.LowWater {
+			aboveLowWater = true
+		}
+	}
+
+	if len(exceeded) > 0 {
+		Log.WithFields(logrus.Fields{
+			"heap":       mem.HeapAlloc,
+			"goroutines": goroutines,
+			"fds":        fds,
+			"exceeded":   exceeded,
+		}).Warn("watchdog limit exceeded")
+	}
+	w.over = len(exceeded) > 0 || (w.over && aboveLowWater)
+
+	// Flushing caches only helps if it's the heap that's too large
+	if w.opt.MaxHeap > 0 && mem.HeapAlloc > w.opt.MaxHeap && len(w.opt.Caches) > 0 {
+		for _, c := range w.opt.Caches {
+			c.flush()
+		}
+		w.metrics.flushed.Add(1)
+		debug.FreeOSMemory()
+	}
+	if w.opt.ShedLoad {
+		w.setShedding(w.over)
+	}
+	return w.over
+}
+
+func (w *Watchdog) setShedding(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	if atomic.SwapInt32(&shedding, v) != v {
+		if on {
+			Log.Warn("refusing queries until usage is below the watchdog limits")
+		} else {
+			Log.Info("usage below the watchdog limits, accepting queries again")
+		}
+	}
+	w.metrics.shedding.Set(int64(v))
+}
+
+// Returns the number of open file descriptors of the process, or -1 if that
+// isn't supported on the platform.
+func openFDs() int {
+	f, err := os.Open("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return -1
+	}
+	// Don't count the descriptor used to read the directory
+	return len(names) - 1
+}
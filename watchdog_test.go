@@ -0,0 +1,84 @@
+package rdns
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatchdog(t *testing.T) {
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600},
+				A:   net.IP{127, 0, 0, 1},
+			}}
+			return a, nil
+		},
+	}
+	c := NewCache("test-watchdog-cache", upstream, CacheOptions{GCPeriod: time.Minute})
+
+	addr, err := getUDPLnAddress()
+	require.NoError(t, err)
+	s := NewDNSListener("test-watchdog-ln", addr, "udp", ListenOptions{}, c)
+	go func() {
+		err := s.Start()
+		require.NoError(t, err)
+	}()
+	defer s.Stop()
+	time.Sleep(time.Second)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	a, err := dns.Exchange(q, addr)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Equal(t, 1, upstream.HitCount())
+
+	// Usage below the limits
+	w := NewWatchdog(WatchdogOptions{MaxGoroutines: 1 << 20, ShedLoad: true, Caches: []*Cache{c}})
+	require.False(t, w.check())
+	require.False(t, sheddingLoad())
+
+	// The test alone runs more than one goroutine, queries are refused. The
+	// cache is not flushed since that only helps with the heap limit.
+	w = NewWatchdog(WatchdogOptions{MaxGoroutines: 1, ShedLoad: true, Caches: []*Cache{c}})
+	defer w.setShedding(false)
+	require.True(t, w.check())
+	require.True(t, sheddingLoad())
+	a, err = dns.Exchange(q, addr)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeRefused, a.Rcode)
+
+	// Back below the limit, but still above the low-water mark. Queries are
+	// still refused.
+	w.opt.MaxGoroutines = runtime.NumGoroutine() + 100
+	w.opt.LowWater = 0.01
+	require.True(t, w.check())
+	require.True(t, sheddingLoad())
+
+	// Below the low-water mark, the response is still cached
+	w.opt.LowWater = 1
+	require.False(t, w.check())
+	require.False(t, sheddingLoad())
+	a, err = dns.Exchange(q, addr)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Equal(t, 1, upstream.HitCount())
+
+	// Exceeding the heap limit flushes the cache
+	w = NewWatchdog(WatchdogOptions{MaxHeap: 1, LowWater: 1, Caches: []*Cache{c}})
+	require.True(t, w.check())
+	w.opt.MaxHeap = 1 << 40
+	require.False(t, w.check())
+	a, err = dns.Exchange(q, addr)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Equal(t, 2, upstream.HitCount())
+}
@@ -0,0 +1,336 @@
+package rdns
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ZoneResolver answers queries authoritatively from one or more zone files in
+// RFC 1035 format. Wildcards, delegations and CNAMEs within the zone are
+// supported. Queries for names outside the loaded zones are refused.
+type ZoneResolver struct {
+	id    string
+	opt   ZoneResolverOptions
+	mu    sync.RWMutex
+	zones []*zone
+}
+
+var _ Resolver = &ZoneResolver{}
+
+type ZoneResolverOptions struct {
+	// Zone files to load, each file has to contain exactly one zone
+	// starting with a SOA record.
+	Files []string
+
+	// Refresh period for the zone files. Disabled if 0.
+	Refresh time.Duration
+}
+
+// Maximum number of CNAMEs followed within a zone.
+const maxZoneCNAMEChain = 8
+
+// NewZoneResolver returns a new instance of a zone resolver.
+func NewZoneResolver(id string, opt ZoneResolverOptions) (*ZoneResolver, error) {
+	r := &ZoneResolver{
+		id:  id,
+		opt: opt,
+	}
+	zones, err := loadZones(opt.Files)
+	if err != nil {
+		return nil, err
+	}
+	r.zones = zones
+
+	if opt.Refresh > 0 {
+		go r.refreshLoop(opt.Refresh)
+	}
+	return r, nil
+}
+
+// Resolve a DNS query using the records in the zone files.
+func (r *ZoneResolver) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return nil, fmt.Errorf("no question in query")
+	}
+	question := q.Question[0]
+	log := logger(r.id, q, ci)
+
+	r.mu.RLock()
+	z := r.findZone(question.Name)
+	r.mu.RUnlock()
+
+	if z == nil || question.Qclass != dns.ClassINET {
+		log.Debug("name not in any zone, refusing")
+		return refused(q), nil
+	}
+	a := z.answer(q)
+	log.WithField("zone", z.origin).WithField("rcode", rCode(a)).Debug("responding")
+	return a, nil
+}
+
+func (r *ZoneResolver) String() string {
+	return r.id
+}
+
+// Returns the zone with the longest origin matching the name, or nil.
+func (r *ZoneResolver) findZone(name string) *zone {
+	for _, z := range r.zones {
+		if dns.IsSubDomain(z.origin, name) {
+			return z
+		}
+	}
+	return nil
+}
+
+func (r *ZoneResolver) refreshLoop(refresh time.Duration) {
+	for {
+		time.Sleep(refresh)
+		log := Log.WithField("id", r.id)
+		log.Debug("reloading zone files")
+		zones, err := loadZones(r.opt.Files)
+		if err != nil {
+			log.WithError(err).Error("failed to load zone files")
+			continue
+		}
+		r.mu.Lock()
+		r.zones = zones
+		r.mu.Unlock()
+	}
+}
+
+// Loads all zone files and returns the zones ordered by the length of their
+// origin, longest first.
+func loadZones(files []string) ([]*zone, error) {
+	var zones []*zone
+	for _, file := range files {
+		z, err := loadZone(file)
+		if err != nil {
+			return nil, err
+		}
+		zones = append(zones, z)
+	}
+	sort.SliceStable(zones, func(i, j int) bool {
+		return dns.CountLabel(zones[i].origin) > dns.CountLabel(zones[j].origin)
+	})
+	return zones, nil
+}
+
+// Authoritative data of one zone.
+type zone struct {
+	origin  string
+	soa     *dns.SOA
+	records map[string][]dns.RR // Records by lowercase owner name
+	names   map[string]struct{} // All names in the zone including empty non-terminals
+}
+
+func loadZone(file string) (*zone, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	z := &zone{
+		records: make(map[string][]dns.RR),
+		names:   make(map[string]struct{}),
+	}
+	zp := dns.NewZoneParser(f, "", file)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if soa, ok := rr.(*dns.SOA); ok && z.soa == nil {
+			z.soa = soa
+			z.origin = strings.ToLower(soa.Hdr.Name)
+		}
+		if z.soa == nil {
+			return nil, fmt.Errorf("%s: zone has to start with a SOA record", file)
+		}
+		name := strings.ToLower(rr.Header().Name)
+		if !dns.IsSubDomain(z.origin, name) {
+			return nil, fmt.Errorf("%s: record '%s' is outside of zone '%s'", file, rr.Header().Name, z.origin)
+		}
+		z.records[name] = append(z.records[name], rr)
+
+		// Register the name and all its parents up to the origin to be able to
+		// tell empty non-terminals apart from non-existent names.
+		for n := name; n != z.origin; n = parentName(n) {
+			z.names[n] = struct{}{}
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	if z.soa == nil {
+		return nil, fmt.Errorf("%s: no SOA record found", file)
+	}
+	z.names[z.origin] = struct{}{}
+	return z, nil
+}
+
+// Builds the authoritative answer for a query. The query name has to be in
+// the zone.
+func (z *zone) answer(q *dns.Msg) *dns.Msg {
+	a := new(dns.Msg)
+	a.SetReply(q)
+	a.Authoritative = true
+
+	question := q.Question[0]
+	name := strings.ToLower(question.Name)
+	qtype := question.Qtype
+
+	for i := 0; i < maxZoneCNAMEChain; i++ {
+		// Names at or below a zone cut are answered with a referral. DS
+		// records at the cut itself belong to the parent.
+		if ns := z.delegation(name, qtype); ns != nil {
+			if len(a.Answer) == 0 {
+				a.Authoritative = false
+			}
+			a.Ns = copyRRs(ns)
+			a.Extra = copyRRs(z.glue(ns))
+			return a
+		}
+
+		rrs, ok := z.records[name]
+		if !ok {
+			if _, exists := z.names[name]; exists { // empty non-terminal
+				return z.nodata(a)
+			}
+			rrs, ok = z.wildcard(name)
+			if !ok {
+				a.Rcode = dns.RcodeNameError
+				a.Ns = []dns.RR{z.negativeSOA()}
+				return a
+			}
+		}
+
+		var (
+			match []dns.RR
+			cname *dns.CNAME
+		)
+		for _, rr := range rrs {
+			rrType := rr.Header().Rrtype
+			switch {
+			case qtype == dns.TypeANY || rrType == qtype:
+				match = append(match, rr)
+			case rrType == dns.TypeCNAME:
+				cname = rr.(*dns.CNAME)
+			}
+		}
+		if len(match) > 0 {
+			a.Answer = append(a.Answer, withOwner(match, question.Name)...)
+			return a
+		}
+		if cname == nil {
+			return z.nodata(a)
+		}
+
+		// Follow the CNAME if the target is in the same zone
+		a.Answer = append(a.Answer, withOwner([]dns.RR{cname}, question.Name)...)
+		target := strings.ToLower(cname.Target)
+		if !dns.IsSubDomain(z.origin, target) {
+			return a
+		}
+		name = target
+		question.Name = cname.Target
+	}
+	return a
+}
+
+// Returns the NS records of the zone cut at or above the name if there is
+// one below the origin.
+func (z *zone) delegation(name string, qtype uint16) []dns.RR {
+	for n := name; n != z.origin && n != "."; n = parentName(n) {
+		if n == name && qtype == dns.TypeDS {
+			continue
+		}
+		var ns []dns.RR
+		for _, rr := range z.records[n] {
+			if rr.Header().Rrtype == dns.TypeNS {
+				ns = append(ns, rr)
+			}
+		}
+		if len(ns) > 0 {
+			return ns
+		}
+	}
+	return nil
+}
+
+// Returns A and AAAA records in the zone for the name servers.
+func (z *zone) glue(ns []dns.RR) []dns.RR {
+	var extra []dns.RR
+	for _, rr := range ns {
+		target := strings.ToLower(rr.(*dns.NS).Ns)
+		for _, g := range z.records[target] {
+			switch g.Header().Rrtype {
+			case dns.TypeA, dns.TypeAAAA:
+				extra = append(extra, g)
+			}
+		}
+	}
+	return extra
+}
+
+// Looks for a wildcard record that applies to a name that doesn't exist in
+// the zone. The wildcard has to be a direct child of the closest encloser.
+func (z *zone) wildcard(name string) ([]dns.RR, bool) {
+	for n := parentName(name); ; n = parentName(n) {
+		if _, ok := z.names[n]; ok {
+			wildcard := "*." + n
+			if n == "." {
+				wildcard = "*."
+			}
+			rrs, ok := z.records[wildcard]
+			return rrs, ok
+		}
+	}
+}
+
+// Turns the response into a NODATA response.
+func (z *zone) nodata(a *dns.Msg) *dns.Msg {
+	a.Ns = []dns.RR{z.negativeSOA()}
+	return a
+}
+
+// Returns the SOA record for negative responses. Its TTL is the minimum of the
+// SOA TTL and the MINIMUM field as per RFC 2308.
+func (z *zone) negativeSOA() dns.RR {
+	soa := dns.Copy(z.soa).(*dns.SOA)
+	if soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+	return soa
+}
+
+// Returns copies of the records with the owner name set, needed for records
+// synthesized from wildcards.
+func withOwner(rrs []dns.RR, name string) []dns.RR {
+	out := copyRRs(rrs)
+	for _, rr := range out {
+		rr.Header().Name = name
+	}
+	return out
+}
+
+// Returns copies of records so the zone data can't be modified by other
+// elements in the pipeline.
+func copyRRs(rrs []dns.RR) []dns.RR {
+	out := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		out = append(out, dns.Copy(rr))
+	}
+	return out
+}
+
+// Returns the parent of a name, or "." for the root.
+func parentName(name string) string {
+	off, end := dns.NextLabel(name, 0)
+	if end {
+		return "."
+	}
+	return name[off:]
+}
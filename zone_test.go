@@ -0,0 +1,70 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestZoneResolver(t *testing.T) {
+	r, err := NewZoneResolver("test-zone", ZoneResolverOptions{
+		Files: []string{"testdata/example.com.zone"},
+	})
+	require.NoError(t, err)
+
+	resolve := func(name string, qtype uint16) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, qtype)
+		a, err := r.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+		return a
+	}
+
+	// Regular record
+	a := resolve("www.example.com.", dns.TypeA)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.True(t, a.Authoritative)
+	require.Len(t, a.Answer, 1)
+
+	// NODATA
+	a = resolve("ns1.example.com.", dns.TypeAAAA)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Empty(t, a.Answer)
+	require.Len(t, a.Ns, 1)
+	require.Equal(t, dns.TypeSOA, a.Ns[0].Header().Rrtype)
+	require.Equal(t, uint32(300), a.Ns[0].Header().Ttl)
+
+	// Empty non-terminal is NODATA as well
+	a = resolve("b.example.com.", dns.TypeA)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Empty(t, a.Answer)
+
+	// NXDOMAIN
+	a = resolve("missing.example.com.", dns.TypeA)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+	require.Equal(t, dns.TypeSOA, a.Ns[0].Header().Rrtype)
+
+	// CNAME within the zone is followed
+	a = resolve("alias.example.com.", dns.TypeAAAA)
+	require.Len(t, a.Answer, 2)
+	require.Equal(t, dns.TypeCNAME, a.Answer[0].Header().Rrtype)
+	require.Equal(t, dns.TypeAAAA, a.Answer[1].Header().Rrtype)
+
+	// Wildcard
+	a = resolve("x.y.wild.example.com.", dns.TypeA)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, "x.y.wild.example.com.", a.Answer[0].Header().Name)
+
+	// Referral for delegated subdomain
+	a = resolve("host.sub.example.com.", dns.TypeA)
+	require.False(t, a.Authoritative)
+	require.Empty(t, a.Answer)
+	require.Len(t, a.Ns, 1)
+	require.Len(t, a.Extra, 1)
+
+	// Out of zone
+	a = resolve("example.net.", dns.TypeA)
+	require.Equal(t, dns.RcodeRefused, a.Rcode)
+}